@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"strings"
+)
+
+// RoleAdmin may do anything, see the policy package
+const RoleAdmin = "admin"
+
+// Identity represents the authenticated caller of a request
+type Identity struct {
+	// Subject is the user id for access tokens and the configured name for API keys
+	Subject string
+	Roles   []string
+	// Method tells how the caller authenticated, "jwt", "api_key" or "client_cert"
+	Method string
+}
+
+// HasRole reports whether the caller holds the role
+func (i Identity) HasRole(role string) bool {
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of the context carrying the caller identity
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the caller identity, if the request was authenticated
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// APIKeys maps static API keys to the identity they grant. Keys are indexed by their
+// SHA-256 digest so looking one up doesn't compare secrets byte by byte.
+type APIKeys map[[sha256.Size]byte]Identity
+
+// ParseAPIKeys parses a comma separated list of key=subject[:role|role...] entries,
+// e.g. "s3cr3t=billing-service:admin,0th3r=reporting"
+func ParseAPIKeys(s string) (APIKeys, error) {
+	keys := APIKeys{}
+	err := parseIdentities(s, "api_key", "invalid API key entry, expected key=subject[:roles]", func(key string, identity Identity) {
+		keys[sha256.Sum256([]byte(key))] = identity
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// parseIdentities parses a comma separated list of key=subject[:role|role...] entries, failing with invalid
+// on malformed ones
+func parseIdentities(s string, method string, invalid string, add func(key string, identity Identity)) error {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return errors.New(invalid)
+		}
+
+		identity := Identity{Method: method}
+		subjectRoles := strings.SplitN(kv[1], ":", 2)
+		identity.Subject = subjectRoles[0]
+		if len(subjectRoles) == 2 && subjectRoles[1] != "" {
+			identity.Roles = strings.Split(subjectRoles[1], "|")
+		}
+
+		add(kv[0], identity)
+	}
+	return nil
+}
+
+// Lookup returns the identity granted by the key
+func (k APIKeys) Lookup(key string) (Identity, bool) {
+	identity, ok := k[sha256.Sum256([]byte(key))]
+	return identity, ok
+}
+
+// ClientCertificates maps the common name of verified client certificates to the identity they grant
+type ClientCertificates map[string]Identity
+
+// ParseClientCertificates parses a comma separated list of common-name=subject[:role|role...] entries,
+// e.g. "billing.internal=billing-service:admin,reporting.internal=reporting"
+func ParseClientCertificates(s string) (ClientCertificates, error) {
+	certificates := ClientCertificates{}
+	err := parseIdentities(s, "client_cert", "invalid client certificate entry, expected common-name=subject[:roles]", func(commonName string, identity Identity) {
+		certificates[commonName] = identity
+	})
+	if err != nil {
+		return nil, err
+	}
+	return certificates, nil
+}
+
+// Lookup returns the identity granted by the certificate, which must have been verified
+func (c ClientCertificates) Lookup(certificate *x509.Certificate) (Identity, bool) {
+	identity, ok := c[certificate.Subject.CommonName]
+	return identity, ok
+}
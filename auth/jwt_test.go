@@ -0,0 +1,108 @@
+package auth_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpaldi/go-user-api/auth"
+)
+
+func fixedNow(t time.Time) func() time.Time {
+	return func() time.Time { return t }
+}
+
+func TestIssueAndParse(t *testing.T) {
+	t.Parallel()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("couldn't generate rsa key: %s", err)
+	}
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate ed25519 key: %s", err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		method auth.SigningMethod
+	}{
+		{name: "HS256", method: auth.HS256{Secret: []byte("0123456789abcdef0123456789abcdef")}},
+		{name: "RS256", method: auth.RS256{PrivateKey: rsaKey, PublicKey: &rsaKey.PublicKey}},
+		{name: "EdDSA", method: auth.EdDSA{PrivateKey: edPrivate, PublicKey: edPublic}},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := auth.Tokens{Method: tt.method, Issuer: "users", Audience: "api", TTL: time.Minute}
+
+			token, issued, err := tokens.Issue("user-id", []string{"support"})
+			if err != nil {
+				t.Fatalf("couldn't issue token: %s", err)
+			}
+
+			claims, err := tokens.Parse(token)
+			if err != nil {
+				t.Fatalf("couldn't parse token: %s", err)
+			}
+			if claims.Subject != issued.Subject || claims.ID != issued.ID || claims.ExpiresAt != issued.ExpiresAt || claims.Roles[0] != "support" {
+				t.Fatalf("wrong claims: got %+v want %+v", claims, issued)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1600000000, 0)
+	tokens := auth.Tokens{
+		Method:   auth.HS256{Secret: []byte("0123456789abcdef0123456789abcdef")},
+		Issuer:   "users",
+		Audience: "api",
+		TTL:      time.Minute,
+		Now:      fixedNow(now),
+	}
+	valid, _, _ := tokens.Issue("user-id", nil)
+
+	otherSecret := tokens
+	otherSecret.Method = auth.HS256{Secret: []byte("fedcba9876543210fedcba9876543210")}
+	forged, _, _ := otherSecret.Issue("user-id", nil)
+
+	otherIssuer := tokens
+	otherIssuer.Issuer = "someone-else"
+	wrongIssuer, _, _ := otherIssuer.Issue("user-id", nil)
+
+	otherAudience := tokens
+	otherAudience.Audience = "another-api"
+	wrongAudience, _, _ := otherAudience.Issue("user-id", nil)
+
+	later := tokens
+	later.Now = fixedNow(now.Add(time.Hour))
+
+	parts := strings.Split(valid, ".")
+
+	for _, tt := range []struct {
+		name          string
+		tokens        auth.Tokens
+		token         string
+		expectedError error
+	}{
+		{name: "a valid token should be accepted", tokens: tokens, token: valid},
+		{name: "a token signed with another key should be rejected", tokens: tokens, token: forged, expectedError: auth.ErrInvalidToken},
+		{name: "a token from another issuer should be rejected", tokens: tokens, token: wrongIssuer, expectedError: auth.ErrInvalidToken},
+		{name: "a token for another audience should be rejected", tokens: tokens, token: wrongAudience, expectedError: auth.ErrInvalidToken},
+		{name: "an expired token should be rejected", tokens: later, token: valid, expectedError: auth.ErrExpiredToken},
+		{name: "an unsigned token should be rejected", tokens: tokens, token: "eyJhbGciOiJub25lIiwidHlwIjoiSldUIn0." + parts[1] + ".", expectedError: auth.ErrInvalidToken},
+		{name: "garbage should be rejected", tokens: tokens, token: "not-a-token", expectedError: auth.ErrInvalidToken},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.tokens.Parse(tt.token)
+			if err != tt.expectedError {
+				t.Fatalf("wrong error: got %v want %v", err, tt.expectedError)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+)
+
+// NewSigningMethod builds the signing method for the given JWT algorithm.
+// HS256 uses the secret, RS256 and EdDSA load a PEM encoded private key from keyFile.
+func NewSigningMethod(alg string, secret string, keyFile string) (SigningMethod, error) {
+	switch alg {
+	case "", "HS256":
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("HS256 secret must be at least 32 bytes long")
+		}
+		return HS256{Secret: []byte(secret)}, nil
+	case "RS256", "EdDSA":
+		key, err := loadPrivateKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			if alg != "RS256" {
+				break
+			}
+			return RS256{PrivateKey: k, PublicKey: &k.PublicKey}, nil
+		case ed25519.PrivateKey:
+			if alg != "EdDSA" {
+				break
+			}
+			return EdDSA{PrivateKey: k, PublicKey: k.Public().(ed25519.PublicKey)}, nil
+		}
+		return nil, fmt.Errorf("key in %s cannot be used with %s", keyFile, alg)
+	default:
+		return nil, fmt.Errorf("unsupported signing method %q", alg)
+	}
+}
+
+func loadPrivateKey(file string) (interface{}, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading private key: %s", err)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", file)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, file)
+	}
+}
@@ -0,0 +1,166 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The client authentication modes, see ParseClientAuth
+const (
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// ParseClientAuth parses a client authentication mode: optional verifies the certificates clients send,
+// require also rejects clients without one
+func ParseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case ClientAuthOptional:
+		return tls.VerifyClientCertIfGiven, nil
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("unknown client authentication %q, expected optional or require", mode)
+	}
+}
+
+// Reloader serves a certificate and key pair, and the CAs client certificates are verified against, reloading
+// them when their files change so renewed certificates are served without a restart
+type Reloader struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is a PEM bundle of the CAs trusted to issue client certificates, clients aren't verified when empty
+	ClientCAFile string
+	// Interval is how often the files are checked for changes, 0 disables reloads
+	Interval time.Duration
+	Logger   *logrus.Logger
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	// version identifies the files loaded by their modification time and size
+	version string
+}
+
+// Reload loads the files when they changed since they were last loaded, reporting whether they were. The files
+// loaded before are kept when the new ones are invalid, e.g. when a certificate was written before its key.
+func (r *Reloader) Reload() (bool, error) {
+	version, err := r.fileVersion()
+	if err != nil {
+		return false, err
+	}
+	r.mu.RLock()
+	unchanged := version == r.version
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("loading the certificate %s: %w", r.CertFile, err)
+	}
+	if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+		return false, fmt.Errorf("parsing the certificate %s: %w", r.CertFile, err)
+	}
+	var clientCAs *x509.CertPool
+	if r.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.ClientCAFile)
+		if err != nil {
+			return false, fmt.Errorf("loading the client CAs: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("no PEM certificate in %s", r.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.certificate, r.clientCAs, r.version = &certificate, clientCAs, version
+	return true, nil
+}
+
+func (r *Reloader) fileVersion() (string, error) {
+	var version strings.Builder
+	for _, path := range []string{r.CertFile, r.KeyFile, r.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&version, "%s:%d:%d;", path, info.ModTime().UnixNano(), info.Size())
+	}
+	return version.String(), nil
+}
+
+// Run checks the files every Interval until the context is cancelled
+func (r *Reloader) Run(ctx context.Context) {
+	if r.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.Reload()
+			if err != nil {
+				r.Logger.WithError(err).Warn("reloading the TLS certificates, keeping the previous ones")
+				continue
+			}
+			if reloaded {
+				r.Logger.WithField("not_after", r.Certificate().Leaf.NotAfter).Info("reloaded the TLS certificates")
+			}
+		}
+	}
+}
+
+// Certificate returns the certificate served, nil until the files are loaded
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.certificate
+}
+
+// TLSConfig is the server config serving the current certificate, and verifying client certificates against the
+// current client CAs when ClientCAFile is set
+func (r *Reloader) TLSConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	serverConfig := func() *tls.Config {
+		return &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			NextProtos: []string{"h2", "http/1.1"},
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return r.Certificate(), nil
+			},
+		}
+	}
+	config := serverConfig()
+	if r.ClientCAFile == "" {
+		return config
+	}
+	// the client CAs are read on every handshake, tls.Config has no callback for them
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := serverConfig()
+		c.ClientAuth = clientAuth
+		r.mu.RLock()
+		c.ClientCAs = r.clientCAs
+		r.mu.RUnlock()
+		return c, nil
+	}
+	return config
+}
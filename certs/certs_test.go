@@ -0,0 +1,196 @@
+package certs_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jpaldi/go-user-api/certs"
+	"github.com/sirupsen/logrus"
+)
+
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issue creates a certificate for the common name, signed by the issuer or self-signed when nil
+func issue(t *testing.T, parent *issuer, commonName string, isCA bool) (*issuer, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer := &issuer{cert: template, key: key}
+	if parent != nil {
+		signer = parent
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &issuer{cert: cert, key: key},
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, content []byte, modTime time.Time) {
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	reloader := &certs.Reloader{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+	now := time.Now()
+
+	_, certPEM, keyPEM := issue(t, nil, "users-1", false)
+	writeFile(t, reloader.CertFile, certPEM, now)
+	writeFile(t, reloader.KeyFile, keyPEM, now)
+	if reloaded, err := reloader.Reload(); !reloaded || err != nil {
+		t.Fatalf("the certificate should be loaded: got %t %v", reloaded, err)
+	}
+	if reloaded, err := reloader.Reload(); reloaded || err != nil {
+		t.Fatalf("unchanged files should not be reloaded: got %t %v", reloaded, err)
+	}
+
+	_, renewedPEM, renewedKeyPEM := issue(t, nil, "users-2", false)
+	writeFile(t, reloader.CertFile, renewedPEM, now.Add(time.Minute))
+	if _, err := reloader.Reload(); err == nil {
+		t.Fatalf("a certificate not matching its key should not be loaded")
+	}
+	if cn := reloader.Certificate().Leaf.Subject.CommonName; cn != "users-1" {
+		t.Fatalf("the previous certificate should be kept: got %s", cn)
+	}
+
+	writeFile(t, reloader.KeyFile, renewedKeyPEM, now.Add(time.Minute))
+	if reloaded, err := reloader.Reload(); !reloaded || err != nil {
+		t.Fatalf("the renewed certificate should be loaded: got %t %v", reloaded, err)
+	}
+	if cn := reloader.Certificate().Leaf.Subject.CommonName; cn != "users-2" {
+		t.Fatalf("the renewed certificate should be served: got %s", cn)
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+
+	ca, caPEM, _ := issue(t, nil, "internal-ca", true)
+	_, serverPEM, serverKeyPEM := issue(t, ca, "users", false)
+	_, clientPEM, clientKeyPEM := issue(t, ca, "billing.internal", false)
+	stranger, _, _ := issue(t, nil, "other-ca", true)
+	_, strangerPEM, strangerKeyPEM := issue(t, stranger, "billing.internal", false)
+	reloader := &certs.Reloader{
+		CertFile:     filepath.Join(dir, "tls.crt"),
+		KeyFile:      filepath.Join(dir, "tls.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+		Logger:       logrus.New(),
+	}
+	writeFile(t, reloader.CertFile, serverPEM, now)
+	writeFile(t, reloader.KeyFile, serverKeyPEM, now)
+	writeFile(t, reloader.ClientCAFile, caPEM, now)
+	if _, err := reloader.Reload(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	clientAuth, err := certs.ParseClientAuth(certs.ClientAuthRequire)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", reloader.TLSConfig(clientAuth))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Client", r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	})}
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	for _, tt := range []struct {
+		name           string
+		certPEM        []byte
+		keyPEM         []byte
+		expectedClient string
+	}{
+		{name: "clients with a certificate of the CA should be verified", certPEM: clientPEM, keyPEM: clientKeyPEM, expectedClient: "billing.internal"},
+		{name: "clients with a certificate of another CA should be rejected", certPEM: strangerPEM, keyPEM: strangerKeyPEM},
+		{name: "clients without a certificate should be rejected"},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			config := &tls.Config{RootCAs: roots}
+			if tt.certPEM != nil {
+				cert, err := tls.X509KeyPair(tt.certPEM, tt.keyPEM)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				config.Certificates = []tls.Certificate{cert}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+
+			resp, err := client.Get("https://" + listener.Addr().String())
+			if tt.expectedClient == "" {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("the client should be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			resp.Body.Close()
+			if client := resp.Header.Get("X-Client"); client != tt.expectedClient {
+				t.Fatalf("wrong client: got %s want %s", client, tt.expectedClient)
+			}
+		})
+	}
+}
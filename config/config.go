@@ -0,0 +1,304 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Config is the configuration of the service. Every field is named after its environment variable, and is also
+// read from the config file, with the lowercase name, e.g. service_port, and from the flags, with the lowercase
+// name and hyphens, e.g. -service-port. Secrets can be read from the file named by the variable suffixed with
+// _FILE, e.g. MONGO_URI_FILE, and are masked when the config is printed.
+type Config struct {
+	// ConfigFile is the YAML or JSON config file, only set by the CONFIG_FILE variable or the -config flag
+	ConfigFile string `env:"CONFIG_FILE" file:"-"`
+	// PrintConfig prints the effective config, with secrets masked, instead of starting the service
+	PrintConfig bool `env:"PRINT_CONFIG" default:"false" file:"-"`
+
+	ServicePort    int    `env:"SERVICE_PORT"`
+	StorageBackend string `env:"STORAGE_BACKEND" default:"mongo"`
+	PasswordHasher string `env:"PASSWORD_HASHER" default:"argon2id"`
+	LogLevel       string `env:"LOG_LEVEL" default:"info"`
+	LogFormat      string `env:"LOG_FORMAT" default:"text"`
+	RequireIfMatch bool   `env:"REQUIRE_IF_MATCH" default:"false"`
+
+	HTTP     HTTP
+	TLS      TLS
+	Mongo    Mongo
+	Auth     Auth
+	Password Password
+	Purge    Purge
+	Metrics  Metrics
+	Health   Health
+	Tracing  Tracing
+	Events   Events
+	Webhooks Webhooks
+}
+
+// HTTP configures the server
+type HTTP struct {
+	ReadTimeout       time.Duration `env:"HTTP_READ_TIMEOUT" default:"15s"`
+	ReadHeaderTimeout time.Duration `env:"HTTP_READ_HEADER_TIMEOUT" default:"5s"`
+	WriteTimeout      time.Duration `env:"HTTP_WRITE_TIMEOUT" default:"30s"`
+	IdleTimeout       time.Duration `env:"HTTP_IDLE_TIMEOUT" default:"120s"`
+	MaxHeaderBytes    int           `env:"HTTP_MAX_HEADER_BYTES" default:"1048576"`
+	ShutdownDelay     time.Duration `env:"SHUTDOWN_DELAY" default:"5s"`
+	ShutdownTimeout   time.Duration `env:"SHUTDOWN_TIMEOUT" default:"30s"`
+}
+
+// TLS configures HTTPS, served when a certificate is set, and the verification of client certificates
+type TLS struct {
+	CertFile string `env:"TLS_CERT_FILE"`
+	KeyFile  string `env:"TLS_KEY_FILE"`
+	// ClientCAFile enables the verification of client certificates against the CAs of the bundle
+	ClientCAFile string `env:"TLS_CLIENT_CA_FILE"`
+	// ClientAuth is optional, verifying the certificates clients send, or require, rejecting clients without one
+	ClientAuth string `env:"TLS_CLIENT_AUTH" default:"optional"`
+	// ClientIdentities maps the common name of client certificates to identities, see auth.ParseClientCertificates
+	ClientIdentities string        `env:"TLS_CLIENT_IDENTITIES"`
+	ReloadInterval   time.Duration `env:"TLS_RELOAD_INTERVAL" default:"30s"`
+}
+
+// Mongo configures the mongo storage backend
+type Mongo struct {
+	URI                       string `env:"MONGO_URI" secret:"true"`
+	DatabaseName              string `env:"MONGO_DATABASE_NAME"`
+	CollectionName            string `env:"MONGO_COLLECTION_NAME"`
+	RefreshTokensCollection   string `env:"MONGO_REFRESH_TOKENS_COLLECTION_NAME" default:"refresh_tokens"`
+	MigrationsCollection      string `env:"MONGO_MIGRATIONS_COLLECTION_NAME" default:"migrations"`
+	AuditCollection           string `env:"MONGO_AUDIT_COLLECTION_NAME" default:"audit"`
+	OutboxCollection          string `env:"MONGO_OUTBOX_COLLECTION_NAME" default:"outbox"`
+	WebhooksCollection        string `env:"MONGO_WEBHOOKS_COLLECTION_NAME" default:"webhooks"`
+	WebhookDeliveryCollection string `env:"MONGO_WEBHOOK_DELIVERIES_COLLECTION_NAME" default:"webhook_deliveries"`
+	Transactions              bool   `env:"MONGO_TRANSACTIONS" default:"true"`
+}
+
+// Auth configures the access tokens and API keys
+type Auth struct {
+	JWTSigningMethod  string        `env:"JWT_SIGNING_METHOD" default:"HS256"`
+	JWTSecret         string        `env:"JWT_SECRET" secret:"true"`
+	JWTPrivateKeyFile string        `env:"JWT_PRIVATE_KEY_FILE"`
+	JWTIssuer         string        `env:"JWT_ISSUER"`
+	JWTAudience       string        `env:"JWT_AUDIENCE"`
+	JWTTTL            time.Duration `env:"JWT_TTL" default:"15m"`
+	RefreshTokenTTL   time.Duration `env:"REFRESH_TOKEN_TTL" default:"720h"`
+	APIKeys           string        `env:"API_KEYS" secret:"true"`
+	PolicyFile        string        `env:"POLICY_FILE"`
+}
+
+// Password configures the password policy
+type Password struct {
+	MinLength             int     `env:"PASSWORD_MIN_LENGTH" default:"8"`
+	MaxLength             int     `env:"PASSWORD_MAX_LENGTH" default:"128"`
+	MinClasses            int     `env:"PASSWORD_MIN_CLASSES" default:"1"`
+	MinEntropy            float64 `env:"PASSWORD_MIN_ENTROPY" default:"35"`
+	BreachedPasswordsFile string  `env:"BREACHED_PASSWORDS_FILE"`
+}
+
+// Purge configures the purge of deleted users
+type Purge struct {
+	SoftDeleteRetention time.Duration `env:"SOFT_DELETE_RETENTION" default:"720h"`
+	Interval            time.Duration `env:"PURGE_INTERVAL" default:"1h"`
+}
+
+// Metrics configures the metrics not updated by requests
+type Metrics struct {
+	UsersInterval time.Duration `env:"METRICS_USERS_INTERVAL" default:"1m"`
+}
+
+// Health configures the checks of the readiness probe
+type Health struct {
+	PingTimeout  time.Duration `env:"HEALTH_PING_TIMEOUT" default:"2s"`
+	OutboxMaxLag time.Duration `env:"HEALTH_OUTBOX_MAX_LAG" default:"5m"`
+	MinFreeBytes uint64        `env:"HEALTH_MIN_FREE_BYTES" default:"104857600"`
+}
+
+// Tracing configures where spans are exported
+type Tracing struct {
+	Exporter     string  `env:"TRACING_EXPORTER"`
+	OTLPEndpoint string  `env:"TRACING_OTLP_ENDPOINT" default:"http://localhost:4318/v1/traces"`
+	ServiceName  string  `env:"TRACING_SERVICE_NAME" default:"go-user-api"`
+	SampleRatio  float64 `env:"TRACING_SAMPLE_RATIO" default:"1"`
+}
+
+// Events configures where the events of user changes are published
+type Events struct {
+	Publisher         string        `env:"EVENTS_PUBLISHER"`
+	File              string        `env:"EVENTS_FILE"`
+	WebhookURL        string        `env:"EVENTS_WEBHOOK_URL"`
+	NATSURL           string        `env:"EVENTS_NATS_URL" secret:"true"`
+	NATSSubjectPrefix string        `env:"EVENTS_NATS_SUBJECT_PREFIX" default:"users"`
+	KafkaRESTURL      string        `env:"EVENTS_KAFKA_REST_URL"`
+	KafkaTopic        string        `env:"EVENTS_KAFKA_TOPIC" default:"users"`
+	PollInterval      time.Duration `env:"EVENTS_POLL_INTERVAL" default:"1s"`
+}
+
+// Webhooks configures the deliveries of events to webhooks
+type Webhooks struct {
+	Enabled      bool          `env:"WEBHOOKS_ENABLED" default:"false"`
+	MaxAttempts  int           `env:"WEBHOOKS_MAX_ATTEMPTS" default:"10"`
+	DisableAfter int           `env:"WEBHOOKS_DISABLE_AFTER" default:"50"`
+	MinBackoff   time.Duration `env:"WEBHOOKS_MIN_BACKOFF" default:"10s"`
+	MaxBackoff   time.Duration `env:"WEBHOOKS_MAX_BACKOFF" default:"6h"`
+}
+
+// Errors lists every problem found in the configuration
+type Errors []string
+
+func (e Errors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+func (e *Errors) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+// Validate checks the required values are set and the others are in range
+func (c Config) Validate() error {
+	var errs Errors
+
+	if c.ServicePort < 1 || c.ServicePort > 65535 {
+		errs.add("SERVICE_PORT is required, between 1 and 65535")
+	}
+	oneOf(&errs, "STORAGE_BACKEND", c.StorageBackend, "mongo", "memory")
+	oneOf(&errs, "PASSWORD_HASHER", c.PasswordHasher, "argon2id", "bcrypt")
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		errs.add("LOG_LEVEL %q is not a level, e.g. debug, info or warn", c.LogLevel)
+	}
+	oneOf(&errs, "LOG_FORMAT", c.LogFormat, "text", "json")
+
+	notNegative(&errs, "HTTP_READ_TIMEOUT", c.HTTP.ReadTimeout)
+	notNegative(&errs, "HTTP_READ_HEADER_TIMEOUT", c.HTTP.ReadHeaderTimeout)
+	notNegative(&errs, "HTTP_WRITE_TIMEOUT", c.HTTP.WriteTimeout)
+	notNegative(&errs, "HTTP_IDLE_TIMEOUT", c.HTTP.IdleTimeout)
+	if c.HTTP.MaxHeaderBytes <= 0 {
+		errs.add("HTTP_MAX_HEADER_BYTES must be positive")
+	}
+	notNegative(&errs, "SHUTDOWN_DELAY", c.HTTP.ShutdownDelay)
+	positive(&errs, "SHUTDOWN_TIMEOUT", c.HTTP.ShutdownTimeout)
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs.add("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		errs.add("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if c.TLS.ClientIdentities != "" && c.TLS.ClientCAFile == "" {
+		errs.add("TLS_CLIENT_IDENTITIES requires TLS_CLIENT_CA_FILE")
+	}
+	oneOf(&errs, "TLS_CLIENT_AUTH", c.TLS.ClientAuth, "optional", "require")
+	notNegative(&errs, "TLS_RELOAD_INTERVAL", c.TLS.ReloadInterval)
+
+	if c.StorageBackend == "mongo" {
+		required(&errs, "MONGO_URI", c.Mongo.URI)
+		required(&errs, "MONGO_DATABASE_NAME", c.Mongo.DatabaseName)
+		required(&errs, "MONGO_COLLECTION_NAME", c.Mongo.CollectionName)
+		// without transactions a change could be saved and its event lost
+		if !c.Mongo.Transactions && (c.Events.Publisher != "" || c.Webhooks.Enabled) {
+			errs.add("EVENTS_PUBLISHER and WEBHOOKS_ENABLED require MONGO_TRANSACTIONS")
+		}
+	}
+
+	switch c.Auth.JWTSigningMethod {
+	case "HS256":
+		if len(c.Auth.JWTSecret) < 32 {
+			errs.add("JWT_SECRET is required with HS256, at least 32 bytes long")
+		}
+	case "RS256", "EdDSA":
+		required(&errs, "JWT_PRIVATE_KEY_FILE", c.Auth.JWTPrivateKeyFile)
+	default:
+		errs.add("JWT_SIGNING_METHOD %q must be one of HS256, RS256 or EdDSA", c.Auth.JWTSigningMethod)
+	}
+	positive(&errs, "JWT_TTL", c.Auth.JWTTTL)
+	positive(&errs, "REFRESH_TOKEN_TTL", c.Auth.RefreshTokenTTL)
+
+	if c.Password.MinLength < 1 {
+		errs.add("PASSWORD_MIN_LENGTH must be at least 1")
+	}
+	if c.Password.MaxLength < c.Password.MinLength {
+		errs.add("PASSWORD_MAX_LENGTH must be at least PASSWORD_MIN_LENGTH")
+	}
+	if c.Password.MinClasses < 0 || c.Password.MinClasses > 4 {
+		errs.add("PASSWORD_MIN_CLASSES must be between 0 and 4")
+	}
+	if c.Password.MinEntropy < 0 {
+		errs.add("PASSWORD_MIN_ENTROPY must not be negative")
+	}
+
+	notNegative(&errs, "SOFT_DELETE_RETENTION", c.Purge.SoftDeleteRetention)
+	notNegative(&errs, "PURGE_INTERVAL", c.Purge.Interval)
+	notNegative(&errs, "METRICS_USERS_INTERVAL", c.Metrics.UsersInterval)
+	positive(&errs, "HEALTH_PING_TIMEOUT", c.Health.PingTimeout)
+	positive(&errs, "HEALTH_OUTBOX_MAX_LAG", c.Health.OutboxMaxLag)
+
+	if c.Tracing.Exporter != "" {
+		oneOf(&errs, "TRACING_EXPORTER", c.Tracing.Exporter, "stdout", "otlp")
+	}
+	if c.Tracing.Exporter == "otlp" {
+		required(&errs, "TRACING_OTLP_ENDPOINT", c.Tracing.OTLPEndpoint)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs.add("TRACING_SAMPLE_RATIO must be between 0 and 1")
+	}
+
+	switch c.Events.Publisher {
+	case "", "stdout":
+	case "file":
+		required(&errs, "EVENTS_FILE", c.Events.File)
+	case "webhook":
+		required(&errs, "EVENTS_WEBHOOK_URL", c.Events.WebhookURL)
+	case "nats":
+		required(&errs, "EVENTS_NATS_URL", c.Events.NATSURL)
+	case "kafka-rest":
+		required(&errs, "EVENTS_KAFKA_REST_URL", c.Events.KafkaRESTURL)
+	default:
+		errs.add("EVENTS_PUBLISHER %q must be one of stdout, file, webhook, nats or kafka-rest", c.Events.Publisher)
+	}
+	positive(&errs, "EVENTS_POLL_INTERVAL", c.Events.PollInterval)
+
+	if c.Webhooks.MaxAttempts < 1 {
+		errs.add("WEBHOOKS_MAX_ATTEMPTS must be at least 1")
+	}
+	if c.Webhooks.DisableAfter < 1 {
+		errs.add("WEBHOOKS_DISABLE_AFTER must be at least 1")
+	}
+	positive(&errs, "WEBHOOKS_MIN_BACKOFF", c.Webhooks.MinBackoff)
+	if c.Webhooks.MaxBackoff < c.Webhooks.MinBackoff {
+		errs.add("WEBHOOKS_MAX_BACKOFF must be at least WEBHOOKS_MIN_BACKOFF")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func required(errs *Errors, name string, value string) {
+	if value == "" {
+		errs.add("%s is required", name)
+	}
+}
+
+func oneOf(errs *Errors, name string, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	errs.add("%s %q must be one of %s", name, value, strings.Join(allowed, ", "))
+}
+
+func positive(errs *Errors, name string, d time.Duration) {
+	if d <= 0 {
+		errs.add("%s must be positive", name)
+	}
+}
+
+func notNegative(errs *Errors, name string, d time.Duration) {
+	if d < 0 {
+		errs.add("%s must not be negative", name)
+	}
+}
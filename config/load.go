@@ -0,0 +1,318 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// masked replaces the secrets set when the config is printed
+const masked = "********"
+
+// field is a setting of the config, see Config
+type field struct {
+	env      string
+	def      string
+	secret   bool
+	fromFile bool
+	value    reflect.Value
+}
+
+// source is where settings are looked up by the name of their variable
+type source struct {
+	name   string
+	lookup func(env string) (string, bool)
+	// file sources don't set the fields read before the file, see Config.ConfigFile
+	file bool
+}
+
+// Load reads the config from, in order of precedence, the flags in args, the environment variables looked up by
+// lookupEnv, e.g. os.LookupEnv, the config file and the defaults, then validates it. Every problem found is listed
+// in the returned Errors, flag.ErrHelp is returned when args asks for the usage.
+func Load(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	var c Config
+	fields := fieldsOf(reflect.ValueOf(&c).Elem())
+
+	flags, err := parseFlags(args, fields)
+	if err != nil {
+		return c, err
+	}
+	env := source{name: "environment", lookup: lookupEnv}
+
+	var errs Errors
+	sources := []source{env, flags}
+	path, _ := flags.lookup("CONFIG_FILE")
+	if path == "" {
+		path, _ = env.lookup("CONFIG_FILE")
+	}
+	if path != "" {
+		file, err := readFile(path, fields)
+		if fileErrs, ok := err.(Errors); ok {
+			errs = append(errs, fileErrs...)
+		} else if err != nil {
+			errs.add("%s", err)
+		} else {
+			sources = append([]source{file}, sources...)
+		}
+	}
+
+	for _, f := range fields {
+		raw, from := f.def, "default"
+		for _, s := range sources {
+			if s.file && !f.fromFile {
+				continue
+			}
+			v, ok, err := lookupSetting(s, f)
+			if err != nil {
+				errs.add("%s", err)
+			}
+			if ok {
+				raw, from = v, s.name
+			}
+		}
+		if err := set(f.value, raw); err != nil {
+			errs.add("%s from the %s: %s", f.env, from, err)
+		}
+	}
+	if len(errs) > 0 {
+		return c, errs
+	}
+	return c, c.Validate()
+}
+
+// fieldsOf lists the settings of the struct v, nested structs included
+func fieldsOf(v reflect.Value) []field {
+	var fields []field
+	for i := 0; i < v.NumField(); i++ {
+		sf, fv := v.Type().Field(i), v.Field(i)
+		env, ok := sf.Tag.Lookup("env")
+		if !ok {
+			if sf.Type.Kind() == reflect.Struct {
+				fields = append(fields, fieldsOf(fv)...)
+			}
+			continue
+		}
+		fields = append(fields, field{
+			env:      env,
+			def:      sf.Tag.Get("default"),
+			secret:   sf.Tag.Get("secret") == "true",
+			fromFile: sf.Tag.Get("file") != "-",
+			value:    fv,
+		})
+	}
+	return fields
+}
+
+// lookupSetting looks the field up in s, reading secrets from the file named by their _FILE setting
+func lookupSetting(s source, f field) (string, bool, error) {
+	v, ok := s.lookup(f.env)
+	if !f.secret {
+		return v, ok, nil
+	}
+	path, fromFile := s.lookup(f.env + "_FILE")
+	if !fromFile {
+		return v, ok, nil
+	}
+	if ok {
+		return "", false, fmt.Errorf("%s and %s_FILE are both set in the %s", f.env, f.env, s.name)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE from the %s: %s", f.env, s.name, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), true, nil
+}
+
+// FlagName is the flag setting the variable env, e.g. -service-port for SERVICE_PORT
+func FlagName(env string) string {
+	if env == "CONFIG_FILE" {
+		return "config"
+	}
+	return strings.Replace(strings.ToLower(env), "_", "-", -1)
+}
+
+// FileKey is the key of the config file setting the variable env, e.g. service_port for SERVICE_PORT
+func FileKey(env string) string {
+	return strings.ToLower(env)
+}
+
+// names lists the variables of the fields, with the _FILE variables of secrets
+func names(fields []field) []string {
+	var names []string
+	for _, f := range fields {
+		names = append(names, f.env)
+		if f.secret {
+			names = append(names, f.env+"_FILE")
+		}
+	}
+	return names
+}
+
+// flagValue is the raw value of a flag, boolean flags can be set without a value, e.g. -print-config
+type flagValue struct {
+	value  string
+	set    bool
+	isBool bool
+}
+
+func (f *flagValue) String() string {
+	return f.value
+}
+
+func (f *flagValue) Set(value string) error {
+	f.value, f.set = value, true
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+func parseFlags(args []string, fields []field) (source, error) {
+	flags := flag.NewFlagSet("go-user-api", flag.ContinueOnError)
+	values := map[string]*flagValue{}
+	for _, f := range fields {
+		values[f.env] = &flagValue{isBool: f.value.Kind() == reflect.Bool}
+		flags.Var(values[f.env], FlagName(f.env), "overrides "+f.env)
+		if f.secret {
+			values[f.env+"_FILE"] = &flagValue{}
+			flags.Var(values[f.env+"_FILE"], FlagName(f.env+"_FILE"), "overrides "+f.env+"_FILE")
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return source{}, err
+	}
+	return source{name: "flags", lookup: func(env string) (string, bool) {
+		v, ok := values[env]
+		if !ok || !v.set {
+			return "", false
+		}
+		return v.value, true
+	}}, nil
+}
+
+// readFile reads a YAML or JSON config file of scalar settings, rejecting unknown keys
+func readFile(path string, fields []field) (source, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return source{}, fmt.Errorf("reading the config file: %s", err)
+	}
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal(b, &settings); err != nil {
+		return source{}, fmt.Errorf("parsing the config file %s: %s", path, err)
+	}
+
+	known := map[string]bool{}
+	for _, env := range names(fields) {
+		known[FileKey(env)] = true
+	}
+	values := map[string]string{}
+	var errs Errors
+	for key, v := range settings {
+		if !known[key] {
+			errs.add("unknown setting %q in the config file", key)
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			values[key] = v
+		case int, int64, uint64, bool:
+			values[key] = fmt.Sprint(v)
+		case float64:
+			values[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case nil:
+			values[key] = ""
+		default:
+			errs.add("setting %q in the config file must be a scalar", key)
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return source{}, errs
+	}
+	return source{name: "config file", file: true, lookup: func(env string) (string, bool) {
+		v, ok := values[FileKey(env)]
+		return v, ok
+	}}, nil
+}
+
+// set parses raw into the field value v
+func set(v reflect.Value, raw string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration, e.g. 30s or 1h", raw)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean, true or false", raw)
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		if raw == "" {
+			v.SetInt(0)
+			return nil
+		}
+		i, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", raw)
+		}
+		v.SetInt(int64(i))
+	case reflect.Uint64:
+		u, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a positive integer", raw)
+		}
+		v.SetUint(u)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", raw)
+		}
+		v.SetFloat(f)
+	default:
+		panic(fmt.Sprintf("unsupported config field of type %s", v.Type()))
+	}
+	return nil
+}
+
+// Write writes the effective config as a config file, with the secrets set masked
+func (c Config) Write(w io.Writer) error {
+	var settings yaml.MapSlice
+	for _, f := range fieldsOf(reflect.ValueOf(&c).Elem()) {
+		if !f.fromFile {
+			continue
+		}
+		var v interface{}
+		switch {
+		case f.secret && f.value.String() != "":
+			v = masked
+		case f.value.Type() == reflect.TypeOf(time.Duration(0)):
+			v = time.Duration(f.value.Int()).String()
+		default:
+			v = f.value.Interface()
+		}
+		settings = append(settings, yaml.MapItem{Key: FileKey(f.env), Value: v})
+	}
+	b, err := yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,153 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpaldi/go-user-api/mongo"
+)
+
+// WriterPublisher writes events as JSON lines, e.g. to stdout or a file
+type WriterPublisher struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterPublisher returns a publisher writing to w
+func NewWriterPublisher(w io.Writer) *WriterPublisher {
+	return &WriterPublisher{w: w}
+}
+
+// OpenFilePublisher returns a publisher appending to the given file, which is created if needed
+func OpenFilePublisher(path string) (*WriterPublisher, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening events file: %s", err)
+	}
+	return NewWriterPublisher(f), nil
+}
+
+// Publish writes the event on its own line, files are synced so the event survives a crash
+func (p *WriterPublisher) Publish(ctx context.Context, event mongo.Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if f, ok := p.w.(*os.File); ok && f != os.Stdout && f != os.Stderr {
+		return f.Sync()
+	}
+	return nil
+}
+
+// Publishers publishes every event to each of the publishers, e.g. a broker and the webhooks. An event failing
+// on any of them is published again to all of them, which at-least-once delivery allows.
+type Publishers []Publisher
+
+// Publish publishes the event to every publisher, even after one of them failed
+func (ps Publishers) Publish(ctx context.Context, event mongo.Event) error {
+	failed := []string{}
+	for _, p := range ps {
+		if err := p.Publish(ctx, event); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// WebhookPublisher POSTs every event as JSON to a URL, any 2xx response counts as delivered.
+// The event id is sent in the X-Event-ID header so receivers can drop the duplicates at-least-once delivery causes.
+type WebhookPublisher struct {
+	URL string
+	// Client defaults to a client with a 10s timeout
+	Client *http.Client
+}
+
+// Publish posts the event to the webhook
+func (p WebhookPublisher) Publish(ctx context.Context, event mongo.Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Event-ID", event.ID)
+	header.Set("X-Event-Type", event.Type)
+	return post(ctx, client(p.Client), p.URL, header, b)
+}
+
+// KafkaRESTPublisher produces events to a Kafka topic through a Kafka REST proxy (v2 API), keyed by user id
+// so the events of a user land in the same partition
+type KafkaRESTPublisher struct {
+	// URL is the base URL of the REST proxy, e.g. http://kafka-rest:8082
+	URL   string
+	Topic string
+	// Client defaults to a client with a 10s timeout
+	Client *http.Client
+}
+
+// Publish produces the event to the topic
+func (p KafkaRESTPublisher) Publish(ctx context.Context, event mongo.Event) error {
+	type record struct {
+		Key   string      `json:"key"`
+		Value mongo.Event `json:"value"`
+	}
+	b, err := json.Marshal(struct {
+		Records []record `json:"records"`
+	}{Records: []record{{Key: event.UserID, Value: event}}})
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	header.Set("Accept", "application/vnd.kafka.v2+json")
+	target := strings.TrimSuffix(p.URL, "/") + "/topics/" + url.PathEscape(p.Topic)
+	return post(ctx, client(p.Client), target, header, b)
+}
+
+func client(c *http.Client) *http.Client {
+	if c == nil {
+		return &http.Client{Timeout: 10 * time.Second}
+	}
+	return c
+}
+
+// post sends the body and fails unless the response is a 2xx
+func post(ctx context.Context, c *http.Client, target string, header http.Header, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header = header
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s responded %s: %s", target, resp.Status, bytes.TrimSpace(detail))
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package events_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jpaldi/go-user-api/events"
+	"github.com/jpaldi/go-user-api/mongo"
+)
+
+var event = mongo.NewEvent(mongo.EventUserCreated, mongo.User{ID: "user-1", Nickname: "test", Password: "hash", Version: 1})
+
+func TestWriterPublisher(t *testing.T) {
+	t.Parallel()
+	out := &bytes.Buffer{}
+	publisher := events.NewWriterPublisher(out)
+
+	if err := publisher.Publish(context.Background(), event); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	line := out.String()
+	if !strings.HasSuffix(line, "\n") || !strings.Contains(line, `"type":"user.created"`) || strings.Contains(line, "hash") || strings.Contains(line, "attempts") {
+		t.Fatalf("wrong line: got %s", line)
+	}
+}
+
+func TestHTTPPublishers(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name           string
+		publisher      func(url string) events.Publisher
+		status         int
+		expectedPath   string
+		expectedType   string
+		expectedHeader string
+		expectError    bool
+	}{
+		{
+			name:           "webhooks should receive the event",
+			publisher:      func(url string) events.Publisher { return events.WebhookPublisher{URL: url + "/hook"} },
+			status:         http.StatusNoContent,
+			expectedPath:   "/hook",
+			expectedType:   "application/json",
+			expectedHeader: event.ID,
+		},
+		{
+			name:         "webhooks responding an error should fail the delivery",
+			publisher:    func(url string) events.Publisher { return events.WebhookPublisher{URL: url + "/hook"} },
+			status:       http.StatusServiceUnavailable,
+			expectedPath: "/hook",
+			expectedType: "application/json",
+			expectError:  true,
+		},
+		{
+			name:         "kafka rest proxies should receive a record keyed by user",
+			publisher:    func(url string) events.Publisher { return events.KafkaRESTPublisher{URL: url + "/", Topic: "users"} },
+			status:       http.StatusOK,
+			expectedPath: "/topics/users",
+			expectedType: "application/vnd.kafka.json.v2+json",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var received *http.Request
+			var body []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r
+				body, _ = ioutil.ReadAll(r.Body)
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			err := tt.publisher(server.URL).Publish(context.Background(), event)
+
+			if (err != nil) != tt.expectError {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if received.URL.Path != tt.expectedPath || received.Header.Get("Content-Type") != tt.expectedType {
+				t.Fatalf("wrong request: got %s %s", received.URL.Path, received.Header.Get("Content-Type"))
+			}
+			if received.Header.Get("X-Event-ID") != tt.expectedHeader && tt.expectedHeader != "" {
+				t.Fatalf("wrong event id header: got %s", received.Header.Get("X-Event-ID"))
+			}
+			if !bytes.Contains(body, []byte(event.ID)) {
+				t.Fatalf("the event is missing from the body: got %s", body)
+			}
+		})
+	}
+}
+
+// fakeNATS accepts one connection, acknowledges the CONNECT and PUBs it reads and sends them on received
+func fakeNATS(t *testing.T, received chan<- string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {\"server_id\":\"fake\"}\r\n"))
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "PUB "):
+				payload, _ := reader.ReadString('\n')
+				// a server PING in the middle of a publication must be answered
+				conn.Write([]byte("PING\r\n"))
+				received <- strings.TrimSpace(line) + " " + strings.TrimSpace(payload)
+			case strings.HasPrefix(line, "PING"):
+				conn.Write([]byte("PONG\r\n"))
+			}
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestNATSPublisher(t *testing.T) {
+	t.Parallel()
+	received := make(chan string, 1)
+	publisher, err := events.NewNATSPublisher("nats://"+fakeNATS(t, received), "users")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer publisher.Close()
+
+	if err := publisher.Publish(context.Background(), event); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	message := <-received
+	if !strings.HasPrefix(message, "PUB users.user.created ") {
+		t.Fatalf("wrong subject: got %s", message)
+	}
+	published := mongo.Event{}
+	if err := json.Unmarshal([]byte(message[strings.Index(message, "{"):]), &published); err != nil || published.ID != event.ID {
+		t.Fatalf("wrong payload: got %s", message)
+	}
+}
+
+func TestNewNATSPublisherRejectsOtherSchemes(t *testing.T) {
+	t.Parallel()
+	if _, err := events.NewNATSPublisher("http://nats:4222", ""); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestPublishers(t *testing.T) {
+	t.Parallel()
+	failing, working := &mockPublisher{err: fmt.Errorf("connection refused")}, &mockPublisher{}
+
+	err := events.Publishers{failing, working}.Publish(context.Background(), event)
+
+	if err == nil || err.Error() != "connection refused" {
+		t.Fatalf("wrong error: got %v", err)
+	}
+	if len(working.published) != 1 {
+		t.Fatalf("the other publishers should still get the event: got %+v", working.published)
+	}
+}
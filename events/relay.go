@@ -0,0 +1,176 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/sirupsen/logrus"
+)
+
+// Outbox is where events wait until they are published, see mongo.Outbox
+type Outbox interface {
+	Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]mongo.Event, error)
+	MarkPublished(ctx context.Context, id string, at time.Time) error
+	MarkFailed(ctx context.Context, id string, next time.Time, reason string) error
+	// OldestPending returns when the oldest event not published yet occurred, nil when every event is published
+	OldestPending(ctx context.Context) (*time.Time, error)
+}
+
+// Publisher delivers events to downstream services, it must only return nil once the event is delivered
+type Publisher interface {
+	Publish(ctx context.Context, event mongo.Event) error
+}
+
+// defaults of the relays that don't set them
+const (
+	defaultLease          = time.Minute
+	defaultPublishTimeout = 10 * time.Second
+)
+
+// Relay publishes the events of the outbox with at-least-once semantics: an event is only marked published once
+// the publisher accepted it, so it is published again if the relay stops in between. Failed deliveries are retried
+// with exponential backoff, meanwhile later events keep flowing, so consumers should order events by user version.
+type Relay struct {
+	Outbox    Outbox
+	Publisher Publisher
+	Logger    *logrus.Logger
+	// Lease is how long claimed events are left to the relay before other relays may publish them, 1m by default.
+	// Events are published one after the other, so no more are claimed at once than can be published within the
+	// lease, which must be longer than the publish timeout.
+	Lease time.Duration
+	// PublishTimeout bounds each publish, 10s by default
+	PublishTimeout time.Duration
+	// Interval is how often the outbox is polled, 1s by default
+	Interval time.Duration
+	// BatchSize is how many events are claimed at once at most, 100 by default
+	BatchSize int
+	// MinBackoff and MaxBackoff bound the delay before retrying a failed delivery, 1s and 5m by default
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Run delivers the due events every interval, and right away while there are more, until the context is cancelled
+func (r Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval())
+	defer ticker.Stop()
+
+	for {
+		claimed, err := r.Deliver(ctx, time.Now())
+		if err == nil && claimed == r.claimLimit() && ctx.Err() == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Deliver publishes the events due at now and returns how many were claimed. Events which could no longer be
+// published before their lease expires are left to be claimed again, rather than being published by two relays.
+func (r Relay) Deliver(ctx context.Context, now time.Time) (int, error) {
+	claimedAt := time.Now()
+	events, err := r.Outbox.Claim(ctx, now, r.lease(), r.claimLimit())
+	if err != nil {
+		r.Logger.WithError(err).Error("claiming events")
+		return 0, err
+	}
+
+	for i, e := range events {
+		if i > 0 && time.Since(claimedAt)+r.publishTimeout() > r.lease() {
+			r.Logger.WithField("events", len(events)-i).Warn("events lease expiring, leaving them to be claimed again")
+			break
+		}
+		if err := r.publish(ctx, e); err != nil {
+			next := now.Add(r.Backoff(e.Attempts + 1))
+			r.Logger.WithFields(logrus.Fields{
+				"eventID":     e.ID,
+				"type":        e.Type,
+				"attempts":    e.Attempts + 1,
+				"nextAttempt": next,
+			}).WithError(err).Warn("publishing event")
+			if err := r.Outbox.MarkFailed(ctx, e.ID, next, err.Error()); err != nil {
+				r.Logger.WithField("eventID", e.ID).WithError(err).Error("recording failed event")
+			}
+			continue
+		}
+		// the event is published again when this fails, which at-least-once delivery allows
+		if err := r.Outbox.MarkPublished(ctx, e.ID, time.Now()); err != nil {
+			r.Logger.WithField("eventID", e.ID).WithError(err).Error("recording published event")
+		}
+	}
+	return len(events), nil
+}
+
+// publish publishes the event within the publish timeout, the lease assumes publishes are bounded
+func (r Relay) publish(ctx context.Context, e mongo.Event) error {
+	ctx, cancel := context.WithTimeout(ctx, r.publishTimeout())
+	defer cancel()
+	return r.Publisher.Publish(ctx, e)
+}
+
+// Backoff returns the delay before the given delivery attempt, doubling from MinBackoff up to MaxBackoff
+func (r Relay) Backoff(attempt int) time.Duration {
+	min, max := r.MinBackoff, r.MaxBackoff
+	if min <= 0 {
+		min = time.Second
+	}
+	if max <= 0 {
+		max = 5 * time.Minute
+	}
+	return ExponentialBackoff(attempt, min, max)
+}
+
+// ExponentialBackoff returns the delay before the given attempt, starting at min and doubling up to max
+func ExponentialBackoff(attempt int, min time.Duration, max time.Duration) time.Duration {
+	delay := min
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+func (r Relay) interval() time.Duration {
+	if r.Interval <= 0 {
+		return time.Second
+	}
+	return r.Interval
+}
+
+func (r Relay) batchSize() int {
+	if r.BatchSize <= 0 {
+		return 100
+	}
+	return r.BatchSize
+}
+
+func (r Relay) lease() time.Duration {
+	if r.Lease <= 0 {
+		return defaultLease
+	}
+	return r.Lease
+}
+
+func (r Relay) publishTimeout() time.Duration {
+	if r.PublishTimeout <= 0 {
+		return defaultPublishTimeout
+	}
+	return r.PublishTimeout
+}
+
+// claimLimit is how many events are claimed at once: the batch size, but no more than can be published within the lease
+func (r Relay) claimLimit() int {
+	limit := int(r.lease() / r.publishTimeout())
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > r.batchSize() {
+		limit = r.batchSize()
+	}
+	return limit
+}
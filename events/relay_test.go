@@ -0,0 +1,155 @@
+package events_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jpaldi/go-user-api/events"
+	"github.com/jpaldi/go-user-api/memory"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/password"
+	"github.com/sirupsen/logrus"
+)
+
+// mockPublisher records the published events and fails while err is set
+type mockPublisher struct {
+	published []mongo.Event
+	err       error
+}
+
+func (m *mockPublisher) Publish(ctx context.Context, event mongo.Event) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.published = append(m.published, event)
+	return nil
+}
+
+func TestRelay(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	outbox := memory.NewOutbox()
+	db := memory.New(password.Bcrypt{Cost: 4})
+	db.Outbox = outbox
+	publisher := &mockPublisher{err: fmt.Errorf("connection refused")}
+	relay := events.Relay{Outbox: outbox, Publisher: publisher, Logger: logrus.New(), MinBackoff: time.Second}
+
+	user, err := db.CreateUser(ctx, "test", "", "", "S3CR3T", "test@email.uk", "GB")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := db.RemoveUser(ctx, user.ID, 0); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	now := time.Now()
+	if claimed, _ := relay.Deliver(ctx, now); claimed != 2 || len(publisher.published) != 0 {
+		t.Fatalf("failed events shouldn't be published: claimed %d, published %+v", claimed, publisher.published)
+	}
+	if claimed, _ := relay.Deliver(ctx, now.Add(500*time.Millisecond)); claimed != 0 {
+		t.Fatalf("failed events should be retried after the backoff: claimed %d", claimed)
+	}
+
+	publisher.err = nil
+	if claimed, _ := relay.Deliver(ctx, now.Add(2*time.Second)); claimed != 2 {
+		t.Fatalf("failed events should be retried: claimed %d", claimed)
+	}
+	if len(publisher.published) != 2 || publisher.published[0].Type != mongo.EventUserCreated || publisher.published[1].Type != mongo.EventUserDeleted {
+		t.Fatalf("wrong events: got %+v", publisher.published)
+	}
+	if publisher.published[1].User.DeletedAt == nil || publisher.published[1].Version != 2 {
+		t.Fatalf("the event should carry the deleted user: got %+v", publisher.published[1])
+	}
+	if claimed, _ := relay.Deliver(ctx, now.Add(time.Hour)); claimed != 0 {
+		t.Fatalf("published events shouldn't be published again: claimed %d", claimed)
+	}
+}
+
+// slowPublisher takes delay to publish an event, counting the times each event is published
+type slowPublisher struct {
+	delay     time.Duration
+	mu        sync.Mutex
+	published map[string]int
+}
+
+func (s *slowPublisher) Publish(ctx context.Context, event mongo.Event) error {
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published[event.ID]++
+	return nil
+}
+
+func (s *slowPublisher) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.published)
+}
+
+func TestRelayPublishesClaimedEventsOnce(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	outbox := memory.NewOutbox()
+	db := memory.New(password.Bcrypt{Cost: 4})
+	db.Outbox = outbox
+	// a batch of 10 takes longer than the lease
+	publisher := &slowPublisher{delay: 60 * time.Millisecond, published: map[string]int{}}
+	for i := 0; i < 10; i++ {
+		if _, err := db.CreateUser(ctx, fmt.Sprintf("test-%d", i), "", "", "S3CR3T", fmt.Sprintf("test-%d@email.uk", i), "GB"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			relay := events.Relay{
+				Outbox:         outbox,
+				Publisher:      publisher,
+				Logger:         logrus.New(),
+				Lease:          400 * time.Millisecond,
+				PublishTimeout: 100 * time.Millisecond,
+			}
+			for publisher.count() < 10 && time.Now().Before(deadline) {
+				relay.Deliver(ctx, time.Now())
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(publisher.published) != 10 {
+		t.Fatalf("every event should be published: got %d", len(publisher.published))
+	}
+	for id, count := range publisher.published {
+		if count != 1 {
+			t.Fatalf("event %s should be published once: got %d", id, count)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+	relay := events.Relay{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	for _, tt := range []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{attempt: 1, expected: time.Second},
+		{attempt: 2, expected: 2 * time.Second},
+		{attempt: 4, expected: 8 * time.Second},
+		{attempt: 5, expected: 10 * time.Second},
+		{attempt: 100, expected: 10 * time.Second},
+	} {
+		if got := relay.Backoff(tt.attempt); got != tt.expected {
+			t.Fatalf("wrong backoff for attempt %d: got %s want %s", tt.attempt, got, tt.expected)
+		}
+	}
+}
@@ -7,4 +7,6 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/sirupsen/logrus v1.4.2
 	go.mongodb.org/mongo-driver v1.4.1
+	golang.org/x/crypto v0.0.0-20190530122614-20be4c3c3ed5
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jpaldi/go-user-api/auth"
+	"github.com/jpaldi/go-user-api/logging"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/policy"
+	"github.com/sirupsen/logrus"
+)
+
+// AuditLog records every change made to users and lists them
+type AuditLog interface {
+	Record(ctx context.Context, record mongo.AuditRecord) error
+	List(ctx context.Context, userID string, opts mongo.AuditListOptions) (*mongo.AuditPage, error)
+}
+
+// snapshot returns the stored user, deleted or not, so changes can be audited.
+// It returns nil when auditing is disabled or the user can't be read.
+func (handler *Handler) snapshot(ctx context.Context, userid string) *mongo.User {
+	if handler.Audit == nil {
+		return nil
+	}
+	opts := mongo.ListOptions{
+		Filter:         map[string]string{"_id": userid},
+		Limit:          1,
+		Sort:           "created_at",
+		IncludeDeleted: true,
+	}
+	page, err := handler.Database.GetUsers(ctx, opts)
+	if err != nil || len(page.Users) == 0 {
+		return nil
+	}
+	return page.Users[0]
+}
+
+// audit records the change of a user from before to after, before is nil for new users.
+// Changes that left the user as it was aren't recorded. The change is already made, so
+// failing to record it is logged instead of failing the request.
+func (handler *Handler) audit(r *http.Request, action string, before *mongo.User, after mongo.User) {
+	if handler.Audit == nil {
+		return
+	}
+	// users signing up act on their own behalf
+	actor := after.ID
+	if identity, ok := auth.IdentityFromContext(r.Context()); ok {
+		actor = identity.Subject
+	}
+
+	record := mongo.NewAuditRecord(action, actor, logging.RequestID(r.Context()), before, after)
+	if len(record.Changes) == 0 {
+		return
+	}
+	if err := handler.Audit.Record(r.Context(), record); err != nil {
+		logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+			"userID": after.ID,
+			"action": action,
+			"actor":  actor,
+		}).WithError(err).Error("couldn't record audit record")
+	}
+}
+
+// GetAudit handles the GET /users/{userid}/audit request, the changes made to a user, newest first
+func (handler *Handler) GetAudit(w http.ResponseWriter, r *http.Request) {
+	userid := mux.Vars(r)["userid"]
+	if _, ok := handler.authorize(w, r, policy.ReadAudit, userid); !ok {
+		return
+	}
+
+	opts, err := mongo.ParseAuditListOptions(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, codeInvalidParameter, err.Error())
+		return
+	}
+
+	// nothing is recorded when auditing is disabled
+	page := &mongo.AuditPage{Records: []mongo.AuditRecord{}}
+	if handler.Audit != nil {
+		if page, err = handler.Audit.List(r.Context(), userid, opts); err != nil {
+			writeError(w, r, handler.Logger, err)
+			return
+		}
+	}
+
+	// Log to console
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+		"number_records": len(page.Records),
+	}).Info("listed audit records")
+
+	if page.NextPageToken != "" {
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextPageURL(r.URL, page.NextPageToken)))
+	}
+	writeResponse(w, http.StatusOK, page)
+}
@@ -0,0 +1,84 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jpaldi/go-user-api/auth"
+	"github.com/jpaldi/go-user-api/handlers"
+	"github.com/jpaldi/go-user-api/logging"
+	"github.com/jpaldi/go-user-api/memory"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/password"
+	"github.com/sirupsen/logrus"
+)
+
+func TestAuditTrail(t *testing.T) {
+	t.Parallel()
+	handler := handlers.Handler{
+		Database: memory.New(password.Bcrypt{Cost: 4}),
+		Logger:   logrus.New(),
+		Audit:    memory.NewAuditLog(),
+	}
+
+	w := httptest.NewRecorder()
+	r := createPOSTRequest(http.MethodPost, "/users", validUserBody)
+	handler.CreateUser(w, r.WithContext(logging.WithRequestID(r.Context(), "request-1")))
+	created := mongo.User{}
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("couldn't create user: %s", err)
+	}
+	owner := &auth.Identity{Subject: created.ID, Method: "jwt"}
+
+	r, _ = http.NewRequest(http.MethodPatch, "/users/"+created.ID, strings.NewReader(`{"nickname": "renamed", "password": "an0ther-h0rse-battery"}`))
+	r.Header.Set("Content-Type", "application/merge-patch+json")
+	serveRoute(handler.PatchUser, http.MethodPatch, "/users/{userid}", r, owner)
+	for i := 0; i < 2; i++ {
+		r = createPOSTRequest(http.MethodPost, "/users/"+created.ID+"/roles", `{"role": "support"}`)
+		serveRoute(handler.GrantRole, http.MethodPost, "/users/{userid}/roles", r, admin)
+	}
+	r, _ = http.NewRequest(http.MethodDelete, "/users/"+created.ID, nil)
+	serveRoute(handler.RemoveUser, http.MethodDelete, "/users/{userid}", r, owner)
+	r, _ = http.NewRequest(http.MethodPost, "/users/"+created.ID+"/restore", nil)
+	serveRoute(handler.RestoreUser, http.MethodPost, "/users/{userid}/restore", r, admin)
+
+	r, _ = http.NewRequest(http.MethodGet, "/users/"+created.ID+"/audit", nil)
+	if resp, body := serveRoute(handler.GetAudit, http.MethodGet, "/users/{userid}/audit", r, owner); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("users shouldn't read their audit trail: got %d %s", resp.StatusCode, body)
+	}
+	resp, body := serveRoute(handler.GetAudit, http.MethodGet, "/users/{userid}/audit", r, admin)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code: got %d want 200: %s", resp.StatusCode, body)
+	}
+	page := mongo.AuditPage{}
+	if err := json.Unmarshal([]byte(body), &page); err != nil {
+		t.Fatalf("couldn't decode audit page: %s", err)
+	}
+
+	// records of the same millisecond have no defined order, so they are checked by action
+	records := map[string]mongo.AuditRecord{}
+	for _, record := range page.Records {
+		records[record.Action] = record
+	}
+	if len(page.Records) != 5 || len(records) != 5 {
+		t.Fatalf("the no-op grant shouldn't be recorded: got %+v", page.Records)
+	}
+	if create := records[mongo.ActionCreate]; create.Actor != created.ID || create.RequestID != "request-1" {
+		t.Fatalf("wrong create record: got %+v", create)
+	}
+	patched := records[mongo.ActionPatch]
+	if patched.Actor != created.ID || len(patched.Changes) != 2 || strings.Contains(body, "$argon2id$") || strings.Contains(body, "$2a$") {
+		t.Fatalf("wrong patch record: got %+v", patched)
+	}
+	for _, change := range patched.Changes {
+		if change.Field == "password" && (change.Before != mongo.Redacted || change.After != mongo.Redacted) {
+			t.Fatalf("passwords should be redacted: got %+v", change)
+		}
+	}
+	if restore := records[mongo.ActionRestore]; restore.Actor != admin.Subject || len(restore.Changes) != 1 || restore.Changes[0].Field != "deleted_at" || restore.Changes[0].After != nil {
+		t.Fatalf("wrong restore record: got %+v", restore)
+	}
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jpaldi/go-user-api/auth"
+	"github.com/jpaldi/go-user-api/logging"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/password"
+	"github.com/jpaldi/go-user-api/validation"
+	"github.com/sirupsen/logrus"
+)
+
+// Authenticator wraps the Database functions checking user credentials and roles
+type Authenticator interface {
+	Authenticate(ctx context.Context, login string, password string) (*mongo.User, error)
+	GetRoles(ctx context.Context, guid string) ([]string, error)
+}
+
+// RefreshTokenStore wraps the Database functions storing refresh tokens
+type RefreshTokenStore interface {
+	SaveRefreshToken(ctx context.Context, token mongo.RefreshToken) error
+	ConsumeRefreshToken(ctx context.Context, hash string) (*mongo.RefreshToken, error)
+	RevokeRefreshToken(ctx context.Context, hash string) (bool, error)
+}
+
+// AuthHandler represents the handler for auth routes
+type AuthHandler struct {
+	Users         Authenticator
+	RefreshTokens RefreshTokenStore
+	Tokens        auth.Tokens
+	RefreshTTL    time.Duration
+	Logger        *logrus.Logger
+}
+
+type loginRequestBody struct {
+	// Login is either the nickname or the email of the user
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+func (body loginRequestBody) validate() validation.Errors {
+	errs := validation.Errors{}
+	if body.Login == "" {
+		errs = append(errs, required("login"))
+	}
+	if body.Password == "" {
+		errs = append(errs, required("password"))
+	}
+	return errs
+}
+
+type refreshRequestBody struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Login handles the POST /auth/login request
+func (handler *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	body := loginRequestBody{}
+	if err := decodeJSON(r, &body); err != nil {
+		writeProblem(w, r, codeInvalidBody, "invalid json body")
+		return
+	}
+	if errs := body.validate(); len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+
+	user, err := handler.Users.Authenticate(r.Context(), body.Login, body.Password)
+	if errors.Is(err, mongo.ErrNotFound) || errors.Is(err, password.ErrMismatch) {
+		// don't tell which one was wrong
+		writeProblem(w, r, codeInvalidCredentials, "invalid credentials")
+		return
+	}
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	handler.issueTokens(w, r, user.ID, user.Roles)
+}
+
+// Refresh handles the POST /auth/refresh request, the refresh token can only be exchanged once
+func (handler *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	body := refreshRequestBody{}
+	if err := decodeJSON(r, &body); err != nil {
+		writeProblem(w, r, codeInvalidBody, "invalid json body")
+		return
+	}
+	if body.RefreshToken == "" {
+		writeValidationErrors(w, r, validation.Errors{required("refresh_token")})
+		return
+	}
+
+	token, err := handler.RefreshTokens.ConsumeRefreshToken(r.Context(), auth.HashRefreshToken(body.RefreshToken))
+	if errors.Is(err, mongo.ErrNotFound) {
+		writeProblem(w, r, codeInvalidRefreshToken, "invalid refresh token")
+		return
+	}
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	// roles may have changed since the previous token was issued
+	roles, err := handler.Users.GetRoles(r.Context(), token.UserID)
+	if errors.Is(err, mongo.ErrNotFound) {
+		writeProblem(w, r, codeInvalidRefreshToken, "invalid refresh token")
+		return
+	}
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	handler.issueTokens(w, r, token.UserID, roles)
+}
+
+// Logout handles the POST /auth/logout request by revoking the refresh token
+func (handler *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	body := refreshRequestBody{}
+	if err := decodeJSON(r, &body); err != nil {
+		writeProblem(w, r, codeInvalidBody, "invalid json body")
+		return
+	}
+	if body.RefreshToken == "" {
+		writeValidationErrors(w, r, validation.Errors{required("refresh_token")})
+		return
+	}
+
+	// logging out twice is not an error
+	if _, err := handler.RefreshTokens.RevokeRefreshToken(r.Context(), auth.HashRefreshToken(body.RefreshToken)); err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, "OK")
+}
+
+func (handler *AuthHandler) issueTokens(w http.ResponseWriter, r *http.Request, userID string, roles []string) {
+	accessToken, claims, err := handler.Tokens.Issue(userID, roles)
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	refreshToken, hash, err := auth.NewRefreshToken()
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	err = handler.RefreshTokens.SaveRefreshToken(r.Context(), mongo.RefreshToken{
+		Hash:      hash,
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(handler.RefreshTTL),
+	})
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	// Log to console
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+		"userID": userID,
+	}).Info("issued tokens")
+	writeResponse(w, http.StatusOK, tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    claims.ExpiresAt - claims.IssuedAt,
+		RefreshToken: refreshToken,
+	})
+}
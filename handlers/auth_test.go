@@ -0,0 +1,119 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jpaldi/go-user-api/auth"
+	"github.com/jpaldi/go-user-api/handlers"
+	"github.com/jpaldi/go-user-api/memory"
+	"github.com/jpaldi/go-user-api/password"
+	"github.com/sirupsen/logrus"
+)
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+func newAuthHandler(t *testing.T) (*handlers.AuthHandler, string) {
+	users := memory.New(password.Bcrypt{Cost: 4})
+	user, err := users.CreateUser(context.Background(), "test", "test", "test", "S3CR3T", "test@email.uk", "UK")
+	if err != nil {
+		t.Fatalf("couldn't create user: %s", err)
+	}
+
+	return &handlers.AuthHandler{
+		Users:         users,
+		RefreshTokens: memory.NewRefreshTokens(),
+		Tokens: auth.Tokens{
+			Method: auth.HS256{Secret: []byte("0123456789abcdef0123456789abcdef")},
+			TTL:    time.Minute,
+		},
+		RefreshTTL: time.Hour,
+		Logger:     logrus.New(),
+	}, user.ID
+}
+
+func serve(handler http.HandlerFunc, r *http.Request) (*http.Response, tokenResponse) {
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	tokens := tokenResponse{}
+	json.NewDecoder(w.Result().Body).Decode(&tokens)
+	return w.Result(), tokens
+}
+
+func TestLogin(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name               string
+		body               string
+		expectedStatusCode int
+	}{
+		{name: "should return tokens when logging in with the nickname", body: `{"login": "test", "password": "S3CR3T"}`, expectedStatusCode: 200},
+		{name: "should return tokens when logging in with the email", body: `{"login": "test@email.uk", "password": "S3CR3T"}`, expectedStatusCode: 200},
+		{name: "should return tokens when logging in with the email in another case", body: `{"login": "Test@EMAIL.uk", "password": "S3CR3T"}`, expectedStatusCode: 200},
+		{name: "should return a 401 if the password is wrong", body: `{"login": "test", "password": "wrong"}`, expectedStatusCode: 401},
+		{name: "should return a 401 if the user doesn't exist", body: `{"login": "nobody", "password": "S3CR3T"}`, expectedStatusCode: 401},
+		{name: "should return a 400 if the password is missing", body: `{"login": "test"}`, expectedStatusCode: 400},
+		{name: "should return a 400 if the body isn't json", body: `login=test`, expectedStatusCode: 400},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			handler, userID := newAuthHandler(t)
+
+			resp, tokens := serve(handler.Login, createPOSTRequest(http.MethodPost, "/auth/login", tt.body))
+
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d", resp.StatusCode, tt.expectedStatusCode)
+			}
+			if tt.expectedStatusCode != 200 {
+				return
+			}
+
+			claims, err := handler.Tokens.Parse(tokens.AccessToken)
+			if err != nil {
+				t.Fatalf("couldn't parse access token: %s", err)
+			}
+			if claims.Subject != userID {
+				t.Fatalf("wrong subject: got %s want %s", claims.Subject, userID)
+			}
+			if tokens.RefreshToken == "" || tokens.ExpiresIn != 60 {
+				t.Fatalf("wrong token response: got %+v", tokens)
+			}
+		})
+	}
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	t.Parallel()
+	handler, _ := newAuthHandler(t)
+	_, login := serve(handler.Login, createPOSTRequest(http.MethodPost, "/auth/login", `{"login": "test", "password": "S3CR3T"}`))
+
+	refreshBody := `{"refresh_token": "` + login.RefreshToken + `"}`
+
+	resp, refreshed := serve(handler.Refresh, createPOSTRequest(http.MethodPost, "/auth/refresh", refreshBody))
+	if resp.StatusCode != 200 || refreshed.AccessToken == "" {
+		t.Fatalf("refresh failed: got %d", resp.StatusCode)
+	}
+
+	// refresh tokens are rotated, the first one can't be used twice
+	if resp, _ := serve(handler.Refresh, createPOSTRequest(http.MethodPost, "/auth/refresh", refreshBody)); resp.StatusCode != 401 {
+		t.Fatalf("reused refresh token: got %d want 401", resp.StatusCode)
+	}
+
+	logoutBody := `{"refresh_token": "` + refreshed.RefreshToken + `"}`
+	if resp, _ := serve(handler.Logout, createPOSTRequest(http.MethodPost, "/auth/logout", logoutBody)); resp.StatusCode != 200 {
+		t.Fatalf("logout failed: got %d", resp.StatusCode)
+	}
+
+	if resp, _ := serve(handler.Refresh, createPOSTRequest(http.MethodPost, "/auth/refresh", logoutBody)); resp.StatusCode != 401 {
+		t.Fatalf("revoked refresh token: got %d want 401", resp.StatusCode)
+	}
+}
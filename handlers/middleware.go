@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jpaldi/go-user-api/auth"
+	"github.com/jpaldi/go-user-api/logging"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/policy"
+	"github.com/sirupsen/logrus"
+)
+
+// RoleStore wraps the Database function returning the current roles of a user
+type RoleStore interface {
+	GetRoles(ctx context.Context, guid string) ([]string, error)
+}
+
+// Authentication validates the bearer token of every request, either a JWT access token
+// or a static API key, and stores the caller identity in the request context. Requests without
+// a bearer token are authenticated by their verified TLS client certificate, when it is mapped.
+type Authentication struct {
+	Tokens             auth.Tokens
+	APIKeys            auth.APIKeys
+	ClientCertificates auth.ClientCertificates
+	// Users resolves the roles of access token callers on every request, rather than trusting the roles of the
+	// token, so revoked roles and deleted users lose their access before the token expires
+	Users  RoleStore
+	Logger *logrus.Logger
+}
+
+// Middleware rejects unauthenticated requests with a 401
+func (a Authentication) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			if identity, ok := a.clientCertificateIdentity(r); ok {
+				next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+				return
+			}
+			writeUnauthorized(w, r, "missing bearer token")
+			return
+		}
+		token := strings.TrimPrefix(header, "Bearer ")
+
+		if identity, ok := a.APIKeys.Lookup(token); ok {
+			next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+			return
+		}
+
+		claims, err := a.Tokens.Parse(token)
+		if err != nil {
+			logging.FromContext(r.Context(), a.Logger).WithError(err).Warn("rejected bearer token")
+			writeUnauthorized(w, r, err.Error())
+			return
+		}
+
+		roles, err := a.Users.GetRoles(r.Context(), claims.Subject)
+		if errors.Is(err, mongo.ErrNotFound) {
+			writeUnauthorized(w, r, "user no longer exists")
+			return
+		}
+		if err != nil {
+			writeError(w, r, a.Logger, err)
+			return
+		}
+		identity := auth.Identity{
+			Subject: claims.Subject,
+			Roles:   roles,
+			Method:  "jwt",
+		}
+		next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+	})
+}
+
+// clientCertificateIdentity maps the client certificate to an identity, only certificates verified
+// against the client CAs during the TLS handshake are trusted
+func (a Authentication) clientCertificateIdentity(r *http.Request) (auth.Identity, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return auth.Identity{}, false
+	}
+	return a.ClientCertificates.Lookup(r.TLS.VerifiedChains[0][0])
+}
+
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="users"`)
+	writeProblem(w, r, codeUnauthorized, message)
+}
+
+// authorize checks the policy allows the caller to perform the operation on the user, writing the
+// error response when not. Listings have no target user and are checked against the query parameters.
+func (handler *Handler) authorize(w http.ResponseWriter, r *http.Request, operation string, userID string) (auth.Identity, bool) {
+	return authorize(w, r, handler.policy(), operation, userID)
+}
+
+func authorize(w http.ResponseWriter, r *http.Request, p *policy.Policy, operation string, userID string) (auth.Identity, bool) {
+	identity, ok := auth.IdentityFromContext(r.Context())
+	if !ok {
+		writeUnauthorized(w, r, "missing bearer token")
+		return identity, false
+	}
+	if !p.Allows(identity, operation, userID, r.URL.Query()) {
+		writeProblem(w, r, codeForbidden, fmt.Sprintf("%s is not allowed", operation))
+		return identity, false
+	}
+	return identity, true
+}
+
+func (handler *Handler) policy() *policy.Policy {
+	if handler.Policy == nil {
+		return &policy.Default
+	}
+	return handler.Policy
+}
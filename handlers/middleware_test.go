@@ -0,0 +1,272 @@
+package handlers_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jpaldi/go-user-api/auth"
+	"github.com/jpaldi/go-user-api/handlers"
+	"github.com/jpaldi/go-user-api/memory"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/password"
+	"github.com/sirupsen/logrus"
+)
+
+func mockRemoveUserOK() mockDatabase {
+	return mockDatabase{
+		removeUser: func(ctx context.Context, guid string, version int64) (int64, error) {
+			return 1, nil
+		},
+	}
+}
+
+// mockRoleStore maps users to their roles, the users missing don't exist
+type mockRoleStore map[string][]string
+
+func (m mockRoleStore) GetRoles(ctx context.Context, guid string) ([]string, error) {
+	roles, ok := m[guid]
+	if !ok {
+		return nil, mongo.ErrNotFound
+	}
+	return roles, nil
+}
+
+func TestAuthenticationMiddleware(t *testing.T) {
+	t.Parallel()
+	tokens := auth.Tokens{
+		Method: auth.HS256{Secret: []byte("0123456789abcdef0123456789abcdef")},
+		TTL:    time.Minute,
+	}
+	userToken, _, _ := tokens.Issue("user-1", nil)
+
+	expired := tokens
+	expired.Now = func() time.Time { return time.Now().Add(-time.Hour) }
+	expiredToken, _, _ := expired.Issue("user-1", nil)
+	deletedToken, _, _ := tokens.Issue("user-3", []string{"admin"})
+
+	apiKeys, err := auth.ParseAPIKeys("admin-key=ops:admin,service-key=reporting")
+	if err != nil {
+		t.Fatalf("couldn't parse api keys: %s", err)
+	}
+
+	for _, tt := range []struct {
+		name               string
+		authorization      string
+		userID             string
+		expectedStatusCode int
+		expectedResponse   string
+	}{
+		{
+			name:               "should return a 401 without a bearer token",
+			userID:             "user-1",
+			expectedStatusCode: 401,
+			expectedResponse:   "{\"type\":\"/problems/unauthorized\",\"title\":\"Unauthorized\",\"status\":401,\"detail\":\"missing bearer token\",\"instance\":\"/users/user-1\",\"code\":\"unauthorized\"}\n",
+		},
+		{
+			name:               "should return a 401 with an expired token",
+			authorization:      "Bearer " + expiredToken,
+			userID:             "user-1",
+			expectedStatusCode: 401,
+			expectedResponse:   "{\"type\":\"/problems/unauthorized\",\"title\":\"Unauthorized\",\"status\":401,\"detail\":\"token has expired\",\"instance\":\"/users/user-1\",\"code\":\"unauthorized\"}\n",
+		},
+		{
+			name:               "should return a 401 with an unknown api key",
+			authorization:      "Bearer unknown-key",
+			userID:             "user-1",
+			expectedStatusCode: 401,
+			expectedResponse:   "{\"type\":\"/problems/unauthorized\",\"title\":\"Unauthorized\",\"status\":401,\"detail\":\"invalid token\",\"instance\":\"/users/user-1\",\"code\":\"unauthorized\"}\n",
+		},
+		{
+			name:               "should return a 401 for users deleted since the token was issued",
+			authorization:      "Bearer " + deletedToken,
+			userID:             "user-2",
+			expectedStatusCode: 401,
+			expectedResponse:   "{\"type\":\"/problems/unauthorized\",\"title\":\"Unauthorized\",\"status\":401,\"detail\":\"user no longer exists\",\"instance\":\"/users/user-2\",\"code\":\"unauthorized\"}\n",
+		},
+		{
+			name:               "users should be able to remove themselves",
+			authorization:      "Bearer " + userToken,
+			userID:             "user-1",
+			expectedStatusCode: 200,
+			expectedResponse:   "\"OK\"\n",
+		},
+		{
+			name:               "users should not be able to remove someone else",
+			authorization:      "Bearer " + userToken,
+			userID:             "user-2",
+			expectedStatusCode: 403,
+			expectedResponse:   "{\"type\":\"/problems/forbidden\",\"title\":\"Forbidden\",\"status\":403,\"detail\":\"users:delete is not allowed\",\"instance\":\"/users/user-2\",\"code\":\"forbidden\"}\n",
+		},
+		{
+			name:               "admins should be able to remove anyone",
+			authorization:      "Bearer admin-key",
+			userID:             "user-2",
+			expectedStatusCode: 200,
+			expectedResponse:   "\"OK\"\n",
+		},
+		{
+			name:               "api keys without the admin role should not be able to remove users",
+			authorization:      "Bearer service-key",
+			userID:             "user-2",
+			expectedStatusCode: 403,
+			expectedResponse:   "{\"type\":\"/problems/forbidden\",\"title\":\"Forbidden\",\"status\":403,\"detail\":\"users:delete is not allowed\",\"instance\":\"/users/user-2\",\"code\":\"forbidden\"}\n",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			handler := handlers.Handler{
+				Database: mockRemoveUserOK(),
+				Logger:   logrus.New(),
+			}
+			authentication := handlers.Authentication{
+				Tokens:  tokens,
+				APIKeys: apiKeys,
+				Users:   mockRoleStore{"user-1": nil},
+				Logger:  logrus.New(),
+			}
+
+			router := mux.NewRouter()
+			router.Use(authentication.Middleware)
+			router.HandleFunc("/users/{userid}", handler.RemoveUser).Methods(http.MethodDelete)
+
+			r, _ := http.NewRequest(http.MethodDelete, "/users/"+tt.userID, nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, r)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+
+			if string(body) != tt.expectedResponse {
+				t.Fatalf("wrong response: got %s want %s", body, tt.expectedResponse)
+			}
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d", resp.StatusCode, tt.expectedStatusCode)
+			}
+		})
+	}
+}
+
+func TestRevokedRolesApplyToIssuedTokens(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := memory.New(password.Bcrypt{Cost: 4})
+	revoked, _ := db.CreateUser(ctx, "revoked", "", "", "S3CR3T", "revoked@email.uk", "GB")
+	other, _ := db.CreateUser(ctx, "other", "", "", "S3CR3T", "other@email.uk", "GB")
+	if _, err := db.GrantRole(ctx, revoked.ID, "admin"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tokens := auth.Tokens{
+		Method: auth.HS256{Secret: []byte("0123456789abcdef0123456789abcdef")},
+		TTL:    time.Minute,
+	}
+	oldToken, _, _ := tokens.Issue(revoked.ID, []string{"admin"})
+	apiKeys, err := auth.ParseAPIKeys("admin-key=ops:admin")
+	if err != nil {
+		t.Fatalf("couldn't parse api keys: %s", err)
+	}
+
+	handler := handlers.Handler{Database: db, Logger: logrus.New()}
+	authentication := handlers.Authentication{Tokens: tokens, APIKeys: apiKeys, Users: db, Logger: logrus.New()}
+	router := mux.NewRouter()
+	router.Use(authentication.Middleware)
+	router.HandleFunc("/users/{userid}", handler.GetUser).Methods(http.MethodGet)
+	router.HandleFunc("/users/{userid}", handler.RemoveUser).Methods(http.MethodDelete)
+	router.HandleFunc("/users/{userid}/roles/{role}", handler.RevokeRole).Methods(http.MethodDelete)
+	call := func(method string, path string, token string) int {
+		r, _ := http.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := call(http.MethodGet, "/users/"+other.ID, oldToken); code != http.StatusOK {
+		t.Fatalf("admins should read other users: got %d", code)
+	}
+	if code := call(http.MethodDelete, "/users/"+revoked.ID+"/roles/admin", "admin-key"); code != http.StatusOK {
+		t.Fatalf("unexpected status code revoking the role: %d", code)
+	}
+	if code := call(http.MethodGet, "/users/"+other.ID, oldToken); code != http.StatusForbidden {
+		t.Fatalf("revoked roles should apply to tokens issued before: got %d", code)
+	}
+	if code := call(http.MethodDelete, "/users/"+revoked.ID, "admin-key"); code != http.StatusOK {
+		t.Fatalf("unexpected status code removing the user: %d", code)
+	}
+	if code := call(http.MethodGet, "/users/"+revoked.ID, oldToken); code != http.StatusUnauthorized {
+		t.Fatalf("deleted users should be rejected with tokens issued before: got %d", code)
+	}
+}
+
+func TestAuthenticationWithClientCertificates(t *testing.T) {
+	t.Parallel()
+	certificates, err := auth.ParseClientCertificates("billing.internal=billing-service:admin")
+	if err != nil {
+		t.Fatalf("couldn't parse client certificates: %s", err)
+	}
+	billing := &x509.Certificate{Subject: pkix.Name{CommonName: "billing.internal"}}
+	reporting := &x509.Certificate{Subject: pkix.Name{CommonName: "reporting.internal"}}
+
+	for _, tt := range []struct {
+		name               string
+		tls                *tls.ConnectionState
+		expectedStatusCode int
+	}{
+		{
+			name:               "verified certificates should grant their identity",
+			tls:                &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{billing}}},
+			expectedStatusCode: 200,
+		},
+		{
+			name:               "unverified certificates should not be trusted",
+			tls:                &tls.ConnectionState{PeerCertificates: []*x509.Certificate{billing}},
+			expectedStatusCode: 401,
+		},
+		{
+			name:               "unmapped certificates should not be trusted",
+			tls:                &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{reporting}}},
+			expectedStatusCode: 401,
+		},
+		{
+			name:               "plaintext requests should need a bearer token",
+			expectedStatusCode: 401,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			handler := handlers.Handler{
+				Database: mockRemoveUserOK(),
+				Logger:   logrus.New(),
+			}
+			authentication := handlers.Authentication{
+				ClientCertificates: certificates,
+				Logger:             logrus.New(),
+			}
+
+			router := mux.NewRouter()
+			router.Use(authentication.Middleware)
+			router.HandleFunc("/users/{userid}", handler.RemoveUser).Methods(http.MethodDelete)
+
+			r, _ := http.NewRequest(http.MethodDelete, "/users/user-2", nil)
+			r.TLS = tt.tls
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d", w.Code, tt.expectedStatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jpaldi/go-user-api/mongo"
+)
+
+// etag returns the entity tag of a user version
+func etag(version int64) string {
+	return fmt.Sprintf("%q", strconv.FormatInt(version, 10))
+}
+
+// entityTags is a parsed If-Match or If-None-Match header
+type entityTags struct {
+	present bool
+	// any is set by "*"
+	any  bool
+	tags []string
+}
+
+func parseEntityTags(header string) entityTags {
+	tags := entityTags{present: header != ""}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		switch {
+		case tag == "*":
+			tags.any = true
+		case tag != "":
+			tags.tags = append(tags.tags, tag)
+		}
+	}
+	return tags
+}
+
+// matches compares the tags with the version, weak tags only match when weak is set
+func (t entityTags) matches(version int64, weak bool) bool {
+	if t.any {
+		return true
+	}
+	for _, tag := range t.tags {
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// single returns the version of an If-Match header naming exactly one strong tag
+func (t entityTags) single() (int64, bool) {
+	if t.any || len(t.tags) != 1 {
+		return 0, false
+	}
+	unquoted, err := strconv.Unquote(t.tags[0])
+	if err != nil {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	return version, err == nil && version > 0
+}
+
+// ifMatch parses the If-Match header, and writes a 428 when it is required but missing
+func (handler *Handler) ifMatch(w http.ResponseWriter, r *http.Request) (entityTags, bool) {
+	ifMatch := parseEntityTags(r.Header.Get("If-Match"))
+	if !ifMatch.present && handler.RequireIfMatch {
+		writeProblem(w, r, codePreconditionRequired, "the If-Match header is required, send the ETag of the user")
+		return ifMatch, false
+	}
+	return ifMatch, true
+}
+
+// expectedVersion returns the version a PUT or DELETE request expects from its If-Match header, 0 for any version.
+// It writes a 428 when the header is required but missing, and a 412 when no tag matches the stored user.
+func (handler *Handler) expectedVersion(w http.ResponseWriter, r *http.Request, userid string) (int64, bool) {
+	ifMatch, ok := handler.ifMatch(w, r)
+	if !ok {
+		return 0, false
+	}
+	if !ifMatch.present || ifMatch.any {
+		return 0, true
+	}
+	if version, ok := ifMatch.single(); ok {
+		return version, true
+	}
+
+	// several tags, check them against the stored user
+	user, err := handler.Database.GetUser(r.Context(), userid)
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return 0, false
+	}
+	if !ifMatch.matches(user.Version, false) {
+		writeError(w, r, handler.Logger, mongo.ErrVersionMismatch)
+		return 0, false
+	}
+	return user.Version, true
+}
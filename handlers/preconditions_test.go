@@ -0,0 +1,148 @@
+package handlers_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jpaldi/go-user-api/handlers"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/sirupsen/logrus"
+)
+
+// mockVersionedUser stores user-1 at version 3 and records the versions changes expect
+func mockVersionedUser(expected *[]int64) mockDatabase {
+	stored := mongo.User{ID: "user-1", Nickname: "test", FirstName: "test", LastName: "test", Email: "test@email.uk", Country: "GB", Version: 3}
+	change := func(version int64) (*mongo.User, error) {
+		*expected = append(*expected, version)
+		if version != 0 && version != stored.Version {
+			return nil, mongo.ErrVersionMismatch
+		}
+		u := stored
+		u.Version++
+		return &u, nil
+	}
+	return mockDatabase{
+		getUser: func(ctx context.Context, guid string) (*mongo.User, error) {
+			u := stored
+			return &u, nil
+		},
+		updateUser: func(ctx context.Context, guid string, version int64, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error) {
+			return change(version)
+		},
+		patchUser: func(ctx context.Context, guid string, version int64, changes map[string]string) (*mongo.User, error) {
+			return change(version)
+		},
+		removeUser: func(ctx context.Context, guid string, version int64) (int64, error) {
+			if _, err := change(version); err != nil {
+				return 0, err
+			}
+			return 1, nil
+		},
+	}
+}
+
+func TestPreconditions(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name               string
+		method             string
+		header             string
+		value              string
+		requireIfMatch     bool
+		expectedStatusCode int
+		expectedETag       string
+		expectedVersions   []int64
+	}{
+		{name: "PUT with a matching If-Match", method: http.MethodPut, header: "If-Match", value: `"3"`, expectedStatusCode: 200, expectedETag: `"4"`, expectedVersions: []int64{3}},
+		{name: "PUT with a stale If-Match", method: http.MethodPut, header: "If-Match", value: `"2"`, expectedStatusCode: 412, expectedVersions: []int64{2}},
+		{name: "PUT with If-Match any", method: http.MethodPut, header: "If-Match", value: "*", expectedStatusCode: 200, expectedETag: `"4"`, expectedVersions: []int64{0}},
+		{name: "PUT with several tags, one matching", method: http.MethodPut, header: "If-Match", value: `"2", "3"`, expectedStatusCode: 200, expectedETag: `"4"`, expectedVersions: []int64{3}},
+		{name: "PUT with several tags, none matching", method: http.MethodPut, header: "If-Match", value: `"1", "2"`, expectedStatusCode: 412},
+		{name: "PUT with a weak tag", method: http.MethodPut, header: "If-Match", value: `W/"3"`, expectedStatusCode: 412},
+		{name: "PUT without If-Match", method: http.MethodPut, expectedStatusCode: 200, expectedETag: `"4"`, expectedVersions: []int64{0}},
+		{name: "PUT without a required If-Match", method: http.MethodPut, requireIfMatch: true, expectedStatusCode: 428},
+		{name: "PATCH with a matching If-Match", method: http.MethodPatch, header: "If-Match", value: `"3"`, expectedStatusCode: 200, expectedETag: `"4"`, expectedVersions: []int64{3}},
+		{name: "PATCH with a stale If-Match", method: http.MethodPatch, header: "If-Match", value: `"2"`, expectedStatusCode: 412},
+		{name: "PATCH without If-Match applies to the read version", method: http.MethodPatch, expectedStatusCode: 200, expectedETag: `"4"`, expectedVersions: []int64{3}},
+		{name: "PATCH without a required If-Match", method: http.MethodPatch, requireIfMatch: true, expectedStatusCode: 428},
+		{name: "DELETE with a matching If-Match", method: http.MethodDelete, header: "If-Match", value: `"3"`, expectedStatusCode: 200, expectedVersions: []int64{3}},
+		{name: "DELETE with a stale If-Match", method: http.MethodDelete, header: "If-Match", value: `"2"`, expectedStatusCode: 412, expectedVersions: []int64{2}},
+		{name: "DELETE without a required If-Match", method: http.MethodDelete, requireIfMatch: true, expectedStatusCode: 428},
+		{name: "GET with a matching If-None-Match", method: http.MethodGet, header: "If-None-Match", value: `"3"`, expectedStatusCode: 304, expectedETag: `"3"`},
+		{name: "GET with a weak matching If-None-Match", method: http.MethodGet, header: "If-None-Match", value: `"1", W/"3"`, expectedStatusCode: 304, expectedETag: `"3"`},
+		{name: "GET with a stale If-None-Match", method: http.MethodGet, header: "If-None-Match", value: `"2"`, expectedStatusCode: 200, expectedETag: `"3"`},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var versions []int64
+			handler := handlers.Handler{
+				Database:       mockVersionedUser(&versions),
+				Logger:         logrus.New(),
+				RequireIfMatch: tt.requireIfMatch,
+			}
+			routes := map[string]http.HandlerFunc{
+				http.MethodGet:    handler.GetUser,
+				http.MethodPut:    handler.UpdateUser,
+				http.MethodPatch:  handler.PatchUser,
+				http.MethodDelete: handler.RemoveUser,
+			}
+			body := validUserBody
+			if tt.method == http.MethodPatch {
+				body = `{"country": "PT"}`
+			}
+
+			r, _ := http.NewRequest(tt.method, "/users/user-1", strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/merge-patch+json")
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			resp, respBody := serveRoute(routes[tt.method], tt.method, "/users/{userid}", r, admin)
+
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d: %s", resp.StatusCode, tt.expectedStatusCode, respBody)
+			}
+			if etag := resp.Header.Get("ETag"); etag != tt.expectedETag {
+				t.Fatalf("wrong ETag: got %s want %s", etag, tt.expectedETag)
+			}
+			if len(versions) != len(tt.expectedVersions) || (len(versions) > 0 && versions[0] != tt.expectedVersions[0]) {
+				t.Fatalf("wrong expected versions: got %v want %v", versions, tt.expectedVersions)
+			}
+		})
+	}
+}
+
+func TestPatchUserRetriesWithoutIfMatch(t *testing.T) {
+	t.Parallel()
+	version := int64(1)
+	attempts := 0
+	handler := handlers.Handler{
+		Database: mockDatabase{
+			getUser: func(ctx context.Context, guid string) (*mongo.User, error) {
+				return &mongo.User{ID: "user-1", Nickname: "test", FirstName: "test", LastName: "test", Email: "test@email.uk", Country: "GB", Version: version}, nil
+			},
+			patchUser: func(ctx context.Context, guid string, expected int64, changes map[string]string) (*mongo.User, error) {
+				attempts++
+				if attempts == 1 {
+					// another request changes the user between the read and the write
+					version++
+					return nil, mongo.ErrVersionMismatch
+				}
+				return &mongo.User{ID: "user-1", Version: expected + 1}, nil
+			},
+		},
+		Logger: logrus.New(),
+	}
+
+	r, _ := http.NewRequest(http.MethodPatch, "/users/user-1", strings.NewReader(`{"country": "PT"}`))
+	r.Header.Set("Content-Type", "application/merge-patch+json")
+	resp, body := serveRoute(handler.PatchUser, http.MethodPatch, "/users/{userid}", r, admin)
+
+	if resp.StatusCode != http.StatusOK || attempts != 2 {
+		t.Fatalf("wrong result: got %d after %d attempts: %s", resp.StatusCode, attempts, body)
+	}
+	if etag := resp.Header.Get("ETag"); etag != `"3"` {
+		t.Fatalf("wrong ETag: got %s want \"3\"", etag)
+	}
+}
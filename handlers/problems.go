@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/jpaldi/go-user-api/logging"
+	"github.com/jpaldi/go-user-api/validation"
+)
+
+// ProblemContentType is the media type of every error response
+const ProblemContentType = "application/problem+json"
+
+// problemTypeBase prefixes the codes to form the problem type URIs, GET /problems/{code} documents them
+const problemTypeBase = "/problems/"
+
+// The error codes, the last segment of the problem types
+const (
+	codeInvalidBody          = "invalid_body"
+	codeInvalidParameter     = "invalid_parameter"
+	codeValidationFailed     = "validation_failed"
+	codeUnknownRole          = "unknown_role"
+	codeUnauthorized         = "unauthorized"
+	codeInvalidCredentials   = "invalid_credentials"
+	codeInvalidRefreshToken  = "invalid_refresh_token"
+	codeForbidden            = "forbidden"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeConflict             = "conflict"
+	codeTestFailed           = "test_failed"
+	codePreconditionFailed   = "precondition_failed"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeInvalidPatch         = "invalid_patch"
+	codeInvalidDocument      = "invalid_document"
+	codePreconditionRequired = "precondition_required"
+	codeInternalError        = "internal_error"
+	codeUnavailable          = "unavailable"
+)
+
+// problemType documents an error code
+type problemType struct {
+	Type        string `json:"type"`
+	Code        string `json:"code"`
+	Status      int    `json:"status"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// problemTypes maps every error code to its documentation, the title is the same for every occurrence
+var problemTypes = map[string]problemType{
+	codeInvalidBody: {Status: http.StatusBadRequest, Title: "Invalid request body",
+		Description: "The body isn't valid JSON or a field has the wrong type."},
+	codeInvalidParameter: {Status: http.StatusBadRequest, Title: "Invalid query parameter",
+		Description: "A query parameter has an invalid value, e.g. a limit out of range or a malformed page token."},
+	codeValidationFailed: {Status: http.StatusBadRequest, Title: "Validation failed",
+		Description: "Some fields are invalid, errors lists each of them with a code such as required, too_short or invalid_email."},
+	codeUnknownRole: {Status: http.StatusBadRequest, Title: "Unknown role",
+		Description: "The role isn't defined by the access policy or can't be granted."},
+	codeUnauthorized: {Status: http.StatusUnauthorized, Title: "Unauthorized",
+		Description: "The bearer token is missing, invalid or expired."},
+	codeInvalidCredentials: {Status: http.StatusUnauthorized, Title: "Invalid credentials",
+		Description: "The login or the password is wrong, which one isn't told."},
+	codeInvalidRefreshToken: {Status: http.StatusUnauthorized, Title: "Invalid refresh token",
+		Description: "The refresh token is unknown, expired, already used or its user was removed."},
+	codeForbidden: {Status: http.StatusForbidden, Title: "Forbidden",
+		Description: "The access policy doesn't allow the caller to perform the operation."},
+	codeNotFound: {Status: http.StatusNotFound, Title: "Not found",
+		Description: "The requested resource or route doesn't exist."},
+	codeMethodNotAllowed: {Status: http.StatusMethodNotAllowed, Title: "Method not allowed",
+		Description: "The route doesn't support the request method."},
+	codeConflict: {Status: http.StatusConflict, Title: "Conflict",
+		Description: "The change clashes with another resource, e.g. a nickname or email already taken. errors names the field."},
+	codeTestFailed: {Status: http.StatusConflict, Title: "Patch test failed",
+		Description: "A test operation of a JSON Patch didn't match the stored user."},
+	codePreconditionFailed: {Status: http.StatusPreconditionFailed, Title: "Precondition failed",
+		Description: "The If-Match header doesn't match the current version of the user, read it again and retry."},
+	codeUnsupportedMediaType: {Status: http.StatusUnsupportedMediaType, Title: "Unsupported media type",
+		Description: "The Content-Type of the body isn't supported by the route."},
+	codeInvalidPatch: {Status: http.StatusUnprocessableEntity, Title: "Invalid patch",
+		Description: "The patch can't be applied, e.g. it targets an unknown field."},
+	codeInvalidDocument: {Status: http.StatusUnprocessableEntity, Title: "Invalid document",
+		Description: "The database rejected the document as invalid."},
+	codePreconditionRequired: {Status: http.StatusPreconditionRequired, Title: "Precondition required",
+		Description: "Changes must send the ETag of the user in the If-Match header."},
+	codeInternalError: {Status: http.StatusInternalServerError, Title: "Internal server error",
+		Description: "An unexpected error, its details are logged with the request id."},
+	codeUnavailable: {Status: http.StatusServiceUnavailable, Title: "Service unavailable",
+		Description: "The database can't be reached, retry after the Retry-After delay."},
+}
+
+// problem is an RFC 7807 problem details body, extended with the error code, the invalid fields and the request id
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+	// Errors lists the invalid fields, if any
+	Errors    []validation.FieldError `json:"errors,omitempty"`
+	RequestID string                  `json:"request_id,omitempty"`
+}
+
+// newProblem returns the problem of the request for an error code, the instance is the request path
+func newProblem(r *http.Request, code string, detail string) problem {
+	t := problemTypes[code]
+	return problem{
+		Type:      problemTypeBase + code,
+		Title:     t.Title,
+		Status:    t.Status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: logging.RequestID(r.Context()),
+	}
+}
+
+// writeProblem writes the problem of an error code
+func writeProblem(w http.ResponseWriter, r *http.Request, code string, detail string) {
+	newProblem(r, code, detail).write(w)
+}
+
+func (p problem) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// NotFound answers requests to unknown routes, see mux.Router.NotFoundHandler
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, codeNotFound, "no route matches "+r.URL.Path)
+}
+
+// MethodNotAllowed answers requests to known routes with another method, see mux.Router.MethodNotAllowedHandler
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, codeMethodNotAllowed, r.Method+" isn't supported by "+r.URL.Path)
+}
+
+// GetProblemTypes handles the GET /problems request, the documentation of every error code
+func GetProblemTypes(w http.ResponseWriter, r *http.Request) {
+	types := make([]problemType, 0, len(problemTypes))
+	for code := range problemTypes {
+		types = append(types, describe(code))
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Code < types[j].Code })
+	writeResponse(w, http.StatusOK, types)
+}
+
+// GetProblemType handles the GET /problems/{code} request, the documentation of an error code
+func GetProblemType(w http.ResponseWriter, r *http.Request) {
+	code := mux.Vars(r)["code"]
+	if _, ok := problemTypes[code]; !ok {
+		writeProblem(w, r, codeNotFound, "unknown error code "+code)
+		return
+	}
+	writeResponse(w, http.StatusOK, describe(code))
+}
+
+func describe(code string) problemType {
+	t := problemTypes[code]
+	t.Type, t.Code = problemTypeBase+code, code
+	return t
+}
@@ -0,0 +1,98 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jpaldi/go-user-api/handlers"
+	"github.com/jpaldi/go-user-api/logging"
+	"github.com/sirupsen/logrus"
+)
+
+func TestProblems(t *testing.T) {
+	t.Parallel()
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(handlers.NotFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(handlers.MethodNotAllowed)
+	router.HandleFunc("/problems", handlers.GetProblemTypes).Methods(http.MethodGet)
+	router.HandleFunc("/problems/{code}", handlers.GetProblemType).Methods(http.MethodGet)
+	server := logging.Middleware{Logger: logrus.New(), Routes: router}.Handler(router)
+
+	for _, tt := range []struct {
+		name                string
+		method              string
+		path                string
+		expectedStatusCode  int
+		expectedContentType string
+		expectedResponse    string
+	}{
+		{
+			name:                "unknown routes should be reported as problems",
+			method:              http.MethodGet,
+			path:                "/unknown",
+			expectedStatusCode:  http.StatusNotFound,
+			expectedContentType: handlers.ProblemContentType,
+			expectedResponse:    "{\"type\":\"/problems/not_found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"no route matches /unknown\",\"instance\":\"/unknown\",\"code\":\"not_found\",\"request_id\":\"request-1\"}\n",
+		},
+		{
+			name:                "unsupported methods should be reported as problems",
+			method:              http.MethodDelete,
+			path:                "/problems",
+			expectedStatusCode:  http.StatusMethodNotAllowed,
+			expectedContentType: handlers.ProblemContentType,
+			expectedResponse:    "{\"type\":\"/problems/method_not_allowed\",\"title\":\"Method not allowed\",\"status\":405,\"detail\":\"DELETE isn't supported by /problems\",\"instance\":\"/problems\",\"code\":\"method_not_allowed\",\"request_id\":\"request-1\"}\n",
+		},
+		{
+			name:                "problem types should be documented",
+			method:              http.MethodGet,
+			path:                "/problems/precondition_failed",
+			expectedStatusCode:  http.StatusOK,
+			expectedContentType: "application/json",
+			expectedResponse:    "{\"type\":\"/problems/precondition_failed\",\"code\":\"precondition_failed\",\"status\":412,\"title\":\"Precondition failed\",\"description\":\"The If-Match header doesn't match the current version of the user, read it again and retry.\"}\n",
+		},
+		{
+			name:                "unknown problem types should be reported",
+			method:              http.MethodGet,
+			path:                "/problems/teapot",
+			expectedStatusCode:  http.StatusNotFound,
+			expectedContentType: handlers.ProblemContentType,
+			expectedResponse:    "{\"type\":\"/problems/not_found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"unknown error code teapot\",\"instance\":\"/problems/teapot\",\"code\":\"not_found\",\"request_id\":\"request-1\"}\n",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(tt.method, tt.path, nil)
+			r.Header.Set("X-Request-ID", "request-1")
+			w := httptest.NewRecorder()
+
+			server.ServeHTTP(w, r)
+
+			if w.Code != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d", w.Code, tt.expectedStatusCode)
+			}
+			if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, tt.expectedContentType) {
+				t.Fatalf("wrong content type: got %s want %s", contentType, tt.expectedContentType)
+			}
+			if w.Body.String() != tt.expectedResponse {
+				t.Fatalf("wrong response: got %s want %s", w.Body.String(), tt.expectedResponse)
+			}
+		})
+	}
+}
+
+func TestProblemTypesAreDocumented(t *testing.T) {
+	t.Parallel()
+	r, _ := http.NewRequest(http.MethodGet, "/problems", nil)
+	w := httptest.NewRecorder()
+
+	handlers.GetProblemTypes(w, r)
+
+	for _, code := range []string{"invalid_body", "validation_failed", "unauthorized", "forbidden", "not_found", "conflict", "internal_error", "unavailable"} {
+		if !strings.Contains(w.Body.String(), "\"code\":\""+code+"\"") {
+			t.Fatalf("%s isn't documented: got %s", code, w.Body.String())
+		}
+	}
+}
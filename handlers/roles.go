@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jpaldi/go-user-api/logging"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/policy"
+	"github.com/sirupsen/logrus"
+)
+
+type roleRequestBody struct {
+	Role string `json:"role"`
+}
+
+// GrantRole handles the POST /users/{userid}/roles request
+func (handler *Handler) GrantRole(w http.ResponseWriter, r *http.Request) {
+	userid := mux.Vars(r)["userid"]
+	identity, ok := handler.authorize(w, r, policy.GrantRole, userid)
+	if !ok {
+		return
+	}
+
+	body := roleRequestBody{}
+	if err := decodeJSON(r, &body); err != nil {
+		writeProblem(w, r, codeInvalidBody, "invalid json body")
+		return
+	}
+	if !handler.policy().Grantable(body.Role) {
+		writeProblem(w, r, codeUnknownRole, fmt.Sprintf("unknown role %q", body.Role))
+		return
+	}
+
+	before := handler.snapshot(r.Context(), userid)
+	user, err := handler.Database.GrantRole(r.Context(), userid, body.Role)
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	// Log to console
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+		"role":      body.Role,
+		"grantedBy": identity.Subject,
+	}).Info("granted role")
+	handler.audit(r, mongo.ActionGrantRole, before, *user)
+	w.Header().Set("ETag", etag(user.Version))
+	writeResponse(w, http.StatusOK, handler.policy().Redact(identity, *user))
+}
+
+// RevokeRole handles the DELETE /users/{userid}/roles/{role} request
+func (handler *Handler) RevokeRole(w http.ResponseWriter, r *http.Request) {
+	userid := mux.Vars(r)["userid"]
+	role := mux.Vars(r)["role"]
+	identity, ok := handler.authorize(w, r, policy.RevokeRole, userid)
+	if !ok {
+		return
+	}
+
+	before := handler.snapshot(r.Context(), userid)
+	user, err := handler.Database.RevokeRole(r.Context(), userid, role)
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	// Log to console
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+		"revokedBy": identity.Subject,
+	}).Info("revoked role")
+	handler.audit(r, mongo.ActionRevokeRole, before, *user)
+	w.Header().Set("ETag", etag(user.Version))
+	writeResponse(w, http.StatusOK, handler.policy().Redact(identity, *user))
+}
@@ -0,0 +1,122 @@
+package handlers_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/jpaldi/go-user-api/auth"
+	"github.com/jpaldi/go-user-api/handlers"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/sirupsen/logrus"
+)
+
+func mockRoles(err error) mockDatabase {
+	update := func(ctx context.Context, guid string, role string) (*mongo.User, error) {
+		if err != nil {
+			return nil, err
+		}
+		return &mongo.User{ID: guid, Roles: []string{role}}, nil
+	}
+	return mockDatabase{grantRole: update, revokeRole: update}
+}
+
+func TestGrantRole(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name               string
+		body               string
+		identity           *auth.Identity
+		database           mockDatabase
+		expectedStatusCode int
+		expectedResponse   string
+	}{
+		{
+			name:               "should return a 200 and the user with the new role",
+			body:               `{"role": "support"}`,
+			identity:           admin,
+			database:           mockRoles(nil),
+			expectedStatusCode: 200,
+			expectedResponse:   "{\"id\":\"user-1\",\"nickname\":\"\",\"first_name\":\"\",\"last_name\":\"\",\"email\":\"\",\"country\":\"\",\"roles\":[\"support\"],\"created_at\":\"0001-01-01T00:00:00Z\",\"updated_at\":\"0001-01-01T00:00:00Z\",\"version\":0}\n",
+		},
+		{
+			name:               "should return a 400 for unknown roles",
+			body:               `{"role": "superuser"}`,
+			identity:           admin,
+			database:           mockRoles(nil),
+			expectedStatusCode: 400,
+			expectedResponse:   "{\"type\":\"/problems/unknown_role\",\"title\":\"Unknown role\",\"status\":400,\"detail\":\"unknown role \\\"superuser\\\"\",\"instance\":\"/users/user-1/roles\",\"code\":\"unknown_role\"}\n",
+		},
+		{
+			name:               "should return a 400 when granting self",
+			body:               `{"role": "self"}`,
+			identity:           admin,
+			database:           mockRoles(nil),
+			expectedStatusCode: 400,
+			expectedResponse:   "{\"type\":\"/problems/unknown_role\",\"title\":\"Unknown role\",\"status\":400,\"detail\":\"unknown role \\\"self\\\"\",\"instance\":\"/users/user-1/roles\",\"code\":\"unknown_role\"}\n",
+		},
+		{
+			name:               "should return a 404 if the user doesn't exist",
+			body:               `{"role": "support"}`,
+			identity:           admin,
+			database:           mockRoles(mongo.ErrNotFound),
+			expectedStatusCode: 404,
+			expectedResponse:   "{\"type\":\"/problems/not_found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"user not found\",\"instance\":\"/users/user-1/roles\",\"code\":\"not_found\"}\n",
+		},
+		{
+			name:               "should return a 403 when users grant themselves a role",
+			body:               `{"role": "admin"}`,
+			identity:           self,
+			database:           mockRoles(nil),
+			expectedStatusCode: 403,
+			expectedResponse:   "{\"type\":\"/problems/forbidden\",\"title\":\"Forbidden\",\"status\":403,\"detail\":\"roles:grant is not allowed\",\"instance\":\"/users/user-1/roles\",\"code\":\"forbidden\"}\n",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			handler := handlers.Handler{
+				Database: tt.database,
+				Logger:   logrus.New(),
+			}
+
+			resp, body := serveRoute(handler.GrantRole, http.MethodPost, "/users/{userid}/roles",
+				createPOSTRequest(http.MethodPost, "/users/user-1/roles", tt.body), tt.identity)
+
+			if body != tt.expectedResponse {
+				t.Fatalf("wrong response: got %s want %s", body, tt.expectedResponse)
+			}
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d", resp.StatusCode, tt.expectedStatusCode)
+			}
+		})
+	}
+}
+
+func TestRevokeRole(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name               string
+		identity           *auth.Identity
+		database           mockDatabase
+		expectedStatusCode int
+	}{
+		{name: "should return a 200 when an admin revokes a role", identity: admin, database: mockRoles(nil), expectedStatusCode: 200},
+		{name: "should return a 404 if the user doesn't exist", identity: admin, database: mockRoles(mongo.ErrNotFound), expectedStatusCode: 404},
+		{name: "should return a 403 for everybody else", identity: support, database: mockRoles(nil), expectedStatusCode: 403},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			handler := handlers.Handler{
+				Database: tt.database,
+				Logger:   logrus.New(),
+			}
+
+			r, _ := http.NewRequest(http.MethodDelete, "/users/user-1/roles/support", nil)
+			resp, _ := serveRoute(handler.RevokeRole, http.MethodDelete, "/users/{userid}/roles/{role}", r, tt.identity)
+
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d", resp.StatusCode, tt.expectedStatusCode)
+			}
+		})
+	}
+}
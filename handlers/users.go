@@ -2,55 +2,83 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 
 	"github.com/gorilla/mux"
+	"github.com/jpaldi/go-user-api/logging"
 	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/patch"
+	"github.com/jpaldi/go-user-api/policy"
+	"github.com/jpaldi/go-user-api/validation"
 	"github.com/sirupsen/logrus"
 )
 
 // UsersDatabase wraps the Database client functions
 type UsersDatabase interface {
 	CreateUser(ctx context.Context, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error)
-	UpdateUser(ctx context.Context, guid string, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error)
-	RemoveUser(ctx context.Context, guid string) (int64, error)
-	GetUsers(ctx context.Context, params url.Values) ([]*mongo.User, error)
+	UpdateUser(ctx context.Context, guid string, version int64, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error)
+	PatchUser(ctx context.Context, guid string, version int64, changes map[string]string) (*mongo.User, error)
+	RemoveUser(ctx context.Context, guid string, version int64) (int64, error)
+	RestoreUser(ctx context.Context, guid string) (*mongo.User, error)
+	GetUser(ctx context.Context, guid string) (*mongo.User, error)
+	GetUsers(ctx context.Context, opts mongo.ListOptions) (*mongo.UserPage, error)
+	GrantRole(ctx context.Context, guid string, role string) (*mongo.User, error)
+	RevokeRole(ctx context.Context, guid string, role string) (*mongo.User, error)
 }
 
 // Handler represents the handler for users routes
 type Handler struct {
 	Database UsersDatabase
 	Logger   *logrus.Logger
+	// Policy defaults to policy.Default when not set
+	Policy *policy.Policy
+	// Validation defaults to validation.Users when not set
+	Validation validation.Schema
+	// RequireIfMatch rejects changes without an If-Match header with a 428
+	RequireIfMatch bool
+	// Audit records every change made to users, nothing is recorded when it is not set
+	Audit AuditLog
+}
+
+// patchRetries is how many times a PATCH without If-Match is applied again when the user changes meanwhile
+const patchRetries = 3
+
+func (handler *Handler) validation() validation.Schema {
+	if handler.Validation == nil {
+		return validation.Users
+	}
+	return handler.Validation
 }
 
 // CreateUser handles the POST /users request
 func (handler *Handler) CreateUser(w http.ResponseWriter, r *http.Request) {
 	userBody, err := validateJSON(r)
 	if err != nil {
-		writeResponse(w, http.StatusBadRequest, "invalid json body")
+		writeProblem(w, r, codeInvalidBody, "invalid json body")
 		return
 	}
-	if validErrs := userBody.validate(); len(validErrs) > 0 {
-		err := map[string]interface{}{"validationError": validErrs}
-		writeResponse(w, http.StatusBadRequest, err)
+	if validErrs := userBody.validate(handler.validation(), false); len(validErrs) > 0 {
+		writeValidationErrors(w, r, validErrs)
 		return
 	}
 
 	user, err := handler.Database.CreateUser(r.Context(), userBody.Nickname, userBody.FirstName, userBody.LastName, userBody.Password, userBody.Email, userBody.Country)
 	if err != nil {
-		handler.Logger.WithError(err)
-		writeResponse(w, http.StatusInternalServerError, err)
+		writeError(w, r, handler.Logger, err)
 		return
 	}
 
 	// Log to console
-	handler.Logger.WithFields(logrus.Fields{
-		"status_code": http.StatusOK,
-		"route":       "POST /users",
-		"userID":      user.ID,
-	}).Info()
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+		"userID": user.ID,
+	}).Info("created user")
+	handler.audit(r, mongo.ActionCreate, nil, *user)
 	// In case User, was inserted return the user object
 	writeResponse(w, http.StatusOK, user)
 
@@ -59,77 +87,273 @@ func (handler *Handler) CreateUser(w http.ResponseWriter, r *http.Request) {
 // UpdateUser handles the Put /users/{userid} request
 func (handler *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	userid := mux.Vars(r)["userid"]
+	identity, ok := handler.authorize(w, r, policy.UpdateUser, userid)
+	if !ok {
+		return
+	}
 
 	userBody, err := validateJSON(r)
 	if err != nil {
-		writeResponse(w, http.StatusBadRequest, "invalid json body")
+		writeProblem(w, r, codeInvalidBody, "invalid json body")
 		return
 	}
 
-	if validErrs := userBody.validate(); len(validErrs) > 0 {
-		err := map[string]interface{}{"validationError": validErrs}
-		writeResponse(w, http.StatusBadRequest, err)
+	if validErrs := userBody.validate(handler.validation(), false); len(validErrs) > 0 {
+		writeValidationErrors(w, r, validErrs)
 		return
 	}
 
-	user, err := handler.Database.UpdateUser(r.Context(), userid, userBody.Nickname, userBody.FirstName, userBody.LastName, userBody.Password, userBody.Email, userBody.Country)
+	version, ok := handler.expectedVersion(w, r, userid)
+	if !ok {
+		return
+	}
+
+	before := handler.snapshot(r.Context(), userid)
+	user, err := handler.Database.UpdateUser(r.Context(), userid, version, userBody.Nickname, userBody.FirstName, userBody.LastName, userBody.Password, userBody.Email, userBody.Country)
 	if err != nil {
-		handler.Logger.WithError(err)
-		writeResponse(w, http.StatusInternalServerError, err)
+		writeError(w, r, handler.Logger, err)
 		return
 	}
 
 	// Log to console
-	handler.Logger.WithFields(logrus.Fields{
-		"status_code": http.StatusOK,
-		"route":       fmt.Sprintf("PUT /users/%s", userid),
-		"userID":      user.ID,
-	}).Info()
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+		"userID": user.ID,
+	}).Info("updated user")
+	handler.audit(r, mongo.ActionUpdate, before, *user)
 	// In case User, was inserted return the user object
-	writeResponse(w, http.StatusOK, user)
+	w.Header().Set("ETag", etag(user.Version))
+	writeResponse(w, http.StatusOK, handler.policy().Redact(identity, *user))
+}
+
+// PatchUser handles the PATCH /users/{userid} request, with either a JSON Merge Patch or a JSON Patch body.
+// The patched user is validated like a PUT body, but the password may be left out.
+func (handler *Handler) PatchUser(w http.ResponseWriter, r *http.Request) {
+	userid := mux.Vars(r)["userid"]
+	identity, ok := handler.authorize(w, r, policy.UpdateUser, userid)
+	if !ok {
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != patch.MergePatchType && mediaType != patch.JSONPatchType {
+		w.Header().Set("Accept-Patch", patch.MergePatchType+", "+patch.JSONPatchType)
+		writeProblem(w, r, codeUnsupportedMediaType, fmt.Sprintf("content type must be %s or %s", patch.MergePatchType, patch.JSONPatchType))
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || !json.Valid(body) {
+		writeProblem(w, r, codeInvalidBody, "invalid json body")
+		return
+	}
+
+	ifMatch, ok := handler.ifMatch(w, r)
+	if !ok {
+		return
+	}
+
+	// the patch applies to the version it was read at, if the user changes meanwhile
+	// it is applied again to the new version, unless the client expects a version
+	var user, current *mongo.User
+	var changes map[string]string
+	for attempt := 1; ; attempt++ {
+		current, err = handler.Database.GetUser(r.Context(), userid)
+		if err != nil {
+			writeError(w, r, handler.Logger, err)
+			return
+		}
+		if ifMatch.present && !ifMatch.matches(current.Version, false) {
+			writeError(w, r, handler.Logger, mongo.ErrVersionMismatch)
+			return
+		}
+
+		if changes, ok = handler.applyPatch(w, r, mediaType, body, *current); !ok {
+			return
+		}
+		user, err = handler.Database.PatchUser(r.Context(), userid, current.Version, changes)
+		if errors.Is(err, mongo.ErrVersionMismatch) && !ifMatch.present && attempt < patchRetries {
+			continue
+		}
+		if err != nil {
+			writeError(w, r, handler.Logger, err)
+			return
+		}
+		break
+	}
+
+	// Log to console
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+		"userID":  user.ID,
+		"changes": len(changes),
+	}).Info("patched user")
+	handler.audit(r, mongo.ActionPatch, current, *user)
+	w.Header().Set("ETag", etag(user.Version))
+	writeResponse(w, http.StatusOK, handler.policy().Redact(identity, *user))
+}
+
+// applyPatch applies the patch to the user and returns the changed fields,
+// it writes the error response when the patch can't be applied or the patched user is invalid
+func (handler *Handler) applyPatch(w http.ResponseWriter, r *http.Request, mediaType string, body []byte, user mongo.User) (map[string]string, bool) {
+	original := userDocument(user)
+	var patched interface{}
+	var err error
+	if mediaType == patch.MergePatchType {
+		patched, err = patch.Merge(original.object(), body)
+	} else {
+		patched, err = patch.Apply(original.object(), body)
+	}
+	if err != nil {
+		writePatchError(w, r, err)
+		return nil, false
+	}
+
+	userBody, err := patchedDocument(patched)
+	if err != nil {
+		writePatchError(w, r, err)
+		return nil, false
+	}
+	if validErrs := userBody.validate(handler.validation(), true); len(validErrs) > 0 {
+		writeValidationErrors(w, r, validErrs)
+		return nil, false
+	}
+	return userBody.changes(original), true
 }
 
 // RemoveUser handles the DELETE /users/{userid} request
 func (handler *Handler) RemoveUser(w http.ResponseWriter, r *http.Request) {
 	userid := mux.Vars(r)["userid"]
+	if _, ok := handler.authorize(w, r, policy.RemoveUser, userid); !ok {
+		return
+	}
+
+	version, ok := handler.expectedVersion(w, r, userid)
+	if !ok {
+		return
+	}
 
-	count, err := handler.Database.RemoveUser(r.Context(), userid)
+	before := handler.snapshot(r.Context(), userid)
+	count, err := handler.Database.RemoveUser(r.Context(), userid, version)
 	if err != nil {
-		handler.Logger.WithError(err)
-		writeResponse(w, http.StatusInternalServerError, err)
+		writeError(w, r, handler.Logger, err)
 		return
 	}
 
 	if count == 0 {
-		writeResponse(w, http.StatusNotFound, "user not found")
+		writeError(w, r, handler.Logger, mongo.ErrNotFound)
 		return
 	}
 
 	// Log to console
-	handler.Logger.WithFields(logrus.Fields{
-		"status_code": http.StatusOK,
-		"route":       fmt.Sprintf("DELETE /users/%s", userid),
-	}).Info()
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+		"userID": userid,
+	}).Info("deleted user")
+	if after := handler.snapshot(r.Context(), userid); after != nil {
+		handler.audit(r, mongo.ActionDelete, before, *after)
+	}
 	writeResponse(w, http.StatusOK, "OK")
 }
 
+// RestoreUser handles the POST /users/{userid}/restore request, undoing the soft delete of a user not purged yet
+func (handler *Handler) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	userid := mux.Vars(r)["userid"]
+	identity, ok := handler.authorize(w, r, policy.RestoreUser, userid)
+	if !ok {
+		return
+	}
+
+	before := handler.snapshot(r.Context(), userid)
+	user, err := handler.Database.RestoreUser(r.Context(), userid)
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	// Log to console
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+		"restoredBy": identity.Subject,
+	}).Info("restored user")
+	handler.audit(r, mongo.ActionRestore, before, *user)
+	w.Header().Set("ETag", etag(user.Version))
+	writeResponse(w, http.StatusOK, handler.policy().Redact(identity, *user))
+}
+
+// GetUser handles the GET /users/{userid} request
+func (handler *Handler) GetUser(w http.ResponseWriter, r *http.Request) {
+	userid := mux.Vars(r)["userid"]
+	identity, ok := handler.authorize(w, r, policy.ReadUser, userid)
+	if !ok {
+		return
+	}
+
+	user, err := handler.Database.GetUser(r.Context(), userid)
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(user.Version))
+	if parseEntityTags(r.Header.Get("If-None-Match")).matches(user.Version, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeResponse(w, http.StatusOK, handler.policy().Redact(identity, *user))
+}
+
 // GetUsers handles the GET /users request
 func (handler *Handler) GetUsers(w http.ResponseWriter, r *http.Request) {
+	identity, ok := handler.authorize(w, r, policy.ListUsers, "")
+	if !ok {
+		return
+	}
+
 	queryParams := r.URL.Query()
-	results, err := handler.Database.GetUsers(r.Context(), queryParams)
+	opts, err := mongo.ParseListOptions(queryParams)
+	if err != nil {
+		writeProblem(w, r, codeInvalidParameter, err.Error())
+		return
+	}
+	if opts.IncludeDeleted && !handler.policy().Allows(identity, policy.ListDeletedUsers, "", queryParams) {
+		writeProblem(w, r, codeForbidden, fmt.Sprintf("%s is not allowed", policy.ListDeletedUsers))
+		return
+	}
+
+	results, err := handler.Database.GetUsers(r.Context(), opts)
 	if err != nil {
-		handler.Logger.WithError(err)
-		writeResponse(w, http.StatusInternalServerError, err)
+		writeError(w, r, handler.Logger, err)
 		return
 	}
 
 	// Log to console
-	handler.Logger.WithFields(logrus.Fields{
-		"status_code":  http.StatusOK,
-		"route":        "GET /users",
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
 		"params":       queryParams,
-		"number_users": len(results),
-	}).Info()
-	// In case User, was inserted return the user object
-	writeResponse(w, http.StatusOK, results)
+		"number_users": len(results.Users),
+	}).Info("listed users")
+
+	response := usersPage{
+		Users:         make([]mongo.User, len(results.Users)),
+		NextPageToken: results.NextPageToken,
+	}
+	for i, u := range results.Users {
+		response.Users[i] = handler.policy().Redact(identity, *u)
+	}
+
+	if results.NextPageToken != "" {
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextPageURL(r.URL, results.NextPageToken)))
+	}
+	writeResponse(w, http.StatusOK, response)
+}
+
+// usersPage is the envelope of the GET /users response
+type usersPage struct {
+	Users         []mongo.User `json:"users"`
+	NextPageToken string       `json:"next_page_token,omitempty"`
+}
+
+// nextPageURL returns the request URL pointing to the next page
+func nextPageURL(u *url.URL, token string) string {
+	params := u.Query()
+	params.Del("cursor")
+	params.Set("page_token", token)
+	next := url.URL{Path: u.Path, RawQuery: params.Encode()}
+	return next.String()
 }
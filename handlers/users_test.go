@@ -2,39 +2,68 @@ package handlers_test
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
-	"net/url"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/jpaldi/go-user-api/auth"
 	"github.com/jpaldi/go-user-api/handlers"
 	"github.com/jpaldi/go-user-api/mongo"
 	"github.com/sirupsen/logrus"
 )
 
 type mockDatabase struct {
-	createUser func(ctx context.Context, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error)
-	updateUser func(ctx context.Context, guid string, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error)
-	removeUser func(ctx context.Context, guid string) (int64, error)
-	getUsers   func(ctx context.Context, params url.Values) ([]*mongo.User, error)
+	createUser  func(ctx context.Context, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error)
+	updateUser  func(ctx context.Context, guid string, version int64, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error)
+	patchUser   func(ctx context.Context, guid string, version int64, changes map[string]string) (*mongo.User, error)
+	removeUser  func(ctx context.Context, guid string, version int64) (int64, error)
+	restoreUser func(ctx context.Context, guid string) (*mongo.User, error)
+	getUser     func(ctx context.Context, guid string) (*mongo.User, error)
+	getUsers    func(ctx context.Context, opts mongo.ListOptions) (*mongo.UserPage, error)
+	grantRole   func(ctx context.Context, guid string, role string) (*mongo.User, error)
+	revokeRole  func(ctx context.Context, guid string, role string) (*mongo.User, error)
 }
 
 func (m mockDatabase) CreateUser(ctx context.Context, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error) {
 	return m.createUser(ctx, nickname, firstname, lastname, password, email, country)
 }
 
-func (m mockDatabase) GetUsers(ctx context.Context, params url.Values) ([]*mongo.User, error) {
-	return m.getUsers(ctx, params)
+func (m mockDatabase) GetUser(ctx context.Context, guid string) (*mongo.User, error) {
+	return m.getUser(ctx, guid)
 }
 
-func (m mockDatabase) RemoveUser(ctx context.Context, guid string) (int64, error) {
-	return m.removeUser(ctx, guid)
+func (m mockDatabase) GetUsers(ctx context.Context, opts mongo.ListOptions) (*mongo.UserPage, error) {
+	return m.getUsers(ctx, opts)
 }
 
-func (m mockDatabase) UpdateUser(ctx context.Context, guid string, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error) {
-	return m.updateUser(ctx, guid, nickname, firstname, lastname, password, email, country)
+func (m mockDatabase) RemoveUser(ctx context.Context, guid string, version int64) (int64, error) {
+	return m.removeUser(ctx, guid, version)
+}
+
+func (m mockDatabase) RestoreUser(ctx context.Context, guid string) (*mongo.User, error) {
+	return m.restoreUser(ctx, guid)
+}
+
+func (m mockDatabase) UpdateUser(ctx context.Context, guid string, version int64, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error) {
+	return m.updateUser(ctx, guid, version, nickname, firstname, lastname, password, email, country)
+}
+
+func (m mockDatabase) PatchUser(ctx context.Context, guid string, version int64, changes map[string]string) (*mongo.User, error) {
+	return m.patchUser(ctx, guid, version, changes)
+}
+
+func (m mockDatabase) GrantRole(ctx context.Context, guid string, role string) (*mongo.User, error) {
+	return m.grantRole(ctx, guid, role)
+}
+
+func (m mockDatabase) RevokeRole(ctx context.Context, guid string, role string) (*mongo.User, error) {
+	return m.revokeRole(ctx, guid, role)
 }
 
 func createPOSTRequest(method string, path string, body string) *http.Request {
@@ -44,6 +73,67 @@ func createPOSTRequest(method string, path string, body string) *http.Request {
 	return r
 }
 
+const validUserBody = `{
+	"nickname": "test",
+	"email": "test@email.uk",
+	"first_name": "test",
+	"last_name": "test",
+	"password": "c0rrect-h0rse-battery",
+	"country": "GB"}`
+
+// serveRoute calls the handler through a router so the route variables are set
+func serveRoute(handler http.HandlerFunc, method string, route string, r *http.Request, identity *auth.Identity) (*http.Response, string) {
+	if identity != nil {
+		r = r.WithContext(auth.WithIdentity(r.Context(), *identity))
+	}
+	router := mux.NewRouter()
+	router.HandleFunc(route, handler).Methods(method)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	return w.Result(), string(body)
+}
+
+var (
+	self    = &auth.Identity{Subject: "user-1", Method: "jwt"}
+	admin   = &auth.Identity{Subject: "admin-1", Roles: []string{"admin"}, Method: "jwt"}
+	support = &auth.Identity{Subject: "support-1", Roles: []string{"support"}, Method: "jwt"}
+)
+
+func mockCreateUserError(err error) mockDatabase {
+	return mockDatabase{
+		createUser: func(ctx context.Context, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error) {
+			return nil, err
+		},
+	}
+}
+
+func mockUpdateUser(user *mongo.User, err error) mockDatabase {
+	return mockDatabase{
+		updateUser: func(ctx context.Context, guid string, version int64, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error) {
+			return user, err
+		},
+	}
+}
+
+func mockRemoveUser(count int64, err error) mockDatabase {
+	return mockDatabase{
+		removeUser: func(ctx context.Context, guid string, version int64) (int64, error) {
+			return count, err
+		},
+	}
+}
+
+func mockGetUsers(page *mongo.UserPage, err error) mockDatabase {
+	return mockDatabase{
+		getUsers: func(ctx context.Context, opts mongo.ListOptions) (*mongo.UserPage, error) {
+			return page, err
+		},
+	}
+}
+
 func mockInsertUserInDatabaseOK() mockDatabase {
 	return mockDatabase{
 		createUser: func(ctx context.Context, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error) {
@@ -69,10 +159,10 @@ func TestCreateUser(t *testing.T) {
 					"email": "test@email.uk",
 					"first_name": "test",
 					"last_name": "test",
-					"password": "test",
-					"country": "UK"}`),
+					"password": "c0rrect-h0rse-battery",
+					"country": "GB"}`),
 			database:           mockInsertUserInDatabaseOK(),
-			expectedResponse:   "{\"id\":\"\",\"nickname\":\"test\",\"first_name\":\"\",\"last_name\":\"\",\"password\":\"\",\"email\":\"\",\"country\":\"\"}\n",
+			expectedResponse:   "{\"id\":\"\",\"nickname\":\"test\",\"first_name\":\"\",\"last_name\":\"\",\"email\":\"\",\"country\":\"\",\"created_at\":\"0001-01-01T00:00:00Z\",\"updated_at\":\"0001-01-01T00:00:00Z\",\"version\":0}\n",
 			expectedStatusCode: 200,
 		},
 
@@ -84,11 +174,46 @@ func TestCreateUser(t *testing.T) {
 					"email": "test@email.uk",
 					"first_name": "test",
 					"last_name": "test",
+					"country": "GB"}`),
+			database:           mockInsertUserInDatabaseOK(),
+			expectedResponse:   "{\"type\":\"/problems/validation_failed\",\"title\":\"Validation failed\",\"status\":400,\"detail\":\"some fields are invalid, see errors\",\"instance\":\"/users\",\"code\":\"validation_failed\",\"errors\":[{\"field\":\"password\",\"code\":\"required\",\"message\":\"The password field is required!\"}]}\n",
+			expectedStatusCode: 400,
+		},
+		{
+			name: "should report every invalid field with its code and return a 400",
+			request: createPOSTRequest(http.MethodPost, "/users",
+				`{
+					"nickname": "-t",
+					"email": "Test <test@email.uk>",
+					"first_name": "test",
+					"last_name": "test",
+					"password": "password123",
 					"country": "UK"}`),
 			database:           mockInsertUserInDatabaseOK(),
-			expectedResponse:   "{\"validationError\":{\"password\":[\"The password field is required!\"]}}\n",
+			expectedResponse:   "{\"type\":\"/problems/validation_failed\",\"title\":\"Validation failed\",\"status\":400,\"detail\":\"some fields are invalid, see errors\",\"instance\":\"/users\",\"code\":\"validation_failed\",\"errors\":[{\"field\":\"nickname\",\"code\":\"too_short\",\"message\":\"nickname must have at least 3 characters\"},{\"field\":\"password\",\"code\":\"weak_password\",\"message\":\"password is too easy to guess, avoid common words, repetitions and sequences\"},{\"field\":\"email\",\"code\":\"invalid_email\",\"message\":\"email must be a valid email address\"},{\"field\":\"country\",\"code\":\"invalid_country\",\"message\":\"country must be an ISO 3166-1 alpha-2 country code, e.g. PT\"}]}\n",
 			expectedStatusCode: 400,
 		},
+		{
+			name:               "should return a 409 if the database reports a conflict",
+			request:            createPOSTRequest(http.MethodPost, "/users", validUserBody),
+			database:           mockCreateUserError(&mongo.Error{Kind: mongo.ErrConflict, Field: "nickname", Message: "nickname is already taken"}),
+			expectedResponse:   "{\"type\":\"/problems/conflict\",\"title\":\"Conflict\",\"status\":409,\"detail\":\"nickname is already taken\",\"instance\":\"/users\",\"code\":\"conflict\",\"errors\":[{\"field\":\"nickname\",\"code\":\"conflict\",\"message\":\"nickname is already taken\"}]}\n",
+			expectedStatusCode: 409,
+		},
+		{
+			name:               "should return a 503 if the database is unavailable",
+			request:            createPOSTRequest(http.MethodPost, "/users", validUserBody),
+			database:           mockCreateUserError(fmt.Errorf("cannot insert: %w", &mongo.Error{Kind: mongo.ErrUnavailable})),
+			expectedResponse:   "{\"type\":\"/problems/unavailable\",\"title\":\"Service unavailable\",\"status\":503,\"detail\":\"the service is temporarily unavailable\",\"instance\":\"/users\",\"code\":\"unavailable\"}\n",
+			expectedStatusCode: 503,
+		},
+		{
+			name:               "should return a 500 without details on unexpected errors",
+			request:            createPOSTRequest(http.MethodPost, "/users", validUserBody),
+			database:           mockCreateUserError(fmt.Errorf("something broke")),
+			expectedResponse:   "{\"type\":\"/problems/internal_error\",\"title\":\"Internal server error\",\"status\":500,\"detail\":\"internal server error\",\"instance\":\"/users\",\"code\":\"internal_error\"}\n",
+			expectedStatusCode: 500,
+		},
 	} {
 
 		t.Run(tt.name, func(t *testing.T) {
@@ -120,14 +245,580 @@ func TestCreateUser(t *testing.T) {
 	}
 }
 
+func TestGetUser(t *testing.T) {
+	t.Parallel()
+	database := mockDatabase{
+		getUser: func(ctx context.Context, guid string) (*mongo.User, error) {
+			if guid != "user-1" {
+				return nil, mongo.ErrNotFound
+			}
+			return &mongo.User{ID: guid, Nickname: "test", Email: "test@email.uk"}, nil
+		},
+	}
+
+	for _, tt := range []struct {
+		name               string
+		identity           *auth.Identity
+		userID             string
+		expectedStatusCode int
+		expectedResponse   string
+	}{
+		{
+			name:               "should return a 200 and the user when reading yourself",
+			identity:           &auth.Identity{Subject: "user-1", Method: "jwt"},
+			userID:             "user-1",
+			expectedStatusCode: 200,
+			expectedResponse:   "{\"id\":\"user-1\",\"nickname\":\"test\",\"first_name\":\"\",\"last_name\":\"\",\"email\":\"test@email.uk\",\"country\":\"\",\"created_at\":\"0001-01-01T00:00:00Z\",\"updated_at\":\"0001-01-01T00:00:00Z\",\"version\":0}\n",
+		},
+		{
+			name:               "should mask the email for support",
+			identity:           &auth.Identity{Subject: "support-1", Roles: []string{"support"}, Method: "jwt"},
+			userID:             "user-1",
+			expectedStatusCode: 200,
+			expectedResponse:   "{\"id\":\"user-1\",\"nickname\":\"test\",\"first_name\":\"\",\"last_name\":\"\",\"email\":\"t***@email.uk\",\"country\":\"\",\"created_at\":\"0001-01-01T00:00:00Z\",\"updated_at\":\"0001-01-01T00:00:00Z\",\"version\":0}\n",
+		},
+		{
+			name:               "should return a 404 if the user doesn't exist",
+			identity:           &auth.Identity{Subject: "admin-1", Roles: []string{"admin"}, Method: "jwt"},
+			userID:             "user-2",
+			expectedStatusCode: 404,
+			expectedResponse:   "{\"type\":\"/problems/not_found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"user not found\",\"instance\":\"/users/user-2\",\"code\":\"not_found\"}\n",
+		},
+		{
+			name:               "should return a 403 when reading someone else",
+			identity:           &auth.Identity{Subject: "user-2", Method: "jwt"},
+			userID:             "user-1",
+			expectedStatusCode: 403,
+			expectedResponse:   "{\"type\":\"/problems/forbidden\",\"title\":\"Forbidden\",\"status\":403,\"detail\":\"users:read is not allowed\",\"instance\":\"/users/user-1\",\"code\":\"forbidden\"}\n",
+		},
+		{
+			name:               "should return a 401 when not authenticated",
+			userID:             "user-1",
+			expectedStatusCode: 401,
+			expectedResponse:   "{\"type\":\"/problems/unauthorized\",\"title\":\"Unauthorized\",\"status\":401,\"detail\":\"missing bearer token\",\"instance\":\"/users/user-1\",\"code\":\"unauthorized\"}\n",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			handler := handlers.Handler{
+				Database: database,
+				Logger:   logrus.New(),
+			}
+
+			r, _ := http.NewRequest(http.MethodGet, "/users/"+tt.userID, nil)
+			r = mux.SetURLVars(r, map[string]string{"userid": tt.userID})
+			if tt.identity != nil {
+				r = r.WithContext(auth.WithIdentity(r.Context(), *tt.identity))
+			}
+			w := httptest.NewRecorder()
+
+			handler.GetUser(w, r)
+
+			resp := w.Result()
+			body, _ := ioutil.ReadAll(resp.Body)
+
+			if string(body) != tt.expectedResponse {
+				t.Fatalf("wrong response: got %s want %s", body, tt.expectedResponse)
+			}
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d", resp.StatusCode, tt.expectedStatusCode)
+			}
+		})
+	}
+}
+
 func TestUpdateUser(t *testing.T) {
-	// TODO
+	t.Parallel()
+	for _, tt := range []struct {
+		name               string
+		body               string
+		identity           *auth.Identity
+		database           mockDatabase
+		expectedStatusCode int
+		expectedResponse   string
+	}{
+		{
+			name:               "should return a 200 and the updated user",
+			body:               validUserBody,
+			identity:           self,
+			database:           mockUpdateUser(&mongo.User{ID: "user-1", Nickname: "test"}, nil),
+			expectedStatusCode: 200,
+			expectedResponse:   "{\"id\":\"user-1\",\"nickname\":\"test\",\"first_name\":\"\",\"last_name\":\"\",\"email\":\"\",\"country\":\"\",\"created_at\":\"0001-01-01T00:00:00Z\",\"updated_at\":\"0001-01-01T00:00:00Z\",\"version\":0}\n",
+		},
+		{
+			name:               "should return a 400 if the body isn't json",
+			body:               "nickname=test",
+			identity:           self,
+			database:           mockUpdateUser(nil, nil),
+			expectedStatusCode: 400,
+			expectedResponse:   "{\"type\":\"/problems/invalid_body\",\"title\":\"Invalid request body\",\"status\":400,\"detail\":\"invalid json body\",\"instance\":\"/users/user-1\",\"code\":\"invalid_body\"}\n",
+		},
+		{
+			name:               "should return a 404 if the user doesn't exist",
+			body:               validUserBody,
+			identity:           self,
+			database:           mockUpdateUser(nil, mongo.ErrNotFound),
+			expectedStatusCode: 404,
+			expectedResponse:   "{\"type\":\"/problems/not_found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"user not found\",\"instance\":\"/users/user-1\",\"code\":\"not_found\"}\n",
+		},
+		{
+			name:               "should return a 409 if the update clashes with another user",
+			body:               validUserBody,
+			identity:           self,
+			database:           mockUpdateUser(nil, &mongo.Error{Kind: mongo.ErrConflict, Field: "email", Message: "email is already taken"}),
+			expectedStatusCode: 409,
+			expectedResponse:   "{\"type\":\"/problems/conflict\",\"title\":\"Conflict\",\"status\":409,\"detail\":\"email is already taken\",\"instance\":\"/users/user-1\",\"code\":\"conflict\",\"errors\":[{\"field\":\"email\",\"code\":\"conflict\",\"message\":\"email is already taken\"}]}\n",
+		},
+		{
+			name:               "should return a 422 if the database rejects the document",
+			body:               validUserBody,
+			identity:           admin,
+			database:           mockUpdateUser(nil, &mongo.Error{Kind: mongo.ErrValidation, Message: "document failed validation"}),
+			expectedStatusCode: 422,
+			expectedResponse:   "{\"type\":\"/problems/invalid_document\",\"title\":\"Invalid document\",\"status\":422,\"detail\":\"document failed validation\",\"instance\":\"/users/user-1\",\"code\":\"invalid_document\"}\n",
+		},
+		{
+			name:               "should return a 503 if the database is unavailable",
+			body:               validUserBody,
+			identity:           self,
+			database:           mockUpdateUser(nil, &mongo.Error{Kind: mongo.ErrUnavailable}),
+			expectedStatusCode: 503,
+			expectedResponse:   "{\"type\":\"/problems/unavailable\",\"title\":\"Service unavailable\",\"status\":503,\"detail\":\"the service is temporarily unavailable\",\"instance\":\"/users/user-1\",\"code\":\"unavailable\"}\n",
+		},
+		{
+			name:               "should return a 403 when updating someone else",
+			body:               validUserBody,
+			identity:           &auth.Identity{Subject: "user-2", Method: "jwt"},
+			database:           mockUpdateUser(nil, nil),
+			expectedStatusCode: 403,
+			expectedResponse:   "{\"type\":\"/problems/forbidden\",\"title\":\"Forbidden\",\"status\":403,\"detail\":\"users:update is not allowed\",\"instance\":\"/users/user-1\",\"code\":\"forbidden\"}\n",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			handler := handlers.Handler{
+				Database: tt.database,
+				Logger:   logrus.New(),
+			}
+
+			resp, body := serveRoute(handler.UpdateUser, http.MethodPut, "/users/{userid}",
+				createPOSTRequest(http.MethodPut, "/users/user-1", tt.body), tt.identity)
+
+			if body != tt.expectedResponse {
+				t.Fatalf("wrong response: got %s want %s", body, tt.expectedResponse)
+			}
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d", resp.StatusCode, tt.expectedStatusCode)
+			}
+		})
+	}
+}
+
+// mockPatchUser stores an existing user and records the changes it is patched with
+func mockPatchUser(changes *map[string]string, err error) mockDatabase {
+	stored := mongo.User{ID: "user-1", Nickname: "test", FirstName: "test", LastName: "test", Email: "test@email.uk", Country: "GB"}
+	return mockDatabase{
+		getUser: func(ctx context.Context, guid string) (*mongo.User, error) {
+			if guid != stored.ID {
+				return nil, mongo.ErrNotFound
+			}
+			u := stored
+			return &u, nil
+		},
+		patchUser: func(ctx context.Context, guid string, version int64, c map[string]string) (*mongo.User, error) {
+			*changes = c
+			if err != nil {
+				return nil, err
+			}
+			u := stored
+			for field, value := range c {
+				u.SetField(field, value)
+			}
+			return &u, nil
+		},
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name               string
+		contentType        string
+		body               string
+		path               string
+		identity           *auth.Identity
+		err                error
+		expectedStatusCode int
+		expectedResponse   string
+		expectedChanges    map[string]string
+	}{
+		{
+			name:               "should merge the patch and set only the changed fields",
+			contentType:        "application/merge-patch+json",
+			body:               `{"country": "PT", "nickname": "test"}`,
+			identity:           self,
+			expectedStatusCode: 200,
+			expectedResponse:   "{\"id\":\"user-1\",\"nickname\":\"test\",\"first_name\":\"test\",\"last_name\":\"test\",\"email\":\"test@email.uk\",\"country\":\"PT\",\"created_at\":\"0001-01-01T00:00:00Z\",\"updated_at\":\"0001-01-01T00:00:00Z\",\"version\":0}\n",
+			expectedChanges:    map[string]string{"country": "PT"},
+		},
+		{
+			name:               "should change the password with a merge patch",
+			contentType:        "application/merge-patch+json; charset=utf-8",
+			body:               `{"password": "c0rrect-h0rse-battery"}`,
+			identity:           self,
+			expectedStatusCode: 200,
+			expectedChanges:    map[string]string{"password": "c0rrect-h0rse-battery"},
+		},
+		{
+			name:               "should apply a json patch with a passing test",
+			contentType:        "application/json-patch+json",
+			body:               `[{"op": "test", "path": "/email", "value": "test@email.uk"}, {"op": "replace", "path": "/email", "value": "new@email.uk"}]`,
+			identity:           admin,
+			expectedStatusCode: 200,
+			expectedChanges:    map[string]string{"email": "new@email.uk"},
+		},
+		{
+			name:               "should return a 409 if a json patch test fails",
+			contentType:        "application/json-patch+json",
+			body:               `[{"op": "test", "path": "/email", "value": "old@email.uk"}, {"op": "replace", "path": "/email", "value": "new@email.uk"}]`,
+			identity:           self,
+			expectedStatusCode: 409,
+			expectedResponse:   "{\"type\":\"/problems/test_failed\",\"title\":\"Patch test failed\",\"status\":409,\"detail\":\"operation 0: patch test failed: /email doesn't match\",\"instance\":\"/users/user-1\",\"code\":\"test_failed\"}\n",
+		},
+		{
+			name:               "should return a 422 if a json patch path doesn't exist",
+			contentType:        "application/json-patch+json",
+			body:               `[{"op": "replace", "path": "/address/city", "value": "Lisbon"}]`,
+			identity:           self,
+			expectedStatusCode: 422,
+			expectedResponse:   "{\"type\":\"/problems/invalid_patch\",\"title\":\"Invalid patch\",\"status\":422,\"detail\":\"operation 0: invalid patch: \\\"address\\\" doesn't exist\",\"instance\":\"/users/user-1\",\"code\":\"invalid_patch\"}\n",
+		},
+		{
+			name:               "should return a 422 when patching read-only fields",
+			contentType:        "application/merge-patch+json",
+			body:               `{"roles": ["admin"]}`,
+			identity:           self,
+			expectedStatusCode: 422,
+			expectedResponse:   "{\"type\":\"/problems/invalid_patch\",\"title\":\"Invalid patch\",\"status\":422,\"detail\":\"invalid patch: json: unknown field \\\"roles\\\"\",\"instance\":\"/users/user-1\",\"code\":\"invalid_patch\"}\n",
+		},
+		{
+			name:               "should return a 422 for values that aren't strings",
+			contentType:        "application/merge-patch+json",
+			body:               `{"country": 1}`,
+			identity:           self,
+			expectedStatusCode: 422,
+		},
+		{
+			name:               "should return a 400 if the patched user is invalid",
+			contentType:        "application/merge-patch+json",
+			body:               `{"nickname": null}`,
+			identity:           self,
+			expectedStatusCode: 400,
+			expectedResponse:   "{\"type\":\"/problems/validation_failed\",\"title\":\"Validation failed\",\"status\":400,\"detail\":\"some fields are invalid, see errors\",\"instance\":\"/users/user-1\",\"code\":\"validation_failed\",\"errors\":[{\"field\":\"nickname\",\"code\":\"required\",\"message\":\"The nickname field is required!\"}]}\n",
+		},
+		{
+			name:               "should return a 400 if the new password is weak",
+			contentType:        "application/merge-patch+json",
+			body:               `{"password": "password123"}`,
+			identity:           self,
+			expectedStatusCode: 400,
+			expectedResponse:   "{\"type\":\"/problems/validation_failed\",\"title\":\"Validation failed\",\"status\":400,\"detail\":\"some fields are invalid, see errors\",\"instance\":\"/users/user-1\",\"code\":\"validation_failed\",\"errors\":[{\"field\":\"password\",\"code\":\"weak_password\",\"message\":\"password is too easy to guess, avoid common words, repetitions and sequences\"}]}\n",
+		},
+		{
+			name:               "should return a 400 if the body isn't json",
+			contentType:        "application/merge-patch+json",
+			body:               "nickname=test",
+			identity:           self,
+			expectedStatusCode: 400,
+			expectedResponse:   "{\"type\":\"/problems/invalid_body\",\"title\":\"Invalid request body\",\"status\":400,\"detail\":\"invalid json body\",\"instance\":\"/users/user-1\",\"code\":\"invalid_body\"}\n",
+		},
+		{
+			name:               "should return a 415 for other content types",
+			contentType:        "application/json",
+			body:               `{"country": "PT"}`,
+			identity:           self,
+			expectedStatusCode: 415,
+			expectedResponse:   "{\"type\":\"/problems/unsupported_media_type\",\"title\":\"Unsupported media type\",\"status\":415,\"detail\":\"content type must be application/merge-patch+json or application/json-patch+json\",\"instance\":\"/users/user-1\",\"code\":\"unsupported_media_type\"}\n",
+		},
+		{
+			name:               "should return a 404 if the user doesn't exist",
+			contentType:        "application/merge-patch+json",
+			body:               `{"country": "PT"}`,
+			path:               "/users/user-2",
+			identity:           admin,
+			expectedStatusCode: 404,
+			expectedResponse:   "{\"type\":\"/problems/not_found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"user not found\",\"instance\":\"/users/user-2\",\"code\":\"not_found\"}\n",
+		},
+		{
+			name:               "should return a 409 if the patch clashes with another user",
+			contentType:        "application/merge-patch+json",
+			body:               `{"email": "taken@email.uk"}`,
+			identity:           self,
+			err:                &mongo.Error{Kind: mongo.ErrConflict, Field: "email", Message: "email is already taken"},
+			expectedStatusCode: 409,
+			expectedResponse:   "{\"type\":\"/problems/conflict\",\"title\":\"Conflict\",\"status\":409,\"detail\":\"email is already taken\",\"instance\":\"/users/user-1\",\"code\":\"conflict\",\"errors\":[{\"field\":\"email\",\"code\":\"conflict\",\"message\":\"email is already taken\"}]}\n",
+			expectedChanges:    map[string]string{"email": "taken@email.uk"},
+		},
+		{
+			name:               "should return a 403 when patching someone else",
+			contentType:        "application/merge-patch+json",
+			body:               `{"country": "PT"}`,
+			identity:           support,
+			expectedStatusCode: 403,
+			expectedResponse:   "{\"type\":\"/problems/forbidden\",\"title\":\"Forbidden\",\"status\":403,\"detail\":\"users:update is not allowed\",\"instance\":\"/users/user-1\",\"code\":\"forbidden\"}\n",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var changes map[string]string
+			handler := handlers.Handler{
+				Database: mockPatchUser(&changes, tt.err),
+				Logger:   logrus.New(),
+			}
+			path := tt.path
+			if path == "" {
+				path = "/users/user-1"
+			}
+
+			r, _ := http.NewRequest(http.MethodPatch, path, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			resp, body := serveRoute(handler.PatchUser, http.MethodPatch, "/users/{userid}", r, tt.identity)
+
+			if tt.expectedResponse != "" && body != tt.expectedResponse {
+				t.Fatalf("wrong response: got %s want %s", body, tt.expectedResponse)
+			}
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d: %s", resp.StatusCode, tt.expectedStatusCode, body)
+			}
+			if !reflect.DeepEqual(changes, tt.expectedChanges) {
+				t.Fatalf("wrong changes: got %v want %v", changes, tt.expectedChanges)
+			}
+		})
+	}
 }
 
 func TestRemoveUser(t *testing.T) {
-	// TODO
+	t.Parallel()
+	for _, tt := range []struct {
+		name               string
+		identity           *auth.Identity
+		database           mockDatabase
+		expectedStatusCode int
+		expectedResponse   string
+	}{
+		{
+			name:               "should return a 200 if the user is removed",
+			identity:           self,
+			database:           mockRemoveUser(1, nil),
+			expectedStatusCode: 200,
+			expectedResponse:   "\"OK\"\n",
+		},
+		{
+			name:               "should return a 404 if nothing was removed",
+			identity:           admin,
+			database:           mockRemoveUser(0, nil),
+			expectedStatusCode: 404,
+			expectedResponse:   "{\"type\":\"/problems/not_found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"user not found\",\"instance\":\"/users/user-1\",\"code\":\"not_found\"}\n",
+		},
+		{
+			name:               "should return a 503 if the database is unavailable",
+			identity:           self,
+			database:           mockRemoveUser(0, &mongo.Error{Kind: mongo.ErrUnavailable}),
+			expectedStatusCode: 503,
+			expectedResponse:   "{\"type\":\"/problems/unavailable\",\"title\":\"Service unavailable\",\"status\":503,\"detail\":\"the service is temporarily unavailable\",\"instance\":\"/users/user-1\",\"code\":\"unavailable\"}\n",
+		},
+		{
+			name:               "should return a 500 on unexpected errors",
+			identity:           self,
+			database:           mockRemoveUser(0, fmt.Errorf("something broke")),
+			expectedStatusCode: 500,
+			expectedResponse:   "{\"type\":\"/problems/internal_error\",\"title\":\"Internal server error\",\"status\":500,\"detail\":\"internal server error\",\"instance\":\"/users/user-1\",\"code\":\"internal_error\"}\n",
+		},
+		{
+			name:               "should return a 403 when support removes a user",
+			identity:           support,
+			database:           mockRemoveUser(1, nil),
+			expectedStatusCode: 403,
+			expectedResponse:   "{\"type\":\"/problems/forbidden\",\"title\":\"Forbidden\",\"status\":403,\"detail\":\"users:delete is not allowed\",\"instance\":\"/users/user-1\",\"code\":\"forbidden\"}\n",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			handler := handlers.Handler{
+				Database: tt.database,
+				Logger:   logrus.New(),
+			}
+
+			r, _ := http.NewRequest(http.MethodDelete, "/users/user-1", nil)
+			resp, body := serveRoute(handler.RemoveUser, http.MethodDelete, "/users/{userid}", r, tt.identity)
+
+			if body != tt.expectedResponse {
+				t.Fatalf("wrong response: got %s want %s", body, tt.expectedResponse)
+			}
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d", resp.StatusCode, tt.expectedStatusCode)
+			}
+		})
+	}
+}
+
+func TestRestoreUser(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name               string
+		identity           *auth.Identity
+		err                error
+		expectedStatusCode int
+		expectedResponse   string
+	}{
+		{
+			name:               "should return a 200 and the restored user",
+			identity:           admin,
+			expectedStatusCode: 200,
+			expectedResponse:   "{\"id\":\"user-1\",\"nickname\":\"test\",\"first_name\":\"\",\"last_name\":\"\",\"email\":\"\",\"country\":\"\",\"created_at\":\"0001-01-01T00:00:00Z\",\"updated_at\":\"0001-01-01T00:00:00Z\",\"version\":3}\n",
+		},
+		{
+			name:               "should return a 404 if the user was purged",
+			identity:           admin,
+			err:                mongo.ErrNotFound,
+			expectedStatusCode: 404,
+			expectedResponse:   "{\"type\":\"/problems/not_found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"user not found\",\"instance\":\"/users/user-1/restore\",\"code\":\"not_found\"}\n",
+		},
+		{
+			name:               "should return a 403 when users restore themselves",
+			identity:           self,
+			expectedStatusCode: 403,
+			expectedResponse:   "{\"type\":\"/problems/forbidden\",\"title\":\"Forbidden\",\"status\":403,\"detail\":\"users:restore is not allowed\",\"instance\":\"/users/user-1/restore\",\"code\":\"forbidden\"}\n",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			handler := handlers.Handler{
+				Database: mockDatabase{
+					restoreUser: func(ctx context.Context, guid string) (*mongo.User, error) {
+						if tt.err != nil {
+							return nil, tt.err
+						}
+						return &mongo.User{ID: guid, Nickname: "test", Version: 3}, nil
+					},
+				},
+				Logger: logrus.New(),
+			}
+
+			r, _ := http.NewRequest(http.MethodPost, "/users/user-1/restore", nil)
+			resp, body := serveRoute(handler.RestoreUser, http.MethodPost, "/users/{userid}/restore", r, tt.identity)
+
+			if body != tt.expectedResponse {
+				t.Fatalf("wrong response: got %s want %s", body, tt.expectedResponse)
+			}
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d", resp.StatusCode, tt.expectedStatusCode)
+			}
+		})
+	}
 }
 
 func TestGetUsers(t *testing.T) {
-	// TODO
+	t.Parallel()
+	page := &mongo.UserPage{
+		Users:         []*mongo.User{{ID: "user-1", Nickname: "test", Email: "test@email.uk", Country: "PT"}},
+		NextPageToken: "next",
+	}
+
+	for _, tt := range []struct {
+		name               string
+		url                string
+		identity           *auth.Identity
+		database           mockDatabase
+		expectedStatusCode int
+		expectedResponse   string
+		expectedLink       string
+	}{
+		{
+			name:               "should return a 200, the page and a link to the next page",
+			url:                "/users?country=PT&limit=1",
+			identity:           admin,
+			database:           mockGetUsers(page, nil),
+			expectedStatusCode: 200,
+			expectedResponse:   "{\"users\":[{\"id\":\"user-1\",\"nickname\":\"test\",\"first_name\":\"\",\"last_name\":\"\",\"email\":\"test@email.uk\",\"country\":\"PT\",\"created_at\":\"0001-01-01T00:00:00Z\",\"updated_at\":\"0001-01-01T00:00:00Z\",\"version\":0}],\"next_page_token\":\"next\"}\n",
+			expectedLink:       "</users?country=PT&limit=1&page_token=next>; rel=\"next\"",
+		},
+		{
+			name:               "should mask emails for support",
+			url:                "/users?country=PT",
+			identity:           support,
+			database:           mockGetUsers(&mongo.UserPage{Users: page.Users}, nil),
+			expectedStatusCode: 200,
+			expectedResponse:   "{\"users\":[{\"id\":\"user-1\",\"nickname\":\"test\",\"first_name\":\"\",\"last_name\":\"\",\"email\":\"t***@email.uk\",\"country\":\"PT\",\"created_at\":\"0001-01-01T00:00:00Z\",\"updated_at\":\"0001-01-01T00:00:00Z\",\"version\":0}]}\n",
+		},
+		{
+			name:               "should return a 400 on invalid pagination parameters",
+			url:                "/users?limit=0",
+			identity:           admin,
+			database:           mockGetUsers(page, nil),
+			expectedStatusCode: 400,
+			expectedResponse:   "{\"type\":\"/problems/invalid_parameter\",\"title\":\"Invalid query parameter\",\"status\":400,\"detail\":\"invalid list parameters: limit must be between 1 and 200\",\"instance\":\"/users\",\"code\":\"invalid_parameter\"}\n",
+		},
+		{
+			name:               "should return a 503 if the database is unavailable",
+			url:                "/users",
+			identity:           admin,
+			database:           mockGetUsers(nil, &mongo.Error{Kind: mongo.ErrUnavailable}),
+			expectedStatusCode: 503,
+			expectedResponse:   "{\"type\":\"/problems/unavailable\",\"title\":\"Service unavailable\",\"status\":503,\"detail\":\"the service is temporarily unavailable\",\"instance\":\"/users\",\"code\":\"unavailable\"}\n",
+		},
+		{
+			name:               "should return a 403 when support lists users without a country",
+			url:                "/users",
+			identity:           support,
+			database:           mockGetUsers(page, nil),
+			expectedStatusCode: 403,
+			expectedResponse:   "{\"type\":\"/problems/forbidden\",\"title\":\"Forbidden\",\"status\":403,\"detail\":\"users:list is not allowed\",\"instance\":\"/users\",\"code\":\"forbidden\"}\n",
+		},
+		{
+			name:               "should return a 403 when support includes deleted users",
+			url:                "/users?country=PT&include_deleted=true",
+			identity:           support,
+			database:           mockGetUsers(page, nil),
+			expectedStatusCode: 403,
+			expectedResponse:   "{\"type\":\"/problems/forbidden\",\"title\":\"Forbidden\",\"status\":403,\"detail\":\"users:list_deleted is not allowed\",\"instance\":\"/users\",\"code\":\"forbidden\"}\n",
+		},
+		{
+			name:     "should list deleted users to admins",
+			url:      "/users?include_deleted=true",
+			identity: admin,
+			database: mockDatabase{
+				getUsers: func(ctx context.Context, opts mongo.ListOptions) (*mongo.UserPage, error) {
+					if !opts.IncludeDeleted {
+						return nil, fmt.Errorf("deleted users not included")
+					}
+					deletedAt := time.Date(2020, 10, 10, 10, 0, 0, 0, time.UTC)
+					return &mongo.UserPage{Users: []*mongo.User{{ID: "user-1", DeletedAt: &deletedAt}}}, nil
+				},
+			},
+			expectedStatusCode: 200,
+			expectedResponse:   "{\"users\":[{\"id\":\"user-1\",\"nickname\":\"\",\"first_name\":\"\",\"last_name\":\"\",\"email\":\"\",\"country\":\"\",\"created_at\":\"0001-01-01T00:00:00Z\",\"updated_at\":\"0001-01-01T00:00:00Z\",\"version\":0,\"deleted_at\":\"2020-10-10T10:00:00Z\"}]}\n",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			handler := handlers.Handler{
+				Database: tt.database,
+				Logger:   logrus.New(),
+			}
+
+			r, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			resp, body := serveRoute(handler.GetUsers, http.MethodGet, "/users", r, tt.identity)
+
+			if body != tt.expectedResponse {
+				t.Fatalf("wrong response: got %s want %s", body, tt.expectedResponse)
+			}
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d", resp.StatusCode, tt.expectedStatusCode)
+			}
+			if link := resp.Header.Get("Link"); link != tt.expectedLink {
+				t.Fatalf("wrong link: got %s want %s", link, tt.expectedLink)
+			}
+		})
+	}
 }
@@ -1,9 +1,17 @@
 package handlers
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"net/url"
+
+	"github.com/jpaldi/go-user-api/logging"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/patch"
+	"github.com/jpaldi/go-user-api/validation"
+	"github.com/sirupsen/logrus"
 )
 
 type userRequestBody struct {
@@ -15,41 +23,88 @@ type userRequestBody struct {
 	Country   string `json:"country"`
 }
 
-func (u *userRequestBody) validate() url.Values {
-	errs := url.Values{}
-
-	// check if the nickname empty
-	if u.Nickname == "" {
-		errs.Add("nickname", "The nickname field is required!")
+// validate checks the body against the schema, the password is skipped when partial is set and it is empty
+func (u *userRequestBody) validate(schema validation.Schema, partial bool) validation.Errors {
+	values := map[string]string{}
+	for field, value := range u.object() {
+		values[field] = value.(string)
 	}
-
-	// check if the first_name empty
-	if u.FirstName == "" {
-		errs.Add("first_name", "The first_name field is required!")
+	if partial && u.Password == "" {
+		delete(values, "password")
 	}
+	return schema.Validate(values)
+}
 
-	// check if the last_name empty
-	if u.LastName == "" {
-		errs.Add("last_name", "The last_name field is required!")
-	}
+// required is the error of a missing field, the same the validation rules report
+func required(field string) validation.FieldError {
+	return *validation.Required()(field, "")
+}
 
-	// check if the password empty
-	if u.Password == "" {
-		errs.Add("password", "The password field is required!")
+// writeValidationErrors reports the invalid fields of a request body
+func writeValidationErrors(w http.ResponseWriter, r *http.Request, errs validation.Errors) {
+	p := newProblem(r, codeValidationFailed, "some fields are invalid, see errors")
+	p.Errors = errs
+	p.write(w)
+}
+
+// userDocument returns the patchable fields of a user as a request body, the password is
+// left empty since only its hash is known
+func userDocument(u mongo.User) userRequestBody {
+	return userRequestBody{
+		Nickname:  u.Nickname,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Email:     u.Email,
+		Country:   u.Country,
 	}
+}
 
-	// check if the email empty
-	if u.Email == "" {
-		errs.Add("email", "The email field is required!")
+// object returns the body as the JSON object patches are applied to
+func (u userRequestBody) object() map[string]interface{} {
+	return map[string]interface{}{
+		"nickname":   u.Nickname,
+		"first_name": u.FirstName,
+		"last_name":  u.LastName,
+		"password":   u.Password,
+		"email":      u.Email,
+		"country":    u.Country,
 	}
+}
 
-	// check if the title empty
-	if u.Country == "" {
-		errs.Add("country", "The country field is required!")
+// changes returns the fields that differ from the original, keyed by their json name
+func (u userRequestBody) changes(original userRequestBody) map[string]string {
+	patched, before := u.object(), original.object()
+	changes := map[string]string{}
+	for field, value := range patched {
+		if value != before[field] {
+			changes[field] = value.(string)
+		}
 	}
+	return changes
+}
 
-	return errs
+// patchedDocument reads a patched user back, rejecting unknown fields and non string values
+func patchedDocument(doc interface{}) (*userRequestBody, error) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	userBody := &userRequestBody{}
+	if err := d.Decode(userBody); err != nil {
+		return nil, fmt.Errorf("%w: %s", patch.ErrInvalidPatch, err)
+	}
+	return userBody, nil
+}
 
+// writePatchError reports patches that can't be applied with a 422 and failed tests with a 409
+func writePatchError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, patch.ErrTestFailed) {
+		writeProblem(w, r, codeTestFailed, err.Error())
+		return
+	}
+	writeProblem(w, r, codeInvalidPatch, err.Error())
 }
 
 func writeResponse(w http.ResponseWriter, statusCode int, response interface{}) {
@@ -58,12 +113,49 @@ func writeResponse(w http.ResponseWriter, statusCode int, response interface{})
 	json.NewEncoder(w).Encode(response)
 }
 
+// writeError maps storage errors to their problem, the field at fault is reported in errors.
+// Unexpected errors are logged and reported as a 500 without leaking their details.
+func writeError(w http.ResponseWriter, r *http.Request, logger *logrus.Logger, err error) {
+	log := logging.FromContext(r.Context(), logger)
+	var code string
+	switch {
+	case errors.Is(err, mongo.ErrNotFound):
+		code = codeNotFound
+	case errors.Is(err, mongo.ErrConflict):
+		code = codeConflict
+	case errors.Is(err, mongo.ErrVersionMismatch):
+		code = codePreconditionFailed
+	case errors.Is(err, mongo.ErrValidation):
+		code = codeInvalidDocument
+	case errors.Is(err, mongo.ErrUnavailable):
+		log.WithError(err).Warn("database unavailable")
+		w.Header().Set("Retry-After", "1")
+		writeProblem(w, r, codeUnavailable, "the service is temporarily unavailable")
+		return
+	default:
+		log.WithError(err).Error("unexpected error")
+		writeProblem(w, r, codeInternalError, "internal server error")
+		return
+	}
+
+	p := newProblem(r, code, err.Error())
+	var storageErr *mongo.Error
+	if errors.As(err, &storageErr) && storageErr.Field != "" {
+		p.Errors = []validation.FieldError{{Field: storageErr.Field, Code: code, Message: storageErr.Error()}}
+	}
+	p.write(w)
+}
+
 func validateJSON(r *http.Request) (*userRequestBody, error) {
 	userBody := &userRequestBody{}
 
-	defer r.Body.Close()
-	if err := json.NewDecoder(r.Body).Decode(userBody); err != nil {
+	if err := decodeJSON(r, userBody); err != nil {
 		return userBody, err
 	}
 	return userBody, nil
 }
+
+func decodeJSON(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	return json.NewDecoder(r.Body).Decode(v)
+}
@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jpaldi/go-user-api/logging"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/policy"
+	"github.com/jpaldi/go-user-api/validation"
+	"github.com/jpaldi/go-user-api/webhooks"
+	"github.com/sirupsen/logrus"
+)
+
+// WebhooksHandler represents the handler for webhooks routes, every route requires the webhooks:manage operation
+type WebhooksHandler struct {
+	Store  webhooks.Store
+	Logger *logrus.Logger
+	// Policy defaults to policy.Default when not set
+	Policy *policy.Policy
+}
+
+type webhookRequestBody struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	// Secret is generated when empty
+	Secret string `json:"secret"`
+}
+
+// createdWebhookResponse is the only response carrying the secret
+type createdWebhookResponse struct {
+	mongo.Webhook
+	Secret string `json:"secret"`
+}
+
+// minSecretLength is the shortest secret integrators may choose
+const minSecretLength = 16
+
+// defaultDeliveriesLimit and maxDeliveriesLimit bound how many deliveries are listed
+const (
+	defaultDeliveriesLimit = 20
+	maxDeliveriesLimit     = 100
+)
+
+func (body webhookRequestBody) validate() validation.Errors {
+	errs := validation.Errors{}
+	if u, err := url.Parse(body.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, validation.FieldError{Field: "url", Code: validation.CodeInvalidURL, Message: "url must be an absolute http or https URL"})
+	}
+
+	if len(body.EventTypes) == 0 {
+		errs = append(errs, required("event_types"))
+	}
+	for _, t := range body.EventTypes {
+		if !webhooks.Known(t) {
+			message := fmt.Sprintf("unknown event type %q, expected one of %v", t, webhooks.EventTypes)
+			errs = append(errs, validation.FieldError{Field: "event_types", Code: validation.CodeInvalidEventType, Message: message})
+			break
+		}
+	}
+
+	if body.Secret != "" && len(body.Secret) < minSecretLength {
+		message := fmt.Sprintf("secret must be at least %d characters", minSecretLength)
+		errs = append(errs, validation.FieldError{Field: "secret", Code: validation.CodeTooShort, Message: message})
+	}
+	return errs
+}
+
+// CreateWebhook handles the POST /webhooks request, the response is the only one carrying the secret
+func (handler *WebhooksHandler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	identity, ok := authorize(w, r, handler.policy(), policy.ManageWebhooks, "")
+	if !ok {
+		return
+	}
+
+	body := webhookRequestBody{}
+	if err := decodeJSON(r, &body); err != nil {
+		writeProblem(w, r, codeInvalidBody, "invalid json body")
+		return
+	}
+	if errs := body.validate(); len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	if body.Secret == "" {
+		secret, err := generateSecret()
+		if err != nil {
+			writeError(w, r, handler.Logger, err)
+			return
+		}
+		body.Secret = secret
+	}
+
+	webhook := mongo.Webhook{
+		ID:         uuid.New().String(),
+		URL:        body.URL,
+		EventTypes: body.EventTypes,
+		Secret:     body.Secret,
+		Active:     true,
+		CreatedBy:  identity.Subject,
+		CreatedAt:  mongo.Now(),
+	}
+	if err := handler.Store.CreateWebhook(r.Context(), webhook); err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	// Log to console
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+		"webhookID": webhook.ID,
+		"createdBy": identity.Subject,
+	}).Info("created webhook")
+	w.Header().Set("Location", "/webhooks/"+webhook.ID)
+	writeResponse(w, http.StatusCreated, createdWebhookResponse{Webhook: webhook, Secret: webhook.Secret})
+}
+
+// GetWebhooks handles the GET /webhooks request
+func (handler *WebhooksHandler) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorize(w, r, handler.policy(), policy.ManageWebhooks, ""); !ok {
+		return
+	}
+
+	list, err := handler.Store.ListWebhooks(r.Context())
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	// Log to console
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+		"number_webhooks": len(list),
+	}).Info("listed webhooks")
+	writeResponse(w, http.StatusOK, list)
+}
+
+// GetWebhook handles the GET /webhooks/{webhookid} request
+func (handler *WebhooksHandler) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookid := mux.Vars(r)["webhookid"]
+	if _, ok := authorize(w, r, handler.policy(), policy.ManageWebhooks, ""); !ok {
+		return
+	}
+
+	webhook, err := handler.Store.GetWebhook(r.Context(), webhookid)
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, webhook)
+}
+
+// RemoveWebhook handles the DELETE /webhooks/{webhookid} request, the pending deliveries are dropped
+func (handler *WebhooksHandler) RemoveWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookid := mux.Vars(r)["webhookid"]
+	if _, ok := authorize(w, r, handler.policy(), policy.ManageWebhooks, ""); !ok {
+		return
+	}
+
+	if err := handler.Store.DeleteWebhook(r.Context(), webhookid); err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	// Log to console
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+		"webhookID": webhookid,
+	}).Info("deleted webhook")
+	writeResponse(w, http.StatusOK, "OK")
+}
+
+// EnableWebhook handles the POST /webhooks/{webhookid}/enable request, activating a webhook disabled after failures
+func (handler *WebhooksHandler) EnableWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookid := mux.Vars(r)["webhookid"]
+	if _, ok := authorize(w, r, handler.policy(), policy.ManageWebhooks, ""); !ok {
+		return
+	}
+
+	webhook, err := handler.Store.EnableWebhook(r.Context(), webhookid)
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	// Log to console
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+		"webhookID": webhookid,
+	}).Info("enabled webhook")
+	writeResponse(w, http.StatusOK, webhook)
+}
+
+// GetDeliveries handles the GET /webhooks/{webhookid}/deliveries request, the latest deliveries with their attempts
+func (handler *WebhooksHandler) GetDeliveries(w http.ResponseWriter, r *http.Request) {
+	webhookid := mux.Vars(r)["webhookid"]
+	if _, ok := authorize(w, r, handler.policy(), policy.ManageWebhooks, ""); !ok {
+		return
+	}
+
+	limit := defaultDeliveriesLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > maxDeliveriesLimit {
+			writeProblem(w, r, codeInvalidParameter, fmt.Sprintf("limit must be between 1 and %d", maxDeliveriesLimit))
+			return
+		}
+		limit = l
+	}
+
+	if _, err := handler.Store.GetWebhook(r.Context(), webhookid); err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+	deliveries, err := handler.Store.ListDeliveries(r.Context(), webhookid, limit)
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	// Log to console
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+		"number_deliveries": len(deliveries),
+	}).Info("listed webhook deliveries")
+	writeResponse(w, http.StatusOK, deliveries)
+}
+
+// GetDelivery handles the GET /webhooks/{webhookid}/deliveries/{deliveryid} request
+func (handler *WebhooksHandler) GetDelivery(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	webhookid, deliveryid := vars["webhookid"], vars["deliveryid"]
+	if _, ok := authorize(w, r, handler.policy(), policy.ManageWebhooks, ""); !ok {
+		return
+	}
+
+	delivery, err := handler.Store.GetDelivery(r.Context(), webhookid, deliveryid)
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, delivery)
+}
+
+// Redeliver handles the POST /webhooks/{webhookid}/deliveries/{deliveryid}/redeliver request, scheduling
+// the delivery again right away with a fresh backoff
+func (handler *WebhooksHandler) Redeliver(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	webhookid, deliveryid := vars["webhookid"], vars["deliveryid"]
+	if _, ok := authorize(w, r, handler.policy(), policy.ManageWebhooks, ""); !ok {
+		return
+	}
+
+	delivery, err := handler.Store.Redeliver(r.Context(), webhookid, deliveryid, mongo.Now())
+	if err != nil {
+		writeError(w, r, handler.Logger, err)
+		return
+	}
+
+	// Log to console
+	logging.FromContext(r.Context(), handler.Logger).WithFields(logrus.Fields{
+		"webhookID":  webhookid,
+		"deliveryID": deliveryid,
+	}).Info("scheduled webhook redelivery")
+	writeResponse(w, http.StatusAccepted, delivery)
+}
+
+func (handler *WebhooksHandler) policy() *policy.Policy {
+	if handler.Policy == nil {
+		return &policy.Default
+	}
+	return handler.Policy
+}
+
+// generateSecret returns a random 256-bit secret
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
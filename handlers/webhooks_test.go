@@ -0,0 +1,141 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jpaldi/go-user-api/handlers"
+	"github.com/jpaldi/go-user-api/memory"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCreateWebhook(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name               string
+		body               string
+		expectedStatusCode int
+		expectedResponse   string
+	}{
+		{
+			name:               "webhooks with a secret should be created",
+			body:               `{"url": "https://example.com/hooks", "event_types": ["user.created"], "secret": "s3cr3t-s3cr3t-s3cr3t"}`,
+			expectedStatusCode: http.StatusCreated,
+			expectedResponse:   `"secret":"s3cr3t-s3cr3t-s3cr3t"`,
+		},
+		{
+			name:               "webhooks without a secret should get one",
+			body:               `{"url": "https://example.com/hooks", "event_types": ["user.created", "user.deleted"]}`,
+			expectedStatusCode: http.StatusCreated,
+			expectedResponse:   `"secret":"whsec_`,
+		},
+		{
+			name:               "relative urls should be rejected",
+			body:               `{"url": "/hooks", "event_types": ["user.created"]}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedResponse:   `"code":"invalid_url"`,
+		},
+		{
+			name:               "unknown event types should be rejected",
+			body:               `{"url": "https://example.com/hooks", "event_types": ["user.renamed"]}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedResponse:   `"code":"invalid_event_type"`,
+		},
+		{
+			name:               "webhooks without event types should be rejected",
+			body:               `{"url": "https://example.com/hooks"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedResponse:   `"field":"event_types","code":"required"`,
+		},
+		{
+			name:               "short secrets should be rejected",
+			body:               `{"url": "https://example.com/hooks", "event_types": ["user.created"], "secret": "short"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedResponse:   `"field":"secret","code":"too_short"`,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			handler := handlers.WebhooksHandler{Store: memory.NewWebhooks(), Logger: logrus.New()}
+
+			resp, body := serveRoute(handler.CreateWebhook, http.MethodPost, "/webhooks", createPOSTRequest(http.MethodPost, "/webhooks", tt.body), admin)
+
+			if resp.StatusCode != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d: %s", resp.StatusCode, tt.expectedStatusCode, body)
+			}
+			if !strings.Contains(body, tt.expectedResponse) {
+				t.Fatalf("wrong response: got %s want it to contain %s", body, tt.expectedResponse)
+			}
+		})
+	}
+}
+
+func TestWebhookRoutes(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := memory.NewWebhooks()
+	handler := handlers.WebhooksHandler{Store: store, Logger: logrus.New()}
+
+	r := createPOSTRequest(http.MethodPost, "/webhooks", `{"url": "https://example.com/hooks", "event_types": ["user.created"]}`)
+	if resp, body := serveRoute(handler.CreateWebhook, http.MethodPost, "/webhooks", r, support); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("only admins should manage webhooks: got %d %s", resp.StatusCode, body)
+	}
+	r = createPOSTRequest(http.MethodPost, "/webhooks", `{"url": "https://example.com/hooks", "event_types": ["user.created"]}`)
+	_, body := serveRoute(handler.CreateWebhook, http.MethodPost, "/webhooks", r, admin)
+	created := mongo.Webhook{}
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatalf("couldn't decode webhook: %s", err)
+	}
+
+	r, _ = http.NewRequest(http.MethodGet, "/webhooks/"+created.ID, nil)
+	resp, body := serveRoute(handler.GetWebhook, http.MethodGet, "/webhooks/{webhookid}", r, admin)
+	if resp.StatusCode != http.StatusOK || strings.Contains(body, "secret") || !strings.Contains(body, `"created_by":"admin-1"`) {
+		t.Fatalf("wrong webhook: got %d %s", resp.StatusCode, body)
+	}
+
+	delivery := mongo.Delivery{ID: "delivery-1", WebhookID: created.ID, Status: mongo.DeliveryFailed, Failures: 10}
+	store.AddDelivery(ctx, delivery)
+
+	r, _ = http.NewRequest(http.MethodGet, "/webhooks/"+created.ID+"/deliveries?limit=1000", nil)
+	if resp, body := serveRoute(handler.GetDeliveries, http.MethodGet, "/webhooks/{webhookid}/deliveries", r, admin); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("wrong status code: got %d want 400: %s", resp.StatusCode, body)
+	}
+	r, _ = http.NewRequest(http.MethodGet, "/webhooks/unknown/deliveries", nil)
+	if resp, body := serveRoute(handler.GetDeliveries, http.MethodGet, "/webhooks/{webhookid}/deliveries", r, admin); resp.StatusCode != http.StatusNotFound || !strings.Contains(body, "webhook not found") {
+		t.Fatalf("wrong response: got %d %s", resp.StatusCode, body)
+	}
+	r, _ = http.NewRequest(http.MethodGet, "/webhooks/"+created.ID+"/deliveries", nil)
+	if resp, body := serveRoute(handler.GetDeliveries, http.MethodGet, "/webhooks/{webhookid}/deliveries", r, admin); resp.StatusCode != http.StatusOK || !strings.Contains(body, `"id":"delivery-1"`) {
+		t.Fatalf("wrong deliveries: got %d %s", resp.StatusCode, body)
+	}
+
+	r, _ = http.NewRequest(http.MethodPost, "/webhooks/other/deliveries/delivery-1/redeliver", nil)
+	if resp, _ := serveRoute(handler.Redeliver, http.MethodPost, "/webhooks/{webhookid}/deliveries/{deliveryid}/redeliver", r, admin); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("deliveries of other webhooks shouldn't be found: got %d", resp.StatusCode)
+	}
+	r, _ = http.NewRequest(http.MethodPost, "/webhooks/"+created.ID+"/deliveries/delivery-1/redeliver", nil)
+	resp, body = serveRoute(handler.Redeliver, http.MethodPost, "/webhooks/{webhookid}/deliveries/{deliveryid}/redeliver", r, admin)
+	if resp.StatusCode != http.StatusAccepted || !strings.Contains(body, `"status":"pending","created_at"`) || !strings.Contains(body, `"failures":0`) {
+		t.Fatalf("the delivery should be scheduled again: got %d %s", resp.StatusCode, body)
+	}
+
+	store.RecordResult(ctx, created.ID, false, 1, mongo.Now())
+	r, _ = http.NewRequest(http.MethodPost, "/webhooks/"+created.ID+"/enable", nil)
+	resp, body = serveRoute(handler.EnableWebhook, http.MethodPost, "/webhooks/{webhookid}/enable", r, admin)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"active":true`) || strings.Contains(body, "disabled_at") {
+		t.Fatalf("the webhook should be enabled: got %d %s", resp.StatusCode, body)
+	}
+
+	r, _ = http.NewRequest(http.MethodDelete, "/webhooks/"+created.ID, nil)
+	if resp, _ := serveRoute(handler.RemoveWebhook, http.MethodDelete, "/webhooks/{webhookid}", r, admin); resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code: got %d want 200", resp.StatusCode)
+	}
+	r, _ = http.NewRequest(http.MethodGet, "/webhooks", nil)
+	if resp, body := serveRoute(handler.GetWebhooks, http.MethodGet, "/webhooks", r, admin); resp.StatusCode != http.StatusOK || body != "[]\n" {
+		t.Fatalf("the webhook should be removed: got %d %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,46 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// PendingEvents reports the oldest event waiting in the outbox, see events.Outbox
+type PendingEvents interface {
+	OldestPending(ctx context.Context) (*time.Time, error)
+}
+
+// OutboxLag checks the oldest event waiting in the outbox occurred less than max ago, a longer lag means
+// the relay is stuck or can't keep up
+func OutboxLag(outbox PendingEvents, max time.Duration, now func() time.Time) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		oldest, err := outbox.OldestPending(ctx)
+		if err != nil {
+			return fmt.Errorf("reading the outbox: %w", err)
+		}
+		if oldest == nil {
+			return nil
+		}
+		if lag := now().Sub(*oldest); lag > max {
+			return fmt.Errorf("the oldest pending event occurred %s ago, more than %s", lag.Round(time.Second), max)
+		}
+		return nil
+	}
+}
+
+// DiskSpace checks the file system holding path has at least min free bytes, e.g. for the events file
+func DiskSpace(path string, min uint64) func(ctx context.Context) error {
+	dir := filepath.Dir(path)
+	return func(ctx context.Context) error {
+		free, err := freeBytes(dir)
+		if err != nil {
+			return fmt.Errorf("reading the free space of %s: %w", dir, err)
+		}
+		if free < min {
+			return fmt.Errorf("%d bytes free on %s, less than %d", free, dir, min)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package health
+
+import "errors"
+
+// freeBytes is only supported on linux and darwin, the service is built for linux containers
+func freeBytes(dir string) (uint64, error) {
+	return 0, errors.New("disk space checks aren't supported on this platform")
+}
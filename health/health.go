@@ -0,0 +1,237 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The statuses of checks and probes
+const (
+	StatusOK = "ok"
+	// StatusDegraded is the status of a ready service with failing non critical checks
+	StatusDegraded    = "degraded"
+	StatusFailing     = "failing"
+	StatusUnavailable = "unavailable"
+	// StatusShuttingDown is the status of a service draining its requests before stopping
+	StatusShuttingDown = "shutting_down"
+)
+
+// defaults of the checks that don't set them
+const (
+	defaultTimeout = 2 * time.Second
+	defaultTTL     = 5 * time.Second
+)
+
+// Check is a named dependency of the service, checked by the readiness probe
+type Check struct {
+	Name string
+	// Critical checks make the service unready when they fail, others only degrade it
+	Critical bool
+	// Timeout bounds each run of the check, 2s by default
+	Timeout time.Duration
+	// TTL is how long a result is reused, so frequent probes don't load the dependency, 5s by default
+	TTL time.Duration
+	// Run returns an error when the dependency isn't usable
+	Run func(ctx context.Context) error
+}
+
+// Result is the last run of a check
+type Result struct {
+	Name       string    `json:"name"`
+	Status     string    `json:"status"`
+	Critical   bool      `json:"critical"`
+	Error      string    `json:"error,omitempty"`
+	CheckedAt  time.Time `json:"checked_at"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// Registry holds the checks of the service and serves the liveness and readiness probes
+type Registry struct {
+	// Now defaults to time.Now
+	Now func() time.Time
+
+	mu           sync.Mutex
+	checks       []*entry
+	shuttingDown bool
+}
+
+type entry struct {
+	check Check
+
+	mu     sync.Mutex
+	result *Result
+}
+
+// Register adds a check, checks are run in the order they were registered
+func (r *Registry) Register(check Check) {
+	if check.Timeout <= 0 {
+		check.Timeout = defaultTimeout
+	}
+	if check.TTL <= 0 {
+		check.TTL = defaultTTL
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks = append(r.checks, &entry{check: check})
+}
+
+// ShutDown makes the readiness probe fail from now on, so load balancers stop sending requests
+// while the service drains the ones in flight
+func (r *Registry) ShutDown() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.shuttingDown = true
+}
+
+func (r *Registry) isShuttingDown() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.shuttingDown
+}
+
+// Run runs the checks concurrently, or reuses their results younger than their TTL
+func (r *Registry) Run(ctx context.Context) []Result {
+	r.mu.Lock()
+	checks := append([]*entry(nil), r.checks...)
+	r.mu.Unlock()
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, e := range checks {
+		wg.Add(1)
+		go func(i int, e *entry) {
+			defer wg.Done()
+			results[i] = r.run(ctx, e)
+		}(i, e)
+	}
+	wg.Wait()
+	return results
+}
+
+// run runs a check unless its last result is still fresh, concurrent probes wait for the same run
+func (r *Registry) run(ctx context.Context, e *entry) Result {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := r.now()
+	if e.result != nil && now.Sub(e.result.CheckedAt) < e.check.TTL {
+		return *e.result
+	}
+
+	// the result is shared by every probe until it expires, so it mustn't depend on the probe giving up
+	checkCtx, cancel := context.WithTimeout(detached{ctx}, e.check.Timeout)
+	defer cancel()
+	err := e.check.Run(checkCtx)
+
+	result := Result{
+		Name:       e.check.Name,
+		Status:     StatusOK,
+		Critical:   e.check.Critical,
+		CheckedAt:  now,
+		DurationMS: r.now().Sub(now).Milliseconds(),
+	}
+	if err != nil {
+		result.Status, result.Error = StatusFailing, err.Error()
+	}
+	e.result = &result
+	return result
+}
+
+// detached keeps the values of a context, e.g. its trace, but not its cancellation
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+func (r *Registry) now() time.Time {
+	if r.Now == nil {
+		return time.Now()
+	}
+	return r.Now()
+}
+
+// Status summarises results: unavailable when a critical check fails, degraded when another one does
+func Status(results []Result) string {
+	status := StatusOK
+	for _, res := range results {
+		if res.Status == StatusOK {
+			continue
+		}
+		if res.Critical {
+			return StatusUnavailable
+		}
+		status = StatusDegraded
+	}
+	return status
+}
+
+type probeResponse struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks,omitempty"`
+}
+
+// Livez handles the GET /livez request. The service is alive as long as it serves requests, dependencies aren't
+// checked so their outages don't get every instance restarted.
+func (r *Registry) Livez(w http.ResponseWriter, req *http.Request) {
+	writeProbe(w, http.StatusOK, probeResponse{Status: StatusOK})
+}
+
+// Readyz handles the GET /readyz request, a 503 when a critical check fails or the service is shutting down.
+// With ?verbose=1 the result of every check is listed.
+func (r *Registry) Readyz(w http.ResponseWriter, req *http.Request) {
+	if r.isShuttingDown() {
+		writeProbe(w, http.StatusServiceUnavailable, probeResponse{Status: StatusShuttingDown})
+		return
+	}
+	results := r.Run(req.Context())
+	response := probeResponse{Status: Status(results)}
+	if verbose(req) {
+		response.Checks = results
+	}
+
+	statusCode := http.StatusOK
+	if response.Status == StatusUnavailable {
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeProbe(w, statusCode, response)
+}
+
+// Health handles the former GET /health request, kept with its response for the clients and monitors parsing it:
+// {"database_status":"OK"}, or "UNHEALTHY" with a 503 when the check named database fails. There is nothing to
+// check when no check has this name, e.g. without an external database.
+func (r *Registry) Health(database string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		status, statusCode := "OK", http.StatusOK
+		for _, result := range r.Run(req.Context()) {
+			if result.Name == database && result.Status != StatusOK {
+				status, statusCode = "UNHEALTHY", http.StatusServiceUnavailable
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(struct {
+			Database string `json:"database_status"`
+		}{Database: status})
+	}
+}
+
+func verbose(req *http.Request) bool {
+	switch req.URL.Query().Get("verbose") {
+	case "1", "true":
+		return true
+	}
+	return false
+}
+
+func writeProbe(w http.ResponseWriter, statusCode int, response probeResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,268 @@
+package health_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpaldi/go-user-api/health"
+)
+
+func ok(ctx context.Context) error { return nil }
+
+func failing(ctx context.Context) error { return errors.New("connection refused") }
+
+func TestReadyz(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name               string
+		checks             []health.Check
+		verbose            bool
+		expectedStatusCode int
+		expectedResponse   string
+	}{
+		{
+			name:               "passing checks should be ready",
+			checks:             []health.Check{{Name: "mongo", Critical: true, Run: ok}},
+			expectedStatusCode: http.StatusOK,
+			expectedResponse:   "{\"status\":\"ok\"}\n",
+		},
+		{
+			name:               "failing critical checks should be unavailable",
+			checks:             []health.Check{{Name: "mongo", Critical: true, Run: failing}, {Name: "outbox", Run: ok}},
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedResponse:   "{\"status\":\"unavailable\"}\n",
+		},
+		{
+			name:               "failing non critical checks should be degraded",
+			checks:             []health.Check{{Name: "mongo", Critical: true, Run: ok}, {Name: "outbox", Run: failing}},
+			expectedStatusCode: http.StatusOK,
+			expectedResponse:   "{\"status\":\"degraded\"}\n",
+		},
+		{
+			name:               "verbose probes should list the checks",
+			checks:             []health.Check{{Name: "mongo", Critical: true, Run: failing}},
+			verbose:            true,
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedResponse:   "{\"status\":\"unavailable\",\"checks\":[{\"name\":\"mongo\",\"status\":\"failing\",\"critical\":true,\"error\":\"connection refused\",\"checked_at\":\"2020-10-10T10:00:00Z\",\"duration_ms\":0}]}\n",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			registry := health.Registry{Now: func() time.Time { return time.Date(2020, 10, 10, 10, 0, 0, 0, time.UTC) }}
+			for _, c := range tt.checks {
+				registry.Register(c)
+			}
+			path := "/readyz"
+			if tt.verbose {
+				path += "?verbose=1"
+			}
+			r, _ := http.NewRequest(http.MethodGet, path, nil)
+			w := httptest.NewRecorder()
+
+			registry.Readyz(w, r)
+
+			if w.Code != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d", w.Code, tt.expectedStatusCode)
+			}
+			if w.Body.String() != tt.expectedResponse {
+				t.Fatalf("wrong response: got %s want %s", w.Body.String(), tt.expectedResponse)
+			}
+		})
+	}
+}
+
+func TestHealth(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name               string
+		checks             []health.Check
+		expectedStatusCode int
+		expectedResponse   string
+	}{
+		{
+			name:               "a passing database should be healthy",
+			checks:             []health.Check{{Name: "mongo", Critical: true, Run: ok}, {Name: "outbox", Run: failing}},
+			expectedStatusCode: http.StatusOK,
+			expectedResponse:   "{\"database_status\":\"OK\"}\n",
+		},
+		{
+			name:               "a failing database should be unhealthy",
+			checks:             []health.Check{{Name: "mongo", Critical: true, Run: failing}},
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedResponse:   "{\"database_status\":\"UNHEALTHY\"}\n",
+		},
+		{
+			name:               "services without a database should be healthy",
+			expectedStatusCode: http.StatusOK,
+			expectedResponse:   "{\"database_status\":\"OK\"}\n",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			registry := health.Registry{}
+			for _, c := range tt.checks {
+				registry.Register(c)
+			}
+			r, _ := http.NewRequest(http.MethodGet, "/health", nil)
+			w := httptest.NewRecorder()
+
+			registry.Health("mongo")(w, r)
+
+			if w.Code != tt.expectedStatusCode {
+				t.Fatalf("wrong status code: got %d want %d", w.Code, tt.expectedStatusCode)
+			}
+			if w.Body.String() != tt.expectedResponse {
+				t.Fatalf("wrong response: got %s want %s", w.Body.String(), tt.expectedResponse)
+			}
+		})
+	}
+}
+
+func TestLivezDoesntCheckDependencies(t *testing.T) {
+	t.Parallel()
+	registry := health.Registry{}
+	registry.Register(health.Check{Name: "mongo", Critical: true, Run: failing})
+	r, _ := http.NewRequest(http.MethodGet, "/livez", nil)
+	w := httptest.NewRecorder()
+
+	registry.Livez(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %d want 200", w.Code)
+	}
+}
+
+func TestReadyzFailsWhileShuttingDown(t *testing.T) {
+	t.Parallel()
+	registry := health.Registry{}
+	registry.Register(health.Check{Name: "mongo", Critical: true, Run: ok})
+	registry.ShutDown()
+	r, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+	w := httptest.NewRecorder()
+
+	registry.Readyz(w, r)
+
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "{\"status\":\"shutting_down\"}\n" {
+		t.Fatalf("wrong response: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestResultsAreCached(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	runs := 0
+	registry := health.Registry{Now: func() time.Time { return now }}
+	registry.Register(health.Check{Name: "mongo", TTL: time.Second, Run: func(ctx context.Context) error {
+		runs++
+		return nil
+	}})
+
+	registry.Run(context.Background())
+	now = now.Add(500 * time.Millisecond)
+	registry.Run(context.Background())
+	if runs != 1 {
+		t.Fatalf("fresh results should be reused: got %d runs", runs)
+	}
+	now = now.Add(time.Second)
+	registry.Run(context.Background())
+	if runs != 2 {
+		t.Fatalf("stale results should be refreshed: got %d runs", runs)
+	}
+}
+
+func TestChecksTimeOut(t *testing.T) {
+	t.Parallel()
+	registry := health.Registry{}
+	registry.Register(health.Check{Name: "mongo", Timeout: 10 * time.Millisecond, Run: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}})
+
+	results := registry.Run(context.Background())
+
+	if results[0].Status != health.StatusFailing || !strings.Contains(results[0].Error, "deadline exceeded") {
+		t.Fatalf("slow checks should fail: got %+v", results[0])
+	}
+}
+
+func TestChecksOutliveCancelledProbes(t *testing.T) {
+	t.Parallel()
+	registry := health.Registry{}
+	registry.Register(health.Check{Name: "mongo", TTL: time.Minute, Run: func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(20 * time.Millisecond):
+			return nil
+		}
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	registry.Run(ctx)
+	results := registry.Run(context.Background())
+
+	if results[0].Status != health.StatusOK {
+		t.Fatalf("a probe giving up shouldn't fail the check: got %+v", results[0])
+	}
+}
+
+type mockOutbox struct {
+	oldest *time.Time
+	err    error
+}
+
+func (m mockOutbox) OldestPending(ctx context.Context) (*time.Time, error) {
+	return m.oldest, m.err
+}
+
+func TestOutboxLag(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	recent, old := now.Add(-time.Second), now.Add(-time.Hour)
+
+	for _, tt := range []struct {
+		name        string
+		outbox      mockOutbox
+		expectError bool
+	}{
+		{name: "an empty outbox should pass", outbox: mockOutbox{}},
+		{name: "recent events should pass", outbox: mockOutbox{oldest: &recent}},
+		{name: "old events should fail", outbox: mockOutbox{oldest: &old}, expectError: true},
+		{name: "storage errors should fail", outbox: mockOutbox{err: errors.New("database unavailable")}, expectError: true},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := health.OutboxLag(tt.outbox, time.Minute, func() time.Time { return now })(context.Background())
+			if (err != nil) != tt.expectError {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestDiskSpace(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "events.jsonl")
+
+	if err := health.DiskSpace(file, 1)(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := health.DiskSpace(file, math.MaxUint64)(context.Background()); err == nil {
+		t.Fatalf("full disks should fail")
+	}
+}
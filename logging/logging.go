@@ -0,0 +1,163 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader carries the request id, it is read from requests and echoed in responses
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the request ids accepted from clients, longer ones are replaced
+const maxRequestIDLength = 128
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	entryKey
+)
+
+// WithRequestID returns a copy of ctx carrying the request id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request id stored in ctx, empty outside of a request
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithEntry returns a copy of ctx carrying the log entry of the request
+func WithEntry(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, entryKey, entry)
+}
+
+// FromContext returns the log entry of the request stored in ctx, already holding its id, method and route.
+// Outside of a request it returns an entry of fallback, or of the standard logger when fallback is nil.
+func FromContext(ctx context.Context, fallback *logrus.Logger) *logrus.Entry {
+	if entry, ok := ctx.Value(entryKey).(*logrus.Entry); ok {
+		return entry
+	}
+	if fallback == nil {
+		fallback = logrus.StandardLogger()
+	}
+	return logrus.NewEntry(fallback)
+}
+
+// Middleware gives every request an id and a log entry, and logs one access line per request
+type Middleware struct {
+	Logger *logrus.Logger
+	// Routes is the router serving the requests, used to log the route template instead of the raw path
+	Routes *mux.Router
+	// Now defaults to time.Now
+	Now func() time.Time
+}
+
+// Handler wraps next, it must wrap the whole router so unknown routes are logged too.
+// The request id is taken from the X-Request-ID header when valid, or generated otherwise.
+func (m Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := m.now()
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		entry := logrus.NewEntry(m.logger()).WithFields(logrus.Fields{
+			"requestID": id,
+			"method":    r.Method,
+			"route":     RouteTemplate(m.Routes, r),
+		})
+		ctx := WithEntry(WithRequestID(r.Context(), id), entry)
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		access := entry.WithFields(logrus.Fields{
+			"status_code": rec.status,
+			"bytes":       rec.bytes,
+			"latency_ms":  float64(m.now().Sub(start).Microseconds()) / 1000,
+			"remote_addr": r.RemoteAddr,
+		})
+		if rec.status >= http.StatusInternalServerError {
+			access.Warn("request")
+			return
+		}
+		access.Info("request")
+	})
+}
+
+func (m Middleware) logger() *logrus.Logger {
+	if m.Logger == nil {
+		return logrus.StandardLogger()
+	}
+	return m.Logger
+}
+
+func (m Middleware) now() time.Time {
+	if m.Now == nil {
+		return time.Now()
+	}
+	return m.Now()
+}
+
+// RouteTemplate returns the template of the route matching the request, e.g. /users/{userid}, so
+// requests to the same route share it. Requests matching no route get "unmatched".
+func RouteTemplate(router *mux.Router, r *http.Request) string {
+	if router == nil {
+		return r.URL.Path
+	}
+	var match mux.RouteMatch
+	if !router.Match(r, &match) || match.Route == nil {
+		return "unmatched"
+	}
+	template, err := match.Route.GetPathTemplate()
+	if err != nil {
+		return "unmatched"
+	}
+	return template
+}
+
+// validRequestID accepts short ids of letters, digits and -_.: so they can't forge log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// recorder captures the status and the size of a response
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status, rec.wroteHeader = status, true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
@@ -0,0 +1,113 @@
+package logging_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jpaldi/go-user-api/logging"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name               string
+		path               string
+		requestID          string
+		expectedRequestID  string
+		expectedRoute      string
+		expectedStatusCode int
+	}{
+		{
+			name:               "request ids sent by clients should be kept",
+			path:               "/users/user-1",
+			requestID:          "request-1",
+			expectedRequestID:  "request-1",
+			expectedRoute:      "/users/{userid}",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "requests without an id should get one",
+			path:               "/users/user-1",
+			expectedRoute:      "/users/{userid}",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "invalid request ids should be replaced",
+			path:               "/users/user-1",
+			requestID:          "request-1\nlevel=error",
+			expectedRoute:      "/users/{userid}",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "unknown routes should be logged without their path",
+			path:               "/unknown/user-1",
+			requestID:          "request-1",
+			expectedRequestID:  "request-1",
+			expectedRoute:      "unmatched",
+			expectedStatusCode: http.StatusNotFound,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			logger, hook := test.NewNullLogger()
+			var handlerRequestID string
+			router := mux.NewRouter()
+			router.HandleFunc("/users/{userid}", func(w http.ResponseWriter, r *http.Request) {
+				handlerRequestID = logging.RequestID(r.Context())
+				logging.FromContext(r.Context(), nil).Info("handled")
+				w.Write([]byte("hello"))
+			})
+			r, _ := http.NewRequest(http.MethodGet, tt.path, nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			if tt.requestID != "" {
+				r.Header.Set(logging.RequestIDHeader, tt.requestID)
+			}
+			w := httptest.NewRecorder()
+
+			logging.Middleware{Logger: logger, Routes: router}.Handler(router).ServeHTTP(w, r)
+
+			requestID := w.Header().Get(logging.RequestIDHeader)
+			if requestID == "" || (tt.expectedRequestID != "" && requestID != tt.expectedRequestID) || strings.Contains(requestID, "\n") {
+				t.Fatalf("wrong request id: got %q want %q", requestID, tt.expectedRequestID)
+			}
+			if w.Code == http.StatusOK && handlerRequestID != requestID {
+				t.Fatalf("the handler should see the request id: got %q want %q", handlerRequestID, requestID)
+			}
+
+			access := hook.LastEntry()
+			if access == nil || access.Message != "request" {
+				t.Fatalf("an access line should be logged: got %+v", access)
+			}
+			if access.Data["requestID"] != requestID || access.Data["route"] != tt.expectedRoute || access.Data["method"] != http.MethodGet ||
+				access.Data["status_code"] != tt.expectedStatusCode || access.Data["remote_addr"] != "192.0.2.1:1234" {
+				t.Fatalf("wrong access line: got %v", access.Data)
+			}
+			if access.Data["bytes"] != w.Body.Len() {
+				t.Fatalf("wrong size: got %v want %d", access.Data["bytes"], w.Body.Len())
+			}
+			if _, ok := access.Data["latency_ms"]; !ok {
+				t.Fatalf("the latency should be logged: got %v", access.Data)
+			}
+			if w.Code == http.StatusOK && hook.AllEntries()[0].Data["requestID"] != requestID {
+				t.Fatalf("handlers should log with the request entry: got %v", hook.AllEntries()[0].Data)
+			}
+		})
+	}
+}
+
+func TestFromContextFallback(t *testing.T) {
+	t.Parallel()
+	logger := logrus.New()
+	if entry := logging.FromContext(context.Background(), logger); entry.Logger != logger {
+		t.Fatalf("the fallback logger should be used outside of requests")
+	}
+	if id := logging.RequestID(context.Background()); id != "" {
+		t.Fatalf("there is no request id outside of requests: got %q", id)
+	}
+}
@@ -2,88 +2,628 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/jpaldi/go-user-api/auth"
+	"github.com/jpaldi/go-user-api/certs"
+	"github.com/jpaldi/go-user-api/config"
+	"github.com/jpaldi/go-user-api/events"
 	"github.com/jpaldi/go-user-api/handlers"
+	"github.com/jpaldi/go-user-api/health"
+	"github.com/jpaldi/go-user-api/logging"
+	"github.com/jpaldi/go-user-api/memory"
+	"github.com/jpaldi/go-user-api/metrics"
 	"github.com/jpaldi/go-user-api/mongo"
 	adapter "github.com/jpaldi/go-user-api/mongo/adapter"
+	"github.com/jpaldi/go-user-api/password"
+	"github.com/jpaldi/go-user-api/policy"
+	"github.com/jpaldi/go-user-api/shutdown"
+	"github.com/jpaldi/go-user-api/tracing"
+	"github.com/jpaldi/go-user-api/validation"
+	"github.com/jpaldi/go-user-api/webhooks"
+	"github.com/jpaldi/go-user-api/worker"
 	"github.com/sirupsen/logrus"
 )
 
-var (
-	servicePort         = fmt.Sprintf(":%s", os.Getenv("SERVICE_PORT"))
-	mongoURI            = os.Getenv("MONGO_URI")
-	mongoDatabaseName   = os.Getenv("MONGO_DATABASE_NAME")
-	mongoCollectionName = os.Getenv("MONGO_COLLECTION_NAME")
-)
+// usersStorage is implemented by every storage backend
+type usersStorage interface {
+	handlers.UsersDatabase
+	handlers.Authenticator
+	worker.UsersPurger
+	worker.UsersCounter
+}
 
-type health struct {
+// storage groups everything the selected backend provides
+type storage struct {
+	users         usersStorage
+	refreshTokens handlers.RefreshTokenStore
+	audit         handlers.AuditLog
+	// outbox is nil when events and webhooks are disabled
+	outbox events.Outbox
+	// webhooks is nil when webhooks are disabled
+	webhooks webhooks.Store
+	// db is nil when the service doesn't depend on an external database
 	db *adapter.ClientAdapter
 }
 
+// workers are goroutines running in the background until they are stopped
+type workers struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newWorkers() *workers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workers{ctx: ctx, cancel: cancel}
+}
+
+func (w *workers) start(run func(ctx context.Context)) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		run(w.ctx)
+	}()
+}
+
+// stop cancels the context of the workers and waits for them to return, or for ctx to be done
+func (w *workers) stop(ctx context.Context) error {
+	w.cancel()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func main() {
+	cfg := mustLoadConfig()
 	ctx := context.Background()
+	log := mustBuildLogger(cfg)
 	router := mux.NewRouter()
-	database := mustBuildMongoAdapter(ctx)
-	mongoDB := mongo.Mongo{
-		Client: database.Collection(mongoDatabaseName, mongoCollectionName),
+	registry := metrics.NewRegistry()
+	store := mustBuildStorage(ctx, cfg, metrics.NewMongo(registry))
+
+	mustBuildRoutes(router, cfg, store, log)
+	router.Handle("/metrics", registry).Methods(http.MethodGet)
+	checks := buildHealthChecks(cfg, store)
+	router.HandleFunc("/livez", checks.Livez).Methods(http.MethodGet)
+	router.HandleFunc("/readyz", checks.Readyz).Methods(http.MethodGet)
+	router.HandleFunc("/health", checks.Health("mongo")).Methods(http.MethodGet)
+	background := newWorkers()
+	startPurger(background, cfg.Purge, store, log)
+	startRelay(background, cfg.Events, store, log)
+	startDispatcher(background, cfg.Webhooks, store, log)
+	startUsersGauge(background, cfg.Metrics, store, registry, log)
+
+	// the exporters stop last, to export the spans of the requests and workers stopping before them
+	exporters := newWorkers()
+	var handler http.Handler = router
+	if tracer := mustBuildTracer(exporters, cfg.Tracing, log); tracer != nil {
+		handler = tracing.Middleware{Tracer: tracer, Routes: router}.Handler(handler)
 	}
+	handler = metrics.NewHTTP(registry, router).Handler(handler)
+	handler = logging.Middleware{Logger: log, Routes: router}.Handler(handler)
 
-	healthChecker := health{
-		db: database,
+	server := buildServer(cfg, handler)
+	if cfg.TLS.CertFile != "" {
+		server.TLSConfig = mustBuildTLS(background, cfg.TLS, log)
 	}
+	serverErrors := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			serverErrors <- server.ListenAndServeTLS("", "")
+			return
+		}
+		serverErrors <- server.ListenAndServe()
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serverErrors:
+		panic(err)
+	case sig := <-signals:
+		log.WithField("signal", sig.String()).Info("shutting down")
+	}
+	buildShutdown(cfg.HTTP, server, checks, background, exporters, store, log).Run()
+}
 
-	mustBuildRoutes(router, mongoDB, healthChecker)
+// buildServer listens on SERVICE_PORT. HTTP_READ_TIMEOUT, HTTP_READ_HEADER_TIMEOUT, HTTP_WRITE_TIMEOUT and
+// HTTP_IDLE_TIMEOUT bound how long slow clients hold connections, HTTP_MAX_HEADER_BYTES the size of request headers.
+func buildServer(cfg config.Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.ServicePort),
+		Handler:           handler,
+		ReadTimeout:       cfg.HTTP.ReadTimeout,
+		ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+		WriteTimeout:      cfg.HTTP.WriteTimeout,
+		IdleTimeout:       cfg.HTTP.IdleTimeout,
+		MaxHeaderBytes:    cfg.HTTP.MaxHeaderBytes,
+	}
+}
 
-	err := http.ListenAndServe(servicePort, router)
+// mustBuildTLS serves HTTPS with the certificate and key of TLS_CERT_FILE and TLS_KEY_FILE, reloaded when the files
+// change, checked every TLS_RELOAD_INTERVAL. With TLS_CLIENT_CA_FILE client certificates are verified against its CAs,
+// when clients send one with TLS_CLIENT_AUTH=optional or always with require.
+func mustBuildTLS(background *workers, cfg config.TLS, log *logrus.Logger) *tls.Config {
+	clientAuth, err := certs.ParseClientAuth(cfg.ClientAuth)
 	if err != nil {
 		panic(err)
 	}
+	reloader := &certs.Reloader{
+		CertFile:     cfg.CertFile,
+		KeyFile:      cfg.KeyFile,
+		ClientCAFile: cfg.ClientCAFile,
+		Interval:     cfg.ReloadInterval,
+		Logger:       log,
+	}
+	if _, err := reloader.Reload(); err != nil {
+		panic(err)
+	}
+	background.start(reloader.Run)
+	return reloader.TLSConfig(clientAuth)
 }
 
-func mustBuildRoutes(r *mux.Router, db mongo.Mongo, healthChecker health) {
-	log := logrus.New()
+// buildShutdown fails the readiness probe and keeps serving for SHUTDOWN_DELAY, then drains the requests in flight,
+// stops the workers in order and disconnects from mongo, all within SHUTDOWN_TIMEOUT
+func buildShutdown(cfg config.HTTP, server *http.Server, checks *health.Registry, background *workers, exporters *workers, store storage, log *logrus.Logger) shutdown.Sequence {
+	steps := []shutdown.Step{
+		{Name: "the background workers", Stop: background.stop},
+		{Name: "the exporters", Stop: exporters.stop},
+	}
+	if store.db != nil {
+		steps = append(steps, shutdown.Step{Name: "the mongo client", Stop: store.db.Disconnect})
+	}
+	return shutdown.Sequence{
+		Readiness: checks,
+		Server:    server,
+		Steps:     steps,
+		Delay:     cfg.ShutdownDelay,
+		Timeout:   cfg.ShutdownTimeout,
+		Logger:    log,
+	}
+}
+
+func mustBuildRoutes(r *mux.Router, cfg config.Config, store storage, log *logrus.Logger) {
+	tokens := mustBuildTokens(cfg.Auth)
 	usersHandler := handlers.Handler{
-		Database: db,
-		Logger:   log,
+		Database:       store.users,
+		Logger:         log,
+		Policy:         mustLoadPolicy(cfg.Auth),
+		Validation:     mustBuildValidation(cfg.Password),
+		RequireIfMatch: cfg.RequireIfMatch,
+		Audit:          store.audit,
+	}
+	authHandler := handlers.AuthHandler{
+		Users:         store.users,
+		RefreshTokens: store.refreshTokens,
+		Tokens:        tokens,
+		RefreshTTL:    cfg.Auth.RefreshTokenTTL,
+		Logger:        log,
+	}
+	authentication := handlers.Authentication{
+		Tokens:             tokens,
+		APIKeys:            mustParseAPIKeys(cfg.Auth),
+		ClientCertificates: mustParseClientCertificates(cfg.TLS),
+		Users:              store.users,
+		Logger:             log,
 	}
 
-	r.HandleFunc("/health", healthChecker.health).Methods(http.MethodGet)
+	r.NotFoundHandler = http.HandlerFunc(handlers.NotFound)
+	r.MethodNotAllowedHandler = http.HandlerFunc(handlers.MethodNotAllowed)
+	r.HandleFunc("/problems", handlers.GetProblemTypes).Methods(http.MethodGet)
+	r.HandleFunc("/problems/{code}", handlers.GetProblemType).Methods(http.MethodGet)
+	r.HandleFunc("/auth/login", authHandler.Login).Methods(http.MethodPost)
+	r.HandleFunc("/auth/refresh", authHandler.Refresh).Methods(http.MethodPost)
+	r.HandleFunc("/auth/logout", authHandler.Logout).Methods(http.MethodPost)
+	// signing up doesn't require authentication, every other users route does
 	r.HandleFunc("/users", usersHandler.CreateUser).Methods(http.MethodPost)
-	r.HandleFunc("/users", usersHandler.GetUsers).Methods(http.MethodGet).Queries()
-	r.HandleFunc("/users/{userid}", usersHandler.UpdateUser).Methods(http.MethodPut)
-	r.HandleFunc("/users/{userid}", usersHandler.RemoveUser).Methods(http.MethodDelete)
 
+	users := r.PathPrefix("/users").Subrouter()
+	users.Use(authentication.Middleware)
+	users.HandleFunc("", usersHandler.GetUsers).Methods(http.MethodGet).Queries()
+	users.HandleFunc("/{userid}", usersHandler.GetUser).Methods(http.MethodGet)
+	users.HandleFunc("/{userid}", usersHandler.UpdateUser).Methods(http.MethodPut)
+	users.HandleFunc("/{userid}", usersHandler.PatchUser).Methods(http.MethodPatch)
+	users.HandleFunc("/{userid}", usersHandler.RemoveUser).Methods(http.MethodDelete)
+	users.HandleFunc("/{userid}/restore", usersHandler.RestoreUser).Methods(http.MethodPost)
+	users.HandleFunc("/{userid}/audit", usersHandler.GetAudit).Methods(http.MethodGet)
+	users.HandleFunc("/{userid}/roles", usersHandler.GrantRole).Methods(http.MethodPost)
+	users.HandleFunc("/{userid}/roles/{role}", usersHandler.RevokeRole).Methods(http.MethodDelete)
+
+	if store.webhooks == nil {
+		return
+	}
+	webhooksHandler := handlers.WebhooksHandler{
+		Store:  store.webhooks,
+		Logger: log,
+		Policy: usersHandler.Policy,
+	}
+	hooks := r.PathPrefix("/webhooks").Subrouter()
+	hooks.Use(authentication.Middleware)
+	hooks.HandleFunc("", webhooksHandler.CreateWebhook).Methods(http.MethodPost)
+	hooks.HandleFunc("", webhooksHandler.GetWebhooks).Methods(http.MethodGet)
+	hooks.HandleFunc("/{webhookid}", webhooksHandler.GetWebhook).Methods(http.MethodGet)
+	hooks.HandleFunc("/{webhookid}", webhooksHandler.RemoveWebhook).Methods(http.MethodDelete)
+	hooks.HandleFunc("/{webhookid}/enable", webhooksHandler.EnableWebhook).Methods(http.MethodPost)
+	hooks.HandleFunc("/{webhookid}/deliveries", webhooksHandler.GetDeliveries).Methods(http.MethodGet)
+	hooks.HandleFunc("/{webhookid}/deliveries/{deliveryid}", webhooksHandler.GetDelivery).Methods(http.MethodGet)
+	hooks.HandleFunc("/{webhookid}/deliveries/{deliveryid}/redeliver", webhooksHandler.Redeliver).Methods(http.MethodPost)
+}
+
+// startPurger purges the users deleted for longer than SOFT_DELETE_RETENTION every PURGE_INTERVAL,
+// a PURGE_INTERVAL of 0 keeps deleted users until they are removed by other means
+func startPurger(background *workers, cfg config.Purge, store storage, log *logrus.Logger) {
+	if cfg.Interval <= 0 {
+		return
+	}
+	purger := worker.Purger{
+		Users:     store.users,
+		Retention: cfg.SoftDeleteRetention,
+		Interval:  cfg.Interval,
+		Logger:    log,
+	}
+	background.start(purger.Run)
+}
+
+// buildHealthChecks registers the checks of the readiness probe: a mongo ping (critical) within HEALTH_PING_TIMEOUT,
+// the age of the oldest pending event, at most HEALTH_OUTBOX_MAX_LAG, and the free space left for EVENTS_FILE, at least
+// HEALTH_MIN_FREE_BYTES
+func buildHealthChecks(cfg config.Config, store storage) *health.Registry {
+	checks := &health.Registry{}
+	if store.db != nil {
+		db := store.db
+		checks.Register(health.Check{
+			Name:     "mongo",
+			Critical: true,
+			Timeout:  cfg.Health.PingTimeout,
+			Run: func(ctx context.Context) error {
+				return db.Ping(ctx, nil)
+			},
+		})
+	}
+	if store.outbox != nil {
+		checks.Register(health.Check{
+			Name: "outbox",
+			Run:  health.OutboxLag(store.outbox, cfg.Health.OutboxMaxLag, time.Now),
+		})
+	}
+	if cfg.Events.Publisher == "file" {
+		checks.Register(health.Check{
+			Name: "events_file_disk",
+			Run:  health.DiskSpace(cfg.Events.File, cfg.Health.MinFreeBytes),
+		})
+	}
+	return checks
+}
+
+// startUsersGauge refreshes the users gauge every METRICS_USERS_INTERVAL, 0 disables it
+func startUsersGauge(background *workers, cfg config.Metrics, store storage, registry *metrics.Registry, log *logrus.Logger) {
+	if cfg.UsersInterval <= 0 {
+		return
+	}
+	gauge := worker.UsersGauge{
+		Users:    store.users,
+		Gauge:    registry.Gauge("users", "Users, deleted users excluded."),
+		Interval: cfg.UsersInterval,
+		Logger:   log,
+	}
+	background.start(gauge.Run)
+}
+
+// startRelay publishes the events of user changes with the publisher selected by EVENTS_PUBLISHER,
+// and schedules their deliveries to the webhooks when they are enabled
+func startRelay(background *workers, cfg config.Events, store storage, log *logrus.Logger) {
+	if store.outbox == nil {
+		return
+	}
+	publishers := events.Publishers{}
+	if cfg.Publisher != "" {
+		publishers = append(publishers, mustBuildPublisher(cfg))
+	}
+	if store.webhooks != nil {
+		publishers = append(publishers, webhooks.Fanout{Store: store.webhooks})
+	}
+	relay := events.Relay{
+		Outbox:    store.outbox,
+		Publisher: publishers,
+		Logger:    log,
+		Interval:  cfg.PollInterval,
+	}
+	background.start(relay.Run)
+}
+
+// startDispatcher sends the scheduled deliveries to the webhooks, retrying failures with backoff from WEBHOOKS_MIN_BACKOFF
+// to WEBHOOKS_MAX_BACKOFF up to WEBHOOKS_MAX_ATTEMPTS times, and disabling webhooks failing WEBHOOKS_DISABLE_AFTER times in a row
+func startDispatcher(background *workers, cfg config.Webhooks, store storage, log *logrus.Logger) {
+	if store.webhooks == nil {
+		return
+	}
+	dispatcher := webhooks.Dispatcher{
+		Store:        store.webhooks,
+		Logger:       log,
+		MinBackoff:   cfg.MinBackoff,
+		MaxBackoff:   cfg.MaxBackoff,
+		MaxAttempts:  cfg.MaxAttempts,
+		DisableAfter: cfg.DisableAfter,
+	}
+	background.start(dispatcher.Run)
+}
+
+// mustBuildTracer selects where the spans of requests and mongo operations are exported from TRACING_EXPORTER:
+// stdout, one OTLP JSON span per line, or otlp, an OpenTelemetry collector at TRACING_OTLP_ENDPOINT. Tracing is
+// disabled when it isn't set. TRACING_SAMPLE_RATIO is the share of new traces sampled.
+func mustBuildTracer(exporters *workers, cfg config.Tracing, log *logrus.Logger) *tracing.Tracer {
+	tracer := &tracing.Tracer{SampleRatio: cfg.SampleRatio}
+
+	switch cfg.Exporter {
+	case "":
+		return nil
+	case "stdout":
+		tracer.Exporter = tracing.NewWriter(os.Stdout)
+	case "otlp":
+		exporter := &tracing.OTLP{URL: cfg.OTLPEndpoint, Service: cfg.ServiceName, Logger: log}
+		exporters.start(exporter.Run)
+		tracer.Exporter = exporter
+	default:
+		panic(fmt.Sprintf("unknown TRACING_EXPORTER %q", cfg.Exporter))
+	}
+	return tracer
+}
+
+// mustBuildPublisher selects where events are published: stdout, file (EVENTS_FILE), webhook (EVENTS_WEBHOOK_URL),
+// nats (EVENTS_NATS_URL) or kafka-rest (EVENTS_KAFKA_REST_URL, a Kafka REST proxy)
+func mustBuildPublisher(cfg config.Events) events.Publisher {
+	switch cfg.Publisher {
+	case "stdout":
+		return events.NewWriterPublisher(os.Stdout)
+	case "file":
+		publisher, err := events.OpenFilePublisher(cfg.File)
+		if err != nil {
+			panic(err)
+		}
+		return publisher
+	case "webhook":
+		return events.WebhookPublisher{URL: cfg.WebhookURL}
+	case "nats":
+		publisher, err := events.NewNATSPublisher(cfg.NATSURL, cfg.NATSSubjectPrefix)
+		if err != nil {
+			panic(err)
+		}
+		return publisher
+	case "kafka-rest":
+		return events.KafkaRESTPublisher{URL: cfg.KafkaRESTURL, Topic: cfg.KafkaTopic}
+	default:
+		panic(fmt.Sprintf("unknown EVENTS_PUBLISHER %q", cfg.Publisher))
+	}
 }
 
-func mustBuildMongoAdapter(ctx context.Context) *adapter.ClientAdapter {
-	cl, err := adapter.NewClient(mongoURI)
+// mustBuildStorage selects the storage backend from STORAGE_BACKEND, defaulting to mongo.
+// The operations on mongo collections are reported to the observer.
+func mustBuildStorage(ctx context.Context, cfg config.Config, observer mongo.Observer) storage {
+	hasher := mustBuildPasswordHasher(cfg.PasswordHasher)
+	withOutbox := cfg.Events.Publisher != "" || cfg.Webhooks.Enabled
+	names := cfg.Mongo
+
+	switch cfg.StorageBackend {
+	case "memory":
+		users := memory.New(hasher)
+		store := storage{
+			users:         users,
+			refreshTokens: memory.NewRefreshTokens(),
+			audit:         memory.NewAuditLog(),
+		}
+		if withOutbox {
+			users.Outbox = memory.NewOutbox()
+			store.outbox = users.Outbox
+		}
+		if cfg.Webhooks.Enabled {
+			store.webhooks = memory.NewWebhooks()
+		}
+		return store
+	case "mongo":
+		database := mustBuildMongoAdapter(ctx, cfg.Mongo.URI)
+		collection := func(name string) mongo.Collection {
+			return mongo.Instrumented{Collection: database.Collection(names.DatabaseName, name), Name: name, Observer: observer}
+		}
+		users := collection(names.CollectionName)
+		if err := database.CreateIndexes(ctx, names.DatabaseName, names.CollectionName, mongo.UserIndexes()); err != nil {
+			panic(err)
+		}
+		if err := database.CreateIndexes(ctx, names.DatabaseName, names.AuditCollection, mongo.AuditIndexes()); err != nil {
+			panic(err)
+		}
+		mustMigrate(ctx, collection(names.MigrationsCollection), mongo.UserMigrations(users))
+
+		db := mongo.Mongo{
+			Client: users,
+			Hasher: hasher,
+		}
+		var outbox events.Outbox
+		if withOutbox {
+			if err := database.CreateIndexes(ctx, names.DatabaseName, names.OutboxCollection, mongo.OutboxIndexes()); err != nil {
+				panic(err)
+			}
+			db.Outbox = collection(names.OutboxCollection)
+			outbox = mongo.Outbox{Client: db.Outbox}
+			db.Transactions = database
+		}
+		var hooks webhooks.Store
+		if cfg.Webhooks.Enabled {
+			if err := database.CreateIndexes(ctx, names.DatabaseName, names.WebhookDeliveryCollection, mongo.WebhookDeliveriesIndexes()); err != nil {
+				panic(err)
+			}
+			hooks = mongo.Webhooks{
+				Client:     collection(names.WebhooksCollection),
+				Deliveries: collection(names.WebhookDeliveryCollection),
+			}
+		}
+
+		return storage{
+			users:    db,
+			outbox:   outbox,
+			webhooks: hooks,
+			refreshTokens: mongo.RefreshTokens{
+				Client: collection(names.RefreshTokensCollection),
+			},
+			audit: mongo.AuditLog{
+				Client: collection(names.AuditCollection),
+			},
+			db: database,
+		}
+	default:
+		panic(fmt.Sprintf("unknown STORAGE_BACKEND %q", cfg.StorageBackend))
+	}
+}
+
+// mustMigrate runs the migrations not applied yet, the service doesn't start until they succeed
+func mustMigrate(ctx context.Context, log mongo.Collection, migrations []mongo.Migration) {
+	applied, err := mongo.Migrate(ctx, log, migrations)
+	for _, id := range applied {
+		logrus.WithField("migration", id).Info("applied migration")
+	}
 	if err != nil {
 		panic(err)
 	}
-	return cl
 }
 
-func (h health) health(w http.ResponseWriter, r *http.Request) {
-	var databaseStatus = "OK"
-	err := h.db.Ping(context.TODO(), nil)
+// mustLoadConfig loads the config from the flags, the environment and CONFIG_FILE, see config.Load. Every problem
+// found is reported before exiting, and -print-config prints the effective config, secrets masked, and exits.
+func mustLoadConfig() config.Config {
+	cfg, err := config.Load(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if cfg.PrintConfig {
+		if err := cfg.Write(os.Stdout); err != nil {
+			panic(err)
+		}
+		os.Exit(0)
+	}
+	return cfg
+}
+
+// mustBuildLogger configures the logger from LOG_LEVEL (a logrus level, info by default) and LOG_FORMAT (text or json).
+// Requests log with an entry carrying their id, see logging.Middleware, and mongo operations are logged at debug level.
+func mustBuildLogger(cfg config.Config) *logrus.Logger {
+	log := logrus.New()
+	level, err := logrus.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		panic(fmt.Sprintf("invalid LOG_LEVEL: %s", err))
+	}
+	log.SetLevel(level)
+	switch cfg.LogFormat {
+	case "text":
+	case "json":
+		log.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		panic(fmt.Sprintf("unknown LOG_FORMAT %q", cfg.LogFormat))
+	}
+	// the mongo adapter logs operations outside of requests with the standard logger
+	logrus.SetLevel(level)
+	logrus.SetFormatter(log.Formatter)
+	return log
+}
+
+// mustBuildPasswordHasher selects the password hashing algorithm from PASSWORD_HASHER, defaulting to argon2id.
+// Existing hashes from the other algorithm keep working and are replaced on the next successful verification.
+func mustBuildPasswordHasher(algorithm string) mongo.PasswordHasher {
+	switch algorithm {
+	case "argon2id":
+		return password.DefaultArgon2id
+	case "bcrypt":
+		return password.DefaultBcrypt
+	default:
+		panic(fmt.Sprintf("unknown PASSWORD_HASHER %q", algorithm))
+	}
+}
+
+// mustBuildTokens configures how access tokens are signed, JWT_SIGNING_METHOD is one of HS256 (default), RS256 or EdDSA
+func mustBuildTokens(cfg config.Auth) auth.Tokens {
+	method, err := auth.NewSigningMethod(cfg.JWTSigningMethod, cfg.JWTSecret, cfg.JWTPrivateKeyFile)
 	if err != nil {
-		databaseStatus = "UNHEALTHY"
+		panic(err)
 	}
+	return auth.Tokens{
+		Method:   method,
+		Issuer:   cfg.JWTIssuer,
+		Audience: cfg.JWTAudience,
+		TTL:      cfg.JWTTTL,
+	}
+}
 
-	type HealthStatusResponse struct {
-		Database string `json:"database_status"`
+// mustParseAPIKeys parses API_KEYS, a comma separated list of key=subject[:role|role...] entries
+func mustParseAPIKeys(cfg config.Auth) auth.APIKeys {
+	keys, err := auth.ParseAPIKeys(cfg.APIKeys)
+	if err != nil {
+		panic(fmt.Sprintf("invalid API_KEYS: %s", err))
 	}
+	return keys
+}
 
-	response := HealthStatusResponse{
-		Database: databaseStatus,
+// mustParseClientCertificates parses TLS_CLIENT_IDENTITIES, a comma separated list of common-name=subject[:role|role...]
+// entries mapping verified client certificates to identities
+func mustParseClientCertificates(cfg config.TLS) auth.ClientCertificates {
+	certificates, err := auth.ParseClientCertificates(cfg.ClientIdentities)
+	if err != nil {
+		panic(fmt.Sprintf("invalid TLS_CLIENT_IDENTITIES: %s", err))
 	}
+	return certificates
+}
 
-	w.Header().Set("Content-type", "application/json")
-	w.WriteHeader(200)
-	json.NewEncoder(w).Encode(response)
+// mustLoadPolicy loads the access control policy from POLICY_FILE, defaulting to policy.Default
+func mustLoadPolicy(cfg config.Auth) *policy.Policy {
+	if cfg.PolicyFile == "" {
+		return &policy.Default
+	}
+	p, err := policy.Load(cfg.PolicyFile)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// mustBuildValidation builds the user validation rules with the password policy from the PASSWORD_* variables
+// and the breached passwords listed in BREACHED_PASSWORDS_FILE, one per line
+func mustBuildValidation(cfg config.Password) validation.Schema {
+	passwords := validation.PasswordPolicy{
+		MinLength:  cfg.MinLength,
+		MaxLength:  cfg.MaxLength,
+		MinClasses: cfg.MinClasses,
+		MinEntropy: cfg.MinEntropy,
+	}
+	if cfg.BreachedPasswordsFile != "" {
+		var err error
+		if passwords.Breached, err = validation.LoadBreachedPasswords(cfg.BreachedPasswordsFile); err != nil {
+			panic(err)
+		}
+	}
+	return validation.UserSchema(passwords)
+}
+
+func mustBuildMongoAdapter(ctx context.Context, uri string) *adapter.ClientAdapter {
+	cl, err := adapter.NewClient(uri)
+	if err != nil {
+		panic(err)
+	}
+	return cl
 }
@@ -0,0 +1,50 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/jpaldi/go-user-api/mongo"
+)
+
+// AuditLog is an in-memory, append-only audit log, safe for concurrent use
+type AuditLog struct {
+	mu      sync.RWMutex
+	records []mongo.AuditRecord
+}
+
+// NewAuditLog returns an empty in-memory audit log
+func NewAuditLog() *AuditLog {
+	return &AuditLog{}
+}
+
+// Record appends a record to the audit log
+func (a *AuditLog) Record(ctx context.Context, record mongo.AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.records = append(a.records, record)
+	return nil
+}
+
+// List returns a page of the audit records of a user, newest first
+func (a *AuditLog) List(ctx context.Context, userID string, opts mongo.AuditListOptions) (*mongo.AuditPage, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	records := []mongo.AuditRecord{}
+	for _, r := range a.records {
+		if r.UserID == userID && opts.Includes(r) {
+			records = append(records, r)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return mongo.LessRecords(records[i], records[j])
+	})
+	if len(records) > opts.Limit+1 {
+		records = records[:opts.Limit+1]
+	}
+
+	return mongo.PageRecords(opts, records), nil
+}
@@ -0,0 +1,51 @@
+package memory_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jpaldi/go-user-api/memory"
+	"github.com/jpaldi/go-user-api/mongo"
+)
+
+func TestAuditLogPagination(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	audit := memory.NewAuditLog()
+	start := time.Date(2020, 10, 10, 10, 0, 0, 0, time.UTC)
+	for i, id := range []string{"a", "b", "c"} {
+		record := mongo.AuditRecord{ID: id, UserID: "user-1", Timestamp: start.Add(time.Duration(i) * time.Minute)}
+		if err := audit.Record(ctx, record); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := audit.Record(ctx, mongo.AuditRecord{ID: "d", UserID: "user-2", Timestamp: start}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ids := []string{}
+	params := url.Values{"limit": {"2"}}
+	for pages := 0; pages < 3; pages++ {
+		opts, err := mongo.ParseAuditListOptions(params)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		page, err := audit.List(ctx, "user-1", opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for _, r := range page.Records {
+			ids = append(ids, r.ID)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		params.Set("page_token", page.NextPageToken)
+	}
+
+	if len(ids) != 3 || ids[0] != "c" || ids[1] != "b" || ids[2] != "a" {
+		t.Fatalf("wrong records: got %v want [c b a]", ids)
+	}
+}
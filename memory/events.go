@@ -0,0 +1,95 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jpaldi/go-user-api/mongo"
+)
+
+// Outbox is an in-memory outbox, safe for concurrent use. The events of the changes made to a Memory
+// database wait there until they are published, published events are dropped.
+type Outbox struct {
+	mu     sync.Mutex
+	events []mongo.Event
+}
+
+// NewOutbox returns an empty in-memory outbox
+func NewOutbox() *Outbox {
+	return &Outbox{}
+}
+
+func (o *Outbox) add(event mongo.Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.events = append(o.events, event)
+}
+
+// Claim returns up to limit events due for delivery, oldest first, and defers their next delivery by lease
+func (o *Outbox) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]mongo.Event, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	claimed := []mongo.Event{}
+	for i := range o.events {
+		if len(claimed) == limit {
+			break
+		}
+		if o.events[i].NextAttemptAt.After(now) {
+			continue
+		}
+		o.events[i].NextAttemptAt = now.Add(lease)
+		claimed = append(claimed, o.events[i])
+	}
+	return claimed, nil
+}
+
+// MarkPublished drops a published event
+func (o *Outbox) MarkPublished(ctx context.Context, id string, at time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i, e := range o.events {
+		if e.ID == id {
+			o.events = append(o.events[:i], o.events[i+1:]...)
+			return nil
+		}
+	}
+	return mongo.ErrNotFound
+}
+
+// MarkFailed records a failed delivery of an event and when to try again
+func (o *Outbox) MarkFailed(ctx context.Context, id string, next time.Time, reason string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i, e := range o.events {
+		if e.ID == id {
+			o.events[i].Attempts++
+			o.events[i].NextAttemptAt = next
+			o.events[i].LastError = reason
+			return nil
+		}
+	}
+	return mongo.ErrNotFound
+}
+
+// OldestPending returns when the oldest event not published yet occurred, nil when every event is published
+func (o *Outbox) OldestPending(ctx context.Context) (*time.Time, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var oldest *time.Time
+	for i, e := range o.events {
+		if oldest == nil || e.OccurredAt.Before(*oldest) {
+			oldest = &o.events[i].OccurredAt
+		}
+	}
+	if oldest == nil {
+		return nil, nil
+	}
+	at := *oldest
+	return &at, nil
+}
@@ -0,0 +1,419 @@
+package memory
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/password"
+)
+
+// Memory is an in-memory users database, safe for concurrent use.
+// It mirrors the behaviour of mongo.Mongo so it can replace it in local runs and tests.
+type Memory struct {
+	mu     sync.RWMutex
+	users  map[string]mongo.User
+	hasher mongo.PasswordHasher
+	// order keeps the insertion order of the ids so listings are stable
+	order []string
+	// Outbox receives the event of every change when set, like mongo.Mongo.Outbox
+	Outbox *Outbox
+}
+
+// New returns an empty in-memory users database, hasher defaults to argon2id when nil
+func New(hasher mongo.PasswordHasher) *Memory {
+	if hasher == nil {
+		hasher = password.DefaultArgon2id
+	}
+	return &Memory{
+		users:  map[string]mongo.User{},
+		hasher: hasher,
+	}
+}
+
+// CreateUser creates a user and returns the object if is successfully inserted
+func (m *Memory) CreateUser(ctx context.Context, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error) {
+	hash, err := m.hasher.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+
+	now := mongo.Now()
+	user := mongo.User{
+		ID:        uuid.New().String(),
+		Nickname:  nickname,
+		FirstName: firstname,
+		LastName:  lastname,
+		Password:  hash,
+		Email:     mongo.NormalizeEmail(email),
+		Country:   country,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Version:   1,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.unique(user); err != nil {
+		return nil, err
+	}
+	m.users[user.ID] = user
+	m.order = append(m.order, user.ID)
+	m.emit(mongo.EventUserCreated, user)
+
+	return &user, nil
+}
+
+// UpdateUser replaces the fields of a user and returns the updated object, at the given version unless it is 0
+func (m *Memory) UpdateUser(ctx context.Context, guid string, version int64, nickname string, firstname string, lastname string, password string, email string, country string) (*mongo.User, error) {
+	hash, err := m.hasher.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.active(guid)
+	if !ok {
+		return nil, mongo.ErrNotFound
+	}
+	if version > 0 && user.Version != version {
+		return nil, mongo.ErrVersionMismatch
+	}
+
+	user.Nickname = nickname
+	user.FirstName = firstname
+	user.LastName = lastname
+	user.Password = hash
+	user.Email = mongo.NormalizeEmail(email)
+	user.Country = country
+	if err := m.unique(user); err != nil {
+		return nil, err
+	}
+	touch(&user)
+	m.users[guid] = user
+	m.emit(mongo.EventUserUpdated, user)
+
+	return &user, nil
+}
+
+// PatchUser sets only the changed fields and returns the updated user, or ErrNotFound. Like UpdateUser, a version other than 0 must match.
+func (m *Memory) PatchUser(ctx context.Context, guid string, version int64, changes map[string]string) (*mongo.User, error) {
+	if plain, ok := changes["password"]; ok {
+		hash, err := m.hasher.Hash(plain)
+		if err != nil {
+			return nil, err
+		}
+		hashed := make(map[string]string, len(changes))
+		for k, v := range changes {
+			hashed[k] = v
+		}
+		hashed["password"] = hash
+		changes = hashed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.active(guid)
+	if !ok {
+		return nil, mongo.ErrNotFound
+	}
+	if version > 0 && user.Version != version {
+		return nil, mongo.ErrVersionMismatch
+	}
+	for field, value := range changes {
+		if err := user.SetField(field, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.unique(user); err != nil {
+		return nil, err
+	}
+	if len(changes) > 0 {
+		touch(&user)
+		m.emit(mongo.EventUserUpdated, user)
+	}
+	m.users[guid] = user
+
+	return &user, nil
+}
+
+// VerifyPassword checks the password of a user and returns the user when it matches.
+// Hashes produced with outdated algorithms or parameters are transparently replaced.
+func (m *Memory) VerifyPassword(ctx context.Context, guid string, plain string) (*mongo.User, error) {
+	m.mu.RLock()
+	user, ok := m.active(guid)
+	m.mu.RUnlock()
+	if !ok {
+		return nil, mongo.ErrNotFound
+	}
+
+	return m.verify(user, plain)
+}
+
+// Authenticate finds a user by nickname or email and returns it when the password matches
+func (m *Memory) Authenticate(ctx context.Context, login string, plain string) (*mongo.User, error) {
+	m.mu.RLock()
+	var (
+		user  mongo.User
+		found bool
+	)
+	field, value := "nickname", login
+	if mongo.IsEmailLogin(login) {
+		field, value = "email", mongo.NormalizeEmail(login)
+	}
+	for _, id := range m.order {
+		if u := m.users[id]; u.DeletedAt == nil && u.Field(field) == value {
+			user, found = u, true
+			break
+		}
+	}
+	m.mu.RUnlock()
+	if !found {
+		mongo.VerifyUnknownLogin(m.hasher, plain)
+		return nil, mongo.ErrNotFound
+	}
+
+	return m.verify(user, plain)
+}
+
+func (m *Memory) verify(user mongo.User, plain string) (*mongo.User, error) {
+	rehash, err := m.hasher.Verify(plain, user.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	if rehash {
+		hash, err := m.hasher.Hash(plain)
+		if err != nil {
+			return nil, err
+		}
+
+		m.mu.Lock()
+		// only replace the hash if the password didn't change in the meantime
+		if current, ok := m.users[user.ID]; ok && current.Password == user.Password {
+			current.Password = hash
+			m.users[user.ID] = current
+			user = current
+		}
+		m.mu.Unlock()
+	}
+
+	return &user, nil
+}
+
+// GetUser returns a single user by id, or mongo.ErrNotFound when it doesn't exist or was deleted
+func (m *Memory) GetUser(ctx context.Context, guid string) (*mongo.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.active(guid)
+	if !ok {
+		return nil, mongo.ErrNotFound
+	}
+	return &user, nil
+}
+
+// GetRoles returns the roles of a user
+func (m *Memory) GetRoles(ctx context.Context, guid string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.active(guid)
+	if !ok {
+		return nil, mongo.ErrNotFound
+	}
+	return user.Roles, nil
+}
+
+// GrantRole adds a role to a user and returns the updated user, granting a role twice is a no-op
+func (m *Memory) GrantRole(ctx context.Context, guid string, role string) (*mongo.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.active(guid)
+	if !ok {
+		return nil, mongo.ErrNotFound
+	}
+	for _, r := range user.Roles {
+		if r == role {
+			return &user, nil
+		}
+	}
+
+	// copy the roles so users handed out before are not modified
+	user.Roles = append(append([]string{}, user.Roles...), role)
+	touch(&user)
+	m.users[guid] = user
+	m.emit(mongo.EventUserUpdated, user)
+	return &user, nil
+}
+
+// RevokeRole removes a role from a user and returns the updated user
+func (m *Memory) RevokeRole(ctx context.Context, guid string, role string) (*mongo.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.active(guid)
+	if !ok {
+		return nil, mongo.ErrNotFound
+	}
+
+	roles := []string{}
+	for _, r := range user.Roles {
+		if r != role {
+			roles = append(roles, r)
+		}
+	}
+	if len(roles) == len(user.Roles) {
+		return &user, nil
+	}
+	user.Roles = roles
+	touch(&user)
+	m.users[guid] = user
+	m.emit(mongo.EventUserUpdated, user)
+	return &user, nil
+}
+
+// RemoveUser soft deletes a user, at the given version unless it is 0, and returns the number of deleted users
+func (m *Memory) RemoveUser(ctx context.Context, guid string, version int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.active(guid)
+	if !ok {
+		return 0, nil
+	}
+	if version > 0 && user.Version != version {
+		return 0, mongo.ErrVersionMismatch
+	}
+
+	now := mongo.Now()
+	user.DeletedAt = &now
+	touch(&user)
+	m.users[guid] = user
+	m.emit(mongo.EventUserDeleted, user)
+
+	return 1, nil
+}
+
+// RestoreUser undoes the soft delete of a user and returns it, restoring a user that isn't deleted is a no-op
+func (m *Memory) RestoreUser(ctx context.Context, guid string) (*mongo.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[guid]
+	if !ok {
+		return nil, mongo.ErrNotFound
+	}
+	if user.DeletedAt == nil {
+		return &user, nil
+	}
+
+	user.DeletedAt = nil
+	touch(&user)
+	m.users[guid] = user
+	m.emit(mongo.EventUserUpdated, user)
+	return &user, nil
+}
+
+// PurgeUsers permanently removes the users soft deleted before the given time and returns how many were removed
+func (m *Memory) PurgeUsers(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var purged int64
+	order := []string{}
+	for _, id := range m.order {
+		if u := m.users[id]; u.DeletedAt != nil && u.DeletedAt.Before(deletedBefore) {
+			delete(m.users, id)
+			purged++
+			continue
+		}
+		order = append(order, id)
+	}
+	m.order = order
+
+	return purged, nil
+}
+
+// CountUsers returns how many users exist, deleted users excluded
+func (m *Memory) CountUsers(ctx context.Context) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var count int64
+	for _, u := range m.users {
+		if u.DeletedAt == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// GetUsers returns a page of the users matching the filter, ordered the same way as mongo
+func (m *Memory) GetUsers(ctx context.Context, opts mongo.ListOptions) (*mongo.UserPage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	users := []*mongo.User{}
+	for _, id := range m.order {
+		u := m.users[id]
+		if opts.Visible(u) && matches(u, opts.Filter) && opts.WithinRanges(u) {
+			users = append(users, &u)
+		}
+	}
+
+	return mongo.Page(opts, users), nil
+}
+
+// active returns a user unless it doesn't exist or was deleted, it must be called with the lock held
+func (m *Memory) active(guid string) (mongo.User, bool) {
+	user, ok := m.users[guid]
+	return user, ok && user.DeletedAt == nil
+}
+
+// emit adds the event of a change to the outbox, it must be called with the lock held so events keep the order of the changes
+func (m *Memory) emit(eventType string, user mongo.User) {
+	if m.Outbox != nil {
+		m.Outbox.add(mongo.NewEvent(eventType, user))
+	}
+}
+
+// touch records a change like mongo.Mongo does, with the update time and the next version
+func touch(user *mongo.User) {
+	user.UpdatedAt = mongo.Now()
+	user.Version++
+}
+
+// unique enforces the same unique nickname and case-insensitive email as the mongo indexes,
+// deleted users keep theirs until they are purged. It must be called with the lock held.
+func (m *Memory) unique(user mongo.User) error {
+	for id, other := range m.users {
+		if id == user.ID {
+			continue
+		}
+		if other.Nickname == user.Nickname {
+			return mongo.ConflictError("nickname", nil)
+		}
+		if strings.EqualFold(other.Email, user.Email) {
+			return mongo.ConflictError("email", nil)
+		}
+	}
+	return nil
+}
+
+func matches(u mongo.User, filter map[string]string) bool {
+	for k, v := range filter {
+		if u.Field(k) != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,504 @@
+package memory_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jpaldi/go-user-api/memory"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/password"
+)
+
+// testHasher is cheap enough to keep the tests fast
+var testHasher = password.Bcrypt{Cost: 4}
+
+func seed(t *testing.T) *memory.Memory {
+	db := memory.New(testHasher)
+	for _, u := range []struct{ nickname, country string }{
+		{"alice", "PT"},
+		{"bob", "UK"},
+		{"carol", "PT"},
+	} {
+		if _, err := db.CreateUser(context.Background(), u.nickname, "first", "last", "secret", u.nickname+"@email.uk", u.country); err != nil {
+			t.Fatalf("couldn't seed user %s: %s", u.nickname, err)
+		}
+	}
+	return db
+}
+
+// list returns the first page of users listed with the given query parameters
+func list(t *testing.T, db *memory.Memory, params url.Values) []*mongo.User {
+	opts, err := mongo.ParseListOptions(params)
+	if err != nil {
+		t.Fatalf("couldn't parse list options: %s", err)
+	}
+	page, err := db.GetUsers(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return page.Users
+}
+
+func TestGetUsers(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name              string
+		params            url.Values
+		expectedNicknames []string
+	}{
+		{
+			name:              "it should sort users by nickname",
+			params:            url.Values{"sort": {"nickname"}},
+			expectedNicknames: []string{"alice", "bob", "carol"},
+		},
+		{
+			name:              "it should sort users in descending order",
+			params:            url.Values{"sort": {"-nickname"}},
+			expectedNicknames: []string{"carol", "bob", "alice"},
+		},
+		{
+			name:              "it should filter by the expected parameters",
+			params:            url.Values{"country": {"PT"}, "sort": {"nickname"}},
+			expectedNicknames: []string{"alice", "carol"},
+		},
+		{
+			name:              "it should ignore unexpected parameters",
+			params:            url.Values{"password": {"nope"}, "nickname": {"bob"}},
+			expectedNicknames: []string{"bob"},
+		},
+		{
+			name:              "it should return an empty list when nothing matches",
+			params:            url.Values{"country": {"FR"}},
+			expectedNicknames: []string{},
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			users := list(t, seed(t), tt.params)
+
+			if len(users) != len(tt.expectedNicknames) {
+				t.Fatalf("wrong number of users: got %d want %d", len(users), len(tt.expectedNicknames))
+			}
+			for i, u := range users {
+				if u.Nickname != tt.expectedNicknames[i] {
+					t.Fatalf("wrong Nickname at %d: got %s want %s", i, u.Nickname, tt.expectedNicknames[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGetUsersPagination(t *testing.T) {
+	t.Parallel()
+	db := seed(t)
+	db.CreateUser(context.Background(), "dave", "first", "last", "secret", "dave@email.uk", "UK")
+	db.CreateUser(context.Background(), "erin", "first", "last", "secret", "erin@email.uk", "UK")
+
+	for _, sort := range []string{"nickname", "-nickname", "created_at", "-created_at", "last_name"} {
+		params := url.Values{"sort": {sort}, "limit": {"2"}}
+		all := list(t, db, url.Values{"sort": {sort}})
+
+		seen := []*mongo.User{}
+		for pages := 0; ; pages++ {
+			if pages > 3 {
+				t.Fatalf("sort %s: too many pages", sort)
+			}
+			opts, err := mongo.ParseListOptions(params)
+			if err != nil {
+				t.Fatalf("sort %s: couldn't parse list options: %s", sort, err)
+			}
+			page, _ := db.GetUsers(context.Background(), opts)
+			seen = append(seen, page.Users...)
+			if page.NextPageToken == "" {
+				break
+			}
+			params.Set("page_token", page.NextPageToken)
+		}
+
+		if len(seen) != len(all) {
+			t.Fatalf("sort %s: wrong number of users: got %d want %d", sort, len(seen), len(all))
+		}
+		for i := range all {
+			if seen[i].ID != all[i].ID {
+				t.Fatalf("sort %s: wrong user at %d: got %s want %s", sort, i, seen[i].Nickname, all[i].Nickname)
+			}
+		}
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	t.Parallel()
+	db := seed(t)
+	users := list(t, db, url.Values{"nickname": {"bob"}})
+
+	updated, err := db.UpdateUser(context.Background(), users[0].ID, 0, "robert", "first", "last", "secret", "robert@email.uk", "UK")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if updated.Nickname != "robert" || updated.ID != users[0].ID {
+		t.Fatalf("wrong user: got %+v", updated)
+	}
+
+	if _, err := db.UpdateUser(context.Background(), "missing", 0, "", "", "", "", "", ""); err == nil {
+		t.Fatalf("expected an error updating a missing user")
+	}
+}
+
+func TestVersions(t *testing.T) {
+	t.Parallel()
+	db := seed(t)
+	bob := list(t, db, url.Values{"nickname": {"bob"}})[0]
+	if bob.Version != 1 || bob.CreatedAt.IsZero() || !bob.UpdatedAt.Equal(bob.CreatedAt) {
+		t.Fatalf("wrong new user: got %+v", bob)
+	}
+
+	for _, tt := range []struct {
+		name            string
+		change          func() (*mongo.User, error)
+		expectedVersion int64
+	}{
+		{name: "patching a field", change: func() (*mongo.User, error) {
+			return db.PatchUser(context.Background(), bob.ID, 0, map[string]string{"country": "PT"})
+		}, expectedVersion: 2},
+		{name: "an empty patch", change: func() (*mongo.User, error) {
+			return db.PatchUser(context.Background(), bob.ID, 0, map[string]string{})
+		}, expectedVersion: 2},
+		{name: "granting a role", change: func() (*mongo.User, error) {
+			return db.GrantRole(context.Background(), bob.ID, "support")
+		}, expectedVersion: 3},
+		{name: "granting the role again", change: func() (*mongo.User, error) {
+			return db.GrantRole(context.Background(), bob.ID, "support")
+		}, expectedVersion: 3},
+		{name: "revoking a role the user doesn't have", change: func() (*mongo.User, error) {
+			return db.RevokeRole(context.Background(), bob.ID, "admin")
+		}, expectedVersion: 3},
+		{name: "updating the user", change: func() (*mongo.User, error) {
+			return db.UpdateUser(context.Background(), bob.ID, 0, "bob", "first", "last", "secret", "bob@email.uk", "GB")
+		}, expectedVersion: 4},
+	} {
+		user, err := tt.change()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.name, err)
+		}
+		if user.Version != tt.expectedVersion || user.UpdatedAt.Before(bob.UpdatedAt) || !user.CreatedAt.Equal(bob.CreatedAt) {
+			t.Fatalf("%s: wrong user: got %+v want version %d", tt.name, user, tt.expectedVersion)
+		}
+	}
+}
+
+func TestVersionMismatch(t *testing.T) {
+	t.Parallel()
+	db := seed(t)
+	bob := list(t, db, url.Values{"nickname": {"bob"}})[0]
+
+	if _, err := db.UpdateUser(context.Background(), bob.ID, 2, "bob", "first", "last", "secret", "bob@email.uk", "GB"); !errors.Is(err, mongo.ErrVersionMismatch) {
+		t.Fatalf("wrong error updating a stale version: got %v want %v", err, mongo.ErrVersionMismatch)
+	}
+	if _, err := db.PatchUser(context.Background(), bob.ID, 2, map[string]string{"country": "PT"}); !errors.Is(err, mongo.ErrVersionMismatch) {
+		t.Fatalf("wrong error patching a stale version: got %v want %v", err, mongo.ErrVersionMismatch)
+	}
+	if _, err := db.RemoveUser(context.Background(), bob.ID, 2); !errors.Is(err, mongo.ErrVersionMismatch) {
+		t.Fatalf("wrong error removing a stale version: got %v want %v", err, mongo.ErrVersionMismatch)
+	}
+
+	updated, err := db.PatchUser(context.Background(), bob.ID, 1, map[string]string{"country": "PT"})
+	if err != nil || updated.Version != 2 {
+		t.Fatalf("wrong patch of the current version: got %+v, %v", updated, err)
+	}
+	if count, err := db.RemoveUser(context.Background(), bob.ID, 2); err != nil || count != 1 {
+		t.Fatalf("wrong removal of the current version: got %d, %v", count, err)
+	}
+}
+
+func TestGetUsersWithinRanges(t *testing.T) {
+	t.Parallel()
+	db := seed(t)
+	first := list(t, db, url.Values{})[0]
+	after := first.CreatedAt.Add(-time.Millisecond).Format(time.RFC3339Nano)
+
+	if users := list(t, db, url.Values{"created_after": {after}}); len(users) != 3 {
+		t.Fatalf("wrong number of users created after %s: got %d want 3", after, len(users))
+	}
+	if users := list(t, db, url.Values{"updated_before": {after}}); len(users) != 0 {
+		t.Fatalf("wrong number of users updated before %s: got %d want 0", after, len(users))
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	t.Parallel()
+	db := seed(t)
+	users := list(t, db, url.Values{"nickname": {"bob"}})
+
+	patched, err := db.PatchUser(context.Background(), users[0].ID, 0, map[string]string{"country": "PT", "password": "n3w"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if patched.Country != "PT" || patched.Nickname != "bob" {
+		t.Fatalf("wrong user: got %+v", patched)
+	}
+	if _, err := db.VerifyPassword(context.Background(), users[0].ID, "n3w"); err != nil {
+		t.Fatalf("the new password wasn't stored: %s", err)
+	}
+
+	if _, err := db.PatchUser(context.Background(), users[0].ID, 0, map[string]string{"roles": "admin"}); !errors.Is(err, mongo.ErrValidation) {
+		t.Fatalf("wrong error: got %v want %v", err, mongo.ErrValidation)
+	}
+	if _, err := db.PatchUser(context.Background(), "missing", 0, map[string]string{}); !errors.Is(err, mongo.ErrNotFound) {
+		t.Fatalf("wrong error: got %v want %v", err, mongo.ErrNotFound)
+	}
+}
+
+func TestEmailsIgnoreCase(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := seed(t)
+
+	dave, err := db.CreateUser(ctx, "dave", "first", "last", "secret", "Dave@Email.UK", "PT")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if dave.Email != "dave@email.uk" {
+		t.Fatalf("emails should be stored in lower case: got %s", dave.Email)
+	}
+	if users := list(t, db, url.Values{"email": {"DAVE@email.uk"}}); len(users) != 1 || users[0].ID != dave.ID {
+		t.Fatalf("emails should be filtered regardless of their case: got %+v", users)
+	}
+	if user, err := db.Authenticate(ctx, "dAvE@eMaIl.uk", "secret"); err != nil || user.ID != dave.ID {
+		t.Fatalf("emails should log in regardless of their case: got %+v, %v", user, err)
+	}
+	patched, err := db.PatchUser(ctx, dave.ID, 0, map[string]string{"email": "David@Email.UK"})
+	if err != nil || patched.Email != "david@email.uk" {
+		t.Fatalf("patched emails should be stored in lower case: got %+v, %v", patched, err)
+	}
+	updated, err := db.UpdateUser(ctx, dave.ID, 0, "dave", "first", "last", "secret", "DAVE@email.uk", "PT")
+	if err != nil || updated.Email != "dave@email.uk" {
+		t.Fatalf("updated emails should be stored in lower case: got %+v, %v", updated, err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := memory.New(testHasher)
+	// stored before nicknames were validated, its nickname is the email of another user
+	if _, err := db.CreateUser(ctx, "bob@email.uk", "first", "last", "other", "impostor@email.uk", "PT"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	bob, err := db.CreateUser(ctx, "bob", "first", "last", "secret", "bob@email.uk", "PT")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		login      string
+		expectedID string
+	}{
+		{name: "nicknames should log in", login: "bob", expectedID: bob.ID},
+		{name: "emails should never match nicknames", login: "bob@email.uk", expectedID: bob.ID},
+		{name: "emails in another case should log in", login: "BOB@email.uk", expectedID: bob.ID},
+	} {
+		user, err := db.Authenticate(ctx, tt.login, "secret")
+		if err != nil || user.ID != tt.expectedID {
+			t.Fatalf("%s: wrong user: got %+v, %v", tt.name, user, err)
+		}
+	}
+	if _, err := db.Authenticate(ctx, "nobody", "secret"); !errors.Is(err, mongo.ErrNotFound) {
+		t.Fatalf("wrong error: got %v want %v", err, mongo.ErrNotFound)
+	}
+}
+
+func TestUniqueFields(t *testing.T) {
+	t.Parallel()
+	db := seed(t)
+	bob := list(t, db, url.Values{"nickname": {"bob"}})[0]
+
+	for _, tt := range []struct {
+		name          string
+		call          func() error
+		expectedField string
+	}{
+		{
+			name: "creating a user with a taken nickname",
+			call: func() error {
+				_, err := db.CreateUser(context.Background(), "alice", "first", "last", "secret", "other@email.uk", "PT")
+				return err
+			},
+			expectedField: "nickname",
+		},
+		{
+			name: "creating a user with a taken email in another case",
+			call: func() error {
+				_, err := db.CreateUser(context.Background(), "other", "first", "last", "secret", "Alice@Email.UK", "PT")
+				return err
+			},
+			expectedField: "email",
+		},
+		{
+			name: "updating a user to a taken email",
+			call: func() error {
+				_, err := db.UpdateUser(context.Background(), bob.ID, 0, "bob", "first", "last", "secret", "carol@email.uk", "UK")
+				return err
+			},
+			expectedField: "email",
+		},
+		{
+			name: "patching a user to a taken nickname",
+			call: func() error {
+				_, err := db.PatchUser(context.Background(), bob.ID, 0, map[string]string{"nickname": "carol"})
+				return err
+			},
+			expectedField: "nickname",
+		},
+		{
+			name: "updating a user keeping its own nickname and email",
+			call: func() error {
+				_, err := db.UpdateUser(context.Background(), bob.ID, 0, "bob", "first", "last", "secret", "BOB@email.uk", "UK")
+				return err
+			},
+		},
+	} {
+		err := tt.call()
+		if tt.expectedField == "" {
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", tt.name, err)
+			}
+			continue
+		}
+		var storageErr *mongo.Error
+		if !errors.Is(err, mongo.ErrConflict) || !errors.As(err, &storageErr) || storageErr.Field != tt.expectedField {
+			t.Fatalf("%s: wrong error: got %v want a conflict on %s", tt.name, err, tt.expectedField)
+		}
+	}
+
+	if users := list(t, db, url.Values{}); len(users) != 3 {
+		t.Fatalf("wrong number of users: got %d want 3", len(users))
+	}
+}
+
+func TestRemoveUser(t *testing.T) {
+	t.Parallel()
+	db := seed(t)
+	users := list(t, db, url.Values{"nickname": {"alice"}})
+
+	for _, tt := range []struct {
+		name          string
+		guid          string
+		expectedCount int64
+	}{
+		{name: "it should remove an existing user", guid: users[0].ID, expectedCount: 1},
+		{name: "it should report nothing removed for a missing user", guid: users[0].ID, expectedCount: 0},
+	} {
+		count, err := db.RemoveUser(context.Background(), tt.guid, 0)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.name, err)
+		}
+		if count != tt.expectedCount {
+			t.Fatalf("%s: wrong count: got %d want %d", tt.name, count, tt.expectedCount)
+		}
+	}
+
+	remaining := list(t, db, url.Values{})
+	if len(remaining) != 2 {
+		t.Fatalf("wrong number of users: got %d want 2", len(remaining))
+	}
+}
+
+func TestSoftDeleteLifecycle(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := seed(t)
+	alice := list(t, db, url.Values{"nickname": {"alice"}})[0]
+
+	if _, err := db.RemoveUser(ctx, alice.ID, alice.Version); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := db.GetUser(ctx, alice.ID); !errors.Is(err, mongo.ErrNotFound) {
+		t.Fatalf("deleted user should not be found: got %v", err)
+	}
+	if _, err := db.Authenticate(ctx, "alice", "secret"); !errors.Is(err, mongo.ErrNotFound) {
+		t.Fatalf("deleted user should not authenticate: got %v", err)
+	}
+	if users := list(t, db, url.Values{"include_deleted": {"true"}}); len(users) != 3 || users[0].DeletedAt == nil {
+		t.Fatalf("deleted user should be listed when included: got %+v", users)
+	}
+
+	restored, err := db.RestoreUser(ctx, alice.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if restored.DeletedAt != nil || restored.Version != alice.Version+2 {
+		t.Fatalf("wrong restored user: got %+v", restored)
+	}
+	if again, err := db.RestoreUser(ctx, alice.ID); err != nil || again.Version != restored.Version {
+		t.Fatalf("restoring an active user should be a no-op: got %+v, %v", again, err)
+	}
+
+	if _, err := db.RemoveUser(ctx, alice.ID, 0); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if purged, _ := db.PurgeUsers(ctx, time.Now().Add(-time.Hour)); purged != 0 {
+		t.Fatalf("users deleted within the retention period should be kept: purged %d", purged)
+	}
+	if purged, _ := db.PurgeUsers(ctx, time.Now().Add(time.Hour)); purged != 1 {
+		t.Fatalf("wrong number of purged users: got %d want 1", purged)
+	}
+	if _, err := db.RestoreUser(ctx, alice.ID); !errors.Is(err, mongo.ErrNotFound) {
+		t.Fatalf("purged user should not be restored: got %v", err)
+	}
+	if users := list(t, db, url.Values{"include_deleted": {"true"}}); len(users) != 2 {
+		t.Fatalf("wrong number of users: got %d want 2", len(users))
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	t.Parallel()
+	db := memory.New(testHasher)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		nickname := fmt.Sprintf("nick%d", i)
+		go func() {
+			defer wg.Done()
+			db.CreateUser(context.Background(), nickname, "first", "last", "secret", nickname+"@email.uk", "PT")
+		}()
+		go func() {
+			defer wg.Done()
+			db.GetUsers(context.Background(), mongo.ListOptions{Limit: mongo.MaxLimit, Sort: "created_at"})
+		}()
+	}
+	wg.Wait()
+
+	users := list(t, db, url.Values{})
+	if len(users) != 50 {
+		t.Fatalf("wrong number of users: got %d want 50", len(users))
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	t.Parallel()
+	db := memory.New(testHasher)
+	user, _ := db.CreateUser(context.Background(), "alice", "first", "last", "S3CR3T", "alice@email.uk", "PT")
+
+	if user.Password == "S3CR3T" {
+		t.Fatalf("password was stored in plain text")
+	}
+
+	if _, err := db.VerifyPassword(context.Background(), user.ID, "wrong"); err != password.ErrMismatch {
+		t.Fatalf("wrong error: got %v want %v", err, password.ErrMismatch)
+	}
+
+	verified, err := db.VerifyPassword(context.Background(), user.ID, "S3CR3T")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if verified.ID != user.ID {
+		t.Fatalf("wrong user: got %s want %s", verified.ID, user.ID)
+	}
+}
@@ -0,0 +1,56 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jpaldi/go-user-api/mongo"
+)
+
+// RefreshTokens is an in-memory refresh token store, safe for concurrent use
+type RefreshTokens struct {
+	mu     sync.Mutex
+	tokens map[string]mongo.RefreshToken
+}
+
+// NewRefreshTokens returns an empty in-memory refresh token store
+func NewRefreshTokens() *RefreshTokens {
+	return &RefreshTokens{
+		tokens: map[string]mongo.RefreshToken{},
+	}
+}
+
+// SaveRefreshToken stores a new refresh token
+func (rt *RefreshTokens) SaveRefreshToken(ctx context.Context, token mongo.RefreshToken) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.tokens[token.Hash] = token
+	return nil
+}
+
+// ConsumeRefreshToken revokes a refresh token and returns it, as long as it was neither revoked nor expired
+func (rt *RefreshTokens) ConsumeRefreshToken(ctx context.Context, hash string) (*mongo.RefreshToken, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	now := time.Now()
+	token, ok := rt.tokens[hash]
+	if !ok || token.RevokedAt != nil || !token.ExpiresAt.After(now) {
+		return nil, mongo.ErrNotFound
+	}
+
+	token.RevokedAt = &now
+	rt.tokens[hash] = token
+	return &token, nil
+}
+
+// RevokeRefreshToken revokes a refresh token and reports whether it was still active
+func (rt *RefreshTokens) RevokeRefreshToken(ctx context.Context, hash string) (bool, error) {
+	_, err := rt.ConsumeRefreshToken(ctx, hash)
+	if err == mongo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
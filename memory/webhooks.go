@@ -0,0 +1,222 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jpaldi/go-user-api/mongo"
+)
+
+// Webhooks stores webhooks and their deliveries in memory, safe for concurrent use
+type Webhooks struct {
+	mu         sync.Mutex
+	webhooks   []mongo.Webhook
+	deliveries []mongo.Delivery
+}
+
+// NewWebhooks returns an empty in-memory webhooks store
+func NewWebhooks() *Webhooks {
+	return &Webhooks{}
+}
+
+// CreateWebhook stores a new webhook
+func (s *Webhooks) CreateWebhook(ctx context.Context, webhook mongo.Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.webhook(webhook.ID) != nil {
+		return mongo.ErrConflict
+	}
+	s.webhooks = append(s.webhooks, webhook)
+	return nil
+}
+
+// GetWebhook returns the webhook with the given id
+func (s *Webhooks) GetWebhook(ctx context.Context, id string) (*mongo.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := s.webhook(id)
+	if w == nil {
+		return nil, mongo.ErrWebhookNotFound
+	}
+	webhook := *w
+	return &webhook, nil
+}
+
+// ListWebhooks returns every webhook, oldest first
+func (s *Webhooks) ListWebhooks(ctx context.Context) ([]mongo.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]mongo.Webhook{}, s.webhooks...), nil
+}
+
+// DeleteWebhook removes a webhook
+func (s *Webhooks) DeleteWebhook(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, w := range s.webhooks {
+		if w.ID == id {
+			s.webhooks = append(s.webhooks[:i], s.webhooks[i+1:]...)
+			return nil
+		}
+	}
+	return mongo.ErrWebhookNotFound
+}
+
+// EnableWebhook activates a webhook again and forgets its failures
+func (s *Webhooks) EnableWebhook(ctx context.Context, id string) (*mongo.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := s.webhook(id)
+	if w == nil {
+		return nil, mongo.ErrWebhookNotFound
+	}
+	w.Active, w.ConsecutiveFailures, w.DisabledAt = true, 0, nil
+	webhook := *w
+	return &webhook, nil
+}
+
+// RecordResult resets the consecutive failures of a webhook after a successful attempt, or counts a failed one
+// and disables the webhook once disableAfter failures in a row are reached
+func (s *Webhooks) RecordResult(ctx context.Context, id string, success bool, disableAfter int, now time.Time) (*mongo.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := s.webhook(id)
+	if w == nil {
+		return nil, mongo.ErrWebhookNotFound
+	}
+	if success {
+		w.ConsecutiveFailures = 0
+	} else {
+		w.ConsecutiveFailures++
+		if w.Active && disableAfter > 0 && w.ConsecutiveFailures >= disableAfter {
+			w.Active, w.DisabledAt = false, &now
+		}
+	}
+	webhook := *w
+	return &webhook, nil
+}
+
+// AddDelivery stores a delivery unless one with the same id exists
+func (s *Webhooks) AddDelivery(ctx context.Context, delivery mongo.Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.delivery("", delivery.ID) == nil {
+		s.deliveries = append(s.deliveries, delivery)
+	}
+	return nil
+}
+
+// ClaimDeliveries returns up to limit pending deliveries due at now, oldest first, and defers their next attempt by lease
+func (s *Webhooks) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]mongo.Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*mongo.Delivery{}
+	for i := range s.deliveries {
+		d := &s.deliveries[i]
+		if d.Status == mongo.DeliveryPending && !d.NextAttemptAt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+
+	claimed := []mongo.Delivery{}
+	for _, d := range due {
+		if len(claimed) == limit {
+			break
+		}
+		d.NextAttemptAt = now.Add(lease)
+		claimed = append(claimed, copyDelivery(*d))
+	}
+	return claimed, nil
+}
+
+// RecordAttempt adds an attempt to a delivery and sets its status, failures and next attempt
+func (s *Webhooks) RecordAttempt(ctx context.Context, id string, attempt mongo.DeliveryAttempt, status string, failures int, next time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := s.delivery("", id)
+	if d == nil {
+		return mongo.ErrWebhookNotFound
+	}
+	d.Attempts = append(d.Attempts, attempt)
+	d.Status, d.Failures, d.NextAttemptAt = status, failures, next
+	return nil
+}
+
+// GetDelivery returns a delivery of the webhook
+func (s *Webhooks) GetDelivery(ctx context.Context, webhookID string, id string) (*mongo.Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := s.delivery(webhookID, id)
+	if d == nil {
+		return nil, mongo.ErrWebhookNotFound
+	}
+	delivery := copyDelivery(*d)
+	return &delivery, nil
+}
+
+// ListDeliveries returns the latest deliveries of a webhook, newest first
+func (s *Webhooks) ListDeliveries(ctx context.Context, webhookID string, limit int) ([]mongo.Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deliveries := []mongo.Delivery{}
+	for i := len(s.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if s.deliveries[i].WebhookID == webhookID {
+			deliveries = append(deliveries, copyDelivery(s.deliveries[i]))
+		}
+	}
+	return deliveries, nil
+}
+
+// Redeliver schedules a delivery of the webhook again at now, whatever its status, with a fresh backoff
+func (s *Webhooks) Redeliver(ctx context.Context, webhookID string, id string, now time.Time) (*mongo.Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := s.delivery(webhookID, id)
+	if d == nil {
+		return nil, mongo.ErrWebhookNotFound
+	}
+	d.Status, d.Failures, d.NextAttemptAt = mongo.DeliveryPending, 0, now
+	delivery := copyDelivery(*d)
+	return &delivery, nil
+}
+
+func (s *Webhooks) webhook(id string) *mongo.Webhook {
+	for i := range s.webhooks {
+		if s.webhooks[i].ID == id {
+			return &s.webhooks[i]
+		}
+	}
+	return nil
+}
+
+// delivery finds a delivery by id, of the given webhook unless webhookID is empty
+func (s *Webhooks) delivery(webhookID string, id string) *mongo.Delivery {
+	for i := range s.deliveries {
+		d := &s.deliveries[i]
+		if d.ID == id && (webhookID == "" || d.WebhookID == webhookID) {
+			return d
+		}
+	}
+	return nil
+}
+
+// copyDelivery copies the attempts too, so callers can't change the stored ones
+func copyDelivery(d mongo.Delivery) mongo.Delivery {
+	d.Attempts = append([]mongo.DeliveryAttempt{}, d.Attempts...)
+	return d
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jpaldi/go-user-api/logging"
+)
+
+// HTTP records the requests served by a router, keyed by route template so the number of series
+// doesn't grow with the ids in the paths
+type HTTP struct {
+	Requests *Counter
+	Duration *Histogram
+	InFlight *Gauge
+	// Routes is the router serving the requests
+	Routes *mux.Router
+}
+
+// NewHTTP registers the HTTP metrics
+func NewHTTP(r *Registry, routes *mux.Router) HTTP {
+	return HTTP{
+		Requests: r.Counter("http_requests_total", "Requests served, by method, route and status code.", "method", "route", "code"),
+		Duration: r.Histogram("http_request_duration_seconds", "Time taken to serve requests, by method and route.", DefaultBuckets, "method", "route"),
+		InFlight: r.Gauge("http_requests_in_flight", "Requests being served, by route.", "route"),
+		Routes:   routes,
+	}
+}
+
+// Handler wraps next, it must wrap the whole router so unknown routes are counted too
+func (h HTTP) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := logging.RouteTemplate(h.Routes, r)
+		h.InFlight.Add(1, route)
+		defer h.InFlight.Add(-1, route)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		h.Requests.Inc(r.Method, route, strconv.Itoa(rec.status))
+		h.Duration.Observe(time.Since(start).Seconds(), r.Method, route)
+	})
+}
+
+// statusRecorder captures the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status, rec.wroteHeader = status, true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,224 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the upper bounds of latency histograms, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds the metrics of the service and serves them in the Prometheus text format.
+// Metrics are registered once at startup, registering a name twice panics.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// Counter registers a counter, a value that only goes up, partitioned by the given labels
+func (r *Registry) Counter(name string, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, "counter", nil, labels)}
+}
+
+// Gauge registers a gauge, a value that goes up and down, partitioned by the given labels
+func (r *Registry) Gauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, "gauge", nil, labels)}
+}
+
+// Histogram registers a histogram counting observations in buckets of the given upper bounds, in increasing order
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r.register(name, help, "histogram", buckets, labels)}
+}
+
+func (r *Registry) register(name string, help string, kind string, buckets []float64, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	f := &family{name: name, help: help, kind: kind, buckets: buckets, labels: labels, series: map[string]*series{}}
+	r.families[name] = f
+	return f
+}
+
+// ServeHTTP handles the GET /metrics request
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.Write(w)
+}
+
+// Write writes every metric in the Prometheus text format, sorted by name and labels
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	b := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(b)
+	}
+	return b.Flush()
+}
+
+// Counter is a counter partitioned by labels
+type Counter struct{ f *family }
+
+// Inc adds one to the counter of the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the counter of the label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.f.update(labelValues, func(s *series) { s.value += v })
+}
+
+// Gauge is a gauge partitioned by labels
+type Gauge struct{ f *family }
+
+// Set sets the gauge of the label values
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *series) { s.value = v })
+}
+
+// Add adds v, which may be negative, to the gauge of the label values
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *series) { s.value += v })
+}
+
+// Histogram is a histogram partitioned by labels
+type Histogram struct{ f *family }
+
+// Observe counts v in the histogram of the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.update(labelValues, func(s *series) {
+		for i, bound := range h.f.buckets {
+			if v <= bound {
+				s.buckets[i]++
+			}
+		}
+		s.sum += v
+		s.count++
+	})
+}
+
+// family is a metric and its series, one per combination of label values
+type family struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	labels  []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// buckets, sum and count are only used by histograms, buckets are cumulative
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func (f *family) update(labelValues []string, fn func(s *series)) {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has labels %v, got values %v", f.name, f.labels, labelValues))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...), buckets: make([]uint64, len(f.buckets))}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, f.labelPairs(s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+		for i, bound := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelPairs(s.labelValues, formatFloat(bound)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelPairs(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, f.labelPairs(s.labelValues, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, f.labelPairs(s.labelValues, ""), s.count)
+	}
+}
+
+// labelPairs formats the labels of a series as {name="value",...}, with the le label of histogram buckets when set
+func (f *family) labelPairs(values []string, le string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, name := range f.labels {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,98 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jpaldi/go-user-api/metrics"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Parallel()
+	r := metrics.NewRegistry()
+	requests := r.Counter("requests_total", "Requests\nserved.", "route")
+	users := r.Gauge("users", "Users.")
+	latency := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+
+	requests.Inc("/users/{userid}")
+	requests.Add(2, "/users/{userid}")
+	requests.Inc(`say "hi"`)
+	users.Set(42)
+	users.Add(-2)
+	latency.Observe(0.05, "/users")
+	latency.Observe(0.5, "/users")
+	latency.Observe(5, "/users")
+
+	var b bytes.Buffer
+	if err := r.Write(&b); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/users",le="0.1"} 1
+latency_seconds_bucket{route="/users",le="1"} 2
+latency_seconds_bucket{route="/users",le="+Inf"} 3
+latency_seconds_sum{route="/users"} 5.55
+latency_seconds_count{route="/users"} 3
+# HELP requests_total Requests\nserved.
+# TYPE requests_total counter
+requests_total{route="/users/{userid}"} 3
+requests_total{route="say \"hi\""} 1
+# HELP users Users.
+# TYPE users gauge
+users 40
+`
+	if b.String() != expected {
+		t.Fatalf("wrong exposition: got\n%s\nwant\n%s", b.String(), expected)
+	}
+}
+
+func TestRegistryRejectsDuplicates(t *testing.T) {
+	t.Parallel()
+	r := metrics.NewRegistry()
+	r.Counter("requests_total", "Requests.")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("registering a metric twice should panic")
+		}
+	}()
+	r.Gauge("requests_total", "Requests.")
+}
+
+func TestHTTP(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{userid}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	router.Handle("/metrics", registry)
+	server := metrics.NewHTTP(registry, router).Handler(router)
+
+	for _, path := range []string{"/users/user-1", "/users/user-2", "/unknown"} {
+		r, _ := http.NewRequest(http.MethodGet, path, nil)
+		server.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	r, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if contentType := w.Header().Get("Content-Type"); contentType != metrics.ContentType {
+		t.Fatalf("wrong content type: got %s", contentType)
+	}
+	for _, line := range []string{
+		`http_requests_total{method="GET",route="/users/{userid}",code="201"} 2`,
+		`http_requests_total{method="GET",route="unmatched",code="404"} 1`,
+		`http_request_duration_seconds_count{method="GET",route="/users/{userid}"} 2`,
+		`http_requests_in_flight{route="/metrics"} 1`,
+		`http_requests_in_flight{route="/users/{userid}"} 0`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Fatalf("missing %s in\n%s", line, w.Body.String())
+		}
+	}
+}
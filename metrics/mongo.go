@@ -0,0 +1,23 @@
+package metrics
+
+import "time"
+
+// Mongo records the operations on the mongo collections, it is the mongo.Observer of mongo.Instrumented
+type Mongo struct {
+	Operations *Counter
+	Duration   *Histogram
+}
+
+// NewMongo registers the mongo metrics
+func NewMongo(r *Registry) Mongo {
+	return Mongo{
+		Operations: r.Counter("mongo_operations_total", "Operations on mongo collections, by collection, operation and outcome.", "collection", "operation", "outcome"),
+		Duration:   r.Histogram("mongo_operation_duration_seconds", "Time taken by operations on mongo collections, by collection and operation.", DefaultBuckets, "collection", "operation"),
+	}
+}
+
+// ObserveOperation records an operation and its outcome, see mongo.Outcome
+func (m Mongo) ObserveOperation(collection string, operation string, outcome string, duration time.Duration) {
+	m.Operations.Inc(collection, operation, outcome)
+	m.Duration.Observe(duration.Seconds(), collection, operation)
+}
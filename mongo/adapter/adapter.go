@@ -2,9 +2,14 @@ package adapter
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/jpaldi/go-user-api/logging"
 	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/tracing"
+	"github.com/sirupsen/logrus"
 	mongolib "go.mongodb.org/mongo-driver/mongo"
 	mongolibopts "go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -41,32 +46,114 @@ func (m ClientAdapter) Collection(db, collection string) mongo.Collection {
 	return &CollectionAdapter{m.Client.Database(db).Collection(collection)}
 }
 
+// CreateIndexes creates the given indexes on a collection, indexes that already exist with the same options are left as is
+func (m ClientAdapter) CreateIndexes(ctx context.Context, db, collection string, indexes []mongolib.IndexModel) error {
+	if _, err := m.Client.Database(db).Collection(collection).Indexes().CreateMany(ctx, indexes); err != nil {
+		return fmt.Errorf("creating indexes on %s.%s: %s", db, collection, err)
+	}
+	return nil
+}
+
+// WithTransaction runs fn in a transaction, retrying it on transient errors. Collections must be used with the
+// context fn receives to take part in the transaction, which requires a replica set or a sharded cluster.
+func (m ClientAdapter) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return m.Client.UseSession(ctx, func(session mongolib.SessionContext) error {
+		_, err := session.WithTransaction(session, func(txn mongolib.SessionContext) (interface{}, error) {
+			return nil, fn(txn)
+		})
+		return err
+	})
+}
+
 // CollectionAdapter wraps a mongo lib collection into a Collection.
 type CollectionAdapter struct {
 	*mongolib.Collection
 }
 
 // InsertOne adds a document in Mongo
-func (c CollectionAdapter) InsertOne(ctx context.Context, doc interface{}) error {
-	_, err := c.Collection.InsertOne(ctx, doc)
+func (c CollectionAdapter) InsertOne(ctx context.Context, doc interface{}) (err error) {
+	ctx, done := c.start(ctx, "InsertOne", nil)
+	defer done(&err)
+	_, err = c.Collection.InsertOne(ctx, doc)
 	return err
 }
 
+// FindOne decodes the first document from Mongo matching the given filter into result
+func (c CollectionAdapter) FindOne(ctx context.Context, filter interface{}, result interface{}) (err error) {
+	ctx, done := c.start(ctx, "FindOne", filter)
+	defer done(&err)
+	return c.Collection.FindOne(ctx, filter).Decode(result)
+}
+
 // FindOneAndUpdate and updates a document to Database
-func (c CollectionAdapter) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}) *mongolib.SingleResult {
+func (c CollectionAdapter) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, result interface{}) (err error) {
+	ctx, done := c.start(ctx, "FindOneAndUpdate", filter)
+	defer done(&err)
 	after := mongolibopts.After
 	opt := mongolibopts.FindOneAndUpdateOptions{
 		ReturnDocument: &after, // ReturnDocument option to return the updated document
 	}
-	return c.Collection.FindOneAndUpdate(ctx, filter, update, &opt)
+	return c.Collection.FindOneAndUpdate(ctx, filter, update, &opt).Decode(result)
 }
 
 // DeleteOne removes a document from Mongo
-func (c CollectionAdapter) DeleteOne(ctx context.Context, filter interface{}) (*mongolib.DeleteResult, error) {
+func (c CollectionAdapter) DeleteOne(ctx context.Context, filter interface{}) (res *mongolib.DeleteResult, err error) {
+	ctx, done := c.start(ctx, "DeleteOne", filter)
+	defer done(&err)
 	return c.Collection.DeleteOne(ctx, filter)
 }
 
+// DeleteMany removes every document from Mongo matching the given filter
+func (c CollectionAdapter) DeleteMany(ctx context.Context, filter interface{}) (res *mongolib.DeleteResult, err error) {
+	ctx, done := c.start(ctx, "DeleteMany", filter)
+	defer done(&err)
+	return c.Collection.DeleteMany(ctx, filter)
+}
+
 // Find returns all documents from Mongo matching the given query
-func (c CollectionAdapter) Find(ctx context.Context, query interface{}) (*mongolib.Cursor, error) {
-	return c.Collection.Find(ctx, query)
+func (c CollectionAdapter) Find(ctx context.Context, query interface{}, opts ...*mongolibopts.FindOptions) (cursor *mongolib.Cursor, err error) {
+	ctx, done := c.start(ctx, "Find", query)
+	defer done(&err)
+	return c.Collection.Find(ctx, query, opts...)
+}
+
+// CountDocuments counts the documents from Mongo matching the given filter
+func (c CollectionAdapter) CountDocuments(ctx context.Context, filter interface{}) (count int64, err error) {
+	ctx, done := c.start(ctx, "CountDocuments", filter)
+	defer done(&err)
+	return c.Collection.CountDocuments(ctx, filter)
+}
+
+// start starts the span of an operation, a child of the span of the request in ctx, with the filter
+// sanitised as the statement. The returned func ends the span and logs the operation with the log
+// entry of the request, at debug level unless it failed. Missing documents are an expected outcome,
+// not a failure.
+func (c CollectionAdapter) start(ctx context.Context, operation string, filter interface{}) (context.Context, func(err *error)) {
+	start := time.Now()
+	attributes := []tracing.Attribute{
+		{Key: "db.system", Value: "mongodb"},
+		{Key: "db.name", Value: c.Collection.Database().Name()},
+		{Key: "db.mongodb.collection", Value: c.Collection.Name()},
+		{Key: "db.operation", Value: operation},
+	}
+	if filter != nil {
+		attributes = append(attributes, tracing.Attribute{Key: "db.statement", Value: mongo.SanitizeFilter(filter)})
+	}
+	ctx, span := tracing.StartChild(ctx, "mongo."+operation, tracing.KindClient, attributes...)
+
+	return ctx, func(err *error) {
+		entry := logging.FromContext(ctx, nil).WithFields(logrus.Fields{
+			"collection":  c.Collection.Name(),
+			"operation":   operation,
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+		})
+		if *err != nil && !errors.Is(*err, mongolib.ErrNoDocuments) {
+			span.SetError(*err)
+			span.End()
+			entry.WithError(*err).Warn("mongo operation failed")
+			return
+		}
+		span.End()
+		entry.Debug("mongo operation")
+	}
 }
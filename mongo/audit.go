@@ -0,0 +1,228 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	mongolib "go.mongodb.org/mongo-driver/mongo"
+	mongolibopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The actions recorded in the audit log
+const (
+	ActionCreate     = "create"
+	ActionUpdate     = "update"
+	ActionPatch      = "patch"
+	ActionDelete     = "delete"
+	ActionRestore    = "restore"
+	ActionGrantRole  = "grant_role"
+	ActionRevokeRole = "revoke_role"
+)
+
+// Redacted replaces the values of secret fields, like passwords, in audit records
+const Redacted = "[redacted]"
+
+// AuditRecord describes a change made to a user, who made it and when
+type AuditRecord struct {
+	ID        string    `json:"id" bson:"_id"`
+	UserID    string    `json:"user_id" bson:"user_id"`
+	Action    string    `json:"action" bson:"action"`
+	Actor     string    `json:"actor" bson:"actor"`
+	RequestID string    `json:"request_id,omitempty" bson:"request_id,omitempty"`
+	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
+	// Version is the version of the user after the change
+	Version int64         `json:"version" bson:"version"`
+	Changes []FieldChange `json:"changes" bson:"changes"`
+}
+
+// FieldChange is the value of a field before and after a change, Before is nil for new users
+type FieldChange struct {
+	Field  string      `json:"field" bson:"field"`
+	Before interface{} `json:"before" bson:"before"`
+	After  interface{} `json:"after" bson:"after"`
+}
+
+// AuditPage is a page of audit records and the token of the next page, empty on the last page
+type AuditPage struct {
+	Records       []AuditRecord `json:"records"`
+	NextPageToken string        `json:"next_page_token,omitempty"`
+}
+
+// NewAuditRecord returns the record of an action that changed a user from before to after,
+// before is nil when the user was created
+func NewAuditRecord(action string, actor string, requestID string, before *User, after User) AuditRecord {
+	return AuditRecord{
+		ID:        uuid.New().String(),
+		UserID:    after.ID,
+		Action:    action,
+		Actor:     actor,
+		RequestID: requestID,
+		Timestamp: Now(),
+		Version:   after.Version,
+		Changes:   Diff(before, after),
+	}
+}
+
+// Diff returns the fields that differ between two states of a user, before is nil for new users.
+// Password hashes are never recorded, only the fact that the password changed.
+func Diff(before *User, after User) []FieldChange {
+	old := User{}
+	if before != nil {
+		old = *before
+	}
+
+	changes := []FieldChange{}
+	record := func(field string, from interface{}, to interface{}, changed bool) {
+		if !changed {
+			return
+		}
+		if before == nil {
+			from = nil
+		}
+		changes = append(changes, FieldChange{Field: field, Before: from, After: to})
+	}
+
+	for _, field := range PatchableFields {
+		if field == "password" {
+			record(field, Redacted, Redacted, old.Password != after.Password)
+			continue
+		}
+		from, to := old.Field(field), after.Field(field)
+		record(field, from, to, from != to)
+	}
+	record("roles", old.Roles, after.Roles, strings.Join(old.Roles, ",") != strings.Join(after.Roles, ","))
+	record("deleted_at", old.DeletedAt, after.DeletedAt, !sameTime(old.DeletedAt, after.DeletedAt))
+	return changes
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// AuditListOptions describes which page of a user's audit records to return, newest first
+type AuditListOptions struct {
+	Limit int
+	// After is the position of the last record of the previous page, nil for the first page
+	After *Cursor
+}
+
+// ParseAuditListOptions reads the limit and page_token query parameters
+func ParseAuditListOptions(params url.Values) (AuditListOptions, error) {
+	limit, err := parseLimit(params)
+	if err != nil {
+		return AuditListOptions{}, err
+	}
+	opts := AuditListOptions{Limit: limit}
+
+	if token := params.Get("page_token"); token != "" {
+		cursor, err := decodeCursor(token)
+		if err != nil || cursor.Sort != "timestamp" {
+			return opts, fmt.Errorf("%w: page_token doesn't belong to this listing", ErrInvalidListOptions)
+		}
+		opts.After = cursor
+	}
+	return opts, nil
+}
+
+// Includes reports whether the record comes after the cursor, i.e. belongs to the requested page or later ones
+func (opts AuditListOptions) Includes(record AuditRecord) bool {
+	if opts.After == nil {
+		return true
+	}
+	return newerRecord(opts.After.Value, opts.After.ID, record)
+}
+
+// newerRecord reports whether the record at the given sortable time and id comes before the other one
+func newerRecord(timestamp string, id string, other AuditRecord) bool {
+	otherTimestamp := other.Timestamp.UTC().Format(sortableTime)
+	if timestamp == otherTimestamp {
+		return id > other.ID
+	}
+	return timestamp > otherTimestamp
+}
+
+// LessRecords reports whether a comes before b in audit listings, newest first
+func LessRecords(a, b AuditRecord) bool {
+	return newerRecord(a.Timestamp.UTC().Format(sortableTime), a.ID, b)
+}
+
+// PageRecords trims the records of a listing, sorted and starting after the cursor, to the page size
+func PageRecords(opts AuditListOptions, records []AuditRecord) *AuditPage {
+	p := &AuditPage{Records: records}
+	if len(records) > opts.Limit {
+		p.Records = records[:opts.Limit]
+		last := p.Records[opts.Limit-1]
+		p.NextPageToken = encodeCursor(Cursor{Sort: "timestamp", Descending: true, Value: last.Timestamp.UTC().Format(sortableTime), ID: last.ID})
+	}
+	return p
+}
+
+// AuditLog stores audit records in their own collection, records are only ever inserted
+type AuditLog struct {
+	Client Collection
+}
+
+// Record appends a record to the audit log
+func (a AuditLog) Record(ctx context.Context, record AuditRecord) error {
+	if err := a.Client.InsertOne(ctx, record); err != nil {
+		return fmt.Errorf("cannot insert: %w", translate(err))
+	}
+	return nil
+}
+
+// List returns a page of the audit records of a user, newest first
+func (a AuditLog) List(ctx context.Context, userID string, opts AuditListOptions) (*AuditPage, error) {
+	query := bson.M{"user_id": userID}
+	if opts.After != nil {
+		t, err := time.Parse(time.RFC3339Nano, opts.After.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidListOptions, err)
+		}
+		query["$or"] = bson.A{
+			bson.M{"timestamp": bson.M{"$lt": t}},
+			bson.M{"timestamp": t, "_id": bson.M{"$lt": opts.After.ID}},
+		}
+	}
+
+	// ask for one more record to know whether there is a next page
+	findOpts := mongolibopts.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(opts.Limit + 1))
+	cursor, err := a.Client.Find(ctx, query, findOpts)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer cursor.Close(ctx)
+
+	records := []AuditRecord{}
+	for cursor.Next(ctx) {
+		record := AuditRecord{}
+		if err := cursor.Decode(&record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, translate(err)
+	}
+
+	return PageRecords(opts, records), nil
+}
+
+// AuditIndexes returns the indexes of the audit collection, which is always read by user and newest first
+func AuditIndexes() []mongolib.IndexModel {
+	return []mongolib.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}},
+			Options: mongolibopts.Index().SetName("user_timestamp"),
+		},
+	}
+}
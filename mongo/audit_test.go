@@ -0,0 +1,101 @@
+package mongo_test
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jpaldi/go-user-api/mongo"
+)
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+	deletedAt := time.Date(2020, 10, 10, 10, 0, 0, 0, time.UTC)
+	user := mongo.User{ID: "user-1", Nickname: "jpaldi", Password: "hash", Email: "jpaldi@email.pt", Country: "PT"}
+	renamed := user
+	renamed.Nickname, renamed.Password = "joao", "other hash"
+	granted := user
+	granted.Roles = []string{"support"}
+	deleted := user
+	deleted.DeletedAt = &deletedAt
+
+	for _, tt := range []struct {
+		name     string
+		before   *mongo.User
+		after    mongo.User
+		expected []mongo.FieldChange
+	}{
+		{
+			name:  "new users should record every set field without previous values",
+			after: user,
+			expected: []mongo.FieldChange{
+				{Field: "nickname", After: "jpaldi"},
+				{Field: "password", After: mongo.Redacted},
+				{Field: "email", After: "jpaldi@email.pt"},
+				{Field: "country", After: "PT"},
+			},
+		},
+		{
+			name:   "changed fields should be recorded with passwords redacted",
+			before: &user,
+			after:  renamed,
+			expected: []mongo.FieldChange{
+				{Field: "nickname", Before: "jpaldi", After: "joao"},
+				{Field: "password", Before: mongo.Redacted, After: mongo.Redacted},
+			},
+		},
+		{
+			name:     "role changes should be recorded",
+			before:   &user,
+			after:    granted,
+			expected: []mongo.FieldChange{{Field: "roles", Before: []string(nil), After: []string{"support"}}},
+		},
+		{
+			name:     "deletions should be recorded",
+			before:   &user,
+			after:    deleted,
+			expected: []mongo.FieldChange{{Field: "deleted_at", Before: (*time.Time)(nil), After: &deletedAt}},
+		},
+		{
+			name:     "no-ops should record nothing",
+			before:   &user,
+			after:    user,
+			expected: []mongo.FieldChange{},
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mongo.Diff(tt.before, tt.after); !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("wrong changes: got %+v want %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseAuditListOptions(t *testing.T) {
+	t.Parallel()
+	usersToken := mongo.ListOptions{Sort: "created_at"}.NextPageToken(mongo.User{ID: "id"})
+	page := mongo.PageRecords(mongo.AuditListOptions{Limit: 1}, []mongo.AuditRecord{{ID: "b"}, {ID: "a"}})
+
+	for _, tt := range []struct {
+		name        string
+		params      url.Values
+		expectError bool
+	}{
+		{name: "it should default to the first page", params: url.Values{}},
+		{name: "it should accept the token of the previous page", params: url.Values{"page_token": {page.NextPageToken}}},
+		{name: "it should reject the token of a users listing", params: url.Values{"page_token": {usersToken}}, expectError: true},
+		{name: "it should reject limits above the maximum", params: url.Values{"limit": {"1000"}}, expectError: true},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := mongo.ParseAuditListOptions(tt.params)
+
+			if tt.expectError != errors.Is(err, mongo.ErrInvalidListOptions) || (!tt.expectError && err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
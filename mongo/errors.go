@@ -0,0 +1,132 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	mongolib "go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// The kinds of errors returned by the storage backends. Handlers check them with errors.Is
+// to pick the response status, whatever the backend.
+var (
+	// ErrNotFound is returned when the requested user doesn't exist
+	ErrNotFound = errors.New("user not found")
+	// ErrConflict is returned when a change clashes with another document, e.g. a duplicate key
+	ErrConflict = errors.New("conflict")
+	// ErrValidation is returned when the database rejects a document as invalid
+	ErrValidation = errors.New("validation failed")
+	// ErrUnavailable is returned when the database can't be reached in time
+	ErrUnavailable = errors.New("database unavailable")
+	// ErrVersionMismatch is returned when a change expects another version of the user than the stored one
+	ErrVersionMismatch = errors.New("the user was changed by another request")
+)
+
+// mongo server error codes
+const (
+	codeDuplicateKey               = 11000
+	codeDocumentValidationFailure  = 121
+	labelNetworkError              = "NetworkError"
+	labelRetryableWriteError       = "RetryableWriteError"
+	labelTransientTransactionError = "TransientTransactionError"
+)
+
+// Error is a storage error of one of the kinds above, with details for the client
+type Error struct {
+	// Kind is one of ErrNotFound, ErrConflict, ErrValidation or ErrUnavailable
+	Kind error
+	// Field is the field at fault, if any
+	Field   string
+	Message string
+	// Err is the underlying error, if any
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return e.Kind.Error()
+}
+
+// Is makes errors.Is(err, ErrConflict) and friends match
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// translate maps mongo driver errors to the errors above, other errors are returned as is
+func translate(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == mongolib.ErrNoDocuments {
+		return ErrNotFound
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, topology.ErrServerSelectionTimeout) ||
+		errors.Is(err, mongolib.ErrClientDisconnected) {
+		return &Error{Kind: ErrUnavailable, Err: err}
+	}
+
+	switch e := err.(type) {
+	case mongolib.CommandError:
+		if e.HasErrorLabel(labelNetworkError) || e.HasErrorLabel(labelRetryableWriteError) || e.HasErrorLabel(labelTransientTransactionError) {
+			return &Error{Kind: ErrUnavailable, Err: err}
+		}
+		return translateCode(int(e.Code), e.Message, err)
+	case mongolib.WriteException:
+		if e.HasErrorLabel(labelNetworkError) || e.HasErrorLabel(labelRetryableWriteError) {
+			return &Error{Kind: ErrUnavailable, Err: err}
+		}
+		for _, we := range e.WriteErrors {
+			if translated := translateCode(we.Code, we.Message, err); translated != err {
+				return translated
+			}
+		}
+	}
+	return err
+}
+
+// ConflictError returns the error reported when a unique field is already taken by another user
+func ConflictError(field string, err error) *Error {
+	if field == "" {
+		return &Error{Kind: ErrConflict, Message: "duplicate key", Err: err}
+	}
+	return &Error{Kind: ErrConflict, Field: field, Message: fmt.Sprintf("%s is already taken", field), Err: err}
+}
+
+// duplicateField finds the field of a duplicate key error message, e.g.
+// "E11000 duplicate key error collection: users.users index: email_unique dup key: { email: "a@b.c" }"
+func duplicateField(message string) string {
+	for field, index := range uniqueIndexes {
+		if strings.Contains(message, "index: "+index+" ") {
+			return field
+		}
+	}
+	if i := strings.Index(message, "dup key: { "); i >= 0 {
+		rest := message[i+len("dup key: { "):]
+		if j := strings.Index(rest, ":"); j > 0 {
+			return strings.Trim(rest[:j], `" `)
+		}
+	}
+	return ""
+}
+
+func translateCode(code int, message string, err error) error {
+	switch code {
+	case codeDuplicateKey:
+		return ConflictError(duplicateField(message), err)
+	case codeDocumentValidationFailure:
+		return &Error{Kind: ErrValidation, Message: fmt.Sprintf("document failed validation: %s", message), Err: err}
+	}
+	return err
+}
@@ -0,0 +1,198 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	mongolib "go.mongodb.org/mongo-driver/mongo"
+	mongolibopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The types of the events published for user changes
+const (
+	EventUserCreated = "user.created"
+	EventUserUpdated = "user.updated"
+	EventUserDeleted = "user.deleted"
+)
+
+// publishedRetention is how long published events are kept in the outbox before mongo removes them
+const publishedRetention = 7 * 24 * time.Hour
+
+// Event is a change made to a user. It is written to the outbox with the change and stays there until it is published.
+type Event struct {
+	ID         string    `json:"id" bson:"_id"`
+	Type       string    `json:"type" bson:"type"`
+	UserID     string    `json:"user_id" bson:"user_id"`
+	Version    int64     `json:"version" bson:"version"`
+	OccurredAt time.Time `json:"occurred_at" bson:"occurred_at"`
+	// User is the user after the change, without its password hash
+	User User `json:"user" bson:"user"`
+
+	// the delivery bookkeeping of the outbox
+	Attempts      int        `json:"-" bson:"attempts"`
+	NextAttemptAt time.Time  `json:"-" bson:"next_attempt_at"`
+	LastError     string     `json:"-" bson:"last_error,omitempty"`
+	PublishedAt   *time.Time `json:"-" bson:"published_at,omitempty"`
+}
+
+// NewEvent returns the event of a change that left the user as given, due for delivery right away
+func NewEvent(eventType string, user User) Event {
+	user.Password = ""
+	now := Now()
+	return Event{
+		ID:            uuid.New().String(),
+		Type:          eventType,
+		UserID:        user.ID,
+		Version:       user.Version,
+		OccurredAt:    now,
+		User:          user,
+		NextAttemptAt: now,
+	}
+}
+
+// Transactions runs functions in a transaction, so the changes they make are committed together or not at all.
+// The function may run more than once if the transaction is retried.
+type Transactions interface {
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// errNoTransactions is returned by the changes of a Mongo with an outbox but without transactions
+var errNoTransactions = errors.New("writing events to the outbox requires transactions")
+
+// emit runs a change and writes its event to the outbox in the same transaction, so no change is saved without its
+// event. change reports whether the user changed, no-ops don't emit events. Nothing is emitted without an outbox.
+func (mgo Mongo) emit(ctx context.Context, eventType string, change func(ctx context.Context) (*User, bool, error)) (*User, error) {
+	if mgo.Outbox == nil {
+		user, _, err := change(ctx)
+		return user, err
+	}
+
+	var user *User
+	write := func(ctx context.Context) error {
+		u, changed, err := change(ctx)
+		if err != nil {
+			return err
+		}
+		user = u
+		if !changed {
+			return nil
+		}
+		if err := mgo.Outbox.InsertOne(ctx, NewEvent(eventType, *u)); err != nil {
+			return fmt.Errorf("cannot insert event: %w", translate(err))
+		}
+		return nil
+	}
+
+	if mgo.Transactions == nil {
+		return nil, errNoTransactions
+	}
+	if err := mgo.Transactions.WithTransaction(ctx, write); err != nil {
+		return nil, translate(err)
+	}
+	return user, nil
+}
+
+// Outbox reads the events waiting in the outbox collection for the relay to publish them
+type Outbox struct {
+	Client Collection
+}
+
+// Claim returns up to limit events due for delivery, oldest first, and defers their next delivery by lease
+// so other relays don't publish them meanwhile. The relay must mark them published or failed once delivered.
+func (o Outbox) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Event, error) {
+	pending := bson.M{"published_at": bson.M{"$exists": false}, "next_attempt_at": bson.M{"$lte": now}}
+	findOpts := mongolibopts.Find().SetSort(bson.D{{Key: "occurred_at", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := o.Client.Find(ctx, pending, findOpts)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer cursor.Close(ctx)
+
+	candidates := []Event{}
+	for cursor.Next(ctx) {
+		e := Event{}
+		if err := cursor.Decode(&e); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, e)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, translate(err)
+	}
+
+	return o.claim(ctx, candidates, now.Add(lease))
+}
+
+// claim takes the events nobody claimed since they were read, an event is only claimed if its next attempt didn't move
+func (o Outbox) claim(ctx context.Context, candidates []Event, until time.Time) ([]Event, error) {
+	claimed := []Event{}
+	for _, e := range candidates {
+		filter := bson.M{"_id": e.ID, "published_at": bson.M{"$exists": false}, "next_attempt_at": e.NextAttemptAt}
+		updated := Event{}
+		err := o.Client.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"next_attempt_at": until}}, &updated)
+		if err == mongolib.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return claimed, translate(err)
+		}
+		claimed = append(claimed, updated)
+	}
+	return claimed, nil
+}
+
+// MarkPublished records the delivery of an event, mongo removes published events after a week
+func (o Outbox) MarkPublished(ctx context.Context, id string, at time.Time) error {
+	update := bson.M{"$set": bson.M{"published_at": at}, "$inc": bson.M{"attempts": 1}, "$unset": bson.M{"last_error": ""}}
+	return translate(o.Client.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, &Event{}))
+}
+
+// MarkFailed records a failed delivery of an event and when to try again
+func (o Outbox) MarkFailed(ctx context.Context, id string, next time.Time, reason string) error {
+	update := bson.M{"$set": bson.M{"next_attempt_at": next, "last_error": reason}, "$inc": bson.M{"attempts": 1}}
+	return translate(o.Client.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, &Event{}))
+}
+
+// OldestPending returns when the oldest event not published yet occurred, nil when every event is published
+func (o Outbox) OldestPending(ctx context.Context) (*time.Time, error) {
+	// published_at is never null, matching null matches the missing ones with the pending_by_age index
+	pending := bson.M{"published_at": nil}
+	findOpts := mongolibopts.Find().SetSort(bson.D{{Key: "occurred_at", Value: 1}}).SetLimit(1)
+	cursor, err := o.Client.Find(ctx, pending, findOpts)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer cursor.Close(ctx)
+
+	if !cursor.Next(ctx) {
+		return nil, translate(cursor.Err())
+	}
+	e := Event{}
+	if err := cursor.Decode(&e); err != nil {
+		return nil, err
+	}
+	return &e.OccurredAt, nil
+}
+
+// OutboxIndexes returns the indexes of the outbox collection: pending events are read by due time and by age,
+// and published ones expire after a week
+func OutboxIndexes() []mongolib.IndexModel {
+	return []mongolib.IndexModel{
+		{
+			Keys:    bson.D{{Key: "next_attempt_at", Value: 1}, {Key: "occurred_at", Value: 1}},
+			Options: mongolibopts.Index().SetName("pending"),
+		},
+		{
+			Keys:    bson.D{{Key: "published_at", Value: 1}, {Key: "occurred_at", Value: 1}},
+			Options: mongolibopts.Index().SetName("pending_by_age"),
+		},
+		{
+			Keys:    bson.D{{Key: "published_at", Value: 1}},
+			Options: mongolibopts.Index().SetName("published_ttl").SetExpireAfterSeconds(int32(publishedRetention.Seconds())),
+		},
+	}
+}
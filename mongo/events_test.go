@@ -0,0 +1,182 @@
+package mongo_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/password"
+	"go.mongodb.org/mongo-driver/bson"
+	mongolib "go.mongodb.org/mongo-driver/mongo"
+)
+
+// mockTransactions runs the function once and rolls back nothing, it only counts transactions
+type mockTransactions struct {
+	count *int
+}
+
+func (m mockTransactions) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	*m.count++
+	return fn(ctx)
+}
+
+// mockOutbox returns an outbox collection keeping the inserted events
+func mockOutbox(events *[]mongo.Event, err error) mockDatabase {
+	return mockDatabase{
+		insertOne: func(ctx context.Context, doc interface{}) error {
+			if err != nil {
+				return err
+			}
+			*events = append(*events, doc.(mongo.Event))
+			return nil
+		},
+	}
+}
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+	stored := mongo.User{ID: "guid", Nickname: "test", Password: "hash", Version: 2}
+	users := mockDatabase{
+		insertOne: func(ctx context.Context, doc interface{}) error {
+			return nil
+		},
+		findOneAndUpdate: func(ctx context.Context, filter interface{}, update interface{}, result interface{}) error {
+			// the user already has the role
+			if _, ok := update.(bson.M)["$addToSet"]; ok {
+				return mongolib.ErrNoDocuments
+			}
+			*result.(*mongo.User) = stored
+			return nil
+		},
+		findOne: func(ctx context.Context, filter interface{}, result interface{}) error {
+			*result.(*mongo.User) = stored
+			return nil
+		},
+	}
+
+	for _, tt := range []struct {
+		name           string
+		change         func(ctx context.Context, client mongo.Mongo) error
+		outboxError    error
+		expectedEvents []string
+		expectedError  error
+	}{
+		{
+			name: "creating a user should emit user.created",
+			change: func(ctx context.Context, client mongo.Mongo) error {
+				_, err := client.CreateUser(ctx, "test", "", "", "S3CR3T", "", "")
+				return err
+			},
+			expectedEvents: []string{mongo.EventUserCreated},
+		},
+		{
+			name: "patching a user should emit user.updated",
+			change: func(ctx context.Context, client mongo.Mongo) error {
+				_, err := client.PatchUser(ctx, "guid", 0, map[string]string{"nickname": "test"})
+				return err
+			},
+			expectedEvents: []string{mongo.EventUserUpdated},
+		},
+		{
+			name: "deleting a user should emit user.deleted",
+			change: func(ctx context.Context, client mongo.Mongo) error {
+				_, err := client.RemoveUser(ctx, "guid", 0)
+				return err
+			},
+			expectedEvents: []string{mongo.EventUserDeleted},
+		},
+		{
+			name: "no-ops shouldn't emit events",
+			change: func(ctx context.Context, client mongo.Mongo) error {
+				_, err := client.GrantRole(ctx, "guid", "admin")
+				return err
+			},
+			expectedEvents: []string{},
+		},
+		{
+			name: "failing to write the event should fail the change",
+			change: func(ctx context.Context, client mongo.Mongo) error {
+				_, err := client.RemoveUser(ctx, "guid", 0)
+				return err
+			},
+			outboxError:    mongolib.ErrClientDisconnected,
+			expectedEvents: []string{},
+			expectedError:  mongo.ErrUnavailable,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			events := []mongo.Event{}
+			transactions := 0
+			client := mongo.Mongo{
+				Client:       users,
+				Hasher:       password.Bcrypt{Cost: 4},
+				Outbox:       mockOutbox(&events, tt.outboxError),
+				Transactions: mockTransactions{count: &transactions},
+			}
+
+			err := tt.change(context.Background(), client)
+
+			if !errors.Is(err, tt.expectedError) || (err != nil) != (tt.expectedError != nil) {
+				t.Fatalf("wrong error: got %v want %v", err, tt.expectedError)
+			}
+			if transactions != 1 {
+				t.Fatalf("the change should run in a transaction: got %d transactions", transactions)
+			}
+			if len(events) != len(tt.expectedEvents) {
+				t.Fatalf("wrong events: got %+v want %v", events, tt.expectedEvents)
+			}
+			for i, e := range events {
+				if e.Type != tt.expectedEvents[i] || e.UserID == "" || e.User.Password != "" {
+					t.Fatalf("wrong event: got %+v want %s without password", e, tt.expectedEvents[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEmitRequiresTransactions(t *testing.T) {
+	t.Parallel()
+	events := []mongo.Event{}
+	changed := false
+	client := mongo.Mongo{
+		Client: mockDatabase{
+			findOneAndUpdate: func(ctx context.Context, filter interface{}, update interface{}, result interface{}) error {
+				changed = true
+				return nil
+			},
+		},
+		Outbox: mockOutbox(&events, nil),
+	}
+
+	if _, err := client.GrantRole(context.Background(), "guid", "admin"); err == nil {
+		t.Fatalf("changes with an outbox but without transactions should fail")
+	}
+	if changed || len(events) != 0 {
+		t.Fatalf("nothing should be written: changed %t, events %+v", changed, events)
+	}
+}
+
+func TestOutboxMarkFailed(t *testing.T) {
+	t.Parallel()
+	next := time.Date(2020, 10, 10, 10, 0, 0, 0, time.UTC)
+	var update interface{}
+	outbox := mongo.Outbox{
+		Client: mockDatabase{
+			findOneAndUpdate: func(ctx context.Context, filter interface{}, u interface{}, result interface{}) error {
+				update = u
+				return nil
+			},
+		},
+	}
+
+	if err := outbox.MarkFailed(context.Background(), "event-1", next, "503 Service Unavailable"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	set := update.(bson.M)["$set"].(bson.M)
+	if set["next_attempt_at"] != next || set["last_error"] != "503 Service Unavailable" || update.(bson.M)["$inc"].(bson.M)["attempts"] != 1 {
+		t.Fatalf("wrong update: got %v", update)
+	}
+}
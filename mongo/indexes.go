@@ -0,0 +1,36 @@
+package mongo
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	mongolib "go.mongodb.org/mongo-driver/mongo"
+	mongolibopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// uniqueIndexes names the unique index of every unique field, the names let
+// duplicate key errors be traced back to the clashing field
+var uniqueIndexes = map[string]string{
+	"nickname": "nickname_unique",
+	"email":    "email_unique",
+}
+
+// UserIndexes returns the indexes of the users collection. Nicknames are unique and
+// so are emails, compared case-insensitively. Soft deleted users keep their nickname
+// and email until they are purged.
+func UserIndexes() []mongolib.IndexModel {
+	return []mongolib.IndexModel{
+		{
+			Keys:    bson.D{{Key: "nickname", Value: 1}},
+			Options: mongolibopts.Index().SetName(uniqueIndexes["nickname"]).SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "email", Value: 1}},
+			Options: mongolibopts.Index().SetName(uniqueIndexes["email"]).SetUnique(true).
+				SetCollation(&mongolibopts.Collation{Locale: "en", Strength: 2}),
+		},
+		{
+			// lets the purger find deleted users without scanning the collection
+			Keys:    bson.D{{Key: "deleted_at", Value: 1}},
+			Options: mongolibopts.Index().SetName("deleted_at").SetSparse(true),
+		},
+	}
+}
@@ -0,0 +1,158 @@
+package mongo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	mongolib "go.mongodb.org/mongo-driver/mongo"
+	mongolibopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The outcomes of collection operations reported to observers
+const (
+	OutcomeSuccess     = "success"
+	OutcomeNotFound    = "not_found"
+	OutcomeConflict    = "conflict"
+	OutcomeInvalid     = "invalid"
+	OutcomeUnavailable = "unavailable"
+	OutcomeError       = "error"
+)
+
+// Observer records the operations on a collection, e.g. as metrics
+type Observer interface {
+	ObserveOperation(collection string, operation string, outcome string, duration time.Duration)
+}
+
+// Instrumented wraps a collection to report the outcome and the duration of every operation to an observer
+type Instrumented struct {
+	Collection
+	// Name is the name of the collection reported to the observer
+	Name     string
+	Observer Observer
+	// Now defaults to time.Now
+	Now func() time.Time
+}
+
+// InsertOne adds a document
+func (c Instrumented) InsertOne(ctx context.Context, doc interface{}) (err error) {
+	defer c.observe("InsertOne", c.now(), &err)
+	return c.Collection.InsertOne(ctx, doc)
+}
+
+// FindOne decodes the first document matching the filter into result
+func (c Instrumented) FindOne(ctx context.Context, filter interface{}, result interface{}) (err error) {
+	defer c.observe("FindOne", c.now(), &err)
+	return c.Collection.FindOne(ctx, filter, result)
+}
+
+// FindOneAndUpdate updates the first document matching the filter and decodes the updated document into result
+func (c Instrumented) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, result interface{}) (err error) {
+	defer c.observe("FindOneAndUpdate", c.now(), &err)
+	return c.Collection.FindOneAndUpdate(ctx, filter, update, result)
+}
+
+// DeleteOne removes the first document matching the filter
+func (c Instrumented) DeleteOne(ctx context.Context, filter interface{}) (res *mongolib.DeleteResult, err error) {
+	defer c.observe("DeleteOne", c.now(), &err)
+	return c.Collection.DeleteOne(ctx, filter)
+}
+
+// DeleteMany removes every document matching the filter
+func (c Instrumented) DeleteMany(ctx context.Context, filter interface{}) (res *mongolib.DeleteResult, err error) {
+	defer c.observe("DeleteMany", c.now(), &err)
+	return c.Collection.DeleteMany(ctx, filter)
+}
+
+// Find returns a cursor over the documents matching the query, iterating it isn't timed
+func (c Instrumented) Find(ctx context.Context, query interface{}, opts ...*mongolibopts.FindOptions) (cursor *mongolib.Cursor, err error) {
+	defer c.observe("Find", c.now(), &err)
+	return c.Collection.Find(ctx, query, opts...)
+}
+
+// CountDocuments counts the documents matching the filter
+func (c Instrumented) CountDocuments(ctx context.Context, filter interface{}) (count int64, err error) {
+	defer c.observe("CountDocuments", c.now(), &err)
+	return c.Collection.CountDocuments(ctx, filter)
+}
+
+func (c Instrumented) observe(operation string, start time.Time, err *error) {
+	c.Observer.ObserveOperation(c.Name, operation, Outcome(*err), c.now().Sub(start))
+}
+
+func (c Instrumented) now() time.Time {
+	if c.Now == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+// Outcome classifies the error of an operation, nil being a success
+func Outcome(err error) string {
+	err = translate(err)
+	switch {
+	case err == nil:
+		return OutcomeSuccess
+	case errors.Is(err, ErrNotFound):
+		return OutcomeNotFound
+	case errors.Is(err, ErrConflict):
+		return OutcomeConflict
+	case errors.Is(err, ErrValidation):
+		return OutcomeInvalid
+	case errors.Is(err, ErrUnavailable):
+		return OutcomeUnavailable
+	default:
+		return OutcomeError
+	}
+}
+
+// SanitizeFilter returns the shape of a filter as JSON with every value replaced by "?", so traces
+// don't leak user data, e.g. {"deleted_at":{"$exists":"?"},"email":"?"}
+func SanitizeFilter(filter interface{}) string {
+	b, err := json.Marshal(sanitize(filter))
+	if err != nil {
+		return "?"
+	}
+	return string(b)
+}
+
+func sanitize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case bson.M:
+		return sanitizeMap(v)
+	case map[string]interface{}:
+		return sanitizeMap(v)
+	case bson.D:
+		m := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			m[e.Key] = sanitize(e.Value)
+		}
+		return m
+	case bson.A:
+		return sanitizeList(v)
+	case []interface{}:
+		return sanitizeList(v)
+	default:
+		return "?"
+	}
+}
+
+func sanitizeMap(m map[string]interface{}) map[string]interface{} {
+	sanitized := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		sanitized[k] = sanitize(v)
+	}
+	return sanitized
+}
+
+func sanitizeList(l []interface{}) []interface{} {
+	sanitized := make([]interface{}, 0, len(l))
+	for _, v := range l {
+		sanitized = append(sanitized, sanitize(v))
+	}
+	return sanitized
+}
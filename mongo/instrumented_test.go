@@ -0,0 +1,110 @@
+package mongo_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jpaldi/go-user-api/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	mongolib "go.mongodb.org/mongo-driver/mongo"
+)
+
+// observation is an operation reported to a recordingObserver
+type observation struct {
+	collection, operation, outcome string
+	duration                       time.Duration
+}
+
+type recordingObserver struct {
+	observations []observation
+}
+
+func (o *recordingObserver) ObserveOperation(collection string, operation string, outcome string, duration time.Duration) {
+	o.observations = append(o.observations, observation{collection, operation, outcome, duration})
+}
+
+func TestInstrumented(t *testing.T) {
+	t.Parallel()
+	duplicate := mongolib.WriteException{WriteErrors: mongolib.WriteErrors{{Code: 11000, Message: "E11000 duplicate key error"}}}
+
+	for _, tt := range []struct {
+		name            string
+		err             error
+		expectedOutcome string
+	}{
+		{name: "successful operations should be reported", expectedOutcome: mongo.OutcomeSuccess},
+		{name: "missing documents should be reported", err: mongolib.ErrNoDocuments, expectedOutcome: mongo.OutcomeNotFound},
+		{name: "duplicate keys should be reported as conflicts", err: duplicate, expectedOutcome: mongo.OutcomeConflict},
+		{name: "timeouts should be reported as unavailable", err: context.DeadlineExceeded, expectedOutcome: mongo.OutcomeUnavailable},
+		{name: "other errors should be reported", err: errors.New("boom"), expectedOutcome: mongo.OutcomeError},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			observer := &recordingObserver{}
+			start := time.Now()
+			calls := 0
+			collection := mongo.Instrumented{
+				Collection: mockDatabase{
+					findOne: func(ctx context.Context, filter interface{}, result interface{}) error {
+						return tt.err
+					},
+				},
+				Name:     "users",
+				Observer: observer,
+				// every call to now is 10ms after the previous one
+				Now: func() time.Time {
+					calls++
+					return start.Add(time.Duration(calls) * 10 * time.Millisecond)
+				},
+			}
+
+			err := collection.FindOne(context.Background(), nil, nil)
+
+			if (err == nil) != (tt.err == nil) || (err != nil && err.Error() != tt.err.Error()) {
+				t.Fatalf("errors should be returned as is: got %v want %v", err, tt.err)
+			}
+			expected := observation{"users", "FindOne", tt.expectedOutcome, 10 * time.Millisecond}
+			if len(observer.observations) != 1 || observer.observations[0] != expected {
+				t.Fatalf("wrong observations: got %+v want %+v", observer.observations, expected)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilter(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name     string
+		filter   interface{}
+		expected string
+	}{
+		{
+			name:     "values should be replaced",
+			filter:   bson.M{"email": "someone@example.com", "deleted_at": bson.M{"$exists": false}},
+			expected: `{"deleted_at":{"$exists":"?"},"email":"?"}`,
+		},
+		{
+			name:     "lists should keep their shape",
+			filter:   bson.M{"$or": bson.A{bson.M{"nickname": "joao"}, bson.M{"email": "joao"}}},
+			expected: `{"$or":[{"nickname":"?"},{"email":"?"}]}`,
+		},
+		{
+			name:     "ordered documents should be sanitised",
+			filter:   bson.D{{Key: "_id", Value: "user-1"}},
+			expected: `{"_id":"?"}`,
+		},
+		{
+			name:     "missing filters should stay empty",
+			expected: `null`,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mongo.SanitizeFilter(tt.filter); got != tt.expected {
+				t.Fatalf("wrong filter: got %s want %s", got, tt.expected)
+			}
+		})
+	}
+}
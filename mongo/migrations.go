@@ -0,0 +1,129 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Migration changes existing documents once, e.g. to backfill a new field.
+// Instances starting together may both run a migration, so migrations must be idempotent.
+type Migration struct {
+	ID string
+	Up func(ctx context.Context) error
+}
+
+// migrationRecord is stored in the migrations collection once a migration has run
+type migrationRecord struct {
+	ID        string    `bson:"_id"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+// Migrate runs, in order, the migrations not recorded in the log collection yet and returns their ids.
+// It stops at the first failing migration, which runs again on the next start.
+func Migrate(ctx context.Context, log Collection, migrations []Migration) ([]string, error) {
+	applied := []string{}
+	for _, m := range migrations {
+		err := log.FindOne(ctx, bson.M{"_id": m.ID}, &migrationRecord{})
+		if err == nil {
+			continue
+		}
+		if translate(err) != ErrNotFound {
+			return applied, fmt.Errorf("reading migration %s: %w", m.ID, translate(err))
+		}
+
+		if err := m.Up(ctx); err != nil {
+			return applied, fmt.Errorf("running migration %s: %w", m.ID, err)
+		}
+		// a conflict means another instance recorded the migration first
+		if err := translate(log.InsertOne(ctx, migrationRecord{ID: m.ID, AppliedAt: Now()})); err != nil && !errors.Is(err, ErrConflict) {
+			return applied, fmt.Errorf("recording migration %s: %w", m.ID, err)
+		}
+		applied = append(applied, m.ID)
+	}
+	return applied, nil
+}
+
+// UserMigrations are the migrations of the users collection
+func UserMigrations(users Collection) []Migration {
+	return []Migration{
+		{ID: "0001_backfill_timestamps_and_version", Up: backfillTimestamps(users)},
+		{ID: "0002_lowercase_emails", Up: lowercaseEmails(users)},
+	}
+}
+
+// backfillTimestamps sets created_at, updated_at and version on users stored before they existed.
+// The creation time of those users is unknown so it is set to the migration time.
+func backfillTimestamps(users Collection) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		missing := bson.M{"$or": bson.A{
+			bson.M{"created_at": bson.M{"$exists": false}},
+			bson.M{"updated_at": bson.M{"$exists": false}},
+			bson.M{"version": bson.M{"$exists": false}},
+		}}
+		cursor, err := users.Find(ctx, missing)
+		if err != nil {
+			return translate(err)
+		}
+		defer cursor.Close(ctx)
+
+		now := Now()
+		for cursor.Next(ctx) {
+			u := User{}
+			if err := cursor.Decode(&u); err != nil {
+				return err
+			}
+			// users removed meanwhile are not found, there is nothing to backfill then
+			err := translate(users.FindOneAndUpdate(ctx, bson.M{"_id": u.ID}, bson.M{"$set": backfill(u, now)}, &User{}))
+			if err != nil && err != ErrNotFound {
+				return fmt.Errorf("backfilling user %s: %w", u.ID, err)
+			}
+		}
+		return translate(cursor.Err())
+	}
+}
+
+// backfill returns the missing bookkeeping fields of a user
+func backfill(u User, now time.Time) bson.M {
+	set := bson.M{}
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = now
+		set["created_at"] = now
+	}
+	if u.UpdatedAt.IsZero() {
+		set["updated_at"] = u.CreatedAt
+	}
+	if u.Version == 0 {
+		set["version"] = int64(1)
+	}
+	return set
+}
+
+// lowercaseEmails lowercases the emails stored before they were, so they are found by the lowercased logins and
+// filters. The unique email index ignores case, so no two users end up with the same email.
+func lowercaseEmails(users Collection) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		cursor, err := users.Find(ctx, bson.M{"email": bson.M{"$regex": "[A-Z]"}})
+		if err != nil {
+			return translate(err)
+		}
+		defer cursor.Close(ctx)
+
+		for cursor.Next(ctx) {
+			u := User{}
+			if err := cursor.Decode(&u); err != nil {
+				return err
+			}
+			// the email is only replaced if it didn't change meanwhile
+			filter := bson.M{"_id": u.ID, "email": u.Email}
+			err := translate(users.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"email": NormalizeEmail(u.Email)}}, &User{}))
+			if err != nil && err != ErrNotFound {
+				return fmt.Errorf("lowercasing the email of user %s: %w", u.ID, err)
+			}
+		}
+		return translate(cursor.Err())
+	}
+}
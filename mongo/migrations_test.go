@@ -0,0 +1,91 @@
+package mongo_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/jpaldi/go-user-api/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	mongolib "go.mongodb.org/mongo-driver/mongo"
+)
+
+// mockMigrationLog records migrations in a map
+func mockMigrationLog(recorded map[string]bool) mockDatabase {
+	return mockDatabase{
+		findOne: func(ctx context.Context, filter interface{}, result interface{}) error {
+			if recorded[filter.(bson.M)["_id"].(string)] {
+				return nil
+			}
+			return mongolib.ErrNoDocuments
+		},
+		insertOne: func(ctx context.Context, doc interface{}) error {
+			b, _ := bson.Marshal(doc)
+			record := bson.M{}
+			bson.Unmarshal(b, &record)
+			recorded[record["_id"].(string)] = true
+			return nil
+		},
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+	broken := errors.New("broken")
+	for _, tt := range []struct {
+		name            string
+		recorded        map[string]bool
+		failing         string
+		expectedRuns    []string
+		expectedApplied []string
+		expectedError   error
+	}{
+		{
+			name:            "it should run every migration on a new database",
+			recorded:        map[string]bool{},
+			expectedRuns:    []string{"0001", "0002"},
+			expectedApplied: []string{"0001", "0002"},
+		},
+		{
+			name:            "it should skip recorded migrations",
+			recorded:        map[string]bool{"0001": true},
+			expectedRuns:    []string{"0002"},
+			expectedApplied: []string{"0002"},
+		},
+		{
+			name:            "it should stop at a failing migration without recording it",
+			recorded:        map[string]bool{},
+			failing:         "0001",
+			expectedRuns:    []string{"0001"},
+			expectedApplied: []string{},
+			expectedError:   broken,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			runs := []string{}
+			migration := func(id string) mongo.Migration {
+				return mongo.Migration{ID: id, Up: func(ctx context.Context) error {
+					runs = append(runs, id)
+					if id == tt.failing {
+						return broken
+					}
+					return nil
+				}}
+			}
+
+			applied, err := mongo.Migrate(context.Background(), mockMigrationLog(tt.recorded), []mongo.Migration{migration("0001"), migration("0002")})
+
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("wrong error: got %v want %v", err, tt.expectedError)
+			}
+			if !reflect.DeepEqual(runs, tt.expectedRuns) || !reflect.DeepEqual(applied, tt.expectedApplied) {
+				t.Fatalf("wrong migrations: ran %v and applied %v, want %v and %v", runs, applied, tt.expectedRuns, tt.expectedApplied)
+			}
+			if tt.failing != "" && tt.recorded[tt.failing] {
+				t.Fatalf("the failing migration %s was recorded", tt.failing)
+			}
+		})
+	}
+}
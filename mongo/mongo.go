@@ -4,14 +4,24 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/jpaldi/go-user-api/password"
 	"go.mongodb.org/mongo-driver/bson"
 	mongolib "go.mongodb.org/mongo-driver/mongo"
+	mongolibopts "go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
-	validURLParams = []string{"nickname", "first_name", "country", "last_name", "email"}
+	// ValidURLParams lists the query parameters GetUsers accepts as filters
+	ValidURLParams = []string{"nickname", "first_name", "country", "last_name", "email"}
+	// PatchableFields lists the fields PatchUser can change, by their json and bson name
+	PatchableFields = []string{"nickname", "first_name", "last_name", "password", "email", "country"}
 )
 
 // User represents the object stored in database.
@@ -20,124 +30,486 @@ type User struct {
 	Nickname  string `json:"nickname" bson:"nickname"`
 	FirstName string `json:"first_name" bson:"first_name"`
 	LastName  string `json:"last_name" bson:"last_name"`
-	Password  string `json:"password" bson:"password"`
+	Password  string `json:"-" bson:"password"` // the password hash, never sent to clients
 	Email     string `json:"email" bson:"email"`
 	Country   string `json:"country" bson:"country"`
+	// Roles are granted and revoked by admins, see the policy package
+	Roles     []string  `json:"roles,omitempty" bson:"roles,omitempty"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+	// Version starts at 1 and is incremented by every change
+	Version int64 `json:"version" bson:"version"`
+	// DeletedAt is set when the user is soft deleted, deleted users are purged after a retention period
+	DeletedAt *time.Time `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
 }
 
 // Collection represents the interface to wrap the mongo drive collection
 type Collection interface {
 	InsertOne(ctx context.Context, doc interface{}) error
-	FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}) *mongolib.SingleResult
+	// FindOne decodes the first document matching the filter into result
+	FindOne(ctx context.Context, filter interface{}, result interface{}) error
+	// FindOneAndUpdate updates the first document matching the filter and decodes the updated document into result
+	FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, result interface{}) error
 	DeleteOne(ctx context.Context, filter interface{}) (*mongolib.DeleteResult, error)
-	Find(ctx context.Context, query interface{}) (*mongolib.Cursor, error)
+	DeleteMany(ctx context.Context, filter interface{}) (*mongolib.DeleteResult, error)
+	Find(ctx context.Context, query interface{}, opts ...*mongolibopts.FindOptions) (*mongolib.Cursor, error)
+	CountDocuments(ctx context.Context, filter interface{}) (int64, error)
+}
+
+// PasswordHasher hashes passwords before they are stored and verifies them afterwards.
+// Verify must accept hashes from every supported algorithm and report when a hash
+// should be replaced because it was produced with another algorithm or parameters.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password string, hash string) (rehash bool, err error)
 }
 
 // Mongo represents a mongo client wrapped to provide service-specific functionality.
 type Mongo struct {
 	Client Collection
+	// Hasher defaults to argon2id when not set
+	Hasher PasswordHasher
+	// Outbox receives the event of every change when set, see emit
+	Outbox Collection
+	// Transactions writes changes and their events atomically, it is required with an Outbox
+	Transactions Transactions
+}
+
+func (mgo Mongo) hasher() PasswordHasher {
+	if mgo.Hasher == nil {
+		return password.DefaultArgon2id
+	}
+	return mgo.Hasher
 }
 
 // CreateUser creates a user and returns the object if is successfully inserted
 func (mgo Mongo) CreateUser(ctx context.Context, nickname string, firstname string, lastname string, password string, email string, country string) (*User, error) {
+	hash, err := mgo.hasher().Hash(password)
+	if err != nil {
+		return nil, err
+	}
+
+	now := Now()
 	user := User{
 		ID:        uuid.New().String(),
 		Nickname:  nickname,
 		FirstName: firstname,
 		LastName:  lastname,
-		Password:  password,
-		Email:     email,
+		Password:  hash,
+		Email:     NormalizeEmail(email),
 		Country:   country,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Version:   1,
 	}
 
-	if err := mgo.Client.InsertOne(ctx, user); err != nil {
-		return nil, fmt.Errorf("cannot insert: %s", err)
-	}
-
-	return &user, nil
+	return mgo.emit(ctx, EventUserCreated, func(ctx context.Context) (*User, bool, error) {
+		if err := mgo.Client.InsertOne(ctx, user); err != nil {
+			return nil, false, fmt.Errorf("cannot insert: %w", translate(err))
+		}
+		return &user, true, nil
+	})
 }
 
-// UpdateUser creates a user and returns the object if is successfully inserted
-func (mgo Mongo) UpdateUser(ctx context.Context, guid string, nickname string, firstname string, lastname string, password string, email string, country string) (*User, error) {
+// UpdateUser updates a user and returns the updated object, or ErrNotFound. When version isn't 0
+// the user is only updated at that version, otherwise ErrVersionMismatch is returned.
+func (mgo Mongo) UpdateUser(ctx context.Context, guid string, version int64, nickname string, firstname string, lastname string, password string, email string, country string) (*User, error) {
+	hash, err := mgo.hasher().Hash(password)
+	if err != nil {
+		return nil, err
+	}
 
-	update := bson.M{
+	update := change(bson.M{
 		"$set": bson.M{
 			"nickname":   nickname,
 			"first_name": firstname,
 			"last_name":  lastname,
-			"password":   password,
-			"email":      email,
+			"password":   hash,
+			"email":      NormalizeEmail(email),
 			"country":    country,
 		},
+	})
+	return mgo.emit(ctx, EventUserUpdated, func(ctx context.Context) (*User, bool, error) {
+		user := User{}
+		if err := mgo.Client.FindOneAndUpdate(ctx, versioned(guid, version), update, &user); err != nil {
+			return nil, false, mgo.mismatch(ctx, guid, version, err)
+		}
+		return &user, true, nil
+	})
+}
+
+// versioned returns the filter of a user at a version, any version when it is 0
+func versioned(guid string, version int64) bson.M {
+	filter := active(bson.M{"_id": guid})
+	if version > 0 {
+		filter["version"] = version
+	}
+	return filter
+}
+
+// active restricts a filter to the users that aren't soft deleted
+func active(filter bson.M) bson.M {
+	filter["deleted_at"] = bson.M{"$exists": false}
+	return filter
+}
+
+// mismatch tells apart missing users from users at another version when a versioned change matched nothing
+func (mgo Mongo) mismatch(ctx context.Context, guid string, version int64, err error) error {
+	if err != mongolib.ErrNoDocuments || version == 0 {
+		return translate(err)
+	}
+	if _, err := mgo.GetUser(ctx, guid); err != nil {
+		return err
+	}
+	return ErrVersionMismatch
+}
+
+// PatchUser sets only the changed fields, keyed by their json name, and returns the updated user or ErrNotFound.
+// A new password is hashed before it is stored. Like UpdateUser, a version other than 0 must match the stored one.
+func (mgo Mongo) PatchUser(ctx context.Context, guid string, version int64, changes map[string]string) (*User, error) {
+	set := bson.M{}
+	for field, value := range changes {
+		if !contains(PatchableFields, field) {
+			return nil, &Error{Kind: ErrValidation, Field: field, Message: fmt.Sprintf("%s cannot be changed", field)}
+		}
+		if field == "password" {
+			hash, err := mgo.hasher().Hash(value)
+			if err != nil {
+				return nil, err
+			}
+			value = hash
+		}
+		if field == "email" {
+			value = NormalizeEmail(value)
+		}
+		set[field] = value
+	}
+	if len(set) == 0 {
+		user, err := mgo.GetUser(ctx, guid)
+		if err == nil && version > 0 && user.Version != version {
+			return nil, ErrVersionMismatch
+		}
+		return user, err
+	}
+
+	return mgo.emit(ctx, EventUserUpdated, func(ctx context.Context) (*User, bool, error) {
+		user := User{}
+		if err := mgo.Client.FindOneAndUpdate(ctx, versioned(guid, version), change(bson.M{"$set": set}), &user); err != nil {
+			return nil, false, mgo.mismatch(ctx, guid, version, err)
+		}
+		return &user, true, nil
+	})
+}
+
+// Now returns the current time with the millisecond precision mongo stores
+func Now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// change adds the bookkeeping of every change to an update: the update time and the next version
+func change(update bson.M) bson.M {
+	set, ok := update["$set"].(bson.M)
+	if !ok {
+		set = bson.M{}
+		update["$set"] = set
 	}
-	result := mgo.Client.FindOneAndUpdate(ctx, bson.M{"_id": guid}, update)
-	if result.Err() != nil {
-		return nil, result.Err()
+	set["updated_at"] = Now()
+	update["$inc"] = bson.M{"version": 1}
+	return update
+}
+
+// VerifyPassword checks the password of a user and returns the user when it matches.
+// Hashes produced with outdated algorithms or parameters are transparently replaced.
+func (mgo Mongo) VerifyPassword(ctx context.Context, guid string, plain string) (*User, error) {
+	return mgo.verify(ctx, active(bson.M{"_id": guid}), plain)
+}
+
+// Authenticate finds a user by nickname or email and returns it when the password matches
+func (mgo Mongo) Authenticate(ctx context.Context, login string, plain string) (*User, error) {
+	filter := bson.M{"nickname": login}
+	if IsEmailLogin(login) {
+		filter = bson.M{"email": NormalizeEmail(login)}
 	}
+	user, err := mgo.verify(ctx, active(filter), plain)
+	if err == ErrNotFound {
+		VerifyUnknownLogin(mgo.hasher(), plain)
+	}
+	return user, err
+}
 
-	doc := bson.M{}
-	decodeErr := result.Decode(&doc)
-	if decodeErr != nil {
-		return nil, decodeErr
+// dummyHashes caches the hash unknown logins are verified against, by hasher
+var dummyHashes sync.Map
+
+// VerifyUnknownLogin verifies the password against a dummy hash of the hasher, so unknown logins take as long to
+// reject as wrong passwords and the response time doesn't reveal which logins exist
+func VerifyUnknownLogin(hasher PasswordHasher, plain string) {
+	cacheable := reflect.TypeOf(hasher).Comparable()
+	if cacheable {
+		if hash, ok := dummyHashes.Load(hasher); ok {
+			hasher.Verify(plain, hash.(string))
+			return
+		}
 	}
+	hash, err := hasher.Hash("not the password of any user")
+	if err != nil {
+		return
+	}
+	if cacheable {
+		dummyHashes.Store(hasher, hash)
+	}
+	hasher.Verify(plain, hash)
+}
 
+// IsEmailLogin reports whether a login is an email rather than a nickname, which can't contain an @, so a login
+// never matches the nickname of one user and the email of another
+func IsEmailLogin(login string) bool {
+	return strings.Contains(login, "@")
+}
+
+func (mgo Mongo) verify(ctx context.Context, filter bson.M, plain string) (*User, error) {
 	user := User{}
-	bsonBytes, _ := bson.Marshal(doc)
+	if err := mgo.Client.FindOne(ctx, filter, &user); err != nil {
+		return nil, translate(err)
+	}
 
-	err := bson.Unmarshal(bsonBytes, &user)
+	rehash, err := mgo.hasher().Verify(plain, user.Password)
 	if err != nil {
 		return nil, err
 	}
+
+	if rehash {
+		hash, err := mgo.hasher().Hash(plain)
+		if err != nil {
+			return nil, err
+		}
+		// the password was already verified, failing to upgrade the hash only means trying again next time
+		update := bson.M{"$set": bson.M{"password": hash}}
+		updated := User{}
+		if err := mgo.Client.FindOneAndUpdate(ctx, bson.M{"_id": user.ID, "password": user.Password}, update, &updated); err == nil {
+			user = updated
+		}
+	}
+
 	return &user, nil
 }
 
-// RemoveUser removes a user from mongo
-func (mgo Mongo) RemoveUser(ctx context.Context, guid string) (int64, error) {
-	filter := bson.M{
-		"_id": guid,
+// GetUser returns a single user by id, or ErrNotFound when it doesn't exist or was deleted
+func (mgo Mongo) GetUser(ctx context.Context, guid string) (*User, error) {
+	user := User{}
+	if err := mgo.Client.FindOne(ctx, active(bson.M{"_id": guid}), &user); err != nil {
+		return nil, translate(err)
 	}
-	res, err := mgo.Client.DeleteOne(ctx, filter)
+	return &user, nil
+}
+
+// GetRoles returns the roles of a user
+func (mgo Mongo) GetRoles(ctx context.Context, guid string) ([]string, error) {
+	user, err := mgo.GetUser(ctx, guid)
+	if err != nil {
+		return nil, err
+	}
+	return user.Roles, nil
+}
 
-	return res.DeletedCount, err
+// GrantRole adds a role to a user and returns the updated user, granting a role twice is a no-op
+func (mgo Mongo) GrantRole(ctx context.Context, guid string, role string) (*User, error) {
+	filter := active(bson.M{"_id": guid, "roles": bson.M{"$ne": role}})
+	return mgo.updateMatching(ctx, guid, filter, change(bson.M{"$addToSet": bson.M{"roles": role}}))
 }
 
-// GetUsers get a users from mongo
-func (mgo Mongo) GetUsers(ctx context.Context, params url.Values) ([]*User, error) {
-	query := bson.M{}
-	for k, v := range params {
-		// check if the query parameter is expected to avoid SQL Injections
-		if contains(validURLParams, k) {
-			query[k] = v[0]
+// RevokeRole removes a role from a user and returns the updated user
+func (mgo Mongo) RevokeRole(ctx context.Context, guid string, role string) (*User, error) {
+	filter := active(bson.M{"_id": guid, "roles": role})
+	return mgo.updateMatching(ctx, guid, filter, change(bson.M{"$pull": bson.M{"roles": role}}))
+}
+
+// updateMatching only changes users the filter matches, so no-ops keep the user version and emit no event
+func (mgo Mongo) updateMatching(ctx context.Context, guid string, filter bson.M, update bson.M) (*User, error) {
+	return mgo.emit(ctx, EventUserUpdated, func(ctx context.Context) (*User, bool, error) {
+		user := User{}
+		err := mgo.Client.FindOneAndUpdate(ctx, filter, update, &user)
+		if err == mongolib.ErrNoDocuments {
+			unchanged, err := mgo.GetUser(ctx, guid)
+			return unchanged, false, err
+		}
+		if err != nil {
+			return nil, false, translate(err)
+		}
+		return &user, true, nil
+	})
+}
+
+// RemoveUser soft deletes a user, setting its deleted_at, and returns how many users were deleted.
+// When version isn't 0 the user is only deleted at that version, otherwise ErrVersionMismatch is returned.
+func (mgo Mongo) RemoveUser(ctx context.Context, guid string, version int64) (int64, error) {
+	update := change(bson.M{"$set": bson.M{"deleted_at": Now()}})
+	deleted, err := mgo.emit(ctx, EventUserDeleted, func(ctx context.Context) (*User, bool, error) {
+		user := User{}
+		err := mgo.Client.FindOneAndUpdate(ctx, versioned(guid, version), update, &user)
+		if err == mongolib.ErrNoDocuments {
+			if err := mgo.mismatch(ctx, guid, version, err); err != ErrNotFound {
+				return nil, false, err
+			}
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, translate(err)
 		}
+		return &user, true, nil
+	})
+	if err != nil || deleted == nil {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+// RestoreUser undoes the soft delete of a user and returns it, restoring a user that isn't deleted is a no-op
+func (mgo Mongo) RestoreUser(ctx context.Context, guid string) (*User, error) {
+	filter := bson.M{"_id": guid, "deleted_at": bson.M{"$exists": true}}
+	return mgo.updateMatching(ctx, guid, filter, change(bson.M{"$unset": bson.M{"deleted_at": ""}}))
+}
+
+// PurgeUsers permanently removes the users soft deleted before the given time and returns how many were removed
+func (mgo Mongo) PurgeUsers(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	res, err := mgo.Client.DeleteMany(ctx, bson.M{"deleted_at": bson.M{"$lt": deletedBefore}})
+	if err != nil {
+		return 0, translate(err)
 	}
+	return res.DeletedCount, nil
+}
+
+// CountUsers returns how many users exist, deleted users excluded
+func (mgo Mongo) CountUsers(ctx context.Context) (int64, error) {
+	count, err := mgo.Client.CountDocuments(ctx, active(bson.M{}))
+	if err != nil {
+		return 0, translate(err)
+	}
+	return count, nil
+}
 
-	cursor, err := mgo.Client.Find(ctx, query)
+// GetUsers get a page of users from mongo
+func (mgo Mongo) GetUsers(ctx context.Context, opts ListOptions) (*UserPage, error) {
+	query, err := opts.query()
 	if err != nil {
 		return nil, err
 	}
+
+	// ask for one more user to know whether there is a next page
+	findOpts := mongolibopts.Find().SetSort(opts.sort()).SetLimit(int64(opts.Limit + 1))
+	cursor, err := mgo.Client.Find(ctx, query, findOpts)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer cursor.Close(ctx)
 	users := []*User{}
 
 	for cursor.Next(ctx) {
-		doc := bson.M{}
-		if err = cursor.Decode(&doc); err != nil {
+		u := User{}
+		if err = cursor.Decode(&u); err != nil {
 			return nil, err
 		}
 
-		bytes, err := bson.Marshal(doc)
-		if err != nil {
-			return nil, err
-		}
+		users = append(users, &u)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, translate(err)
+	}
 
-		u := User{}
-		err = bson.Unmarshal(bytes, &u)
-		if err != nil {
-			return nil, err
+	return page(opts, users), nil
+}
+
+// page trims the extra user fetched to detect the next page
+func page(opts ListOptions, users []*User) *UserPage {
+	p := &UserPage{Users: users}
+	if len(users) > opts.Limit {
+		p.Users = users[:opts.Limit]
+		p.NextPageToken = opts.NextPageToken(*p.Users[opts.Limit-1])
+	}
+	return p
+}
+
+// Page returns the page of users described by the options out of every user matching the filter,
+// it lets other backends paginate the same way as mongo
+func Page(opts ListOptions, users []*User) *UserPage {
+	sort.SliceStable(users, func(i, j int) bool {
+		return opts.Less(*users[i], *users[j])
+	})
+
+	selected := []*User{}
+	for _, u := range users {
+		if opts.Includes(*u) {
+			selected = append(selected, u)
 		}
+		if len(selected) > opts.Limit {
+			break
+		}
+	}
+	return page(opts, selected)
+}
 
-		users = append(users, &u)
+// Field returns the value of one of PatchableFields, or the id, by its bson name
+func (u User) Field(field string) string {
+	switch field {
+	case "_id":
+		return u.ID
+	case "nickname":
+		return u.Nickname
+	case "first_name":
+		return u.FirstName
+	case "last_name":
+		return u.LastName
+	case "password":
+		return u.Password
+	case "email":
+		return u.Email
+	case "country":
+		return u.Country
 	}
+	return ""
+}
+
+// SetField sets one of PatchableFields by name, the password must already be hashed
+func (u *User) SetField(field string, value string) error {
+	switch field {
+	case "nickname":
+		u.Nickname = value
+	case "first_name":
+		u.FirstName = value
+	case "last_name":
+		u.LastName = value
+	case "password":
+		u.Password = value
+	case "email":
+		u.Email = NormalizeEmail(value)
+	case "country":
+		u.Country = value
+	default:
+		return &Error{Kind: ErrValidation, Field: field, Message: fmt.Sprintf("%s cannot be changed", field)}
+	}
+	return nil
+}
+
+// FilterParams keeps the first value of every expected query parameter, so every
+// storage backend filters users the same way
+func FilterParams(params url.Values) map[string]string {
+	filter := map[string]string{}
+	for k, v := range params {
+		// check if the query parameter is expected to avoid SQL Injections
+		if contains(ValidURLParams, k) {
+			filter[k] = v[0]
+		}
+	}
+	if email, ok := filter["email"]; ok {
+		filter["email"] = NormalizeEmail(email)
+	}
+	return filter
+}
 
-	return users, nil
+// NormalizeEmail lowercases emails, which are stored and looked up in lower case as they are unique regardless of
+// their case, see UserIndexes
+func NormalizeEmail(email string) string {
+	return strings.ToLower(email)
 }
 
 func contains(arr []string, str string) bool {
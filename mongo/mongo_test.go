@@ -2,11 +2,16 @@ package mongo_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/password"
+	"go.mongodb.org/mongo-driver/bson"
 	mongolib "go.mongodb.org/mongo-driver/mongo"
+	mongolibopts "go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type mockClient struct {
@@ -14,9 +19,12 @@ type mockClient struct {
 }
 type mockDatabase struct {
 	insertOne        func(ctx context.Context, doc interface{}) error
-	findOneAndUpdate func(ctx context.Context, filter interface{}, update interface{}) *mongolib.SingleResult
+	findOne          func(ctx context.Context, filter interface{}, result interface{}) error
+	findOneAndUpdate func(ctx context.Context, filter interface{}, update interface{}, result interface{}) error
 	deleteOne        func(ctx context.Context, filter interface{}) (*mongolib.DeleteResult, error)
-	find             func(ctx context.Context, query interface{}) (*mongolib.Cursor, error)
+	deleteMany       func(ctx context.Context, filter interface{}) (*mongolib.DeleteResult, error)
+	find             func(ctx context.Context, query interface{}, opts ...*mongolibopts.FindOptions) (*mongolib.Cursor, error)
+	countDocuments   func(ctx context.Context, filter interface{}) (int64, error)
 }
 
 func (m mockDatabase) InsertOne(ctx context.Context, doc interface{}) error {
@@ -27,12 +35,24 @@ func (m mockDatabase) DeleteOne(ctx context.Context, filter interface{}) (*mongo
 	return m.deleteOne(ctx, filter)
 }
 
-func (m mockDatabase) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}) *mongolib.SingleResult {
-	return m.findOneAndUpdate(ctx, filter, update)
+func (m mockDatabase) DeleteMany(ctx context.Context, filter interface{}) (*mongolib.DeleteResult, error) {
+	return m.deleteMany(ctx, filter)
 }
 
-func (m mockDatabase) Find(ctx context.Context, query interface{}) (*mongolib.Cursor, error) {
-	return m.find(ctx, query)
+func (m mockDatabase) FindOne(ctx context.Context, filter interface{}, result interface{}) error {
+	return m.findOne(ctx, filter, result)
+}
+
+func (m mockDatabase) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, result interface{}) error {
+	return m.findOneAndUpdate(ctx, filter, update, result)
+}
+
+func (m mockDatabase) Find(ctx context.Context, query interface{}, opts ...*mongolibopts.FindOptions) (*mongolib.Cursor, error) {
+	return m.find(ctx, query, opts...)
+}
+
+func (m mockDatabase) CountDocuments(ctx context.Context, filter interface{}) (int64, error) {
+	return m.countDocuments(ctx, filter)
 }
 
 func mockInsertDatabaseFailure() mockDatabase {
@@ -100,14 +120,451 @@ func TestCreateUser(t *testing.T) {
 	}
 }
 
+func TestCreateUserConflicts(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name          string
+		err           error
+		expectedField string
+	}{
+		{
+			name: "a duplicate key on the email index should name the email",
+			err: mongolib.WriteException{WriteErrors: mongolib.WriteErrors{{
+				Code:    11000,
+				Message: `E11000 duplicate key error collection: users.users index: email_unique dup key: { email: "test@email.uk" }`,
+			}}},
+			expectedField: "email",
+		},
+		{
+			name: "a duplicate key on the nickname index should name the nickname",
+			err: mongolib.WriteException{WriteErrors: mongolib.WriteErrors{{
+				Code:    11000,
+				Message: `E11000 duplicate key error collection: users.users index: nickname_unique dup key: { nickname: "test" }`,
+			}}},
+			expectedField: "nickname",
+		},
+		{
+			name: "a duplicate key on another index should name the key",
+			err: mongolib.CommandError{
+				Code:    11000,
+				Message: `E11000 duplicate key error collection: users.users index: legacy_1 dup key: { legacy: "test" }`,
+			},
+			expectedField: "legacy",
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			client := mongo.Mongo{
+				Client: mockDatabase{
+					insertOne: func(ctx context.Context, doc interface{}) error {
+						return tt.err
+					},
+				},
+				Hasher: password.Bcrypt{Cost: 4},
+			}
+
+			_, err := client.CreateUser(context.Background(), "test", "", "", "S3CR3T", "test@email.uk", "")
+
+			var storageErr *mongo.Error
+			if !errors.Is(err, mongo.ErrConflict) || !errors.As(err, &storageErr) {
+				t.Fatalf("wrong error: got %v want %v", err, mongo.ErrConflict)
+			}
+			if storageErr.Field != tt.expectedField {
+				t.Fatalf("wrong field: got %s want %s", storageErr.Field, tt.expectedField)
+			}
+		})
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name             string
+		database         mockDatabase
+		expectedError    error
+		expectedNickname string
+	}{
+		{
+			name: "if the user exists, it should return it",
+			database: mockDatabase{
+				findOne: func(ctx context.Context, filter interface{}, result interface{}) error {
+					*result.(*mongo.User) = mongo.User{ID: "guid", Nickname: "test"}
+					return nil
+				},
+			},
+			expectedNickname: "test",
+		},
+		{
+			name: "if the user doesn't exist, it should return ErrNotFound",
+			database: mockDatabase{
+				findOne: func(ctx context.Context, filter interface{}, result interface{}) error {
+					return mongolib.ErrNoDocuments
+				},
+			},
+			expectedError: mongo.ErrNotFound,
+		},
+		{
+			name: "if database adapter returns an error, it should return it",
+			database: mockDatabase{
+				findOne: func(ctx context.Context, filter interface{}, result interface{}) error {
+					return fmt.Errorf("connection refused")
+				},
+			},
+			expectedError: fmt.Errorf("connection refused"),
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			client := mongo.Mongo{
+				Client: tt.database,
+			}
+
+			usr, err := client.GetUser(context.Background(), "guid")
+
+			if fmt.Sprint(err) != fmt.Sprint(tt.expectedError) {
+				t.Fatalf("wrong error: got %v want %v", err, tt.expectedError)
+			}
+			if usr != nil && usr.Nickname != tt.expectedNickname {
+				t.Fatalf("wrong Nickname: got %s want %s", usr.Nickname, tt.expectedNickname)
+			}
+		})
+	}
+}
+
+func mockFindOneAndUpdate(err error) mockDatabase {
+	return mockDatabase{
+		findOneAndUpdate: func(ctx context.Context, filter interface{}, update interface{}, result interface{}) error {
+			if err != nil {
+				return err
+			}
+			*result.(*mongo.User) = mongo.User{ID: "guid", Nickname: "test"}
+			return nil
+		},
+	}
+}
+
 func TestUpdateUser(t *testing.T) {
-	// TODO
+	t.Parallel()
+	for _, tt := range []struct {
+		name          string
+		database      mockDatabase
+		expectedError error
+	}{
+		{
+			name:     "if database adapter updates successfully, it should return the updated user",
+			database: mockFindOneAndUpdate(nil),
+		},
+		{
+			name:          "if the user doesn't exist, it should return ErrNotFound",
+			database:      mockFindOneAndUpdate(mongolib.ErrNoDocuments),
+			expectedError: mongo.ErrNotFound,
+		},
+		{
+			name:          "if the update hits a duplicate key, it should return ErrConflict",
+			database:      mockFindOneAndUpdate(mongolib.CommandError{Code: 11000, Message: "E11000 duplicate key error"}),
+			expectedError: mongo.ErrConflict,
+		},
+		{
+			name:          "if the document fails validation, it should return ErrValidation",
+			database:      mockFindOneAndUpdate(mongolib.CommandError{Code: 121, Message: "Document failed validation"}),
+			expectedError: mongo.ErrValidation,
+		},
+		{
+			name:          "if the server can't be reached, it should return ErrUnavailable",
+			database:      mockFindOneAndUpdate(mongolib.CommandError{Message: "connection reset", Labels: []string{"NetworkError"}}),
+			expectedError: mongo.ErrUnavailable,
+		},
+		{
+			name:          "if the context expires, it should return ErrUnavailable",
+			database:      mockFindOneAndUpdate(context.DeadlineExceeded),
+			expectedError: mongo.ErrUnavailable,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			client := mongo.Mongo{
+				Client: tt.database,
+				Hasher: password.Bcrypt{Cost: 4},
+			}
+
+			usr, err := client.UpdateUser(context.Background(), "guid", 0, "test", "", "", "S3CR3T", "", "")
+
+			if !errors.Is(err, tt.expectedError) || (err != nil) != (tt.expectedError != nil) {
+				t.Fatalf("wrong error: got %v want %v", err, tt.expectedError)
+			}
+			if err == nil && usr.Nickname != "test" {
+				t.Fatalf("wrong Nickname: got %s want test", usr.Nickname)
+			}
+		})
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	t.Parallel()
+	var update interface{}
+	client := mongo.Mongo{
+		Client: mockDatabase{
+			findOneAndUpdate: func(ctx context.Context, filter interface{}, u interface{}, result interface{}) error {
+				update = u
+				*result.(*mongo.User) = mongo.User{ID: "guid", Country: "PT"}
+				return nil
+			},
+		},
+		Hasher: password.Bcrypt{Cost: 4},
+	}
+
+	if _, err := client.PatchUser(context.Background(), "guid", 0, map[string]string{"country": "PT", "password": "S3CR3T"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	set := update.(bson.M)["$set"].(bson.M)
+	if len(set) != 3 || set["country"] != "PT" || set["updated_at"] == nil {
+		t.Fatalf("wrong update: got %v", set)
+	}
+	if inc := update.(bson.M)["$inc"]; inc.(bson.M)["version"] != 1 {
+		t.Fatalf("wrong version increment: got %v", inc)
+	}
+	if set["password"] == "S3CR3T" {
+		t.Fatal("the password wasn't hashed")
+	}
+
+	if _, err := client.PatchUser(context.Background(), "guid", 0, map[string]string{"_id": "other"}); !errors.Is(err, mongo.ErrValidation) {
+		t.Fatalf("wrong error: got %v want %v", err, mongo.ErrValidation)
+	}
+}
+
+func TestUpdateUserVersionMismatch(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name          string
+		stored        bool
+		expectedError error
+	}{
+		{name: "if the user is at another version, it should return ErrVersionMismatch", stored: true, expectedError: mongo.ErrVersionMismatch},
+		{name: "if the user doesn't exist, it should return ErrNotFound", expectedError: mongo.ErrNotFound},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var filter interface{}
+			client := mongo.Mongo{
+				Client: mockDatabase{
+					findOneAndUpdate: func(ctx context.Context, f interface{}, update interface{}, result interface{}) error {
+						filter = f
+						return mongolib.ErrNoDocuments
+					},
+					findOne: func(ctx context.Context, f interface{}, result interface{}) error {
+						if !tt.stored {
+							return mongolib.ErrNoDocuments
+						}
+						*result.(*mongo.User) = mongo.User{ID: "guid", Version: 4}
+						return nil
+					},
+				},
+				Hasher: password.Bcrypt{Cost: 4},
+			}
+
+			_, err := client.UpdateUser(context.Background(), "guid", 3, "test", "", "", "S3CR3T", "", "")
+
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("wrong error: got %v want %v", err, tt.expectedError)
+			}
+			if filter.(bson.M)["version"] != int64(3) {
+				t.Fatalf("wrong filter: got %v", filter)
+			}
+		})
+	}
 }
 
 func TestRemoveUser(t *testing.T) {
-	// TODO
+	t.Parallel()
+	for _, tt := range []struct {
+		name          string
+		database      mockDatabase
+		expectedCount int64
+		expectedError error
+	}{
+		{
+			name: "if the user is deleted, it should set deleted_at and return the count",
+			database: mockDatabase{
+				findOneAndUpdate: func(ctx context.Context, filter interface{}, update interface{}, result interface{}) error {
+					if _, ok := update.(bson.M)["$set"].(bson.M)["deleted_at"]; !ok {
+						return fmt.Errorf("deleted_at not set: %v", update)
+					}
+					if filter.(bson.M)["deleted_at"] == nil {
+						return fmt.Errorf("deleted users not excluded: %v", filter)
+					}
+					return nil
+				},
+			},
+			expectedCount: 1,
+		},
+		{
+			name: "if the user doesn't exist or was already deleted, it should return no count",
+			database: mockDatabase{
+				findOneAndUpdate: func(ctx context.Context, filter interface{}, update interface{}, result interface{}) error {
+					return mongolib.ErrNoDocuments
+				},
+			},
+		},
+		{
+			name: "if database adapter returns an error, it should return a typed error",
+			database: mockDatabase{
+				findOneAndUpdate: func(ctx context.Context, filter interface{}, update interface{}, result interface{}) error {
+					return mongolib.ErrClientDisconnected
+				},
+			},
+			expectedError: mongo.ErrUnavailable,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			client := mongo.Mongo{
+				Client: tt.database,
+			}
+
+			count, err := client.RemoveUser(context.Background(), "guid", 0)
+
+			if !errors.Is(err, tt.expectedError) || (err != nil) != (tt.expectedError != nil) {
+				t.Fatalf("wrong error: got %v want %v", err, tt.expectedError)
+			}
+			if count != tt.expectedCount {
+				t.Fatalf("wrong count: got %d want %d", count, tt.expectedCount)
+			}
+		})
+	}
+}
+
+func TestRestoreUser(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name          string
+		deleted       bool
+		active        bool
+		expectedError error
+	}{
+		{name: "if the user is deleted, it should unset deleted_at", deleted: true},
+		{name: "if the user isn't deleted, it should return it unchanged", active: true},
+		{name: "if the user doesn't exist, it should return ErrNotFound", expectedError: mongo.ErrNotFound},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			client := mongo.Mongo{
+				Client: mockDatabase{
+					findOneAndUpdate: func(ctx context.Context, filter interface{}, update interface{}, result interface{}) error {
+						if _, ok := update.(bson.M)["$unset"].(bson.M)["deleted_at"]; !ok {
+							return fmt.Errorf("deleted_at not unset: %v", update)
+						}
+						if !tt.deleted {
+							return mongolib.ErrNoDocuments
+						}
+						*result.(*mongo.User) = mongo.User{ID: "guid", Version: 3}
+						return nil
+					},
+					findOne: func(ctx context.Context, filter interface{}, result interface{}) error {
+						if !tt.active {
+							return mongolib.ErrNoDocuments
+						}
+						*result.(*mongo.User) = mongo.User{ID: "guid", Version: 2}
+						return nil
+					},
+				},
+			}
+
+			user, err := client.RestoreUser(context.Background(), "guid")
+
+			if !errors.Is(err, tt.expectedError) || (err != nil) != (tt.expectedError != nil) {
+				t.Fatalf("wrong error: got %v want %v", err, tt.expectedError)
+			}
+			if err == nil && user.ID != "guid" {
+				t.Fatalf("wrong user: got %+v", user)
+			}
+		})
+	}
+}
+
+func TestPurgeUsers(t *testing.T) {
+	t.Parallel()
+	before := time.Date(2020, 10, 10, 0, 0, 0, 0, time.UTC)
+	var filter interface{}
+	client := mongo.Mongo{
+		Client: mockDatabase{
+			deleteMany: func(ctx context.Context, f interface{}) (*mongolib.DeleteResult, error) {
+				filter = f
+				return &mongolib.DeleteResult{DeletedCount: 2}, nil
+			},
+		},
+	}
+
+	count, err := client.PurgeUsers(context.Background(), before)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if count != 2 {
+		t.Fatalf("wrong count: got %d want 2", count)
+	}
+	if filter.(bson.M)["deleted_at"].(bson.M)["$lt"] != before {
+		t.Fatalf("wrong filter: got %v", filter)
+	}
 }
 
 func TestGetUsers(t *testing.T) {
 	// TODO
 }
+
+func TestCreateUserHashesPassword(t *testing.T) {
+	t.Parallel()
+	var stored mongo.User
+	client := mongo.Mongo{
+		Client: mockDatabase{
+			insertOne: func(ctx context.Context, doc interface{}) error {
+				stored = doc.(mongo.User)
+				return nil
+			},
+		},
+		Hasher: password.Bcrypt{Cost: 4},
+	}
+
+	if _, err := client.CreateUser(context.Background(), "test", "", "", "S3CR3T", "", ""); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if stored.Password == "S3CR3T" {
+		t.Fatalf("password was stored in plain text")
+	}
+	if err := password.Compare("S3CR3T", stored.Password); err != nil {
+		t.Fatalf("stored hash doesn't match the password: %s", err)
+	}
+}
+
+// countingHasher counts the passwords verified by the hasher it wraps
+type countingHasher struct {
+	password.Bcrypt
+	verified int
+}
+
+func (h *countingHasher) Verify(plain string, hash string) (bool, error) {
+	h.verified++
+	return h.Bcrypt.Verify(plain, hash)
+}
+
+func TestAuthenticateUnknownLogin(t *testing.T) {
+	t.Parallel()
+	hasher := &countingHasher{Bcrypt: password.Bcrypt{Cost: 4}}
+	client := mongo.Mongo{
+		Client: mockDatabase{
+			findOne: func(ctx context.Context, filter interface{}, result interface{}) error {
+				return mongolib.ErrNoDocuments
+			},
+		},
+		Hasher: hasher,
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Authenticate(context.Background(), "nobody", "S3CR3T"); !errors.Is(err, mongo.ErrNotFound) {
+			t.Fatalf("wrong error: got %v want %v", err, mongo.ErrNotFound)
+		}
+	}
+	if hasher.verified != 2 {
+		t.Fatalf("unknown logins should verify a password like known ones: got %d verifications", hasher.verified)
+	}
+}
@@ -0,0 +1,286 @@
+package mongo
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// DefaultLimit is the page size when the limit parameter is not given
+	DefaultLimit = 50
+	// MaxLimit is the largest page size a client can ask for
+	MaxLimit = 200
+)
+
+// SortFields lists the fields users can be sorted by
+var SortFields = []string{"created_at", "updated_at", "nickname", "last_name"}
+
+// rangeParams maps the time range query parameters to the field and operator they filter on, bounds are exclusive
+var rangeParams = map[string]struct{ field, op string }{
+	"created_after":  {"created_at", "$gt"},
+	"created_before": {"created_at", "$lt"},
+	"updated_after":  {"updated_at", "$gt"},
+	"updated_before": {"updated_at", "$lt"},
+}
+
+// ErrInvalidListOptions is returned when the pagination parameters can't be used
+var ErrInvalidListOptions = errors.New("invalid list parameters")
+
+// ListOptions describes which page of users to return.
+// Users are always ordered by the sort field and then by id, so pages are stable.
+type ListOptions struct {
+	Filter map[string]string
+	// Ranges holds the time bounds of the created_after, created_before, updated_after and updated_before parameters
+	Ranges     map[string]time.Time
+	Limit      int
+	Sort       string
+	Descending bool
+	// After is the position of the last user of the previous page, nil for the first page
+	After *Cursor
+	// IncludeDeleted lists soft deleted users too, they are left out by default
+	IncludeDeleted bool
+}
+
+// Cursor is the position of a user in a listing, encoded in page tokens
+type Cursor struct {
+	Sort       string `json:"s"`
+	Descending bool   `json:"d,omitempty"`
+	Value      string `json:"v"`
+	ID         string `json:"id"`
+}
+
+// UserPage is a page of users and the token of the next page, empty on the last page
+type UserPage struct {
+	Users         []*User `json:"users"`
+	NextPageToken string  `json:"next_page_token,omitempty"`
+}
+
+// ParseListOptions reads the filter and the limit, sort, include_deleted and page_token (or cursor) query parameters.
+// sort is one of SortFields, prefixed by "-" for descending order.
+func ParseListOptions(params url.Values) (ListOptions, error) {
+	opts := ListOptions{
+		Filter: FilterParams(params),
+		Ranges: map[string]time.Time{},
+		Limit:  DefaultLimit,
+		Sort:   "created_at",
+	}
+
+	for param := range rangeParams {
+		if value := params.Get(param); value != "" {
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return opts, fmt.Errorf("%w: %s must be an RFC 3339 time, e.g. 2020-10-10T10:00:00Z", ErrInvalidListOptions, param)
+			}
+			opts.Ranges[param] = t
+		}
+	}
+
+	limit, err := parseLimit(params)
+	if err != nil {
+		return opts, err
+	}
+	opts.Limit = limit
+
+	if sort := params.Get("sort"); sort != "" {
+		opts.Descending = strings.HasPrefix(sort, "-")
+		opts.Sort = strings.TrimPrefix(sort, "-")
+		if !contains(SortFields, opts.Sort) {
+			return opts, fmt.Errorf("%w: sort must be one of %s", ErrInvalidListOptions, strings.Join(SortFields, ", "))
+		}
+	}
+
+	if include := params.Get("include_deleted"); include != "" {
+		b, err := strconv.ParseBool(include)
+		if err != nil {
+			return opts, fmt.Errorf("%w: include_deleted must be true or false", ErrInvalidListOptions)
+		}
+		opts.IncludeDeleted = b
+	}
+
+	token := params.Get("page_token")
+	if token == "" {
+		token = params.Get("cursor")
+	}
+	if token != "" {
+		cursor, err := decodeCursor(token)
+		if err != nil || cursor.Sort != opts.Sort || cursor.Descending != opts.Descending {
+			return opts, fmt.Errorf("%w: page_token doesn't belong to this listing", ErrInvalidListOptions)
+		}
+		opts.After = cursor
+	}
+
+	return opts, nil
+}
+
+// parseLimit reads the limit query parameter, DefaultLimit when it is not given
+func parseLimit(params url.Values) (int, error) {
+	limit := params.Get("limit")
+	if limit == "" {
+		return DefaultLimit, nil
+	}
+	l, err := strconv.Atoi(limit)
+	if err != nil || l < 1 || l > MaxLimit {
+		return 0, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidListOptions, MaxLimit)
+	}
+	return l, nil
+}
+
+// Less reports whether a comes before b in the listing
+func (opts ListOptions) Less(a, b User) bool {
+	va, vb := sortValue(a, opts.Sort), sortValue(b, opts.Sort)
+	if va == vb {
+		va, vb = a.ID, b.ID
+	}
+	if opts.Descending {
+		return va > vb
+	}
+	return va < vb
+}
+
+// WithinRanges reports whether the user was created and updated within the time ranges of the listing
+func (opts ListOptions) WithinRanges(u User) bool {
+	for param, bound := range opts.Ranges {
+		r := rangeParams[param]
+		t := u.CreatedAt
+		if r.field == "updated_at" {
+			t = u.UpdatedAt
+		}
+		if (r.op == "$gt" && !t.After(bound)) || (r.op == "$lt" && !t.Before(bound)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Visible reports whether the user is listed, soft deleted users are only listed when IncludeDeleted is set
+func (opts ListOptions) Visible(u User) bool {
+	return u.DeletedAt == nil || opts.IncludeDeleted
+}
+
+// Includes reports whether the user comes after the cursor, i.e. belongs to the requested page or later ones
+func (opts ListOptions) Includes(u User) bool {
+	if opts.After == nil {
+		return true
+	}
+	last := User{ID: opts.After.ID}
+	setSortValue(&last, opts.Sort, opts.After.Value)
+	return opts.Less(last, u)
+}
+
+// NextPageToken returns the token of the page following the given last user
+func (opts ListOptions) NextPageToken(last User) string {
+	return encodeCursor(Cursor{
+		Sort:       opts.Sort,
+		Descending: opts.Descending,
+		Value:      sortValue(last, opts.Sort),
+		ID:         last.ID,
+	})
+}
+
+// query returns the mongo filter of the page, a range query on the sort field and the id
+// so large collections don't need to skip over previous pages
+func (opts ListOptions) query() (bson.M, error) {
+	query := bson.M{}
+	for k, v := range opts.Filter {
+		query[k] = v
+	}
+	if !opts.IncludeDeleted {
+		active(query)
+	}
+	for param, bound := range opts.Ranges {
+		r := rangeParams[param]
+		ops, ok := query[r.field].(bson.M)
+		if !ok {
+			ops = bson.M{}
+			query[r.field] = ops
+		}
+		ops[r.op] = bound
+	}
+	if opts.After == nil {
+		return query, nil
+	}
+
+	var value interface{} = opts.After.Value
+	if opts.Sort == "created_at" || opts.Sort == "updated_at" {
+		t, err := time.Parse(time.RFC3339Nano, opts.After.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidListOptions, err)
+		}
+		value = t
+	}
+
+	op := "$gt"
+	if opts.Descending {
+		op = "$lt"
+	}
+	query["$or"] = bson.A{
+		bson.M{opts.Sort: bson.M{op: value}},
+		bson.M{opts.Sort: value, "_id": bson.M{op: opts.After.ID}},
+	}
+	return query, nil
+}
+
+// sort returns the mongo sort document of the listing
+func (opts ListOptions) sort() bson.D {
+	direction := 1
+	if opts.Descending {
+		direction = -1
+	}
+	return bson.D{{Key: opts.Sort, Value: direction}, {Key: "_id", Value: direction}}
+}
+
+func encodeCursor(cursor Cursor) string {
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(token string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &Cursor{}
+	if err := json.Unmarshal(b, cursor); err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+// sortValue returns the value of the sort field, times are formatted so they sort lexically
+func sortValue(u User, field string) string {
+	switch field {
+	case "nickname":
+		return u.Nickname
+	case "last_name":
+		return u.LastName
+	case "created_at":
+		return u.CreatedAt.UTC().Format(sortableTime)
+	case "updated_at":
+		return u.UpdatedAt.UTC().Format(sortableTime)
+	}
+	return ""
+}
+
+func setSortValue(u *User, field string, value string) {
+	switch field {
+	case "nickname":
+		u.Nickname = value
+	case "last_name":
+		u.LastName = value
+	case "created_at":
+		u.CreatedAt, _ = time.Parse(time.RFC3339Nano, value)
+	case "updated_at":
+		u.UpdatedAt, _ = time.Parse(time.RFC3339Nano, value)
+	}
+}
+
+// sortableTime is RFC 3339 with a fixed number of fractional digits
+const sortableTime = "2006-01-02T15:04:05.000000000Z07:00"
@@ -0,0 +1,115 @@
+package mongo_test
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jpaldi/go-user-api/mongo"
+)
+
+func TestParseListOptions(t *testing.T) {
+	t.Parallel()
+	byNickname, _ := mongo.ParseListOptions(url.Values{"sort": {"nickname"}})
+	nicknameToken := byNickname.NextPageToken(mongo.User{ID: "id", Nickname: "jpaldi"})
+
+	for _, tt := range []struct {
+		name               string
+		params             url.Values
+		expectedLimit      int
+		expectedSort       string
+		expectedDescending bool
+		expectError        bool
+	}{
+		{name: "it should default to the first page sorted by creation", params: url.Values{}, expectedLimit: mongo.DefaultLimit, expectedSort: "created_at"},
+		{name: "it should read the limit and descending sort", params: url.Values{"limit": {"10"}, "sort": {"-last_name"}}, expectedLimit: 10, expectedSort: "last_name", expectedDescending: true},
+		{name: "it should accept a page token of the same listing", params: url.Values{"sort": {"nickname"}, "page_token": {nicknameToken}}, expectedLimit: mongo.DefaultLimit, expectedSort: "nickname"},
+		{name: "it should accept the token as cursor", params: url.Values{"sort": {"nickname"}, "cursor": {nicknameToken}}, expectedLimit: mongo.DefaultLimit, expectedSort: "nickname"},
+		{name: "it should reject a page token of another listing", params: url.Values{"sort": {"-nickname"}, "page_token": {nicknameToken}}, expectError: true},
+		{name: "it should reject a malformed page token", params: url.Values{"page_token": {"%%%"}}, expectError: true},
+		{name: "it should reject limits above the maximum", params: url.Values{"limit": {"1000"}}, expectError: true},
+		{name: "it should reject non numeric limits", params: url.Values{"limit": {"ten"}}, expectError: true},
+		{name: "it should sort by update time", params: url.Values{"sort": {"-updated_at"}}, expectedLimit: mongo.DefaultLimit, expectedSort: "updated_at", expectedDescending: true},
+		{name: "it should accept time ranges", params: url.Values{"created_after": {"2020-10-10T10:00:00Z"}, "updated_before": {"2020-10-11T10:00:00.5+01:00"}}, expectedLimit: mongo.DefaultLimit, expectedSort: "created_at"},
+		{name: "it should reject times that aren't RFC 3339", params: url.Values{"created_after": {"2020-10-10"}}, expectError: true},
+		{name: "it should reject unknown sort fields", params: url.Values{"sort": {"password"}}, expectError: true},
+		{name: "it should reject include_deleted values that aren't booleans", params: url.Values{"include_deleted": {"yes please"}}, expectError: true},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := mongo.ParseListOptions(tt.params)
+
+			if tt.expectError {
+				if !errors.Is(err, mongo.ErrInvalidListOptions) {
+					t.Fatalf("wrong error: got %v want %v", err, mongo.ErrInvalidListOptions)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if opts.Limit != tt.expectedLimit || opts.Sort != tt.expectedSort || opts.Descending != tt.expectedDescending {
+				t.Fatalf("wrong options: got %+v", opts)
+			}
+		})
+	}
+}
+
+func TestWithinRanges(t *testing.T) {
+	t.Parallel()
+	day := func(d int) time.Time { return time.Date(2020, 10, d, 0, 0, 0, 0, time.UTC) }
+	user := mongo.User{CreatedAt: day(10), UpdatedAt: day(20)}
+
+	for _, tt := range []struct {
+		name     string
+		params   url.Values
+		expected bool
+	}{
+		{name: "no ranges", params: url.Values{}, expected: true},
+		{name: "created after an earlier day", params: url.Values{"created_after": {"2020-10-09T00:00:00Z"}}, expected: true},
+		{name: "created after the same time", params: url.Values{"created_after": {"2020-10-10T00:00:00Z"}}, expected: false},
+		{name: "created before a later day", params: url.Values{"created_before": {"2020-10-11T00:00:00Z"}}, expected: true},
+		{name: "updated within a range", params: url.Values{"updated_after": {"2020-10-19T00:00:00Z"}, "updated_before": {"2020-10-21T00:00:00Z"}}, expected: true},
+		{name: "updated before an earlier day", params: url.Values{"updated_before": {"2020-10-15T00:00:00Z"}}, expected: false},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := mongo.ParseListOptions(tt.params)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := opts.WithinRanges(user); got != tt.expected {
+				t.Fatalf("wrong result: got %t want %t", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestVisible(t *testing.T) {
+	t.Parallel()
+	deletedAt := time.Date(2020, 10, 10, 0, 0, 0, 0, time.UTC)
+
+	for _, tt := range []struct {
+		name     string
+		params   url.Values
+		user     mongo.User
+		expected bool
+	}{
+		{name: "active users are listed", params: url.Values{}, user: mongo.User{}, expected: true},
+		{name: "deleted users are left out by default", params: url.Values{}, user: mongo.User{DeletedAt: &deletedAt}, expected: false},
+		{name: "deleted users are listed when included", params: url.Values{"include_deleted": {"true"}}, user: mongo.User{DeletedAt: &deletedAt}, expected: true},
+		{name: "deleted users are left out when not included", params: url.Values{"include_deleted": {"false"}}, user: mongo.User{DeletedAt: &deletedAt}, expected: false},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := mongo.ParseListOptions(tt.params)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := opts.Visible(tt.user); got != tt.expected {
+				t.Fatalf("wrong result: got %t want %t", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// RefreshToken represents a refresh token stored in database, identified by the hash of the token
+type RefreshToken struct {
+	Hash      string     `bson:"_id"`
+	UserID    string     `bson:"user_id"`
+	ExpiresAt time.Time  `bson:"expires_at"`
+	RevokedAt *time.Time `bson:"revoked_at"`
+}
+
+// RefreshTokens stores refresh tokens in their own collection
+type RefreshTokens struct {
+	Client Collection
+}
+
+// SaveRefreshToken stores a new refresh token
+func (rt RefreshTokens) SaveRefreshToken(ctx context.Context, token RefreshToken) error {
+	if err := rt.Client.InsertOne(ctx, token); err != nil {
+		return fmt.Errorf("cannot insert: %w", translate(err))
+	}
+	return nil
+}
+
+// ConsumeRefreshToken revokes a refresh token and returns it, as long as it was neither revoked nor expired,
+// otherwise it returns ErrNotFound.
+// The check and the revocation are atomic so a token can only be exchanged once.
+func (rt RefreshTokens) ConsumeRefreshToken(ctx context.Context, hash string) (*RefreshToken, error) {
+	now := time.Now()
+	filter := bson.M{
+		"_id":        hash,
+		"revoked_at": nil,
+		"expires_at": bson.M{"$gt": now},
+	}
+
+	token := RefreshToken{}
+	if err := rt.Client.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"revoked_at": now}}, &token); err != nil {
+		return nil, translate(err)
+	}
+	return &token, nil
+}
+
+// RevokeRefreshToken revokes a refresh token and reports whether it was still active
+func (rt RefreshTokens) RevokeRefreshToken(ctx context.Context, hash string) (bool, error) {
+	_, err := rt.ConsumeRefreshToken(ctx, hash)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,273 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	mongolib "go.mongodb.org/mongo-driver/mongo"
+	mongolibopts "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The states of a webhook delivery
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// deliveriesRetention is how long deliveries are kept before mongo removes them
+const deliveriesRetention = 30 * 24 * time.Hour
+
+// maxRecordedAttempts is how many attempts a delivery keeps, the oldest are dropped first
+const maxRecordedAttempts = 20
+
+// ErrWebhookNotFound is returned when the requested webhook or delivery doesn't exist, it matches ErrNotFound
+var ErrWebhookNotFound = &Error{Kind: ErrNotFound, Message: "webhook not found"}
+
+// Webhook is a subscription of an integrator endpoint to user events
+type Webhook struct {
+	ID  string `json:"id" bson:"_id"`
+	URL string `json:"url" bson:"url"`
+	// EventTypes lists the events the endpoint receives, e.g. user.created
+	EventTypes []string `json:"event_types" bson:"event_types"`
+	// Secret signs the payloads, it is only sent to clients when the webhook is created
+	Secret    string    `json:"-" bson:"secret"`
+	Active    bool      `json:"active" bson:"active"`
+	CreatedBy string    `json:"created_by" bson:"created_by"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	// ConsecutiveFailures counts the failed attempts since the last successful one
+	ConsecutiveFailures int `json:"consecutive_failures" bson:"consecutive_failures"`
+	// DisabledAt is set when the webhook was disabled after too many failures
+	DisabledAt *time.Time `json:"disabled_at,omitempty" bson:"disabled_at,omitempty"`
+}
+
+// Subscribes reports whether the webhook receives events of the given type
+func (w Webhook) Subscribes(eventType string) bool {
+	for _, t := range w.EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery is an event to send to a webhook, with the attempts made so far
+type Delivery struct {
+	ID        string `json:"id" bson:"_id"`
+	WebhookID string `json:"webhook_id" bson:"webhook_id"`
+	EventID   string `json:"event_id" bson:"event_id"`
+	EventType string `json:"event_type" bson:"event_type"`
+	// Payload is the JSON body sent, kept as is so redeliveries are identical
+	Payload   string    `json:"payload" bson:"payload"`
+	Status    string    `json:"status" bson:"status"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	// Failures counts the failed attempts since the delivery was (re)scheduled, it drives the backoff
+	Failures      int               `json:"failures" bson:"failures"`
+	NextAttemptAt time.Time         `json:"next_attempt_at" bson:"next_attempt_at"`
+	Attempts      []DeliveryAttempt `json:"attempts" bson:"attempts"`
+}
+
+// DeliveryAttempt is a request made to a webhook
+type DeliveryAttempt struct {
+	At time.Time `json:"at" bson:"at"`
+	// StatusCode is the status of the response, 0 when none was received
+	StatusCode int    `json:"status_code,omitempty" bson:"status_code,omitempty"`
+	Error      string `json:"error,omitempty" bson:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms" bson:"duration_ms"`
+}
+
+// Webhooks stores the webhooks and their deliveries
+type Webhooks struct {
+	Client     Collection
+	Deliveries Collection
+}
+
+// CreateWebhook stores a new webhook
+func (wh Webhooks) CreateWebhook(ctx context.Context, webhook Webhook) error {
+	return translate(wh.Client.InsertOne(ctx, webhook))
+}
+
+// GetWebhook returns the webhook with the given id
+func (wh Webhooks) GetWebhook(ctx context.Context, id string) (*Webhook, error) {
+	webhook := &Webhook{}
+	if err := wh.Client.FindOne(ctx, bson.M{"_id": id}, webhook); err != nil {
+		return nil, webhookErr(err)
+	}
+	return webhook, nil
+}
+
+// ListWebhooks returns every webhook, oldest first
+func (wh Webhooks) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	cursor, err := wh.Client.Find(ctx, bson.M{}, mongolibopts.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer cursor.Close(ctx)
+
+	webhooks := []Webhook{}
+	if err := cursor.All(ctx, &webhooks); err != nil {
+		return nil, translate(err)
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook removes a webhook, its pending deliveries are dropped when they are due
+func (wh Webhooks) DeleteWebhook(ctx context.Context, id string) error {
+	result, err := wh.Client.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return translate(err)
+	}
+	if result.DeletedCount == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// EnableWebhook activates a webhook again and forgets its failures
+func (wh Webhooks) EnableWebhook(ctx context.Context, id string) (*Webhook, error) {
+	update := bson.M{"$set": bson.M{"active": true, "consecutive_failures": 0}, "$unset": bson.M{"disabled_at": ""}}
+	webhook := &Webhook{}
+	if err := wh.Client.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, webhook); err != nil {
+		return nil, webhookErr(err)
+	}
+	return webhook, nil
+}
+
+// RecordResult resets the consecutive failures of a webhook after a successful attempt, or counts a failed one
+// and disables the webhook once disableAfter failures in a row are reached. It returns the updated webhook.
+func (wh Webhooks) RecordResult(ctx context.Context, id string, success bool, disableAfter int, now time.Time) (*Webhook, error) {
+	webhook := &Webhook{}
+	if success {
+		err := wh.Client.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"consecutive_failures": 0}}, webhook)
+		return webhook, webhookErr(err)
+	}
+
+	if err := wh.Client.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$inc": bson.M{"consecutive_failures": 1}}, webhook); err != nil {
+		return nil, webhookErr(err)
+	}
+	if !webhook.Active || disableAfter <= 0 || webhook.ConsecutiveFailures < disableAfter {
+		return webhook, nil
+	}
+	filter := bson.M{"_id": id, "active": true}
+	err := wh.Client.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"active": false, "disabled_at": now}}, webhook)
+	if err == mongolib.ErrNoDocuments {
+		// disabled meanwhile
+		return wh.GetWebhook(ctx, id)
+	}
+	return webhook, webhookErr(err)
+}
+
+// AddDelivery stores a delivery unless one with the same id exists, so scheduling the same event twice is harmless
+func (wh Webhooks) AddDelivery(ctx context.Context, delivery Delivery) error {
+	err := translate(wh.Deliveries.InsertOne(ctx, delivery))
+	if errors.Is(err, ErrConflict) {
+		return nil
+	}
+	return err
+}
+
+// ClaimDeliveries returns up to limit pending deliveries due at now, oldest first, and defers their next attempt
+// by lease so other dispatchers don't send them meanwhile
+func (wh Webhooks) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]Delivery, error) {
+	due := bson.M{"status": DeliveryPending, "next_attempt_at": bson.M{"$lte": now}}
+	findOpts := mongolibopts.Find().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := wh.Deliveries.Find(ctx, due, findOpts)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer cursor.Close(ctx)
+
+	candidates := []Delivery{}
+	if err := cursor.All(ctx, &candidates); err != nil {
+		return nil, translate(err)
+	}
+
+	// a delivery is only claimed if its next attempt didn't move since it was read
+	claimed := []Delivery{}
+	for _, d := range candidates {
+		filter := bson.M{"_id": d.ID, "status": DeliveryPending, "next_attempt_at": d.NextAttemptAt}
+		updated := Delivery{}
+		err := wh.Deliveries.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"next_attempt_at": now.Add(lease)}}, &updated)
+		if err == mongolib.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return claimed, translate(err)
+		}
+		claimed = append(claimed, updated)
+	}
+	return claimed, nil
+}
+
+// RecordAttempt adds an attempt to a delivery and sets its status, failures and next attempt
+func (wh Webhooks) RecordAttempt(ctx context.Context, id string, attempt DeliveryAttempt, status string, failures int, next time.Time) error {
+	update := bson.M{
+		"$set":  bson.M{"status": status, "failures": failures, "next_attempt_at": next},
+		"$push": bson.M{"attempts": bson.M{"$each": []DeliveryAttempt{attempt}, "$slice": -maxRecordedAttempts}},
+	}
+	return webhookErr(wh.Deliveries.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, &Delivery{}))
+}
+
+// GetDelivery returns a delivery of the webhook
+func (wh Webhooks) GetDelivery(ctx context.Context, webhookID string, id string) (*Delivery, error) {
+	delivery := &Delivery{}
+	if err := wh.Deliveries.FindOne(ctx, bson.M{"_id": id, "webhook_id": webhookID}, delivery); err != nil {
+		return nil, webhookErr(err)
+	}
+	return delivery, nil
+}
+
+// ListDeliveries returns the latest deliveries of a webhook, newest first
+func (wh Webhooks) ListDeliveries(ctx context.Context, webhookID string, limit int) ([]Delivery, error) {
+	findOpts := mongolibopts.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(int64(limit))
+	cursor, err := wh.Deliveries.Find(ctx, bson.M{"webhook_id": webhookID}, findOpts)
+	if err != nil {
+		return nil, translate(err)
+	}
+	defer cursor.Close(ctx)
+
+	deliveries := []Delivery{}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, translate(err)
+	}
+	return deliveries, nil
+}
+
+// Redeliver schedules a delivery of the webhook again at now, whatever its status, with a fresh backoff
+func (wh Webhooks) Redeliver(ctx context.Context, webhookID string, id string, now time.Time) (*Delivery, error) {
+	update := bson.M{"$set": bson.M{"status": DeliveryPending, "failures": 0, "next_attempt_at": now}}
+	delivery := &Delivery{}
+	if err := wh.Deliveries.FindOneAndUpdate(ctx, bson.M{"_id": id, "webhook_id": webhookID}, update, delivery); err != nil {
+		return nil, webhookErr(err)
+	}
+	return delivery, nil
+}
+
+// WebhookDeliveriesIndexes returns the indexes of the deliveries collection: pending deliveries are read by due time,
+// the deliveries of a webhook newest first, and deliveries expire after 30 days
+func WebhookDeliveriesIndexes() []mongolib.IndexModel {
+	return []mongolib.IndexModel{
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}},
+			Options: mongolibopts.Index().SetName("due"),
+		},
+		{
+			Keys:    bson.D{{Key: "webhook_id", Value: 1}, {Key: "created_at", Value: -1}},
+			Options: mongolibopts.Index().SetName("webhook_created_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "created_at", Value: 1}},
+			Options: mongolibopts.Index().SetName("created_at_ttl").SetExpireAfterSeconds(int32(deliveriesRetention.Seconds())),
+		},
+	}
+}
+
+// webhookErr reports missing webhooks and deliveries as ErrWebhookNotFound rather than a missing user
+func webhookErr(err error) error {
+	if err == mongolib.ErrNoDocuments {
+		return ErrWebhookNotFound
+	}
+	return translate(err)
+}
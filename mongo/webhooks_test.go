@@ -0,0 +1,138 @@
+package mongo_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jpaldi/go-user-api/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	mongolib "go.mongodb.org/mongo-driver/mongo"
+)
+
+// mockWebhooks returns a webhooks collection applying $set and $inc to the stored webhook, or
+// failing every update when the webhook is nil
+func mockWebhooks(stored *mongo.Webhook) mockDatabase {
+	return mockDatabase{
+		findOneAndUpdate: func(ctx context.Context, filter interface{}, update interface{}, result interface{}) error {
+			if stored == nil {
+				return mongolib.ErrNoDocuments
+			}
+			if active, ok := filter.(bson.M)["active"]; ok && active != stored.Active {
+				return mongolib.ErrNoDocuments
+			}
+			if set, ok := update.(bson.M)["$set"].(bson.M); ok {
+				if v, ok := set["consecutive_failures"]; ok {
+					stored.ConsecutiveFailures = v.(int)
+				}
+				if v, ok := set["active"]; ok {
+					stored.Active = v.(bool)
+				}
+				if v, ok := set["disabled_at"]; ok {
+					at := v.(time.Time)
+					stored.DisabledAt = &at
+				}
+			}
+			if _, ok := update.(bson.M)["$inc"]; ok {
+				stored.ConsecutiveFailures++
+			}
+			*result.(*mongo.Webhook) = *stored
+			return nil
+		},
+	}
+}
+
+func TestRecordResult(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+
+	for _, tt := range []struct {
+		name             string
+		stored           *mongo.Webhook
+		success          bool
+		expectedFailures int
+		expectedActive   bool
+		expectedErr      error
+	}{
+		{
+			name:             "a successful attempt should reset the failures",
+			stored:           &mongo.Webhook{ID: "hook-1", Active: true, ConsecutiveFailures: 4},
+			success:          true,
+			expectedFailures: 0,
+			expectedActive:   true,
+		},
+		{
+			name:             "a failed attempt should be counted",
+			stored:           &mongo.Webhook{ID: "hook-1", Active: true, ConsecutiveFailures: 1},
+			expectedFailures: 2,
+			expectedActive:   true,
+		},
+		{
+			name:             "the failure reaching the limit should disable the webhook",
+			stored:           &mongo.Webhook{ID: "hook-1", Active: true, ConsecutiveFailures: 2},
+			expectedFailures: 3,
+			expectedActive:   false,
+		},
+		{
+			name:        "missing webhooks should be reported as not found",
+			expectedErr: mongo.ErrNotFound,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			store := mongo.Webhooks{Client: mockWebhooks(tt.stored)}
+
+			webhook, err := store.RecordResult(context.Background(), "hook-1", tt.success, 3, now)
+
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("wrong error: got %v want %v", err, tt.expectedErr)
+			}
+			if err != nil {
+				if err.Error() != "webhook not found" {
+					t.Fatalf("wrong message: got %s", err)
+				}
+				return
+			}
+			if webhook.ConsecutiveFailures != tt.expectedFailures || webhook.Active != tt.expectedActive {
+				t.Fatalf("wrong webhook: got %+v", webhook)
+			}
+			if !webhook.Active && (webhook.DisabledAt == nil || !webhook.DisabledAt.Equal(now)) {
+				t.Fatalf("disabled webhooks should record when: got %+v", webhook)
+			}
+		})
+	}
+}
+
+func TestAddDeliveryIgnoresDuplicates(t *testing.T) {
+	t.Parallel()
+	duplicate := mongolib.WriteException{WriteErrors: mongolib.WriteErrors{{
+		Code:    11000,
+		Message: `E11000 duplicate key error collection: users.webhook_deliveries index: _id_ dup key: { _id: "delivery-1" }`,
+	}}}
+
+	for _, tt := range []struct {
+		name        string
+		err         error
+		expectedErr error
+	}{
+		{name: "new deliveries should be stored"},
+		{name: "deliveries scheduled twice should be ignored", err: duplicate},
+		{name: "other errors should be reported", err: context.DeadlineExceeded, expectedErr: mongo.ErrUnavailable},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			store := mongo.Webhooks{Deliveries: mockDatabase{
+				insertOne: func(ctx context.Context, doc interface{}) error {
+					return tt.err
+				},
+			}}
+
+			err := store.AddDelivery(context.Background(), mongo.Delivery{ID: "delivery-1"})
+
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("wrong error: got %v want %v", err, tt.expectedErr)
+			}
+		})
+	}
+}
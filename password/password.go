@@ -0,0 +1,161 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrMismatch is returned when a password doesn't match the stored hash
+	ErrMismatch = errors.New("password does not match")
+	// ErrUnknownFormat is returned when a stored hash wasn't produced by a supported algorithm
+	ErrUnknownFormat = errors.New("unknown password hash format")
+
+	// DefaultArgon2id follows the OWASP recommendation for argon2id
+	DefaultArgon2id = Argon2id{
+		Memory:      19 * 1024,
+		Iterations:  2,
+		Parallelism: 1,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+
+	// DefaultBcrypt uses the bcrypt library default cost
+	DefaultBcrypt = Bcrypt{Cost: bcrypt.DefaultCost}
+)
+
+// Argon2id hashes passwords with argon2id and encodes them in the PHC string format:
+// $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+type Argon2id struct {
+	Memory      uint32 // in KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// Hash returns the encoded argon2id hash of the password with a random salt
+func (a Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, a.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("generating salt: %s", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.Iterations, a.Memory, a.Parallelism, a.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Iterations, a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify checks the password against a hash produced by any supported algorithm and
+// reports whether the hash should be replaced because it wasn't produced with these parameters
+func (a Argon2id) Verify(password string, encoded string) (bool, error) {
+	if err := Compare(password, encoded); err != nil {
+		return false, err
+	}
+
+	stored, _, _, err := decodeArgon2id(encoded)
+	if err != nil {
+		// a valid hash from another algorithm
+		return true, nil
+	}
+	return stored != a, nil
+}
+
+// Bcrypt hashes passwords with bcrypt, the cost is encoded in the hash by the algorithm itself
+type Bcrypt struct {
+	Cost int
+}
+
+// Hash returns the bcrypt hash of the password
+func (b Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", fmt.Errorf("hashing password: %s", err)
+	}
+	return string(hash), nil
+}
+
+// Verify checks the password against a hash produced by any supported algorithm and
+// reports whether the hash should be replaced because it wasn't produced with this cost
+func (b Bcrypt) Verify(password string, encoded string) (bool, error) {
+	if err := Compare(password, encoded); err != nil {
+		return false, err
+	}
+
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		// a valid hash from another algorithm
+		return true, nil
+	}
+	return cost != b.Cost, nil
+}
+
+// Compare checks the password against an encoded hash, detecting the algorithm from its prefix
+func Compare(password string, encoded string) error {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return ErrMismatch
+		}
+		return nil
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrMismatch
+		}
+		return err
+	default:
+		return ErrUnknownFormat
+	}
+}
+
+func decodeArgon2id(encoded string) (Argon2id, []byte, []byte, error) {
+	params := Argon2id{}
+
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownFormat
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, fmt.Errorf("decoding argon2id version: %s", err)
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("decoding argon2id parameters: %s", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("decoding argon2id salt: %s", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("decoding argon2id key: %s", err)
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
@@ -0,0 +1,117 @@
+package password_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jpaldi/go-user-api/password"
+)
+
+// cheap parameters keep the tests fast, they are not meant for production
+var (
+	testArgon2id = password.Argon2id{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	testBcrypt   = password.Bcrypt{Cost: 4}
+)
+
+type hasher interface {
+	Hash(password string) (string, error)
+	Verify(password string, hash string) (bool, error)
+}
+
+func mustHash(t *testing.T, h hasher, plain string) string {
+	hash, err := h.Hash(plain)
+	if err != nil {
+		t.Fatalf("couldn't hash password: %s", err)
+	}
+	return hash
+}
+
+func TestHash(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name           string
+		hasher         hasher
+		expectedPrefix string
+	}{
+		{name: "argon2id should encode its parameters", hasher: testArgon2id, expectedPrefix: "$argon2id$v=19$m=64,t=1,p=1$"},
+		{name: "bcrypt should encode its cost", hasher: testBcrypt, expectedPrefix: "$2a$04$"},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			first := mustHash(t, tt.hasher, "S3CR3T")
+			second := mustHash(t, tt.hasher, "S3CR3T")
+
+			if !strings.HasPrefix(first, tt.expectedPrefix) {
+				t.Fatalf("wrong hash: got %s want prefix %s", first, tt.expectedPrefix)
+			}
+			if strings.Contains(first, "S3CR3T") {
+				t.Fatalf("hash contains the plain password: %s", first)
+			}
+			if first == second {
+				t.Fatalf("hashes should be salted: got %s twice", first)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+	stronger := testArgon2id
+	stronger.Iterations = 2
+
+	for _, tt := range []struct {
+		name            string
+		stored          string
+		hasher          hasher
+		plain           string
+		expectedRehash  bool
+		expectedFailure error
+	}{
+		{
+			name:   "argon2id hash with the same parameters should not be rehashed",
+			stored: mustHash(t, testArgon2id, "S3CR3T"), hasher: testArgon2id, plain: "S3CR3T",
+		},
+		{
+			name:   "argon2id hash with other parameters should be rehashed",
+			stored: mustHash(t, testArgon2id, "S3CR3T"), hasher: stronger, plain: "S3CR3T",
+			expectedRehash: true,
+		},
+		{
+			name:   "bcrypt hash should be rehashed when argon2id is configured",
+			stored: mustHash(t, testBcrypt, "S3CR3T"), hasher: testArgon2id, plain: "S3CR3T",
+			expectedRehash: true,
+		},
+		{
+			name:   "bcrypt hash with another cost should be rehashed",
+			stored: mustHash(t, testBcrypt, "S3CR3T"), hasher: password.Bcrypt{Cost: 5}, plain: "S3CR3T",
+			expectedRehash: true,
+		},
+		{
+			name:   "wrong argon2id password should fail",
+			stored: mustHash(t, testArgon2id, "S3CR3T"), hasher: testArgon2id, plain: "secret",
+			expectedFailure: password.ErrMismatch,
+		},
+		{
+			name:   "wrong bcrypt password should fail",
+			stored: mustHash(t, testBcrypt, "S3CR3T"), hasher: testArgon2id, plain: "secret",
+			expectedFailure: password.ErrMismatch,
+		},
+		{
+			name:   "plain text passwords should be rejected",
+			stored: "S3CR3T", hasher: testArgon2id, plain: "S3CR3T",
+			expectedFailure: password.ErrUnknownFormat,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			rehash, err := tt.hasher.Verify(tt.plain, tt.stored)
+
+			if err != tt.expectedFailure {
+				t.Fatalf("wrong error: got %v want %v", err, tt.expectedFailure)
+			}
+			if rehash != tt.expectedRehash {
+				t.Fatalf("wrong rehash: got %t want %t", rehash, tt.expectedRehash)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Operation is a single JSON Patch operation
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Apply applies a JSON Patch to the document and returns the patched document.
+// Operations are applied in order to a copy of the document, so the patch is applied
+// entirely or not at all. A failed test operation returns ErrTestFailed.
+func Apply(doc interface{}, jsonPatch []byte) (interface{}, error) {
+	ops := []Operation{}
+	if err := json.Unmarshal(jsonPatch, &ops); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+	}
+
+	doc, err := deepCopy(doc)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range ops {
+		if doc, err = op.apply(doc); err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return doc, nil
+}
+
+func (op Operation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return nil, fmt.Errorf("%w: %s requires a value", ErrInvalidPatch, op.Op)
+		}
+		var value interface{}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+		}
+		switch op.Op {
+		case "add":
+			return add(doc, path, value)
+		case "replace":
+			return replace(doc, path, value)
+		}
+		current, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, fmt.Errorf("%w: %s doesn't match", ErrTestFailed, op.Path)
+		}
+		return doc, nil
+	case "remove":
+		return remove(doc, path)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			if value, err = deepCopy(value); err != nil {
+				return nil, err
+			}
+			return add(doc, path, value)
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("%w: cannot move %s into one of its children", ErrInvalidPatch, op.From)
+		}
+		if doc, err = remove(doc, from); err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	}
+	return nil, fmt.Errorf("%w: unknown operation %q", ErrInvalidPatch, op.Op)
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: path %q must start with /", ErrInvalidPatch, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+func get(node interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: %q doesn't exist", ErrInvalidPatch, token)
+			}
+			node = child
+		case []interface{}:
+			i, err := index(n, token, false)
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("%w: %q doesn't exist", ErrInvalidPatch, token)
+		}
+	}
+	return node, nil
+}
+
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[token] = value
+			return p, nil
+		case []interface{}:
+			i, err := index(p, token, true)
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = value
+			return p, nil
+		}
+		return nil, fmt.Errorf("%w: cannot add %q to a value", ErrInvalidPatch, token)
+	})
+}
+
+func remove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%w: cannot remove the whole document", ErrInvalidPatch)
+	}
+	return update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := p[token]; !ok {
+				return nil, fmt.Errorf("%w: %q doesn't exist", ErrInvalidPatch, token)
+			}
+			delete(p, token)
+			return p, nil
+		case []interface{}:
+			i, err := index(p, token, false)
+			if err != nil {
+				return nil, err
+			}
+			return append(p[:i], p[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("%w: %q doesn't exist", ErrInvalidPatch, token)
+	})
+}
+
+func replace(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := p[token]; !ok {
+				return nil, fmt.Errorf("%w: %q doesn't exist", ErrInvalidPatch, token)
+			}
+			p[token] = value
+			return p, nil
+		case []interface{}:
+			i, err := index(p, token, false)
+			if err != nil {
+				return nil, err
+			}
+			p[i] = value
+			return p, nil
+		}
+		return nil, fmt.Errorf("%w: %q doesn't exist", ErrInvalidPatch, token)
+	})
+}
+
+// update walks down to the parent of the last token and replaces it with the result of fn,
+// so changes to arrays are propagated to their parents
+func update(node interface{}, path []string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(node, path[0])
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q doesn't exist", ErrInvalidPatch, path[0])
+		}
+		updated, err := update(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		n[path[0]] = updated
+		return n, nil
+	case []interface{}:
+		i, err := index(n, path[0], false)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := update(n[i], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = updated
+		return n, nil
+	}
+	return nil, fmt.Errorf("%w: %q doesn't exist", ErrInvalidPatch, path[0])
+}
+
+// index parses an array index, "-" and len(array) are only valid when adding
+func index(array []interface{}, token string, adding bool) (int, error) {
+	if adding && token == "-" {
+		return len(array), nil
+	}
+	u, err := strconv.ParseUint(token, 10, 32)
+	if err != nil || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("%w: invalid array index %q", ErrInvalidPatch, token)
+	}
+	i := int(u)
+	if i > len(array) || (i == len(array) && !adding) {
+		return 0, fmt.Errorf("%w: array index %d out of bounds", ErrInvalidPatch, i)
+	}
+	return i, nil
+}
+
+func deepCopy(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var c interface{}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,62 @@
+// Package patch applies JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902) documents
+// to JSON values decoded with encoding/json.
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Media types of the supported patch formats
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+var (
+	// ErrInvalidPatch is returned when a patch is malformed or can't be applied to the document
+	ErrInvalidPatch = errors.New("invalid patch")
+	// ErrTestFailed is returned when a JSON Patch test operation doesn't match the document
+	ErrTestFailed = errors.New("patch test failed")
+)
+
+// Merge applies a JSON Merge Patch to the document and returns the patched document.
+// Members set to null are removed, objects are merged recursively and any other value replaces the target.
+func Merge(doc interface{}, mergePatch []byte) (interface{}, error) {
+	var p interface{}
+	if err := json.Unmarshal(mergePatch, &p); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+	}
+	return merge(doc, p), nil
+}
+
+func merge(target interface{}, p interface{}) interface{} {
+	members, ok := p.(map[string]interface{})
+	if !ok {
+		return p
+	}
+
+	object, ok := target.(map[string]interface{})
+	if !ok {
+		object = map[string]interface{}{}
+	} else {
+		object = copyObject(object)
+	}
+	for k, v := range members {
+		if v == nil {
+			delete(object, k)
+			continue
+		}
+		object[k] = merge(object[k], v)
+	}
+	return object
+}
+
+func copyObject(object map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(object))
+	for k, v := range object {
+		c[k] = v
+	}
+	return c
+}
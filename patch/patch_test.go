@@ -0,0 +1,131 @@
+package patch_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/jpaldi/go-user-api/patch"
+)
+
+func decode(t *testing.T, s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("invalid json %s: %s", s, err)
+	}
+	return v
+}
+
+func TestMerge(t *testing.T) {
+	t.Parallel()
+	// the examples of RFC 7396 appendix A
+	for _, tt := range []struct {
+		doc      string
+		patch    string
+		expected string
+	}{
+		{doc: `{"a":"b"}`, patch: `{"a":"c"}`, expected: `{"a":"c"}`},
+		{doc: `{"a":"b"}`, patch: `{"b":"c"}`, expected: `{"a":"b","b":"c"}`},
+		{doc: `{"a":"b"}`, patch: `{"a":null}`, expected: `{}`},
+		{doc: `{"a":"b","b":"c"}`, patch: `{"a":null}`, expected: `{"b":"c"}`},
+		{doc: `{"a":["b"]}`, patch: `{"a":"c"}`, expected: `{"a":"c"}`},
+		{doc: `{"a":"c"}`, patch: `{"a":["b"]}`, expected: `{"a":["b"]}`},
+		{doc: `{"a":{"b":"c"}}`, patch: `{"a":{"b":"d","c":null}}`, expected: `{"a":{"b":"d"}}`},
+		{doc: `{"a":[{"b":"c"}]}`, patch: `{"a":[1]}`, expected: `{"a":[1]}`},
+		{doc: `["a","b"]`, patch: `["c","d"]`, expected: `["c","d"]`},
+		{doc: `{"a":"b"}`, patch: `["c"]`, expected: `["c"]`},
+		{doc: `{"a":"foo"}`, patch: `null`, expected: `null`},
+		{doc: `{"e":null}`, patch: `{"a":1}`, expected: `{"e":null,"a":1}`},
+		{doc: `[1,2]`, patch: `{"a":"b","c":null}`, expected: `{"a":"b"}`},
+		{doc: `{}`, patch: `{"a":{"bb":{"ccc":null}}}`, expected: `{"a":{"bb":{}}}`},
+	} {
+		tt := tt
+		t.Run(tt.doc+" "+tt.patch, func(t *testing.T) {
+			got, err := patch.Merge(decode(t, tt.doc), []byte(tt.patch))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if expected := decode(t, tt.expected); !reflect.DeepEqual(got, expected) {
+				t.Fatalf("wrong document: got %v want %v", got, expected)
+			}
+		})
+	}
+}
+
+func TestMergeDoesNotModifyTheDocument(t *testing.T) {
+	doc := map[string]interface{}{"a": "b"}
+	if _, err := patch.Merge(doc, []byte(`{"a":null}`)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if doc["a"] != "b" {
+		t.Fatalf("the document was modified: %v", doc)
+	}
+}
+
+func TestApply(t *testing.T) {
+	t.Parallel()
+	// mostly the examples of RFC 6902 appendix A
+	for _, tt := range []struct {
+		name          string
+		doc           string
+		patch         string
+		expected      string
+		expectedError error
+	}{
+		{name: "add an object member", doc: `{"foo":"bar"}`, patch: `[{"op":"add","path":"/baz","value":"qux"}]`, expected: `{"baz":"qux","foo":"bar"}`},
+		{name: "add an array element", doc: `{"foo":["bar","baz"]}`, patch: `[{"op":"add","path":"/foo/1","value":"qux"}]`, expected: `{"foo":["bar","qux","baz"]}`},
+		{name: "append an array element", doc: `{"foo":["bar"]}`, patch: `[{"op":"add","path":"/foo/-","value":["abc"]}]`, expected: `{"foo":["bar",["abc"]]}`},
+		{name: "remove an object member", doc: `{"baz":"qux","foo":"bar"}`, patch: `[{"op":"remove","path":"/baz"}]`, expected: `{"foo":"bar"}`},
+		{name: "remove an array element", doc: `{"foo":["bar","qux","baz"]}`, patch: `[{"op":"remove","path":"/foo/1"}]`, expected: `{"foo":["bar","baz"]}`},
+		{name: "replace a value", doc: `{"baz":"qux","foo":"bar"}`, patch: `[{"op":"replace","path":"/baz","value":"boo"}]`, expected: `{"baz":"boo","foo":"bar"}`},
+		{name: "move a value", doc: `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, patch: `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, expected: `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{name: "move an array element", doc: `{"foo":["all","grass","cows","eat"]}`, patch: `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, expected: `{"foo":["all","cows","eat","grass"]}`},
+		{name: "copy a value", doc: `{"foo":{"bar":"baz"}}`, patch: `[{"op":"copy","from":"/foo","path":"/qux"}]`, expected: `{"foo":{"bar":"baz"},"qux":{"bar":"baz"}}`},
+		{name: "test a value", doc: `{"baz":"qux","foo":["a",2,"c"]}`, patch: `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, expected: `{"baz":"qux","foo":["a",2,"c"]}`},
+		{name: "escaped pointers", doc: `{"/":1,"~":2}`, patch: `[{"op":"replace","path":"/~1","value":3},{"op":"remove","path":"/~0"}]`, expected: `{"/":3}`},
+		{name: "add a null value", doc: `{}`, patch: `[{"op":"add","path":"/a","value":null}]`, expected: `{"a":null}`},
+		{name: "replace the document", doc: `{"foo":"bar"}`, patch: `[{"op":"replace","path":"","value":[1]}]`, expected: `[1]`},
+		{name: "fail a test", doc: `{"baz":"qux"}`, patch: `[{"op":"test","path":"/baz","value":"bar"}]`, expectedError: patch.ErrTestFailed},
+		{name: "fail a test after changing the document", doc: `{"baz":"qux"}`, patch: `[{"op":"replace","path":"/baz","value":"bar"},{"op":"test","path":"/baz","value":"qux"}]`, expectedError: patch.ErrTestFailed},
+		{name: "add to a missing parent", doc: `{"foo":"bar"}`, patch: `[{"op":"add","path":"/baz/bat","value":"qux"}]`, expectedError: patch.ErrInvalidPatch},
+		{name: "replace a missing member", doc: `{}`, patch: `[{"op":"replace","path":"/a","value":1}]`, expectedError: patch.ErrInvalidPatch},
+		{name: "remove a missing member", doc: `{}`, patch: `[{"op":"remove","path":"/a"}]`, expectedError: patch.ErrInvalidPatch},
+		{name: "add out of bounds", doc: `{"foo":[1]}`, patch: `[{"op":"add","path":"/foo/2","value":1}]`, expectedError: patch.ErrInvalidPatch},
+		{name: "add with a leading zero index", doc: `{"foo":[1,2]}`, patch: `[{"op":"add","path":"/foo/01","value":1}]`, expectedError: patch.ErrInvalidPatch},
+		{name: "add without a value", doc: `{}`, patch: `[{"op":"add","path":"/a"}]`, expectedError: patch.ErrInvalidPatch},
+		{name: "move into a child", doc: `{"a":{"b":{}}}`, patch: `[{"op":"move","from":"/a","path":"/a/b/c"}]`, expectedError: patch.ErrInvalidPatch},
+		{name: "unknown operation", doc: `{}`, patch: `[{"op":"merge","path":"/a","value":1}]`, expectedError: patch.ErrInvalidPatch},
+		{name: "relative path", doc: `{}`, patch: `[{"op":"add","path":"a","value":1}]`, expectedError: patch.ErrInvalidPatch},
+		{name: "not an array of operations", doc: `{}`, patch: `{"op":"add","path":"/a","value":1}`, expectedError: patch.ErrInvalidPatch},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := patch.Apply(decode(t, tt.doc), []byte(tt.patch))
+
+			if tt.expectedError != nil {
+				if !errors.Is(err, tt.expectedError) {
+					t.Fatalf("wrong error: got %v want %v", err, tt.expectedError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if expected := decode(t, tt.expected); !reflect.DeepEqual(got, expected) {
+				t.Fatalf("wrong document: got %v want %v", got, expected)
+			}
+		})
+	}
+}
+
+func TestApplyIsAtomic(t *testing.T) {
+	doc := map[string]interface{}{"a": "b"}
+	_, err := patch.Apply(doc, []byte(`[{"op":"remove","path":"/a"},{"op":"test","path":"/a","value":"b"}]`))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if doc["a"] != "b" {
+		t.Fatalf("the document was modified: %v", doc)
+	}
+}
@@ -0,0 +1,246 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/jpaldi/go-user-api/auth"
+	"github.com/jpaldi/go-user-api/mongo"
+)
+
+// Operations guarded by the policy
+const (
+	ReadUser   = "users:read"
+	ListUsers  = "users:list"
+	UpdateUser = "users:update"
+	RemoveUser = "users:delete"
+	GrantRole  = "roles:grant"
+	RevokeRole = "roles:revoke"
+	// RestoreUser undoes the soft delete of a user
+	RestoreUser = "users:restore"
+	// ListDeletedUsers lets listings include soft deleted users
+	ListDeletedUsers = "users:list_deleted"
+	// ReadAudit lists the changes made to a user
+	ReadAudit = "users:audit"
+	// ManageWebhooks registers, lists and removes webhooks and redelivers their events
+	ManageWebhooks = "webhooks:manage"
+)
+
+// RoleSelf is granted implicitly to callers acting on their own user, it can't be granted explicitly
+const RoleSelf = "self"
+
+// Field visibilities, fields are visible unless stated otherwise
+const (
+	Visible = "visible"
+	Masked  = "mask"
+	Hidden  = "hide"
+)
+
+// Rule describes what a role may do
+type Rule struct {
+	Operations []string `json:"operations"`
+	// RequiredFilters lists the query parameters a listing must be filtered by
+	RequiredFilters []string `json:"required_filters,omitempty"`
+	// Fields maps response fields, by their json name, to their visibility
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// Policy maps role names to their rules
+type Policy struct {
+	Roles map[string]Rule `json:"roles"`
+}
+
+// Default is used when no policy file is configured
+var Default = Policy{
+	Roles: map[string]Rule{
+		auth.RoleAdmin: {
+			Operations: []string{ReadUser, ListUsers, UpdateUser, RemoveUser, GrantRole, RevokeRole, RestoreUser, ListDeletedUsers, ReadAudit, ManageWebhooks},
+		},
+		"support": {
+			Operations:      []string{ReadUser, ListUsers},
+			RequiredFilters: []string{"country"},
+			Fields:          map[string]string{"email": Masked},
+		},
+		RoleSelf: {
+			Operations: []string{ReadUser, UpdateUser, RemoveUser},
+		},
+	},
+}
+
+// Load reads a JSON policy file and checks it is consistent
+func Load(file string) (*Policy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading policy: %s", err)
+	}
+
+	p := &Policy{}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("decoding policy: %s", err)
+	}
+
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %s", file, err)
+	}
+	return p, nil
+}
+
+func (p *Policy) validate() error {
+	known := map[string]bool{
+		ReadUser: true, ListUsers: true, UpdateUser: true, RemoveUser: true,
+		GrantRole: true, RevokeRole: true, RestoreUser: true, ListDeletedUsers: true, ReadAudit: true,
+		ManageWebhooks: true,
+	}
+	for role, rule := range p.Roles {
+		for _, op := range rule.Operations {
+			if !known[op] {
+				return fmt.Errorf("role %s: unknown operation %q", role, op)
+			}
+		}
+		for field, visibility := range rule.Fields {
+			if visibility != Visible && visibility != Masked && visibility != Hidden {
+				return fmt.Errorf("role %s: unknown visibility %q for field %s", role, visibility, field)
+			}
+		}
+	}
+	return nil
+}
+
+// Grantable reports whether the role can be granted to users
+func (p *Policy) Grantable(role string) bool {
+	_, ok := p.Roles[role]
+	return ok && role != RoleSelf
+}
+
+// Allows reports whether the caller may perform the operation on the user with the given id.
+// Listings have no target user and are checked against params, the request filters: they must filter by the
+// required filters, and can't filter or sort by the fields the caller doesn't see, which would reveal them.
+func (p *Policy) Allows(identity auth.Identity, operation string, userID string, params url.Values) bool {
+	for _, rule := range p.rules(identity, userID) {
+		if !contains(rule.Operations, operation) {
+			continue
+		}
+		if operation == ListUsers && (!filtered(params, rule.RequiredFilters) || revealsFields(params, rule.Fields)) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Redact returns a copy of the user with the fields the caller may not see masked or hidden.
+// When several roles apply the most permissive visibility wins.
+func (p *Policy) Redact(identity auth.Identity, user mongo.User) mongo.User {
+	rules := p.rules(identity, user.ID)
+
+	visibility := func(field string) string {
+		result := Hidden
+		for _, rule := range rules {
+			v, ok := rule.Fields[field]
+			if !ok {
+				v = Visible
+			}
+			if rank(v) > rank(result) {
+				result = v
+			}
+		}
+		return result
+	}
+
+	user.Nickname = apply(visibility("nickname"), user.Nickname)
+	user.FirstName = apply(visibility("first_name"), user.FirstName)
+	user.LastName = apply(visibility("last_name"), user.LastName)
+	user.Email = apply(visibility("email"), user.Email)
+	user.Country = apply(visibility("country"), user.Country)
+	if visibility("roles") != Visible {
+		user.Roles = nil
+	}
+	return user
+}
+
+func (p *Policy) rules(identity auth.Identity, userID string) []Rule {
+	rules := []Rule{}
+	for _, role := range identity.Roles {
+		// self can only be earned by acting on your own user
+		if role == RoleSelf {
+			continue
+		}
+		if rule, ok := p.Roles[role]; ok {
+			rules = append(rules, rule)
+		}
+	}
+	if userID != "" && identity.Subject == userID && identity.Method == "jwt" {
+		if rule, ok := p.Roles[RoleSelf]; ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func rank(visibility string) int {
+	switch visibility {
+	case Visible:
+		return 2
+	case Masked:
+		return 1
+	}
+	return 0
+}
+
+func apply(visibility string, value string) string {
+	switch visibility {
+	case Visible:
+		return value
+	case Masked:
+		return mask(value)
+	}
+	return ""
+}
+
+// mask keeps the first character of the value, and the domain of emails
+func mask(value string) string {
+	if value == "" {
+		return value
+	}
+	local, domain := value, ""
+	if at := strings.LastIndex(value, "@"); at > 0 {
+		local, domain = value[:at], value[at:]
+	}
+	runes := []rune(local)
+	return string(runes[0]) + strings.Repeat("*", len(runes)-1) + domain
+}
+
+func filtered(params url.Values, required []string) bool {
+	for _, key := range required {
+		if params.Get(key) == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// revealsFields reports whether params filter or sort by a field which isn't visible
+func revealsFields(params url.Values, fields map[string]string) bool {
+	sort := strings.TrimPrefix(params.Get("sort"), "-")
+	for field, visibility := range fields {
+		if visibility == Visible {
+			continue
+		}
+		if params.Get(field) != "" || sort == field {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(arr []string, str string) bool {
+	for _, a := range arr {
+		if a == str {
+			return true
+		}
+	}
+	return false
+}
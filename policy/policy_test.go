@@ -0,0 +1,131 @@
+package policy_test
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jpaldi/go-user-api/auth"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/policy"
+)
+
+var (
+	admin   = auth.Identity{Subject: "admin-1", Roles: []string{"admin"}, Method: "jwt"}
+	support = auth.Identity{Subject: "support-1", Roles: []string{"support"}, Method: "jwt"}
+	user    = auth.Identity{Subject: "user-1", Method: "jwt"}
+	// API keys can't act as self even if their subject looks like a user id
+	service = auth.Identity{Subject: "user-1", Method: "api_key"}
+)
+
+func TestAllows(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name      string
+		identity  auth.Identity
+		operation string
+		userID    string
+		params    url.Values
+		expected  bool
+	}{
+		{name: "admins can remove anyone", identity: admin, operation: policy.RemoveUser, userID: "user-1", expected: true},
+		{name: "admins can grant roles", identity: admin, operation: policy.GrantRole, userID: "user-1", expected: true},
+		{name: "users can update themselves", identity: user, operation: policy.UpdateUser, userID: "user-1", expected: true},
+		{name: "users can't update someone else", identity: user, operation: policy.UpdateUser, userID: "user-2", expected: false},
+		{name: "users can't grant themselves roles", identity: user, operation: policy.GrantRole, userID: "user-1", expected: false},
+		{name: "users can't list users", identity: user, operation: policy.ListUsers, params: url.Values{"country": {"PT"}}, expected: false},
+		{name: "support can list users by country", identity: support, operation: policy.ListUsers, params: url.Values{"country": {"PT"}}, expected: true},
+		{name: "support can't filter by masked fields", identity: support, operation: policy.ListUsers, params: url.Values{"country": {"PT"}, "email": {"john@email.pt"}}, expected: false},
+		{name: "admins can filter by email", identity: admin, operation: policy.ListUsers, params: url.Values{"email": {"john@email.pt"}}, expected: true},
+		{name: "support can't list every user", identity: support, operation: policy.ListUsers, params: url.Values{}, expected: false},
+		{name: "support can't remove users", identity: support, operation: policy.RemoveUser, userID: "user-1", expected: false},
+		{name: "admins can restore users", identity: admin, operation: policy.RestoreUser, userID: "user-1", expected: true},
+		{name: "users can't restore themselves", identity: user, operation: policy.RestoreUser, userID: "user-1", expected: false},
+		{name: "users can't read their audit trail", identity: user, operation: policy.ReadAudit, userID: "user-1", expected: false},
+		{name: "admins can manage webhooks", identity: admin, operation: policy.ManageWebhooks, expected: true},
+		{name: "support can't manage webhooks", identity: support, operation: policy.ManageWebhooks, expected: false},
+		{name: "support can't list deleted users", identity: support, operation: policy.ListDeletedUsers, params: url.Values{"country": {"PT"}}, expected: false},
+		{name: "api keys are never self", identity: service, operation: policy.UpdateUser, userID: "user-1", expected: false},
+		{name: "self can't be granted", identity: auth.Identity{Subject: "x", Roles: []string{"self"}, Method: "jwt"}, operation: policy.UpdateUser, userID: "user-1", expected: false},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Default.Allows(tt.identity, tt.operation, tt.userID, tt.params); got != tt.expected {
+				t.Fatalf("wrong decision: got %t want %t", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	t.Parallel()
+	u := mongo.User{ID: "user-1", Nickname: "jpaldi", Email: "jpaldi@email.pt", Country: "PT", Roles: []string{"support"}}
+
+	for _, tt := range []struct {
+		name          string
+		identity      auth.Identity
+		expectedEmail string
+	}{
+		{name: "admins see emails in full", identity: admin, expectedEmail: "jpaldi@email.pt"},
+		{name: "users see their own email in full", identity: user, expectedEmail: "jpaldi@email.pt"},
+		{name: "support sees masked emails", identity: support, expectedEmail: "j*****@email.pt"},
+		{name: "callers without any role see nothing", identity: auth.Identity{Subject: "user-2", Method: "jwt"}, expectedEmail: ""},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			redacted := policy.Default.Redact(tt.identity, u)
+			if redacted.Email != tt.expectedEmail {
+				t.Fatalf("wrong email: got %s want %s", redacted.Email, tt.expectedEmail)
+			}
+		})
+	}
+
+	if u.Email != "jpaldi@email.pt" {
+		t.Fatalf("redact modified the original user")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range []struct {
+		name        string
+		content     string
+		expectError bool
+	}{
+		{
+			name:    "a valid policy should load",
+			content: `{"roles": {"auditor": {"operations": ["users:list"], "fields": {"email": "hide"}}}}`,
+		},
+		{
+			name:        "unknown operations should be rejected",
+			content:     `{"roles": {"auditor": {"operations": ["users:explode"]}}}`,
+			expectError: true,
+		},
+		{
+			name:        "unknown visibilities should be rejected",
+			content:     `{"roles": {"auditor": {"operations": ["users:list"], "fields": {"email": "blur"}}}}`,
+			expectError: true,
+		},
+	} {
+		file := filepath.Join(dir, "policy.json")
+		if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+			t.Fatalf("couldn't write policy: %s", err)
+		}
+
+		p, err := policy.Load(file)
+		if (err != nil) != tt.expectError {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if err == nil && !p.Allows(auth.Identity{Roles: []string{"auditor"}}, policy.ListUsers, "", url.Values{}) {
+			t.Fatalf("%s: loaded policy doesn't allow listing users", tt.name)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package shutdown
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Readiness is the readiness probe failed first, see health.Registry
+type Readiness interface {
+	ShutDown()
+}
+
+// Server stops accepting requests, see http.Server
+type Server interface {
+	// Shutdown closes the listener and drains the requests in flight until ctx is done
+	Shutdown(ctx context.Context) error
+	// Close closes the connections left
+	Close() error
+}
+
+// Step is stopped once the server is, e.g. background workers or a database client
+type Step struct {
+	Name string
+	Stop func(ctx context.Context) error
+}
+
+// Sequence stops the service gracefully: it fails the readiness probe and keeps serving for Delay, so load
+// balancers stop sending requests, then drains the requests in flight and stops the steps in order, all within
+// Timeout
+type Sequence struct {
+	Readiness Readiness
+	Server    Server
+	Steps     []Step
+	Delay     time.Duration
+	Timeout   time.Duration
+	Logger    *logrus.Logger
+}
+
+// Run runs the sequence, steps failing or timing out are logged and the next ones still stopped
+func (s Sequence) Run() {
+	s.Readiness.ShutDown()
+	time.Sleep(s.Delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	if err := s.Server.Shutdown(ctx); err != nil {
+		s.Logger.WithError(err).Warn("draining requests, closing the remaining connections")
+		s.Server.Close()
+	}
+	for _, step := range s.Steps {
+		if err := step.Stop(ctx); err != nil {
+			s.Logger.WithError(err).Warnf("stopping %s", step.Name)
+		}
+	}
+	s.Logger.Info("shut down")
+}
@@ -0,0 +1,99 @@
+package shutdown_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jpaldi/go-user-api/health"
+	"github.com/jpaldi/go-user-api/shutdown"
+	"github.com/sirupsen/logrus"
+)
+
+// recorder lists the steps of the sequence in the order they happen
+type recorder struct {
+	mu    sync.Mutex
+	steps []string
+	at    map[string]time.Time
+}
+
+func (r *recorder) record(step string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.steps = append(r.steps, step)
+	r.at[step] = time.Now()
+}
+
+type mockReadiness struct {
+	*health.Registry
+	recorder *recorder
+}
+
+func (m mockReadiness) ShutDown() {
+	m.recorder.record("not ready")
+	m.Registry.ShutDown()
+}
+
+// mockServer probes the readiness of the server it shuts down, while its listener is still open
+type mockServer struct {
+	*http.Server
+	url      string
+	recorder *recorder
+}
+
+func (m mockServer) Shutdown(ctx context.Context) error {
+	resp, err := http.Get(m.url + "/readyz")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	m.recorder.record(fmt.Sprintf("readyz %d", resp.StatusCode))
+
+	err = m.Server.Shutdown(ctx)
+	if _, probeErr := http.Get(m.url + "/readyz"); probeErr != nil {
+		m.recorder.record("listener closed")
+	}
+	return err
+}
+
+func TestSequence(t *testing.T) {
+	t.Parallel()
+	rec := &recorder{at: map[string]time.Time{}}
+	checks := &health.Registry{}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(checks.Readyz)}
+	go server.Serve(listener)
+	step := func(name string, err error) shutdown.Step {
+		return shutdown.Step{Name: name, Stop: func(ctx context.Context) error {
+			rec.record(name)
+			return err
+		}}
+	}
+
+	shutdown.Sequence{
+		Readiness: mockReadiness{Registry: checks, recorder: rec},
+		Server:    mockServer{Server: server, url: "http://" + listener.Addr().String(), recorder: rec},
+		// a failing step doesn't stop the next ones
+		Steps:   []shutdown.Step{step("workers", errors.New("timed out")), step("mongo", nil)},
+		Delay:   50 * time.Millisecond,
+		Timeout: time.Second,
+		Logger:  logrus.New(),
+	}.Run()
+
+	expected := []string{"not ready", "readyz 503", "listener closed", "workers", "mongo"}
+	if !reflect.DeepEqual(rec.steps, expected) {
+		t.Fatalf("wrong steps: got %v want %v", rec.steps, expected)
+	}
+	if delay := rec.at["readyz 503"].Sub(rec.at["not ready"]); delay < 50*time.Millisecond {
+		t.Fatalf("requests should be served for the delay: got %s", delay)
+	}
+}
@@ -0,0 +1,272 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Memory keeps the exported spans in memory, so tests can assert them without a collector
+type Memory struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+// ExportSpan records the span
+func (m *Memory) ExportSpan(span SpanData) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spans = append(m.spans, span)
+}
+
+// Spans returns the exported spans, in the order they ended
+func (m *Memory) Spans() []SpanData {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SpanData(nil), m.spans...)
+}
+
+// Writer writes the spans to an io.Writer, one OTLP JSON span per line
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriter returns an exporter writing to w, e.g. os.Stdout
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// ExportSpan writes the span
+func (w *Writer) ExportSpan(span SpanData) {
+	b, err := json.Marshal(otlpSpanOf(span))
+	if err != nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.w.Write(append(b, '\n'))
+}
+
+// OTLP sends the spans in batches to an OpenTelemetry collector with OTLP/HTTP, in JSON.
+// Spans are queued until Run sends them, the queue drops new spans when full so a collector
+// outage never slows the service down.
+type OTLP struct {
+	// URL is the traces endpoint, e.g. http://collector:4318/v1/traces
+	URL string
+	// Service is the service.name resource attribute
+	Service string
+	Client  *http.Client
+	Logger  *logrus.Logger
+	// Interval between sends, 5s by default
+	Interval time.Duration
+	// MaxQueue bounds the queued spans, 2048 by default
+	MaxQueue int
+
+	mu      sync.Mutex
+	queue   []SpanData
+	dropped int
+}
+
+// ExportSpan queues the span
+func (o *OTLP) ExportSpan(span SpanData) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.queue) >= o.maxQueue() {
+		o.dropped++
+		return
+	}
+	o.queue = append(o.queue, span)
+}
+
+// Run sends the queued spans every interval, and a last time when the context is cancelled
+func (o *OTLP) Run(ctx context.Context) {
+	interval := o.Interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			o.flush(flushCtx)
+			return
+		case <-ticker.C:
+			o.flush(ctx)
+		}
+	}
+}
+
+func (o *OTLP) flush(ctx context.Context) {
+	if err := o.Flush(ctx); err != nil {
+		o.Logger.WithError(err).Warn("exporting spans")
+	}
+}
+
+// Flush sends the queued spans, they are dropped when the collector rejects them
+func (o *OTLP) Flush(ctx context.Context) error {
+	o.mu.Lock()
+	spans, dropped := o.queue, o.dropped
+	o.queue, o.dropped = nil, 0
+	o.mu.Unlock()
+
+	if dropped > 0 {
+		o.Logger.WithField("dropped", dropped).Warn("dropped spans, the queue was full")
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(o.request(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := o.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending %d spans: %w", len(spans), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sending %d spans: collector responded %d", len(spans), resp.StatusCode)
+	}
+	return nil
+}
+
+func (o *OTLP) maxQueue() int {
+	if o.MaxQueue <= 0 {
+		return 2048
+	}
+	return o.MaxQueue
+}
+
+// The OTLP/HTTP JSON encoding, see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue holds one of the fields, int64s are strings in OTLP JSON
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func (o *OTLP) request(spans []SpanData) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		encoded = append(encoded, otlpSpanOf(s))
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes([]Attribute{{"service.name", o.Service}})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/jpaldi/go-user-api/tracing"}, Spans: encoded}},
+	}}}
+}
+
+func otlpSpanOf(s SpanData) otlpSpan {
+	span := otlpSpan{
+		TraceID:           s.SpanContext.TraceID.String(),
+		SpanID:            s.SpanContext.SpanID.String(),
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.Attributes),
+		Status:            otlpStatus{Code: s.StatusCode, Message: s.StatusMessage},
+	}
+	if s.ParentSpanID.IsValid() {
+		span.ParentSpanID = s.ParentSpanID.String()
+	}
+	return span
+}
+
+func otlpAttributes(attributes []Attribute) []otlpAttribute {
+	encoded := make([]otlpAttribute, 0, len(attributes))
+	for _, a := range attributes {
+		var v otlpValue
+		switch value := a.Value.(type) {
+		case string:
+			v.StringValue = &value
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.IntValue = &s
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		case float64:
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			v.DoubleValue = &value
+		case bool:
+			v.BoolValue = &value
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		encoded = append(encoded, otlpAttribute{Key: a.Key, Value: v})
+	}
+	return encoded
+}
@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jpaldi/go-user-api/logging"
+)
+
+// TraceparentHeader carries the span context between services, see https://www.w3.org/TR/trace-context/
+const TraceparentHeader = "traceparent"
+
+// ParseTraceparent parses a version 00 traceparent header, e.g. 00-<trace id>-<parent span id>-01.
+// Headers of later versions are parsed the same way, ignoring what follows the flags.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+	var sc SpanContext
+	var flags [1]byte
+	if !decodeHex(parts[1], sc.TraceID[:]) || !decodeHex(parts[2], sc.SpanID[:]) || !decodeHex(parts[3], flags[:]) {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	return sc, true
+}
+
+// Traceparent formats the span context as a traceparent header
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// decodeHex decodes lowercase hex of exactly the length of b
+func decodeHex(s string, b []byte) bool {
+	if len(s) != hex.EncodedLen(len(b)) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(b, []byte(s))
+	return err == nil
+}
+
+// Middleware starts a server span for every request, the child of the traceparent header of the request when valid
+type Middleware struct {
+	Tracer *Tracer
+	// Routes is the router serving the requests, used to name spans after the route template
+	Routes *mux.Router
+}
+
+// Handler wraps next, it must wrap the whole router so unknown routes are traced too
+func (m Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if sc, ok := ParseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+			ctx = ContextWithRemoteParent(ctx, sc)
+		}
+		route := logging.RouteTemplate(m.Routes, r)
+		ctx, span := m.Tracer.Start(ctx, r.Method+" "+route, KindServer,
+			Attribute{"http.method", r.Method},
+			Attribute{"http.route", route},
+			Attribute{"http.target", r.URL.Path},
+			Attribute{"net.peer.addr", r.RemoteAddr},
+		)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(Attribute{"http.status_code", int64(rec.status)})
+		if rec.status >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("%d %s", rec.status, http.StatusText(rec.status)))
+		}
+	})
+}
+
+// statusRecorder captures the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status, rec.wroteHeader = status, true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.ResponseWriter.Write(b)
+}
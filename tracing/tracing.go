@@ -0,0 +1,247 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace, it is shared by every span of the trace
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the id isn't all zeros
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the id isn't all zeros
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// SpanContext is the part of a span propagated to other services, see Traceparent
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Sampled spans are exported, the decision is made once per trace and followed by every service
+	Sampled bool
+}
+
+// IsValid reports whether both ids are set
+func (sc SpanContext) IsValid() bool { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+
+// The kinds of spans, with their OTLP values
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// The status codes of spans, with their OTLP values. Spans are Unset unless they failed.
+const (
+	StatusUnset = 0
+	StatusOK    = 1
+	StatusError = 2
+)
+
+// Attribute is a key value pair describing a span, values are strings, int64s, float64s or bools
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// SpanData is a finished span, as exported
+type SpanData struct {
+	Name          string
+	Kind          int
+	SpanContext   SpanContext
+	ParentSpanID  SpanID
+	Start         time.Time
+	End           time.Time
+	Attributes    []Attribute
+	StatusCode    int
+	StatusMessage string
+}
+
+// Exporter sends the finished spans somewhere, it is called by every span on End and must not block
+type Exporter interface {
+	ExportSpan(span SpanData)
+}
+
+// Tracer starts spans and exports the sampled ones when they end
+type Tracer struct {
+	Exporter Exporter
+	// SampleRatio is the share of new traces sampled, from 0 to 1. Traces started by other
+	// services follow their decision.
+	SampleRatio float64
+	// Now defaults to time.Now
+	Now func() time.Time
+}
+
+// Span is an operation of a trace. Its methods can be called on a nil span, which records nothing,
+// so code can trace unconditionally.
+type Span struct {
+	tracer *Tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// Start starts a span, the child of the span in ctx or of the remote parent in ctx, and returns a copy of ctx carrying it
+func (t *Tracer) Start(ctx context.Context, name string, kind int, attributes ...Attribute) (context.Context, *Span) {
+	parent, ok := parentFromContext(ctx)
+	sc := SpanContext{TraceID: parent.TraceID, SpanID: newSpanID(), Sampled: parent.Sampled}
+	if !ok {
+		sc.TraceID = newTraceID()
+		sc.Sampled = t.sample(sc.TraceID)
+	}
+	span := &Span{
+		tracer: t,
+		data: SpanData{
+			Name:         name,
+			Kind:         kind,
+			SpanContext:  sc,
+			ParentSpanID: parent.SpanID,
+			Start:        t.now(),
+			Attributes:   append([]Attribute(nil), attributes...),
+		},
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+// StartChild starts a child of the span in ctx with the same tracer, without a span in ctx nothing is traced
+// and the returned span is nil
+func StartChild(ctx context.Context, name string, kind int, attributes ...Attribute) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, kind, attributes...)
+}
+
+// sample keeps the ratio of traces with the lowest ids, so the decision only depends on the trace id
+func (t *Tracer) sample(id TraceID) bool {
+	switch {
+	case t.SampleRatio >= 1:
+		return true
+	case t.SampleRatio <= 0:
+		return false
+	}
+	return float64(binary.BigEndian.Uint64(id[8:])) < t.SampleRatio*(1<<64)
+}
+
+func (t *Tracer) now() time.Time {
+	if t.Now == nil {
+		return time.Now()
+	}
+	return t.Now()
+}
+
+// SpanContext returns the ids of the span, propagated to other services
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes = append(s.data.Attributes, attributes...)
+}
+
+// SetError marks the span as failed with the error, nil errors are ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.StatusCode, s.data.StatusMessage = StatusError, err.Error()
+}
+
+// End ends the span and exports it when sampled, only the first call counts
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = s.tracer.now()
+	data := s.data
+	s.mu.Unlock()
+
+	if data.SpanContext.Sampled && s.tracer.Exporter != nil {
+		s.tracer.Exporter.ExportSpan(data)
+	}
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteParentKey
+)
+
+// ContextWithSpan returns a copy of ctx carrying the span, the parent of the spans started with it
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey, span)
+}
+
+// SpanFromContext returns the span in ctx, nil if there is none
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// ContextWithRemoteParent returns a copy of ctx carrying the span of another service, the parent of the next span started
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteParentKey, sc)
+}
+
+func parentFromContext(ctx context.Context) (SpanContext, bool) {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.SpanContext(), true
+	}
+	sc, ok := ctx.Value(remoteParentKey).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		mustRead(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		mustRead(id[:])
+	}
+	return id
+}
+
+func mustRead(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(errors.New("tracing: reading random ids: " + err.Error()))
+	}
+}
@@ -0,0 +1,190 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jpaldi/go-user-api/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceparent(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name            string
+		header          string
+		expectedValid   bool
+		expectedSampled bool
+	}{
+		{name: "sampled parents should be parsed", header: traceparent, expectedValid: true, expectedSampled: true},
+		{name: "unsampled parents should be parsed", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", expectedValid: true},
+		{name: "later versions should be parsed", header: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", expectedValid: true, expectedSampled: true},
+		{name: "extra fields should be rejected in version 00", header: traceparent + "-extra"},
+		{name: "version ff should be rejected", header: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "zero trace ids should be rejected", header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "zero span ids should be rejected", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{name: "uppercase ids should be rejected", header: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"},
+		{name: "short ids should be rejected", header: "00-4bf92f3577b34da6-00f067aa0ba902b7-01"},
+		{name: "missing headers should be rejected"},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := tracing.ParseTraceparent(tt.header)
+			if ok != tt.expectedValid || sc.Sampled != tt.expectedSampled {
+				t.Fatalf("wrong span context: got %+v %t", sc, ok)
+			}
+			if ok && sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+				t.Fatalf("wrong trace id: got %s", sc.TraceID)
+			}
+		})
+	}
+
+	sc, _ := tracing.ParseTraceparent(traceparent)
+	if sc.Traceparent() != traceparent {
+		t.Fatalf("wrong header: got %s want %s", sc.Traceparent(), traceparent)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name             string
+		traceparent      string
+		sampleRatio      float64
+		path             string
+		expectedSpans    int
+		expectedTraceID  string
+		expectedParentID string
+		expectedStatus   int
+	}{
+		{
+			name:             "requests should continue the trace of their traceparent",
+			traceparent:      traceparent,
+			path:             "/users/user-1",
+			expectedSpans:    2,
+			expectedTraceID:  "4bf92f3577b34da6a3ce929d0e0e4736",
+			expectedParentID: "00f067aa0ba902b7",
+		},
+		{
+			name:          "requests without a traceparent should start a trace",
+			sampleRatio:   1,
+			path:          "/users/user-1",
+			expectedSpans: 2,
+		},
+		{
+			name:        "unsampled traces should not be exported",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			sampleRatio: 1,
+			path:        "/users/user-1",
+		},
+		{
+			name:        "traces should be sampled at the sample ratio",
+			sampleRatio: 0,
+			path:        "/users/user-1",
+		},
+		{
+			name:           "server errors should fail the span",
+			sampleRatio:    1,
+			path:           "/fail",
+			expectedSpans:  1,
+			expectedStatus: tracing.StatusError,
+		},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := &tracing.Memory{}
+			tracer := &tracing.Tracer{Exporter: exporter, SampleRatio: tt.sampleRatio}
+			router := mux.NewRouter()
+			router.HandleFunc("/users/{userid}", func(w http.ResponseWriter, r *http.Request) {
+				_, span := tracing.StartChild(r.Context(), "mongo.FindOne", tracing.KindClient)
+				span.End()
+			})
+			router.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			})
+			r, _ := http.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.traceparent != "" {
+				r.Header.Set(tracing.TraceparentHeader, tt.traceparent)
+			}
+
+			tracing.Middleware{Tracer: tracer, Routes: router}.Handler(router).ServeHTTP(httptest.NewRecorder(), r)
+
+			spans := exporter.Spans()
+			if len(spans) != tt.expectedSpans {
+				t.Fatalf("wrong number of spans: got %d want %d", len(spans), tt.expectedSpans)
+			}
+			if len(spans) == 0 {
+				return
+			}
+			server := spans[len(spans)-1]
+			if server.Kind != tracing.KindServer || server.StatusCode != tt.expectedStatus {
+				t.Fatalf("wrong server span: got %+v", server)
+			}
+			if tt.expectedTraceID != "" && server.SpanContext.TraceID.String() != tt.expectedTraceID {
+				t.Fatalf("wrong trace id: got %s want %s", server.SpanContext.TraceID, tt.expectedTraceID)
+			}
+			if parent := server.ParentSpanID; (tt.expectedParentID == "" && parent.IsValid()) || (tt.expectedParentID != "" && parent.String() != tt.expectedParentID) {
+				t.Fatalf("wrong parent: got %s want %s", parent, tt.expectedParentID)
+			}
+			if len(spans) == 2 {
+				child := spans[0]
+				if child.SpanContext.TraceID != server.SpanContext.TraceID || child.ParentSpanID != server.SpanContext.SpanID {
+					t.Fatalf("the mongo span should be a child of the server span: got %+v", child)
+				}
+				if server.Name != "GET /users/{userid}" {
+					t.Fatalf("spans should be named after the route template: got %s", server.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestStartChildWithoutParent(t *testing.T) {
+	t.Parallel()
+	ctx, span := tracing.StartChild(context.Background(), "mongo.FindOne", tracing.KindClient)
+	if span != nil || tracing.SpanFromContext(ctx) != nil {
+		t.Fatalf("nothing should be traced outside of a trace")
+	}
+	// nil spans record nothing
+	span.SetAttributes(tracing.Attribute{Key: "db.operation", Value: "FindOne"})
+	span.End()
+}
+
+func TestOTLP(t *testing.T) {
+	t.Parallel()
+	var received map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &received)
+	}))
+	defer collector.Close()
+
+	exporter := &tracing.OTLP{URL: collector.URL, Service: "users", Logger: logrus.New()}
+	tracer := &tracing.Tracer{Exporter: exporter, SampleRatio: 1}
+	_, span := tracer.Start(context.Background(), "GET /users", tracing.KindServer, tracing.Attribute{Key: "http.status_code", Value: int64(200)})
+	span.End()
+
+	if err := exporter.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, _ := json.Marshal(received)
+	for _, expected := range []string{
+		`"key":"service.name","value":{"stringValue":"users"}`,
+		`"name":"GET /users"`,
+		`"kind":2`,
+		`"key":"http.status_code","value":{"intValue":"200"}`,
+		`"traceId":"` + span.SpanContext().TraceID.String() + `"`,
+	} {
+		if !strings.Contains(string(b), expected) {
+			t.Fatalf("missing %s in %s", expected, b)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package validation
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy describes how strong passwords must be
+type PasswordPolicy struct {
+	MinLength int
+	// MaxLength of 0 means no limit
+	MaxLength int
+	// MinClasses is how many of lowercase letters, uppercase letters, digits and symbols a password needs
+	MinClasses int
+	// MinEntropy is the minimum estimated entropy in bits, see Entropy
+	MinEntropy float64
+	// Breached passwords are rejected whatever their strength, they are compared case-insensitively
+	Breached map[string]struct{}
+}
+
+// DefaultPasswordPolicy asks for 8 to 128 characters and about 35 bits of entropy
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:  8,
+	MaxLength:  128,
+	MinClasses: 1,
+	MinEntropy: 35,
+}
+
+// LoadBreachedPasswords reads a list of breached passwords, one per line
+func LoadBreachedPasswords(file string) (map[string]struct{}, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("opening breached passwords: %s", err)
+	}
+	defer f.Close()
+
+	breached := map[string]struct{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			breached[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading breached passwords: %s", err)
+	}
+	return breached, nil
+}
+
+// Rule returns the rule checking passwords against the policy
+func (p PasswordPolicy) Rule() Rule {
+	return func(field string, value string) *FieldError {
+		if err := Length(p.MinLength, p.MaxLength)(field, value); err != nil {
+			return err
+		}
+		if _, ok := p.Breached[strings.ToLower(value)]; ok {
+			return &FieldError{Field: field, Code: CodeBreachedPassword, Message: fmt.Sprintf("%s appears in a list of breached passwords", field)}
+		}
+		if classes(value) < p.MinClasses {
+			return &FieldError{Field: field, Code: CodeMissingClasses, Message: fmt.Sprintf("%s must mix at least %d of lowercase letters, uppercase letters, digits and symbols", field, p.MinClasses)}
+		}
+		if Entropy(value) < p.MinEntropy {
+			return &FieldError{Field: field, Code: CodeWeakPassword, Message: fmt.Sprintf("%s is too easy to guess, avoid common words, repetitions and sequences", field)}
+		}
+		return nil
+	}
+}
+
+func classes(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// keyboardRows are adjacent keys, typing along them is as predictable as a sequence
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+// commonWords are frequent password building blocks, compared after undoing leet substitutions
+var commonWords = []string{
+	"password", "passwd", "qwerty", "letmein", "welcome", "admin", "login", "dragon", "monkey",
+	"football", "baseball", "soccer", "master", "shadow", "sunshine", "princess", "iloveyou",
+	"trustno", "secret", "superman", "batman", "hello", "freedom", "whatever", "starwars",
+	"michael", "charlie", "jordan", "hunter", "ranger", "buster", "summer", "winter", "spring",
+	"autumn", "flower", "cookie", "cheese", "pepper", "ginger", "orange", "banana", "computer",
+	"internet", "access", "abc123", "changeme", "default", "user", "test", "guest", "love",
+}
+
+var leet = strings.NewReplacer("0", "o", "1", "l", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s", "!", "i")
+
+// Entropy estimates how many bits an attacker needs to guess a password. Like zxcvbn it doesn't
+// only count the character pool: common words, repeated characters, sequences, keyboard runs
+// and repeated chunks add little on top of their first character.
+func Entropy(password string) float64 {
+	if password == "" {
+		return 0
+	}
+	if unit, count := repeatedChunk(password); count > 1 {
+		return Entropy(unit) + math.Log2(float64(count))
+	}
+
+	runes := []rune(password)
+	perChar := math.Log2(float64(pool(password)))
+
+	// characters covered by a common word count as a pick in the word list, plus a bit for capitals and substitutions
+	word := make([]bool, len(runes))
+	bits := 0.0
+	normalized := leet.Replace(strings.ToLower(password))
+	if utf8.RuneCountInString(normalized) == len(runes) {
+		for _, w := range commonWords {
+			i := strings.Index(normalized, w)
+			if i < 0 {
+				continue
+			}
+			start := utf8.RuneCountInString(normalized[:i])
+			end := start + len(w)
+			if anyOf(word[start:end]) {
+				continue
+			}
+			for j := start; j < end; j++ {
+				word[j] = true
+			}
+			bits += math.Log2(float64(len(commonWords))) + 1
+		}
+	}
+
+	for i, r := range runes {
+		if word[i] {
+			continue
+		}
+		if i == 0 || word[i-1] {
+			bits += perChar
+			continue
+		}
+		prev := unicode.ToLower(runes[i-1])
+		lower := unicode.ToLower(r)
+		switch {
+		case lower == prev:
+			bits++
+		case lower == prev+1 || lower == prev-1:
+			bits++
+		case adjacentKeys(prev, lower):
+			bits += 1.5
+		default:
+			bits += perChar
+		}
+	}
+	return bits
+}
+
+// pool is the number of characters an attacker would try for each position
+func pool(password string) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	size := 0
+	for _, c := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if c.present {
+			size += c.size
+		}
+	}
+	return size
+}
+
+// repeatedChunk finds the shortest chunk the password repeats, e.g. "abcabc" is "abc" twice
+func repeatedChunk(password string) (string, int) {
+	runes := []rune(password)
+	for size := 1; size <= len(runes)/2; size++ {
+		if len(runes)%size != 0 {
+			continue
+		}
+		chunk := string(runes[:size])
+		if strings.Repeat(chunk, len(runes)/size) == password {
+			return chunk, len(runes) / size
+		}
+	}
+	return password, 1
+}
+
+func adjacentKeys(a rune, b rune) bool {
+	for _, row := range keyboardRows {
+		i, j := strings.IndexRune(row, a), strings.IndexRune(row, b)
+		if i >= 0 && j >= 0 && (i-j == 1 || j-i == 1) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyOf(values []bool) bool {
+	for _, v := range values {
+		if v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package validation_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jpaldi/go-user-api/validation"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	t.Parallel()
+	policy := validation.PasswordPolicy{
+		MinLength:  8,
+		MaxLength:  64,
+		MinClasses: 3,
+		MinEntropy: 35,
+		Breached:   map[string]struct{}{"c0rrect-h0rse": {}},
+	}
+	for _, tt := range []struct {
+		password     string
+		expectedCode string
+	}{
+		{password: "Tr0ub4dor&3"},
+		{password: "x7#Kq9!mZ"},
+		{password: "Sh0rt!", expectedCode: validation.CodeTooShort},
+		{password: "Aa1!Aa1!Aa1!Aa1!Aa1!Aa1!Aa1!Aa1!Aa1!Aa1!Aa1!Aa1!Aa1!Aa1!Aa1!Aa1!Aa1!", expectedCode: validation.CodeTooLong},
+		{password: "C0RRECT-h0rse", expectedCode: validation.CodeBreachedPassword},
+		{password: "correcthorsebattery", expectedCode: validation.CodeMissingClasses},
+		{password: "P@ssw0rd1", expectedCode: validation.CodeWeakPassword},
+		{password: "Qwerty123!", expectedCode: validation.CodeWeakPassword},
+		{password: "Abc1!Abc1!Abc1!", expectedCode: validation.CodeWeakPassword},
+	} {
+		tt := tt
+		t.Run(tt.password, func(t *testing.T) {
+			err := policy.Rule()("password", tt.password)
+
+			if tt.expectedCode == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %+v", err)
+				}
+				return
+			}
+			if err == nil || err.Code != tt.expectedCode {
+				t.Fatalf("wrong error: got %+v want %s", err, tt.expectedCode)
+			}
+		})
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	t.Parallel()
+	// pairs of passwords of the same length where the first is much easier to guess
+	for _, tt := range []struct{ weak, strong string }{
+		{weak: "aaaaaaaa", strong: "ahdjeusk"},
+		{weak: "abcdefgh", strong: "agdkbmzq"},
+		{weak: "asdfghjk", strong: "avdmgqjx"},
+		{weak: "p4ssw0rd", strong: "p4sxw9rk"},
+		{weak: "xyzxyzxyz", strong: "xyzkqmwpt"},
+	} {
+		if weak, strong := validation.Entropy(tt.weak), validation.Entropy(tt.strong); weak*2 > strong {
+			t.Fatalf("%s should have much less entropy than %s: got %.1f and %.1f", tt.weak, tt.strong, weak, strong)
+		}
+	}
+}
+
+func TestLoadBreachedPasswords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "breached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "breached.txt")
+	if err := ioutil.WriteFile(file, []byte("123456\n  Monkey  \n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	breached, err := validation.LoadBreachedPasswords(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := breached["monkey"]; !ok || len(breached) != 2 {
+		t.Fatalf("wrong breached passwords: got %v", breached)
+	}
+	if _, err := validation.LoadBreachedPasswords(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Fatal("expected an error loading a missing file")
+	}
+}
@@ -0,0 +1,177 @@
+// Package validation checks user fields against declarative rules and reports
+// every failure with a machine-readable code and a human message.
+package validation
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Error codes reported in FieldError.Code
+const (
+	CodeRequired          = "required"
+	CodeTooShort          = "too_short"
+	CodeTooLong           = "too_long"
+	CodeInvalidCharacters = "invalid_characters"
+	CodeInvalidEmail      = "invalid_email"
+	CodeInvalidCountry    = "invalid_country"
+	CodeMissingClasses    = "missing_character_classes"
+	CodeWeakPassword      = "weak_password"
+	CodeBreachedPassword  = "breached_password"
+	CodeInvalidURL        = "invalid_url"
+	CodeInvalidEventType  = "invalid_event_type"
+)
+
+// FieldError is a failed rule of a field
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Errors are the failed rules of a document, at most one per field
+type Errors []FieldError
+
+func (errs Errors) Error() string {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Message
+	}
+	return strings.Join(messages, ", ")
+}
+
+// Rule checks the value of a field and returns nil when it is valid
+type Rule func(field string, value string) *FieldError
+
+// Field is a field and its rules, checked in order
+type Field struct {
+	Name  string
+	Rules []Rule
+}
+
+// Schema lists the fields of a document in the order their errors are reported
+type Schema []Field
+
+// Validate checks every field of the schema present in values and stops at the first failed rule of each field.
+// Fields missing from values are skipped, so partial documents can be validated, whereas an empty value
+// is checked like any other.
+func (s Schema) Validate(values map[string]string) Errors {
+	errs := Errors{}
+	for _, f := range s {
+		value, ok := values[f.Name]
+		if !ok {
+			continue
+		}
+		for _, rule := range f.Rules {
+			if err := rule(f.Name, value); err != nil {
+				errs = append(errs, *err)
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// Required rejects empty values
+func Required() Rule {
+	return func(field string, value string) *FieldError {
+		if value == "" {
+			return &FieldError{Field: field, Code: CodeRequired, Message: fmt.Sprintf("The %s field is required!", field)}
+		}
+		return nil
+	}
+}
+
+// Length limits the number of characters of a value, a max of 0 means no limit
+func Length(min int, max int) Rule {
+	return func(field string, value string) *FieldError {
+		n := utf8.RuneCountInString(value)
+		if n < min {
+			return &FieldError{Field: field, Code: CodeTooShort, Message: fmt.Sprintf("%s must have at least %d characters", field, min)}
+		}
+		if max > 0 && n > max {
+			return &FieldError{Field: field, Code: CodeTooLong, Message: fmt.Sprintf("%s must have at most %d characters", field, max)}
+		}
+		return nil
+	}
+}
+
+// Matches rejects values not matching the pattern, described to clients by description
+func Matches(pattern *regexp.Regexp, description string) Rule {
+	return func(field string, value string) *FieldError {
+		if !pattern.MatchString(value) {
+			return &FieldError{Field: field, Code: CodeInvalidCharacters, Message: fmt.Sprintf("%s %s", field, description)}
+		}
+		return nil
+	}
+}
+
+// Printable rejects control characters, such as new lines
+func Printable() Rule {
+	return func(field string, value string) *FieldError {
+		for _, r := range value {
+			if !unicode.IsPrint(r) {
+				return &FieldError{Field: field, Code: CodeInvalidCharacters, Message: fmt.Sprintf("%s must not contain control characters", field)}
+			}
+		}
+		return nil
+	}
+}
+
+// Email accepts a single RFC 5322 address without display name, e.g. jpaldi@email.pt
+func Email() Rule {
+	return func(field string, value string) *FieldError {
+		invalid := &FieldError{Field: field, Code: CodeInvalidEmail, Message: fmt.Sprintf("%s must be a valid email address", field)}
+		// the longest address SMTP allows
+		if len(value) > 254 {
+			return invalid
+		}
+		// a bare address formats back to itself, display names, comments and angle brackets don't
+		address, err := mail.ParseAddress(value)
+		if err != nil || address.Name != "" || address.String() != "<"+value+">" {
+			return invalid
+		}
+		at := strings.LastIndex(value, "@")
+		if at < 1 || at > 64 || strings.ContainsAny(value[at+1:], "[]") {
+			return invalid
+		}
+		return nil
+	}
+}
+
+// Country accepts ISO 3166-1 alpha-2 country codes, e.g. PT
+func Country() Rule {
+	return func(field string, value string) *FieldError {
+		if _, ok := countries[value]; !ok {
+			return &FieldError{Field: field, Code: CodeInvalidCountry, Message: fmt.Sprintf("%s must be an ISO 3166-1 alpha-2 country code, e.g. PT", field)}
+		}
+		return nil
+	}
+}
+
+// CountryName returns the short English name of an ISO 3166-1 alpha-2 country code
+func CountryName(code string) (string, bool) {
+	name, ok := countries[code]
+	return name, ok
+}
+
+var nickname = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// UserSchema returns the rules of the user fields, with the given password policy
+func UserSchema(passwords PasswordPolicy) Schema {
+	return Schema{
+		{Name: "nickname", Rules: []Rule{Required(), Length(3, 30), Matches(nickname, "must start with a letter or digit and contain only letters, digits, '.', '_' and '-'")}},
+		{Name: "first_name", Rules: []Rule{Required(), Length(1, 100), Printable()}},
+		{Name: "last_name", Rules: []Rule{Required(), Length(1, 100), Printable()}},
+		{Name: "password", Rules: []Rule{Required(), passwords.Rule()}},
+		{Name: "email", Rules: []Rule{Required(), Email()}},
+		{Name: "country", Rules: []Rule{Required(), Country()}},
+	}
+}
+
+// Users is the user schema with the default password policy
+var Users = UserSchema(DefaultPasswordPolicy)
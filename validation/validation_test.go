@@ -0,0 +1,79 @@
+package validation_test
+
+import (
+	"testing"
+
+	"github.com/jpaldi/go-user-api/validation"
+)
+
+func valid() map[string]string {
+	return map[string]string{
+		"nickname":   "jpaldi",
+		"first_name": "João",
+		"last_name":  "Aldi",
+		"password":   "c0rrect-h0rse-battery",
+		"email":      "jpaldi@email.pt",
+		"country":    "PT",
+	}
+}
+
+func TestUsers(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name         string
+		field        string
+		value        string
+		expectedCode string
+	}{
+		{name: "a valid user", field: "nickname", value: "jpaldi"},
+		{name: "nicknames with dots, dashes and underscores", field: "nickname", value: "j.p_aldi-2"},
+		{name: "empty nicknames", field: "nickname", value: "", expectedCode: validation.CodeRequired},
+		{name: "short nicknames", field: "nickname", value: "jp", expectedCode: validation.CodeTooShort},
+		{name: "long nicknames", field: "nickname", value: "jpaldi-jpaldi-jpaldi-jpaldi-jpaldi", expectedCode: validation.CodeTooLong},
+		{name: "nicknames with spaces", field: "nickname", value: "jp aldi", expectedCode: validation.CodeInvalidCharacters},
+		{name: "nicknames starting with a symbol", field: "nickname", value: "_jpaldi", expectedCode: validation.CodeInvalidCharacters},
+		{name: "names with accents", field: "first_name", value: "Zoë Ångström"},
+		{name: "names with new lines", field: "last_name", value: "Aldi\nAdmin", expectedCode: validation.CodeInvalidCharacters},
+		{name: "emails with plus and subdomains", field: "email", value: "jp+users@mail.email.pt"},
+		{name: "quoted local parts", field: "email", value: `"jp aldi"@email.pt`},
+		{name: "emails without at", field: "email", value: "jpaldi.email.pt", expectedCode: validation.CodeInvalidEmail},
+		{name: "emails with display names", field: "email", value: "JP <jpaldi@email.pt>", expectedCode: validation.CodeInvalidEmail},
+		{name: "several emails", field: "email", value: "a@email.pt, b@email.pt", expectedCode: validation.CodeInvalidEmail},
+		{name: "emails with spaces", field: "email", value: "jp aldi@email.pt", expectedCode: validation.CodeInvalidEmail},
+		{name: "assigned country codes", field: "country", value: "GB"},
+		{name: "reserved country codes", field: "country", value: "UK", expectedCode: validation.CodeInvalidCountry},
+		{name: "lowercase country codes", field: "country", value: "pt", expectedCode: validation.CodeInvalidCountry},
+		{name: "country names", field: "country", value: "Portugal", expectedCode: validation.CodeInvalidCountry},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			values := valid()
+			values[tt.field] = tt.value
+
+			errs := validation.Users.Validate(values)
+
+			if tt.expectedCode == "" {
+				if len(errs) > 0 {
+					t.Fatalf("unexpected errors: %v", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || errs[0].Field != tt.field || errs[0].Code != tt.expectedCode {
+				t.Fatalf("wrong errors: got %+v want %s on %s", errs, tt.expectedCode, tt.field)
+			}
+		})
+	}
+}
+
+func TestValidateSkipsMissingFields(t *testing.T) {
+	errs := validation.Users.Validate(map[string]string{"country": "XX"})
+	if len(errs) != 1 || errs[0].Field != "country" {
+		t.Fatalf("wrong errors: got %+v", errs)
+	}
+}
+
+func TestCountryName(t *testing.T) {
+	if name, ok := validation.CountryName("PT"); !ok || name != "Portugal" {
+		t.Fatalf("wrong country: got %s", name)
+	}
+}
@@ -0,0 +1,256 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/jpaldi/go-user-api/events"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/sirupsen/logrus"
+)
+
+// defaults of the dispatchers that don't set them
+const (
+	defaultLease       = time.Minute
+	defaultSendTimeout = 10 * time.Second
+)
+
+// Dispatcher sends the due deliveries to their webhooks. Failed deliveries are retried with exponential backoff
+// until MaxAttempts is reached, and a webhook failing DisableAfter times in a row is disabled until it is enabled
+// again. Deliveries to deleted or disabled webhooks are failed without being sent.
+type Dispatcher struct {
+	Store  Store
+	Logger *logrus.Logger
+	// Client defaults to a client with a 10s timeout that doesn't follow redirects
+	Client *http.Client
+	// Lease is how long claimed deliveries are left to the dispatcher before others may claim them, 1m by default.
+	// Deliveries are sent one after the other, so no more are claimed at once than can be sent within the lease,
+	// which must be longer than the send timeout.
+	Lease time.Duration
+	// Interval is how often due deliveries are looked for, 1s by default
+	Interval time.Duration
+	// BatchSize is how many deliveries are claimed at once at most, 50 by default
+	BatchSize int
+	// MinBackoff and MaxBackoff bound the delay before retrying a failed delivery, 10s and 6h by default
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxAttempts is how many times a delivery is attempted before it fails, 10 by default
+	MaxAttempts int
+	// DisableAfter is how many failed attempts in a row disable a webhook, 50 by default
+	DisableAfter int
+}
+
+// Run dispatches the due deliveries every interval, and right away while there are more, until the context is cancelled
+func (d Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval())
+	defer ticker.Stop()
+
+	for {
+		claimed, err := d.Dispatch(ctx, time.Now())
+		if err == nil && claimed == d.claimLimit() && ctx.Err() == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Dispatch sends the deliveries due at now and returns how many were claimed. Deliveries which could no longer be
+// sent before their lease expires are left to be claimed again, rather than being sent by two dispatchers.
+func (d Dispatcher) Dispatch(ctx context.Context, now time.Time) (int, error) {
+	claimedAt := time.Now()
+	deliveries, err := d.Store.ClaimDeliveries(ctx, now, d.lease(), d.claimLimit())
+	if err != nil {
+		d.Logger.WithError(err).Error("claiming webhook deliveries")
+		return 0, err
+	}
+
+	for i, delivery := range deliveries {
+		if i > 0 && time.Since(claimedAt)+d.sendTimeout() > d.lease() {
+			d.Logger.WithField("deliveries", len(deliveries)-i).Warn("webhook deliveries lease expiring, leaving them to be claimed again")
+			break
+		}
+		d.deliver(ctx, delivery, now)
+	}
+	return len(deliveries), nil
+}
+
+func (d Dispatcher) deliver(ctx context.Context, delivery mongo.Delivery, now time.Time) {
+	log := d.Logger.WithFields(logrus.Fields{
+		"webhookID":  delivery.WebhookID,
+		"deliveryID": delivery.ID,
+		"eventType":  delivery.EventType,
+	})
+
+	webhook, err := d.Store.GetWebhook(ctx, delivery.WebhookID)
+	if err != nil && !errors.Is(err, mongo.ErrNotFound) {
+		// the delivery is claimed again once its lease expires
+		log.WithError(err).Error("reading webhook")
+		return
+	}
+	if webhook == nil || !webhook.Active {
+		attempt := mongo.DeliveryAttempt{At: now, Error: "the webhook is deleted or disabled"}
+		if err := d.Store.RecordAttempt(ctx, delivery.ID, attempt, mongo.DeliveryFailed, delivery.Failures, now); err != nil {
+			log.WithError(err).Error("recording webhook delivery")
+		}
+		return
+	}
+
+	attempt := mongo.DeliveryAttempt{At: time.Now()}
+	attempt.StatusCode, err = d.send(ctx, *webhook, delivery, attempt.At)
+	attempt.DurationMS = int64(time.Since(attempt.At) / time.Millisecond)
+	if err == nil {
+		if err := d.Store.RecordAttempt(ctx, delivery.ID, attempt, mongo.DeliverySucceeded, delivery.Failures, now); err != nil {
+			log.WithError(err).Error("recording webhook delivery")
+		}
+		if _, err := d.Store.RecordResult(ctx, webhook.ID, true, d.disableAfter(), now); err != nil {
+			log.WithError(err).Error("recording webhook result")
+		}
+		return
+	}
+
+	failures := delivery.Failures + 1
+	status, next := mongo.DeliveryPending, now.Add(events.ExponentialBackoff(failures, d.minBackoff(), d.maxBackoff()))
+	if failures >= d.maxAttempts() {
+		status, next = mongo.DeliveryFailed, now
+	}
+	log.WithFields(logrus.Fields{
+		"statusCode":  attempt.StatusCode,
+		"failures":    failures,
+		"status":      status,
+		"nextAttempt": next,
+	}).WithError(err).Warn("delivering webhook")
+	attempt.Error = err.Error()
+	if err := d.Store.RecordAttempt(ctx, delivery.ID, attempt, status, failures, next); err != nil {
+		log.WithError(err).Error("recording webhook delivery")
+	}
+
+	updated, err := d.Store.RecordResult(ctx, webhook.ID, false, d.disableAfter(), now)
+	if err != nil {
+		log.WithError(err).Error("recording webhook result")
+		return
+	}
+	if !updated.Active && webhook.Active {
+		log.WithField("consecutiveFailures", updated.ConsecutiveFailures).Warn("disabled failing webhook")
+	}
+}
+
+// send posts the signed payload to the webhook and returns the response status, any 2xx response counts as delivered
+func (d Dispatcher) send(ctx context.Context, webhook mongo.Webhook, delivery mongo.Delivery, at time.Time) (int, error) {
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	// custom clients may not time out, the lease assumes sends are bounded
+	ctx, cancel := context.WithTimeout(ctx, d.sendTimeout())
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-user-api-webhooks")
+	req.Header.Set(HeaderDelivery, delivery.ID)
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderSignature, Sign(webhook.Secret, at, payload))
+
+	resp, err := d.client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// drain a bit of the body so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("the webhook responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d Dispatcher) client() *http.Client {
+	if d.Client != nil {
+		return d.Client
+	}
+	return &http.Client{
+		Timeout: defaultSendTimeout,
+		// a redirect isn't an acknowledgement, it is reported as a failure
+		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+func (d Dispatcher) interval() time.Duration {
+	if d.Interval <= 0 {
+		return time.Second
+	}
+	return d.Interval
+}
+
+func (d Dispatcher) batchSize() int {
+	if d.BatchSize <= 0 {
+		return 50
+	}
+	return d.BatchSize
+}
+
+func (d Dispatcher) lease() time.Duration {
+	if d.Lease <= 0 {
+		return defaultLease
+	}
+	return d.Lease
+}
+
+// sendTimeout bounds each send, the timeout of the client when it has one
+func (d Dispatcher) sendTimeout() time.Duration {
+	if d.Client != nil && d.Client.Timeout > 0 {
+		return d.Client.Timeout
+	}
+	return defaultSendTimeout
+}
+
+// claimLimit is how many deliveries are claimed at once: the batch size, but no more than can be sent within the lease
+func (d Dispatcher) claimLimit() int {
+	limit := int(d.lease() / d.sendTimeout())
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > d.batchSize() {
+		limit = d.batchSize()
+	}
+	return limit
+}
+
+func (d Dispatcher) minBackoff() time.Duration {
+	if d.MinBackoff <= 0 {
+		return 10 * time.Second
+	}
+	return d.MinBackoff
+}
+
+func (d Dispatcher) maxBackoff() time.Duration {
+	if d.MaxBackoff <= 0 {
+		return 6 * time.Hour
+	}
+	return d.MaxBackoff
+}
+
+func (d Dispatcher) maxAttempts() int {
+	if d.MaxAttempts <= 0 {
+		return 10
+	}
+	return d.MaxAttempts
+}
+
+func (d Dispatcher) disableAfter() int {
+	if d.DisableAfter <= 0 {
+		return 50
+	}
+	return d.DisableAfter
+}
@@ -0,0 +1,145 @@
+// Package webhooks delivers user events to the endpoints integrators subscribed, see Fanout and Dispatcher.
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jpaldi/go-user-api/mongo"
+)
+
+// The headers of every delivery
+const (
+	HeaderSignature = "X-Webhook-Signature"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderEvent     = "X-Webhook-Event"
+)
+
+// Store keeps the webhooks and their deliveries, see mongo.Webhooks
+type Store interface {
+	CreateWebhook(ctx context.Context, webhook mongo.Webhook) error
+	GetWebhook(ctx context.Context, id string) (*mongo.Webhook, error)
+	ListWebhooks(ctx context.Context) ([]mongo.Webhook, error)
+	DeleteWebhook(ctx context.Context, id string) error
+	EnableWebhook(ctx context.Context, id string) (*mongo.Webhook, error)
+	RecordResult(ctx context.Context, id string, success bool, disableAfter int, now time.Time) (*mongo.Webhook, error)
+
+	AddDelivery(ctx context.Context, delivery mongo.Delivery) error
+	ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]mongo.Delivery, error)
+	RecordAttempt(ctx context.Context, id string, attempt mongo.DeliveryAttempt, status string, failures int, next time.Time) error
+	GetDelivery(ctx context.Context, webhookID string, id string) (*mongo.Delivery, error)
+	ListDeliveries(ctx context.Context, webhookID string, limit int) ([]mongo.Delivery, error)
+	Redeliver(ctx context.Context, webhookID string, id string, now time.Time) (*mongo.Delivery, error)
+}
+
+// EventTypes lists the events webhooks can subscribe to
+var EventTypes = []string{mongo.EventUserCreated, mongo.EventUserUpdated, mongo.EventUserDeleted}
+
+// Known reports whether webhooks can subscribe to the event type
+func Known(eventType string) bool {
+	for _, t := range EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// deliveryNamespace derives delivery ids from the webhook and event ids
+var deliveryNamespace = uuid.MustParse("5f0c8d3e-2f4b-4a6e-9b1d-7c3a2e8f6d41")
+
+// Sign returns the signature header of a payload sent at the given time: t=<unix seconds>,v1=<hex HMAC-SHA256 of
+// "<unix seconds>.<payload>" keyed with the secret>. Signing the timestamp lets receivers reject replayed deliveries.
+func Sign(secret string, at time.Time, payload []byte) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, signature(secret, timestamp, payload))
+}
+
+// Verify checks a signature header made by Sign, rejecting signatures older than tolerance at now
+func Verify(secret string, header string, payload []byte, now time.Time, tolerance time.Duration) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing timestamp")
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("timestamp outside of the tolerance")
+	}
+	expected := signature(secret, timestamp, payload)
+	for _, s := range signatures {
+		if hmac.Equal([]byte(s), []byte(expected)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no matching signature")
+}
+
+func signature(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Fanout is the events.Publisher scheduling a delivery of every event to each active webhook subscribed to it.
+// Delivery ids are derived from the webhook and event ids, so an event published again isn't delivered twice.
+type Fanout struct {
+	Store Store
+}
+
+// Publish schedules the deliveries of the event, it fails if any couldn't be scheduled so the event is published again
+func (f Fanout) Publish(ctx context.Context, event mongo.Event) error {
+	webhooks, err := f.Store.ListWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	now := mongo.Now()
+	for _, w := range webhooks {
+		if !w.Active || !w.Subscribes(event.Type) {
+			continue
+		}
+		delivery := mongo.Delivery{
+			ID:            uuid.NewSHA1(deliveryNamespace, []byte(w.ID+"/"+event.ID)).String(),
+			WebhookID:     w.ID,
+			EventID:       event.ID,
+			EventType:     event.Type,
+			Payload:       string(payload),
+			Status:        mongo.DeliveryPending,
+			CreatedAt:     now,
+			NextAttemptAt: now,
+			Attempts:      []mongo.DeliveryAttempt{},
+		}
+		if err := f.Store.AddDelivery(ctx, delivery); err != nil {
+			return fmt.Errorf("scheduling delivery to webhook %s: %w", w.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package webhooks_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jpaldi/go-user-api/memory"
+	"github.com/jpaldi/go-user-api/mongo"
+	"github.com/jpaldi/go-user-api/webhooks"
+	"github.com/sirupsen/logrus"
+)
+
+const secret = "s3cr3t-s3cr3t-s3cr3t"
+
+func TestSignature(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1600000000, 0)
+	payload := []byte(`{"id":"event-1"}`)
+	header := webhooks.Sign(secret, now, payload)
+
+	for _, tt := range []struct {
+		name        string
+		secret      string
+		header      string
+		payload     []byte
+		now         time.Time
+		expectError bool
+	}{
+		{name: "valid signatures should be accepted", secret: secret, header: header, payload: payload, now: now.Add(time.Minute)},
+		{name: "other secrets should be rejected", secret: "another-secret", header: header, payload: payload, now: now, expectError: true},
+		{name: "changed payloads should be rejected", secret: secret, header: header, payload: []byte(`{"id":"event-2"}`), now: now, expectError: true},
+		{name: "old signatures should be rejected", secret: secret, header: header, payload: payload, now: now.Add(time.Hour), expectError: true},
+		{name: "headers without a timestamp should be rejected", secret: secret, header: header[len("t=1600000000,"):], payload: payload, now: now, expectError: true},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := webhooks.Verify(tt.secret, tt.header, tt.payload, tt.now, 5*time.Minute)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// receiver records the requests of a webhook endpoint and responds with status
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	rc.requests, rc.bodies = append(rc.requests, r), append(rc.bodies, body)
+	w.WriteHeader(rc.status)
+}
+
+func TestDelivery(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	rc := &receiver{status: http.StatusInternalServerError}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	store := memory.NewWebhooks()
+	hooks := []mongo.Webhook{
+		{ID: "hook-1", URL: server.URL, EventTypes: []string{mongo.EventUserCreated}, Secret: secret, Active: true},
+		{ID: "hook-2", URL: server.URL, EventTypes: []string{mongo.EventUserDeleted}, Secret: secret, Active: true},
+	}
+	for _, w := range hooks {
+		if err := store.CreateWebhook(ctx, w); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	fanout := webhooks.Fanout{Store: store}
+	dispatcher := webhooks.Dispatcher{Store: store, Logger: logrus.New(), MinBackoff: time.Second, MaxAttempts: 3, DisableAfter: 100}
+
+	event := mongo.NewEvent(mongo.EventUserCreated, mongo.User{ID: "user-1", Nickname: "test", Password: "hash", Version: 1})
+	for i := 0; i < 2; i++ {
+		if err := fanout.Publish(ctx, event); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	now := time.Now()
+	if claimed, _ := dispatcher.Dispatch(ctx, now); claimed != 1 {
+		t.Fatalf("the event should be delivered once to the subscribed webhook: claimed %d", claimed)
+	}
+	if claimed, _ := dispatcher.Dispatch(ctx, now.Add(500*time.Millisecond)); claimed != 0 {
+		t.Fatalf("failed deliveries should wait for the backoff: claimed %d", claimed)
+	}
+
+	rc.mu.Lock()
+	rc.status = http.StatusNoContent
+	rc.mu.Unlock()
+	if claimed, _ := dispatcher.Dispatch(ctx, now.Add(time.Second)); claimed != 1 {
+		t.Fatalf("failed deliveries should be retried: claimed %d", claimed)
+	}
+
+	deliveries, _ := store.ListDeliveries(ctx, "hook-1", 10)
+	if len(deliveries) != 1 || deliveries[0].Status != mongo.DeliverySucceeded || len(deliveries[0].Attempts) != 2 {
+		t.Fatalf("wrong deliveries: got %+v", deliveries)
+	}
+	if attempts := deliveries[0].Attempts; attempts[0].StatusCode != 500 || attempts[0].Error == "" || attempts[1].StatusCode != 204 {
+		t.Fatalf("wrong attempts: got %+v", attempts)
+	}
+
+	r := rc.requests[1]
+	if r.Header.Get(webhooks.HeaderEvent) != mongo.EventUserCreated || r.Header.Get(webhooks.HeaderDelivery) != deliveries[0].ID {
+		t.Fatalf("wrong headers: got %v", r.Header)
+	}
+	if err := webhooks.Verify(secret, r.Header.Get(webhooks.HeaderSignature), rc.bodies[1], time.Now(), time.Minute); err != nil {
+		t.Fatalf("wrong signature: %s", err)
+	}
+	if string(rc.bodies[0]) != string(rc.bodies[1]) || string(rc.bodies[1]) != deliveries[0].Payload {
+		t.Fatalf("retries should send the same payload: got %s and %s", rc.bodies[0], rc.bodies[1])
+	}
+
+	if _, err := store.Redeliver(ctx, "hook-1", deliveries[0].ID, now.Add(time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if claimed, _ := dispatcher.Dispatch(ctx, now.Add(time.Minute)); claimed != 1 || len(rc.requests) != 3 {
+		t.Fatalf("redeliveries should be sent again: claimed %d", claimed)
+	}
+}
+
+func TestDeliveryGivesUp(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	server := httptest.NewServer(&receiver{status: http.StatusServiceUnavailable})
+	defer server.Close()
+
+	store := memory.NewWebhooks()
+	store.CreateWebhook(ctx, mongo.Webhook{ID: "hook-1", URL: server.URL, EventTypes: webhooks.EventTypes, Secret: secret, Active: true})
+	dispatcher := webhooks.Dispatcher{Store: store, Logger: logrus.New(), MinBackoff: time.Second, MaxBackoff: time.Second, MaxAttempts: 2, DisableAfter: 3}
+
+	for _, eventType := range []string{mongo.EventUserCreated, mongo.EventUserUpdated} {
+		event := mongo.NewEvent(eventType, mongo.User{ID: "user-1", Version: 1})
+		if err := (webhooks.Fanout{Store: store}).Publish(ctx, event); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	now := time.Now()
+	dispatcher.Dispatch(ctx, now)
+	dispatcher.Dispatch(ctx, now.Add(time.Second))
+
+	webhook, _ := store.GetWebhook(ctx, "hook-1")
+	if webhook.Active || webhook.DisabledAt == nil || webhook.ConsecutiveFailures != 3 {
+		t.Fatalf("the webhook should be disabled after 3 failures: got %+v", webhook)
+	}
+	deliveries, _ := store.ListDeliveries(ctx, "hook-1", 10)
+	for _, d := range deliveries {
+		if d.Status != mongo.DeliveryFailed {
+			t.Fatalf("deliveries should fail after 2 attempts or once the webhook is disabled: got %+v", d)
+		}
+	}
+
+	// disabled webhooks don't get new deliveries
+	if err := (webhooks.Fanout{Store: store}).Publish(ctx, mongo.NewEvent(mongo.EventUserDeleted, mongo.User{ID: "user-1"})); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if claimed, _ := dispatcher.Dispatch(ctx, now.Add(time.Hour)); claimed != 0 {
+		t.Fatalf("disabled webhooks shouldn't receive deliveries: claimed %d", claimed)
+	}
+}
+
+func TestDeliveriesAreClaimedOnce(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var mu sync.Mutex
+	received := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a slow receiver, a batch of 10 takes longer than the lease
+		time.Sleep(60 * time.Millisecond)
+		mu.Lock()
+		received[r.Header.Get(webhooks.HeaderDelivery)]++
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	store := memory.NewWebhooks()
+	hook := mongo.Webhook{ID: "hook-1", URL: server.URL, EventTypes: []string{mongo.EventUserCreated}, Secret: secret, Active: true}
+	if err := store.CreateWebhook(ctx, hook); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fanout := webhooks.Fanout{Store: store}
+	for i := 0; i < 10; i++ {
+		event := mongo.NewEvent(mongo.EventUserCreated, mongo.User{ID: "user-1", Nickname: "test", Password: "hash", Version: 1})
+		if err := fanout.Publish(ctx, event); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dispatcher := webhooks.Dispatcher{
+				Store:  store,
+				Logger: logrus.New(),
+				Client: &http.Client{Timeout: 100 * time.Millisecond},
+				Lease:  400 * time.Millisecond,
+			}
+			for time.Now().Before(deadline) {
+				mu.Lock()
+				done := len(received) == 10
+				mu.Unlock()
+				if done {
+					return
+				}
+				dispatcher.Dispatch(ctx, time.Now())
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(received) != 10 {
+		t.Fatalf("every delivery should be sent: got %d", len(received))
+	}
+	for id, count := range received {
+		if count != 1 {
+			t.Fatalf("delivery %s should be sent once: got %d", id, count)
+		}
+	}
+}
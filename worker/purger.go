@@ -0,0 +1,56 @@
+package worker
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UsersPurger permanently removes soft deleted users
+type UsersPurger interface {
+	PurgeUsers(ctx context.Context, deletedBefore time.Time) (int64, error)
+}
+
+// Purger periodically removes the users soft deleted for longer than the retention period.
+// Purging is idempotent, so every instance of the service can run its own purger.
+type Purger struct {
+	Users     UsersPurger
+	Retention time.Duration
+	Interval  time.Duration
+	Logger    *logrus.Logger
+}
+
+// Run purges users right away and then every interval, until the context is cancelled
+func (p Purger) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.Purge(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Purge removes the users deleted before the retention period preceding now and returns how many were removed
+func (p Purger) Purge(ctx context.Context, now time.Time) (int64, error) {
+	deletedBefore := now.Add(-p.Retention)
+	purged, err := p.Users.PurgeUsers(ctx, deletedBefore)
+	if err != nil {
+		p.Logger.WithError(err).Error("purging deleted users")
+		return 0, err
+	}
+
+	// Log to console
+	if purged > 0 {
+		p.Logger.WithFields(logrus.Fields{
+			"purged":        purged,
+			"deletedBefore": deletedBefore,
+		}).Info("purged deleted users")
+	}
+	return purged, nil
+}
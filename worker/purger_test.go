@@ -0,0 +1,87 @@
+package worker_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jpaldi/go-user-api/worker"
+	"github.com/sirupsen/logrus"
+)
+
+type mockUsers struct {
+	mu          sync.Mutex
+	calls       []time.Time
+	purgeResult int64
+	purgeError  error
+}
+
+func (m *mockUsers) PurgeUsers(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, deletedBefore)
+	return m.purgeResult, m.purgeError
+}
+
+func (m *mockUsers) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.calls)
+}
+
+func TestPurge(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2020, 10, 31, 0, 0, 0, 0, time.UTC)
+
+	for _, tt := range []struct {
+		name          string
+		users         *mockUsers
+		expectedCount int64
+		expectError   bool
+	}{
+		{name: "it should return how many users were purged", users: &mockUsers{purgeResult: 2}, expectedCount: 2},
+		{name: "it should return the storage errors", users: &mockUsers{purgeError: fmt.Errorf("database error")}, expectError: true},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			purger := worker.Purger{Users: tt.users, Retention: 30 * 24 * time.Hour, Logger: logrus.New()}
+
+			count, err := purger.Purge(context.Background(), now)
+
+			if (err != nil) != tt.expectError {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if count != tt.expectedCount {
+				t.Fatalf("wrong count: got %d want %d", count, tt.expectedCount)
+			}
+			if expected := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC); !tt.users.calls[0].Equal(expected) {
+				t.Fatalf("wrong retention: got %s want %s", tt.users.calls[0], expected)
+			}
+		})
+	}
+}
+
+func TestRunStopsWhenCancelled(t *testing.T) {
+	t.Parallel()
+	users := &mockUsers{}
+	purger := worker.Purger{Users: users, Retention: time.Hour, Interval: time.Millisecond, Logger: logrus.New()}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		purger.Run(ctx)
+		close(done)
+	}()
+	for users.count() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the purger didn't stop")
+	}
+}
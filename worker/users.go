@@ -0,0 +1,49 @@
+package worker
+
+import (
+	"context"
+	"time"
+
+	"github.com/jpaldi/go-user-api/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// UsersCounter counts the users, deleted users excluded
+type UsersCounter interface {
+	CountUsers(ctx context.Context) (int64, error)
+}
+
+// UsersGauge periodically sets a gauge to the number of users, counting them on every scrape would
+// let scrapers load the database
+type UsersGauge struct {
+	Users    UsersCounter
+	Gauge    *metrics.Gauge
+	Interval time.Duration
+	Logger   *logrus.Logger
+}
+
+// Run refreshes the gauge right away and then every interval, until the context is cancelled
+func (u UsersGauge) Run(ctx context.Context) {
+	ticker := time.NewTicker(u.Interval)
+	defer ticker.Stop()
+
+	for {
+		u.Refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh sets the gauge to the number of users, the gauge keeps its last value when counting fails
+func (u UsersGauge) Refresh(ctx context.Context) error {
+	count, err := u.Users.CountUsers(ctx)
+	if err != nil {
+		u.Logger.WithError(err).Error("counting users")
+		return err
+	}
+	u.Gauge.Set(float64(count))
+	return nil
+}
@@ -0,0 +1,43 @@
+package worker_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jpaldi/go-user-api/metrics"
+	"github.com/jpaldi/go-user-api/worker"
+	"github.com/sirupsen/logrus"
+)
+
+type mockCounter struct {
+	count int64
+	err   error
+}
+
+func (m mockCounter) CountUsers(ctx context.Context) (int64, error) {
+	return m.count, m.err
+}
+
+func TestUsersGauge(t *testing.T) {
+	t.Parallel()
+	registry := metrics.NewRegistry()
+	gauge := worker.UsersGauge{Gauge: registry.Gauge("users", "Users."), Logger: logrus.New()}
+
+	gauge.Users = mockCounter{count: 3}
+	if err := gauge.Refresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	gauge.Users = mockCounter{err: fmt.Errorf("database error")}
+	if err := gauge.Refresh(context.Background()); err == nil {
+		t.Fatalf("the storage error should be returned")
+	}
+
+	var b bytes.Buffer
+	registry.Write(&b)
+	if !strings.Contains(b.String(), "users 3\n") {
+		t.Fatalf("the gauge should keep the last count: got %s", b.String())
+	}
+}